@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// SuperNode capacity
+//
+// Every member measures the round trip time to each member it sends
+// heartbeats to, and how long each has been around since it first heard from
+// it. These add up to a capacity score per member (see capacityScore). What
+// members advertise about themselves in heartbeats can't be checked, so it
+// can only lower their score. The election coordinator elects the members
+// with the best scores, and regular nodes relay through the best SuperNode
+// that isn't overloaded.
+//
+// Regular nodes also advertise which SuperNode they relay through, so every
+// member can count each SuperNode's load. When a SuperNode carries more than
+// superNodeMaxLoad regular nodes, the nodes on it move to a less loaded one;
+// each moves with a probability matching the excess, so they don't all
+// stampede to the same SuperNode at once.
+
+// Regular nodes a SuperNode carries before it counts as overloaded
+const superNodeMaxLoad = membersPerSuperNode * 3 / 2
+
+// NAT types a member can advertise
+const (
+	natOpen    = "open"    // Reachable at its own address
+	natMapped  = "nat"     // Behind a NAT, reachable through the address STUN saw
+	natUnknown = "unknown" // STUN failed or only a private address is known
+)
+
+// Upload bandwidth a member is credited with at most, and when it advertises
+// none. Claims can't be checked, so only lower ones count.
+const bandwidthClaimCap = 256 << 10
+
+// nodeCapacity is what a member advertises about its resources. Uptime and
+// NAT type aren't scored, since the receiver can't check them.
+type nodeCapacity struct {
+	Uptime    int64  `json:"uptime"`               // Seconds since the client started
+	Bandwidth int64  `json:"bandwidth"`            // Upload bytes per second, 0 if unknown
+	NATType   string `json:"nat_type"`             // natOpen, natMapped or natUnknown
+	SuperNode string `json:"super_node,omitempty"` // SuperNode a regular node relays through
+}
+
+// capacityScore rates how well a member could serve as a SuperNode, from 0
+// to 100, from how long it has been heard from, its measured RTT and its
+// advertised bandwidth. An unmeasured RTT counts as average.
+func capacityScore(capacity nodeCapacity, uptime, rtt time.Duration) float64 {
+	// Uptime: full marks after an hour
+	score := min(uptime.Hours(), 1) * 40
+
+	// RTT: full marks when instant, nothing from 500ms up
+	if rtt <= 0 {
+		score += 20
+	} else {
+		score += (1 - min(float64(rtt)/float64(500*time.Millisecond), 1)) * 40
+	}
+
+	// Bandwidth: full marks unless the member admits to less than the cap
+	bandwidth := capacity.Bandwidth
+	if bandwidth <= 0 || bandwidth > bandwidthClaimCap {
+		bandwidth = bandwidthClaimCap
+	}
+	score += float64(bandwidth) / bandwidthClaimCap * 20
+	return score
+}
+
+// Classify the NAT in front of the local node from the public IP STUN
+// reported (or the local IP it fell back to)
+func classifyNAT(publicIP string) string {
+	ip := net.ParseIP(publicIP)
+	if ip == nil || ip.IsPrivate() || ip.IsLoopback() {
+		return natUnknown
+	}
+	if publicIP == getLocalIP() {
+		return natOpen
+	}
+	return natMapped
+}
+
+// Capacity the local node advertises in a room
+func (r *RoomSession) localCapacity() nodeCapacity {
+	bandwidth := AppConfig.UploadBandwidth
+	if bandwidth <= 0 {
+		// Best upload rate seen in any room
+		for _, room := range r.roomList() {
+			bandwidth = max(bandwidth, room.Files.peakUploadRate())
+		}
+	}
+
+	capacity := nodeCapacity{
+		Uptime:    int64(time.Since(r.StartedAt).Seconds()),
+		Bandwidth: bandwidth,
+		NATType:   r.NATType,
+	}
+	if !r.SuperNodeMgr.IsLocalNodeSuperNode() {
+		capacity.SuperNode = r.SuperNodeMgr.AttachedSuperNode()
+	}
+	return capacity
+}
+
+// Pick a SuperNode to relay through if we need one, and move off an
+// overloaded one
+func (r *RoomSession) rebalanceSuperNode() {
+	r.NodeMutex.RLock()
+	nodeCount := len(r.Room.Nodes)
+	r.NodeMutex.RUnlock()
+	if !r.SuperNodeMgr.ShouldEnableSuperNodeMode(nodeCount) || r.SuperNodeMgr.IsLocalNodeSuperNode() {
+		return
+	}
+
+	from, to := r.SuperNodeMgr.Rebalance()
+	if to == "" || from == "" {
+		return
+	}
+	fromNode, _ := r.findRoomNodeByID(from)
+	toNode, _ := r.findRoomNodeByID(to)
+	fmt.Printf("[System] %sSuperNode %s is overloaded, relaying through %s instead\n",
+		r.roomTag(), fromNode.Nickname, toNode.Nickname)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCapacityScore(t *testing.T) {
+	base := capacityScore(nodeCapacity{}, time.Minute, 50*time.Millisecond)
+	tests := []struct {
+		name     string
+		capacity nodeCapacity
+		uptime   time.Duration
+		rtt      time.Duration
+		cmp      int // Sign of the score against base
+	}{
+		{"claimed uptime is ignored", nodeCapacity{Uptime: 1 << 30}, time.Minute, 50 * time.Millisecond, 0},
+		{"claimed NAT type is ignored", nodeCapacity{NATType: natOpen}, time.Minute, 50 * time.Millisecond, 0},
+		{"claimed bandwidth is capped", nodeCapacity{Bandwidth: 1 << 40}, time.Minute, 50 * time.Millisecond, 0},
+		{"admitting to less bandwidth lowers it", nodeCapacity{Bandwidth: 1 << 10}, time.Minute, 50 * time.Millisecond, -1},
+		{"observed uptime raises it", nodeCapacity{}, time.Hour, 50 * time.Millisecond, 1},
+		{"observed RTT lowers it", nodeCapacity{}, time.Minute, 400 * time.Millisecond, -1},
+	}
+	for _, tt := range tests {
+		score := capacityScore(tt.capacity, tt.uptime, tt.rtt)
+		if got := cmpFloat(score, base); got != tt.cmp {
+			t.Errorf("%s: score %.1f against %.1f", tt.name, score, base)
+		}
+	}
+	if score := capacityScore(nodeCapacity{}, 2*time.Hour, 0); score < 0 || score > 100 {
+		t.Fatalf("score %.1f out of range", score)
+	}
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func TestUptimeCountsFromFirstSeen(t *testing.T) {
+	sm := NewSuperNodeManager(NodeInfo{ID: "local"}, NewRoomKeyring(testKey(1), 0, "local"), 0, 0, false)
+	sm.AddNode(NodeInfo{ID: "member"})
+	score := func() float64 { return sm.GetNode("member").Score }
+
+	sm.mu.Lock()
+	sm.supernodes[0].FirstSeen = time.Now().Add(-time.Hour)
+	sm.mu.Unlock()
+	sm.UpdateCapacity("member", nodeCapacity{})
+	settled := score()
+
+	// Claiming a long uptime doesn't help
+	sm.UpdateCapacity("member", nodeCapacity{Uptime: 1 << 30})
+	if score() != settled {
+		t.Fatal("advertised uptime changed the score")
+	}
+
+	// Going offline starts the uptime over
+	sm.MarkOffline("member")
+	sm.UpdateNodeActivity("member")
+	sm.UpdateCapacity("member", nodeCapacity{})
+	if score() >= settled {
+		t.Fatalf("score %.1f after coming back, %.1f before", score(), settled)
+	}
+}
+
+func TestRankingResistsChosenIDs(t *testing.T) {
+	// The local node stays out, so every candidate has the same score
+	keyring := NewRoomKeyring(testKey(1), 0, "local")
+	sm := NewSuperNodeManager(NodeInfo{ID: "local"}, keyring, 0, 0, true)
+	ids := []string{"00000000", "11111111", "22222222", "33333333", "44444444", "55555555"}
+	for _, id := range ids {
+		sm.AddNode(NodeInfo{ID: id})
+		sm.MarkVerified(id)
+	}
+	ranked := func() []string {
+		sm.mu.RLock()
+		defer sm.mu.RUnlock()
+		return sm.rankCandidates()
+	}
+
+	first := ranked()
+	if slices.IsSorted(first) {
+		t.Fatal("candidates ranked by node ID")
+	}
+	if !slices.Equal(ranked(), first) {
+		t.Fatal("ranking isn't deterministic")
+	}
+
+	// Equal scores are broken by rank, not by node ID
+	if elected := sm.ElectSuperNodes(); len(elected) != 1 || elected[0] != first[0] {
+		t.Fatalf("elected %v, want the first ranked %s", elected, first[0])
+	}
+
+	// A rekey reshuffles the ranks
+	keyring.Install(1, testKey(2), "local")
+	if slices.Equal(ranked(), first) {
+		t.Fatal("ranking unchanged after a rekey")
+	}
+}
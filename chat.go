@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io"
 	"math/big"
@@ -17,66 +16,132 @@ import (
 
 // Message structure
 type Message struct {
+	ID        string `json:"id"` // Unique per origin node
 	RoomID    string `json:"room_id"`
 	Sender    string `json:"sender"`
 	Timestamp string `json:"timestamp"`
+	SentAt    int64  `json:"sent_at"` // Unix milliseconds, used to order history
 	Content   string `json:"content"`
+	SenderID  string `json:"sender_id,omitempty"`  // Node ID of the origin node
+	PublicKey string `json:"public_key,omitempty"` // Sender's Ed25519 public key (base64)
+	Signature string `json:"signature,omitempty"`  // Ed25519 signature over the other fields
 }
 
 // Node info structure
 type NodeInfo struct {
-	ID          string `json:"id"`
-	Address     string `json:"address"`
-	Nickname    string `json:"nickname"`
-	NoSuperNode bool   `json:"no_super_node,omitempty"` // Indicates that this node does not participate in SuperNode election
+	ID          string   `json:"id"`
+	Address     string   `json:"address"`
+	Nickname    string   `json:"nickname"`
+	NoSuperNode bool     `json:"no_super_node,omitempty"` // Indicates that this node does not participate in SuperNode election
+	Version     int      `json:"version,omitempty"`       // Highest protocol version the node speaks
+	PublicKey   string   `json:"public_key,omitempty"`    // Ed25519 public key the ID is derived from (base64)
+	KexKey      string   `json:"kex_key,omitempty"`       // X25519 public key peers encrypt to (base64)
+	RoomID      string   `json:"room_id,omitempty"`       // Room the node is a member of
+	Candidates  []string `json:"candidates,omitempty"`    // UDP addresses to punch a hole to, see holepunch.go
+	Signature   string   `json:"signature,omitempty"`     // Ed25519 signature over the other fields
 }
 
 // Room info structure
 type RoomInfo struct {
-	ID       string     `json:"id"`
-	Nodes    []NodeInfo `json:"nodes"`
-	Password string     `json:"password"`
+	ID         string     `json:"id"`
+	CreatorID  string     `json:"creator_id"`
+	Nodes      []NodeInfo `json:"nodes"`
+	Passphrase string     `json:"-"` // Never sent over the network
 }
 
 // P2P chat client
 type P2PChat struct {
+	Identity     *Identity
 	LocalNode    NodeInfo
-	Room         RoomInfo
-	MessageKey   []byte
 	UDPSocket    *net.UDPConn
-	TCPListeners map[string]*net.TCPConn
-	NodeMutex    sync.RWMutex
+	TCPListener  *net.TCPListener
+	Conns        *ConnManager
+	Punch        *PunchSocket // Nil if it couldn't be opened
+	Tunnels      *TunnelRelay // Tunnels we relay for other members
 	Running      bool
 	PublicIP     string
 	PublicPort   int
-	SuperNodeMgr *SuperNodeManager
+	NATType      string // natOpen, natMapped or natUnknown
+	StartedAt    time.Time
+	SeenMessages *SeenCache
+	Outbox       *Outbox
+
+	// Held while checking and reserving room for a new seed copy against
+	// SEED_MAX_SIZE
+	seedMu sync.Mutex
+
+	// Rooms the client is a member of, keyed by room ID, and the room chat
+	// messages and commands apply to
+	Rooms      map[string]*RoomSession
+	activeRoom *RoomSession
+	roomsMu    sync.RWMutex
+
+	// Nodes already warned about an incompatible protocol version
+	incompatibleNodes map[string]bool
+	// Nodes already warned about an unverifiable announcement
+	unverifiedNodes map[string]bool
+
+	// Room being discovered for /join and where to report its members
+	pendingJoinRoom string
+	joinCandidates  chan NodeInfo
 }
 
 // Create new P2P chat client
 func NewP2PChat() *P2PChat {
 	client := &P2PChat{
-		TCPListeners: make(map[string]*net.TCPConn),
-		Running:      false,
+		SeenMessages:      NewSeenCache(seenCacheSize),
+		Rooms:             make(map[string]*RoomSession),
+		Running:           false,
+		StartedAt:         time.Now(),
+		incompatibleNodes: make(map[string]bool),
+		unverifiedNodes:   make(map[string]bool),
 	}
 
+	// Load long-term node identity
+	identity, err := loadOrCreateIdentity(AppConfig.IdentityFile)
+	if err != nil {
+		fmt.Printf("Failed to load node identity, using a temporary one: %v\n", err)
+		seed := make([]byte, 32)
+		rand.Read(seed)
+		identity, _ = newIdentityFromSeed(seed)
+	}
+	client.Identity = identity
+	client.LocalNode.ID = identity.ID
+	client.Conns = NewConnManager(identity, func() string { return client.LocalNode.Address }, client.memberAt, client.handleFrame)
+	client.Outbox = NewOutbox(func() bool { return client.Running }, client.Conns)
+	client.Conns.Fallback = client.dialIndirect
+	client.Tunnels = NewTunnelRelay(AppConfig.RelayMaxTunnels)
+	client.Outbox.OnFailure = client.onDeliveryFailure
+	client.LocalNode.PublicKey = identity.EncodedPublicKey()
+
 	// Generate default nickname
 	client.LocalNode.Nickname = generateRandomNickname()
 
-	// Try to get public IP and port
-	publicIP, publicPort, err := getPublicIPAndPort()
+	// Open the hole punching socket and learn its public address. Peers
+	// outside our NAT reach us through it; TCP is only reachable where the
+	// local address is.
+	localIP := getLocalIP()
+	publicIP, publicPort := localIP, 0
+	punch, err := ListenPunchSocket(AppConfig.PunchPort)
 	if err != nil {
-		fmt.Printf("Failed to get public IP, using local IP: %v\n", err)
-		publicIP = getLocalIP()
-		publicPort = AppConfig.TCPPort
+		fmt.Printf("Failed to open hole punching socket: %v\n", err)
+	} else {
+		client.Punch = punch
+		if ip, port, err := punch.getPublicIPAndPort(); err != nil {
+			fmt.Printf("Failed to get public IP, using local IP: %v\n", err)
+		} else {
+			publicIP, publicPort = ip, port
+			punch.addCandidate(fmt.Sprintf("%s:%d", ip, port))
+		}
 	}
 
 	client.PublicIP = publicIP
 	client.PublicPort = publicPort
-	client.LocalNode.Address = fmt.Sprintf("%s:%d", publicIP, publicPort)
+	client.NATType = classifyNAT(publicIP)
+	client.LocalNode.Address = fmt.Sprintf("%s:%d", localIP, AppConfig.TCPPort)
+	client.LocalNode.Version = ProtocolVersion
 
-	// Initialize SuperNode manager
 	client.LocalNode.NoSuperNode = AppConfig.NoSuperNode
-	client.SuperNodeMgr = NewSuperNodeManager(client.LocalNode, nil, AppConfig.TCPPort, AppConfig.UDPPort, AppConfig.NoSuperNode)
 
 	return client
 }
@@ -97,199 +162,260 @@ func generateRandomNickname() string {
 	return fmt.Sprintf("%s%s%d", adj, noun, num)
 }
 
-// Create room
-func (p *P2PChat) CreateRoom(roomID string) error {
+// Build the signed NodeInfo the local node advertises to peers
+func (r *RoomSession) localNodeInfo() NodeInfo {
+	nodeInfo := NodeInfo{
+		Address:     r.LocalNode.Address,
+		Nickname:    r.LocalNode.Nickname,
+		NoSuperNode: AppConfig.NoSuperNode,
+		Version:     ProtocolVersion,
+		RoomID:      r.Room.ID,
+		Candidates:  r.Punch.Candidates(),
+	}
+	r.Identity.SignNodeInfo(&nodeInfo)
+	return nodeInfo
+}
+
+// Create room and make it the active room
+func (p *P2PChat) CreateRoom(roomID, passphrase string) error {
+	if p.findRoom(roomID) != nil {
+		return fmt.Errorf("you are already in room %s", roomID)
+	}
+
+	// Generate a passphrase for the room unless one was given
+	generated := false
+	if passphrase == "" {
+		var err error
+		if passphrase, err = generatePassphrase(); err != nil {
+			return err
+		}
+		generated = true
+	} else if len(passphrase) < minPassphraseLen {
+		return fmt.Errorf("passphrase too short, should be at least %d characters", minPassphraseLen)
+	}
+
+	psk, err := derivePassphraseKey(roomID, passphrase)
+	if err != nil {
+		return err
+	}
+
 	// Generate AES-128 key
 	key := make([]byte, 16) // 128-bit key
 	if _, err := io.ReadFull(rand.Reader, key); err != nil {
 		return err
 	}
 
-	p.MessageKey = key
-	p.Room.ID = roomID
-	p.Room.Password = base64.StdEncoding.EncodeToString(key)
+	room := p.newRoomSession(roomID, passphrase, psk)
+	room.Keyring = NewRoomKeyring(key, 0, p.LocalNode.ID)
+	room.Room.CreatorID = p.LocalNode.ID
 
-	// Update SuperNode manager with the message key
-	p.SuperNodeMgr = NewSuperNodeManager(p.LocalNode, p.MessageKey, AppConfig.TCPPort, AppConfig.UDPPort, AppConfig.NoSuperNode)
+	// Each room has its own SuperNode manager
+	room.SuperNodeMgr = NewSuperNodeManager(p.LocalNode, room.Keyring, AppConfig.TCPPort, AppConfig.UDPPort, AppConfig.NoSuperNode)
 
 	// Add local node to room
-	localNode := NodeInfo{
-		ID:          p.LocalNode.Address,
-		Address:     p.LocalNode.Address,
-		Nickname:    p.LocalNode.Nickname,
-		NoSuperNode: AppConfig.NoSuperNode,
+	room.Room.Nodes = append(room.Room.Nodes, room.localNodeInfo())
+
+	if _, err := room.openRoomStore(roomID, psk); err != nil {
+		fmt.Printf("Failed to open message store, history will not be saved: %v\n", err)
 	}
-	p.Room.Nodes = append(p.Room.Nodes, localNode)
+	room.saveRoomState()
+	p.addRoom(room)
 
 	fmt.Printf("Room created successfully! Room ID: %s\n", roomID)
-	fmt.Printf("Room key: %s\n", p.Room.Password)
-	fmt.Printf("Your nickname: %s\n", p.LocalNode.Nickname)
+	if generated {
+		fmt.Printf("Room passphrase: %s (share it with the people you want to invite)\n", passphrase)
+	}
+	fmt.Printf("Your nickname: %s (ID %s)\n", p.LocalNode.Nickname, shortID(p.LocalNode.ID))
 
 	return nil
 }
 
-// Join room
-func (p *P2PChat) JoinRoom(roomID, password string) error {
-	// Decode key
-	key, err := base64.StdEncoding.DecodeString(password)
+// Join room by running the passphrase handshake with an existing member, and
+// make it the active room. If memberAddr is empty, a member is discovered via
+// UDP broadcast.
+func (p *P2PChat) JoinRoom(roomID, passphrase, memberAddr string) error {
+	if p.findRoom(roomID) != nil {
+		return fmt.Errorf("you are already in room %s", roomID)
+	}
+
+	psk, err := derivePassphraseKey(roomID, passphrase)
 	if err != nil {
-		return fmt.Errorf("invalid room key: %v", err)
+		return err
 	}
 
-	if len(key) != 16 {
-		return fmt.Errorf("room key length incorrect, should be 16 bytes")
+	if memberAddr == "" {
+		fmt.Printf("Looking for members of room %s...\n", roomID)
+		member, err := p.waitForRoomMember(roomID, 3*AppConfig.BroadcastTimeout)
+		if err != nil {
+			return err
+		}
+		memberAddr = member.Address
 	}
 
-	p.Room.ID = roomID
-	p.MessageKey = key
-	p.Room.Password = password
+	room := p.newRoomSession(roomID, passphrase, psk)
 
-	// Update SuperNode manager with the message key
-	p.LocalNode.NoSuperNode = AppConfig.NoSuperNode
-	p.SuperNodeMgr = NewSuperNodeManager(p.LocalNode, p.MessageKey, AppConfig.TCPPort, AppConfig.UDPPort, AppConfig.NoSuperNode)
+	// Introduce ourselves as a member of the room
+	localNode := room.localNodeInfo()
+
+	accept, err := p.performJoinHandshake(memberAddr, roomID, psk, localNode)
+	if err != nil {
+		return err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(accept.RoomKey)
+	if err != nil || len(key) != 16 {
+		return fmt.Errorf("member sent an invalid room key")
+	}
+
+	room.Room.CreatorID = accept.CreatorID
+	room.Keyring = NewRoomKeyring(key, accept.Epoch, accept.CreatorID)
+	room.denyNodes(accept.Removed)
+
+	// Each room has its own SuperNode manager
+	room.SuperNodeMgr = NewSuperNodeManager(p.LocalNode, room.Keyring, AppConfig.TCPPort, AppConfig.UDPPort, AppConfig.NoSuperNode)
+
+	// Take over the member list from the node that admitted us
+	room.Room.Nodes = []NodeInfo{localNode}
+	for _, node := range accept.Nodes {
+		if node.ID == p.LocalNode.ID || !verifyNodeInfo(node) {
+			continue
+		}
+		room.Room.Nodes = append(room.Room.Nodes, node)
+		room.SuperNodeMgr.AddNode(node)
+	}
+
+	if _, err := room.openRoomStore(roomID, psk); err != nil {
+		fmt.Printf("Failed to open message store, history will not be saved: %v\n", err)
+	}
+	room.saveRoomState()
+	p.addRoom(room)
+	room.runElection()
 
 	fmt.Printf("Successfully joined room %s!\n", roomID)
-	fmt.Printf("Your nickname: %s\n", p.LocalNode.Nickname)
+	fmt.Printf("Your nickname: %s (ID %s)\n", p.LocalNode.Nickname, shortID(p.LocalNode.ID))
+
+	// Catch up on what was said before we arrived
+	member := NodeInfo{Address: memberAddr, Nickname: memberAddr}
+	for _, node := range room.Room.Nodes {
+		if node.Address == memberAddr {
+			member = node
+			break
+		}
+	}
+	if err := room.SyncHistory(member); err != nil {
+		// Fall back to a SuperNode, which sees most of the room's traffic
+		synced := false
+		for _, superNode := range room.SuperNodeMgr.GetSuperNodes() {
+			if superNode.ID != member.ID && room.SyncHistory(superNode.NodeInfo) == nil {
+				synced = true
+				break
+			}
+		}
+		if !synced {
+			fmt.Printf("Failed to fetch chat history: %v\n", err)
+		}
+	}
 
 	return nil
 }
 
 // Send message to all nodes in room
-func (p *P2PChat) SendMessage(content string) error {
+func (r *RoomSession) SendMessage(content string) error {
 	// Create message
+	now := time.Now()
 	message := Message{
-		RoomID:    p.Room.ID,
-		Sender:    p.LocalNode.Nickname,
-		Timestamp: time.Now().Format("2006-01-02 15:04:05"),
+		ID:        newMessageID(),
+		RoomID:    r.Room.ID,
+		Sender:    r.LocalNode.Nickname,
+		Timestamp: now.Format("2006-01-02 15:04:05"),
+		SentAt:    now.UnixMilli(),
 		Content:   content,
 	}
+	r.Identity.SignMessage(&message)
+
+	// Our own message may come back via a fallback delivery
+	r.SeenMessages.MarkSeen(messageKey(message))
 
-	// Serialize message
-	messageData, err := json.Marshal(message)
+	// Serialize message; the outbox encrypts it for each attempt
+	seal, err := r.roomSealer(message)
 	if err != nil {
 		return err
 	}
 
-	// Encrypt message
-	encryptedData, err := encryptAES(p.MessageKey, messageData)
-	if err != nil {
-		return err
+	// Display local message; delivery continues in the background
+	r.displayMessage(message)
+	r.Outbox.Track(message)
+	key := messageKey(message)
+
+	// Gossip mode: push to a few random members, which pass it on
+	if r.Mode == modeGossip {
+		r.gossipMessage(message, AppConfig.GossipTTL, "")
+		return nil
 	}
 
 	// Use SuperNode mode if enabled and there are enough nodes
-	if p.SuperNodeMgr.ShouldEnableSuperNodeMode(len(p.Room.Nodes)) {
-		// If this node is a SuperNode, send to other SuperNodes
-		if p.SuperNodeMgr.IsLocalNodeSuperNode() {
-			// Forward to other SuperNodes
-			err = p.SuperNodeMgr.ForwardMessageToSuperNodes(message, p.MessageKey)
+	if r.Mode == modeAuto && r.SuperNodeMgr.ShouldEnableSuperNodeMode(len(r.Room.Nodes)) {
+		// If this node is a SuperNode, relay along the SuperNode tree
+		if r.SuperNodeMgr.IsLocalNodeSuperNode() {
+			r.relayMessage(message, r.LocalNode.ID)
+			return nil
+		}
+
+		// If not a SuperNode, send to my designated SuperNode to relay
+		if superNode := r.SuperNodeMgr.GetBestSuperNodeForConnection(); superNode != nil {
+			relaySeal, err := r.roomSealer(relayEnvelope{Via: r.LocalNode.ID, Message: message})
 			if err != nil {
 				return err
 			}
-			// Display local message
-			fmt.Printf("[%s] Me: %s\n", message.Timestamp, message.Content)
-		} else {
-			// If not a SuperNode, send to my designated SuperNode
-			superNode := p.SuperNodeMgr.GetBestSuperNodeForConnection()
-			if superNode != nil {
-				// Send to designated SuperNode
-				go func(nodeAddr string) {
-					conn, err := net.DialTimeout("tcp", nodeAddr, 5*time.Second)
-					if err != nil {
-						fmt.Printf("Failed to connect to SuperNode %s: %v\n", nodeAddr, err)
-						return
-					}
-					defer conn.Close()
-
-					_, err = conn.Write(encryptedData)
-					if err != nil {
-						fmt.Printf("Failed to send message to SuperNode %s: %v\n", nodeAddr, err)
-					} else {
-						// Display local message after successful send to SuperNode
-						fmt.Printf("[%s] Me: %s\n", message.Timestamp, message.Content)
-					}
-				}(superNode.Address)
-			} else {
-				// Fallback: send directly to all nodes if no SuperNode available
-				p.NodeMutex.RLock()
-				defer p.NodeMutex.RUnlock()
-
-				// Track if local message has been displayed
-				localDisplayed := false
-				for _, node := range p.Room.Nodes {
-					if node.Address == p.LocalNode.Address {
-						// Display local message
-						fmt.Printf("[%s] Me: %s\n", message.Timestamp, message.Content)
-						localDisplayed = true
-						continue
-					}
-
-					// Connect to other nodes and send message
-					go func(nodeAddr string) {
-						conn, err := net.DialTimeout("tcp", nodeAddr, 5*time.Second)
-						if err != nil {
-							fmt.Printf("Failed to connect to node %s: %v\n", nodeAddr, err)
-							return
-						}
-						defer conn.Close()
-
-						_, err = conn.Write(encryptedData)
-						if err != nil {
-							fmt.Printf("Failed to send message to node %s: %v\n", nodeAddr, err)
-						}
-					}(node.Address)
-				}
-				if !localDisplayed {
-					fmt.Printf("[%s] Me: %s\n", message.Timestamp, message.Content)
-				}
-			}
+			r.Outbox.Enqueue(superNode.NodeInfo, key, FrameRelay, relaySeal)
+			return nil
 		}
-	} else {
-		// Standard mode: send to all nodes directly
-		p.NodeMutex.RLock()
-		defer p.NodeMutex.RUnlock()
-
-		// Track if local message has been displayed
-		localDisplayed := false
-		for _, node := range p.Room.Nodes {
-			if node.Address == p.LocalNode.Address {
-				// Display local message
-				fmt.Printf("[%s] Me: %s\n", message.Timestamp, message.Content)
-				localDisplayed = true
-				continue
-			}
 
-			// Connect to other nodes and send message
-			go func(nodeAddr string) {
-				conn, err := net.DialTimeout("tcp", nodeAddr, 5*time.Second)
-				if err != nil {
-					fmt.Printf("Failed to connect to node %s: %v\n", nodeAddr, err)
-					return
-				}
-				defer conn.Close()
+		// Fallback: send directly to all nodes if no SuperNode available
+	}
 
-				_, err = conn.Write(encryptedData)
-				if err != nil {
-					fmt.Printf("Failed to send message to node %s: %v\n", nodeAddr, err)
-				}
-			}(node.Address)
-		}
-		if !localDisplayed {
-			fmt.Printf("[%s] Me: %s\n", message.Timestamp, message.Content)
+	// Standard mode: send to all nodes directly
+	r.NodeMutex.RLock()
+	defer r.NodeMutex.RUnlock()
+
+	for _, node := range r.Room.Nodes {
+		if node.ID == r.LocalNode.ID {
+			continue
 		}
+		r.Outbox.Enqueue(node, key, FrameMessage, seal)
 	}
 
 	return nil
 }
 
+// Label a node for status output
+func nodeLabel(node NodeInfo) string {
+	return fmt.Sprintf("%s (%s)", node.Nickname, shortID(node.ID))
+}
+
 // Run CLI interface
 func (p *P2PChat) RunCLI() {
 	fmt.Println("P2P chat program started!")
 	fmt.Println("Available commands:")
-	fmt.Println("  /create [room ID] - Create room")
-	fmt.Println("  /join [room ID] [room key] - Join room")
-	fmt.Println("  /list - List nodes in room")
-	fmt.Println("  /save - Save chat log")
-	fmt.Println("  /file [file path] - Send file")
+	fmt.Println("  /create [room ID] [passphrase] - Create room (passphrase is generated if omitted)")
+	fmt.Println("  /join [room ID] [passphrase] [member address] - Join room")
+	fmt.Println("  /reopen [room ID] [passphrase] - Reopen a room saved by an earlier session")
+	fmt.Println("  /msg [nickname|ID] [message] - Send a private message to one member")
+	fmt.Println("  /list - List nodes in the active room")
+	fmt.Println("  /rooms - List the rooms you are in")
+	fmt.Println("  /switch [room ID] - Make another room the active room")
+	fmt.Println("  /leave [room ID] - Leave a room (the active room if omitted)")
+	fmt.Println("  /mode [auto|direct|gossip] - Choose how your messages reach the active room")
+	fmt.Println("  /status [message ID] - Show delivery status of sent messages")
+	fmt.Println("  /rekey - Rotate the room key (creator or SuperNode)")
+	fmt.Println("  /remove [nickname|ID] - Remove a node, rotating the room key and passphrase")
+	fmt.Println("  /save [text|jsonl|md] [from] [to] - Save chat log")
+	fmt.Println("  /file [file path] - Offer a file to the room")
+	fmt.Println("  /accept [file ID] - Download an offered file (lists offers without an ID)")
+	fmt.Println("  /transfers - Show file transfers and their progress")
+	fmt.Println("  /pause [file ID] - Pause a download")
+	fmt.Println("  /resume [file ID] - Resume a paused or interrupted download")
+	fmt.Println("  /cancel [file ID] - Cancel a download, or stop sharing a file")
 	fmt.Println("  /help - Show this help message")
 	fmt.Println("  /exit - Exit program")
 	fmt.Println("  (Messages without / are sent as chat messages)")
@@ -316,96 +442,317 @@ func (p *P2PChat) RunCLI() {
 			// Remove the leading slash to get the actual command
 			command = command[1:]
 
+			// Room-specific commands apply to the active room
+			room := p.ActiveRoom()
+
 			switch command {
 			case "create":
 				if len(parts) < 2 {
-					fmt.Println("Usage: /create [room ID]")
-					continue
-				}
-
-				if p.Room.ID != "" {
-					fmt.Println("You are already in a room!")
+					fmt.Println("Usage: /create [room ID] [passphrase]")
 					continue
 				}
 
 				roomID := parts[1]
-				if err := p.CreateRoom(roomID); err != nil {
+				passphrase := ""
+				if len(parts) >= 3 {
+					passphrase = parts[2]
+				}
+				if err := p.CreateRoom(roomID, passphrase); err != nil {
 					fmt.Printf("Failed to create room: %v\n", err)
 					continue
 				}
 
-				// Start UDP and TCP services
-				if err := p.StartUDPBroadcast(); err != nil {
-					fmt.Printf("Failed to start UDP broadcast: %v\n", err)
-					continue
+				// Start UDP and TCP services unless another room already did
+				if p.UDPSocket == nil {
+					if err := p.StartUDPBroadcast(); err != nil {
+						fmt.Printf("Failed to start UDP broadcast: %v\n", err)
+						continue
+					}
 				}
 
-				if err := p.StartTCPListener(); err != nil {
-					fmt.Printf("Failed to start TCP listener: %v\n", err)
-					continue
+				if p.TCPListener == nil {
+					if err := p.StartTCPListener(); err != nil {
+						fmt.Printf("Failed to start TCP listener: %v\n", err)
+						continue
+					}
 				}
 
 				fmt.Printf("Room %s created, listening for connections...\n", roomID)
 
 			case "join":
 				if len(parts) < 3 {
-					fmt.Println("Usage: /join [room ID] [room key]")
+					fmt.Println("Usage: /join [room ID] [passphrase] [member address]")
 					continue
 				}
 
-				if p.Room.ID != "" {
-					fmt.Println("You are already in a room!")
-					continue
+				roomID := parts[1]
+				passphrase := parts[2]
+				memberAddr := ""
+				if len(parts) >= 4 {
+					memberAddr = parts[3]
 				}
 
-				roomID := parts[1]
-				password := parts[2]
+				// Start UDP and TCP services first so room members can be discovered
+				if p.UDPSocket == nil {
+					if err := p.StartUDPBroadcast(); err != nil {
+						fmt.Printf("Failed to start UDP broadcast: %v\n", err)
+						continue
+					}
+				}
 
-				if err := p.JoinRoom(roomID, password); err != nil {
+				if p.TCPListener == nil {
+					if err := p.StartTCPListener(); err != nil {
+						fmt.Printf("Failed to start TCP listener: %v\n", err)
+						continue
+					}
+				}
+
+				if err := p.JoinRoom(roomID, passphrase, memberAddr); err != nil {
 					fmt.Printf("Failed to join room: %v\n", err)
 					continue
 				}
 
-				// Start UDP and TCP services
-				if err := p.StartUDPBroadcast(); err != nil {
-					fmt.Printf("Failed to start UDP broadcast: %v\n", err)
+				fmt.Printf("Successfully joined room %s, listening for connections...\n", roomID)
+
+			case "reopen":
+				if len(parts) < 3 {
+					fmt.Println("Usage: /reopen [room ID] [passphrase]")
+					continue
+				}
+
+				// Start UDP and TCP services first so room members can reach us
+				if p.UDPSocket == nil {
+					if err := p.StartUDPBroadcast(); err != nil {
+						fmt.Printf("Failed to start UDP broadcast: %v\n", err)
+						continue
+					}
+				}
+
+				if p.TCPListener == nil {
+					if err := p.StartTCPListener(); err != nil {
+						fmt.Printf("Failed to start TCP listener: %v\n", err)
+						continue
+					}
+				}
+
+				if err := p.ReopenRoom(parts[1], parts[2]); err != nil {
+					fmt.Printf("Failed to reopen room: %v\n", err)
+					continue
+				}
+
+				fmt.Printf("Room %s reopened, listening for connections...\n", parts[1])
+
+			case "msg":
+				if len(parts) < 3 {
+					fmt.Println("Usage: /msg [nickname|ID] [message]")
 					continue
 				}
 
-				if err := p.StartTCPListener(); err != nil {
-					fmt.Printf("Failed to start TCP listener: %v\n", err)
+				if room == nil {
+					fmt.Println("Please create or join a room first!")
 					continue
 				}
 
-				fmt.Printf("Successfully joined room %s, listening for connections...\n", roomID)
+				// Keep the message text as typed, including inner spacing
+				content := strings.TrimSpace(strings.TrimPrefix(input, parts[0]))
+				content = strings.TrimSpace(strings.TrimPrefix(content, parts[1]))
+				if err := room.SendDirectMessage(parts[1], content); err != nil {
+					fmt.Printf("Failed to send direct message: %v\n", err)
+				}
 
 			case "list":
-				if p.Room.ID == "" {
+				if room == nil {
 					fmt.Println("Please create or join a room first!")
 					continue
 				}
 
-				p.NodeMutex.RLock()
-				fmt.Printf("Nodes in room %s (%d nodes):\n", p.Room.ID, len(p.Room.Nodes))
-				for i, node := range p.Room.Nodes {
+				room.NodeMutex.RLock()
+				fmt.Printf("Nodes in room %s (%d nodes):\n", room.Room.ID, len(room.Room.Nodes))
+				for i, node := range room.Room.Nodes {
+					var flags []string
+					if node.ID == p.LocalNode.ID {
+						flags = append(flags, "you")
+						if room.SuperNodeMgr.IsLocalNodeSuperNode() {
+							flags = append(flags, "SuperNode")
+						}
+					} else {
+						if sn := room.SuperNodeMgr.GetNode(node.ID); sn != nil {
+							if sn.IsSuperNode {
+								flags = append(flags, fmt.Sprintf("SuperNode, load %d", room.SuperNodeMgr.SuperNodeLoad(sn.ID)))
+							}
+							if sn.ID == room.SuperNodeMgr.AttachedSuperNode() {
+								flags = append(flags, "relaying through")
+							}
+							flags = append(flags, fmt.Sprintf("score %.0f", sn.Score))
+						}
+						switch room.Health.Health(node.ID) {
+						case nodeSuspect:
+							flags = append(flags, "not responding")
+						case nodeOffline:
+							flags = append(flags, "offline")
+						}
+						flags = append(flags, p.Conns.State(node.Address))
+					}
 					status := ""
-					if node.Address == p.LocalNode.Address {
-						status = " (you)"
+					if len(flags) > 0 {
+						status = " (" + strings.Join(flags, ", ") + ")"
 					}
-					fmt.Printf("  %d. %s (%s)%s\n", i+1, node.Nickname, node.Address, status)
+					fmt.Printf("  %d. %s [%s] (%s)%s\n", i+1, node.Nickname, shortID(node.ID), node.Address, status)
+				}
+				room.NodeMutex.RUnlock()
+
+			case "rooms":
+				p.printRooms()
+
+			case "switch":
+				if len(parts) < 2 {
+					fmt.Println("Usage: /switch [room ID]")
+					continue
+				}
+
+				if err := p.SwitchRoom(parts[1]); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				fmt.Printf("Switched to room %s\n", parts[1])
+
+			case "leave":
+				roomID := ""
+				if len(parts) >= 2 {
+					roomID = parts[1]
+				} else if room != nil {
+					roomID = room.Room.ID
+				} else {
+					fmt.Println("Please create or join a room first!")
+					continue
+				}
+
+				if err := p.LeaveRoom(roomID); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				fmt.Printf("Left room %s\n", roomID)
+				if active := p.ActiveRoom(); active != nil {
+					fmt.Printf("Active room is now %s\n", active.Room.ID)
+				} else {
+					fmt.Println("Not in any room, network services stopped")
+				}
+
+			case "mode":
+				if room == nil {
+					fmt.Println("Please create or join a room first!")
+					continue
+				}
+
+				if len(parts) < 2 {
+					fmt.Printf("Messages in room %s are sent in %s mode\n", room.Room.ID, room.Mode)
+					continue
+				}
+				mode := strings.ToLower(parts[1])
+				if !validMode(mode) {
+					fmt.Println("Usage: /mode [auto|direct|gossip]")
+					continue
+				}
+				room.Mode = mode
+				room.saveRoomState()
+				fmt.Printf("Messages in room %s are now sent in %s mode\n", room.Room.ID, mode)
+
+			case "status":
+				if room == nil {
+					fmt.Println("Please create or join a room first!")
+					continue
+				}
+
+				idPrefix := ""
+				if len(parts) >= 2 {
+					idPrefix = parts[1]
+				}
+				p.printDeliveryStatus(idPrefix)
+
+			case "rekey":
+				if room == nil {
+					fmt.Println("Please create or join a room first!")
+					continue
+				}
+
+				if err := room.Rekey(nil); err != nil {
+					fmt.Printf("Failed to rotate room key: %v\n", err)
 				}
-				p.NodeMutex.RUnlock()
+
+			case "remove":
+				if len(parts) < 2 {
+					fmt.Println("Usage: /remove [nickname|ID]")
+					continue
+				}
+
+				if room == nil {
+					fmt.Println("Please create or join a room first!")
+					continue
+				}
+
+				if !room.isRekeyAuthority(p.LocalNode.ID) {
+					fmt.Println("Only the room creator can remove nodes!")
+					continue
+				}
+
+				node, err := room.findRoomNode(parts[1])
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				if node.ID == p.LocalNode.ID {
+					fmt.Println("You can't remove yourself!")
+					continue
+				}
+
+				room.dropRoomNode(node.ID)
+				if err := room.Rekey([]string{node.ID}); err != nil {
+					fmt.Printf("Failed to rotate room key: %v\n", err)
+					continue
+				}
+				fmt.Printf("[System] Removed %s (%s) from the room\n", node.Nickname, shortID(node.ID))
 
 			case "save":
-				// Save chat log (simplified implementation)
-				timestamp := time.Now().Format("20060102_150405")
-				filename := fmt.Sprintf("chat_log_%s.txt", timestamp)
-				content := fmt.Sprintf("P2P Chat Log - %s\n", time.Now().Format("2006-01-02 15:04:05"))
-				err := os.WriteFile(filename, []byte(content), 0644)
+				if room == nil {
+					fmt.Println("Please create or join a room first!")
+					continue
+				}
+
+				// Optional format, then an optional time range
+				args := parts[1:]
+				format := "text"
+				if len(args) > 0 {
+					if _, ok := transcriptFormats[strings.ToLower(args[0])]; ok {
+						format = strings.ToLower(args[0])
+						args = args[1:]
+					}
+				}
+				if len(args) > 2 {
+					fmt.Println("Usage: /save [text|jsonl|md] [from] [to]")
+					continue
+				}
+
+				now := time.Now()
+				var bounds [2]time.Time
+				valid := true
+				for i, arg := range args {
+					t, err := parseTimeBound(arg, now)
+					if err != nil {
+						fmt.Println(err)
+						valid = false
+						break
+					}
+					bounds[i] = t
+				}
+				if !valid {
+					continue
+				}
+
+				filename, count, err := room.SaveTranscript(format, bounds[0], bounds[1])
 				if err != nil {
 					fmt.Printf("Failed to save chat log: %v\n", err)
 				} else {
-					fmt.Printf("Chat log saved to %s\n", filename)
+					fmt.Printf("Chat log saved to %s (%d messages)\n", filename, count)
 				}
 
 			case "file":
@@ -414,51 +761,83 @@ func (p *P2PChat) RunCLI() {
 					continue
 				}
 
-				filePath := parts[1]
-				fileInfo, err := os.Stat(filePath)
-				if err != nil {
-					fmt.Printf("File does not exist: %s\n", filePath)
+				if room == nil {
+					fmt.Println("Please create or join a room first!")
+					continue
+				}
+
+				if err := room.OfferFile(parts[1]); err != nil {
+					fmt.Printf("Failed to offer file: %v\n", err)
+				}
+
+			case "accept":
+				if room == nil {
+					fmt.Println("Please create or join a room first!")
 					continue
 				}
 
-				if fileInfo.IsDir() {
-					fmt.Printf("Cannot send directory: %s\n", filePath)
+				if len(parts) < 2 {
+					room.printFileOffers()
 					continue
 				}
 
-				// Simplified file sending (actual implementation should handle file chunks)
-				fmt.Printf("File sending: Preparing to send file %s (size: %d bytes)\n", filePath, fileInfo.Size())
+				if err := room.AcceptFile(parts[1]); err != nil {
+					fmt.Printf("Failed to accept file: %v\n", err)
+				}
 
-				// Read file content and encode to base64
-				fileData, err := os.ReadFile(filePath)
-				if err != nil {
-					fmt.Printf("Failed to read file: %v\n", err)
+			case "transfers":
+				if room == nil {
+					fmt.Println("Please create or join a room first!")
 					continue
 				}
 
-				encodedData := base64.StdEncoding.EncodeToString(fileData)
-				chunkSize := 100
-				if len(encodedData) < chunkSize {
-					chunkSize = len(encodedData)
+				room.printTransfers()
+
+			case "pause", "resume", "cancel":
+				if len(parts) < 2 {
+					fmt.Printf("Usage: /%s [file ID]\n", command)
+					continue
 				}
-				fileMessage := fmt.Sprintf("[File] %s: %s", fileInfo.Name(), encodedData[:chunkSize])
-				if len(encodedData) > chunkSize {
-					fileMessage += "..."
+
+				if room == nil {
+					fmt.Println("Please create or join a room first!")
+					continue
 				}
 
-				if err := p.SendMessage(fileMessage); err != nil {
-					fmt.Printf("Failed to send file info: %v\n", err)
-				} else {
-					fmt.Printf("File info sent\n")
+				var err error
+				switch command {
+				case "pause":
+					err = room.PauseTransfer(parts[1])
+				case "resume":
+					err = room.ResumeTransfer(parts[1])
+				default:
+					err = room.CancelTransfer(parts[1])
+				}
+				if err != nil {
+					fmt.Println(err)
 				}
 
 			case "help":
 				fmt.Println("Available commands:")
-				fmt.Println("  /create [room ID] - Create room")
-				fmt.Println("  /join [room ID] [room key] - Join room")
-				fmt.Println("  /list - List nodes in room")
-				fmt.Println("  /save - Save chat log")
-				fmt.Println("  /file [file path] - Send file")
+				fmt.Println("  /create [room ID] [passphrase] - Create room (passphrase is generated if omitted)")
+				fmt.Println("  /join [room ID] [passphrase] [member address] - Join room")
+				fmt.Println("  /reopen [room ID] [passphrase] - Reopen a room saved by an earlier session")
+				fmt.Println("  /msg [nickname|ID] [message] - Send a private message to one member")
+				fmt.Println("  /list - List nodes in the active room")
+				fmt.Println("  /rooms - List the rooms you are in")
+				fmt.Println("  /switch [room ID] - Make another room the active room")
+				fmt.Println("  /leave [room ID] - Leave a room (the active room if omitted)")
+				fmt.Println("  /mode [auto|direct|gossip] - Choose how your messages reach the active room")
+				fmt.Println("  /status [message ID] - Show delivery status of sent messages")
+				fmt.Println("  /rekey - Rotate the room key (creator or SuperNode)")
+				fmt.Println("  /remove [nickname|ID] - Remove a node, rotating the room key and passphrase")
+				fmt.Println("  /save [text|jsonl|md] [from] [to] - Save chat log")
+				fmt.Println("  /file [file path] - Offer a file to the room")
+				fmt.Println("  /accept [file ID] - Download an offered file (lists offers without an ID)")
+				fmt.Println("  /transfers - Show file transfers and their progress")
+				fmt.Println("  /pause [file ID] - Pause a download")
+				fmt.Println("  /resume [file ID] - Resume a paused or interrupted download")
+				fmt.Println("  /cancel [file ID] - Cancel a download, or stop sharing a file")
 				fmt.Println("  /help - Show this help message")
 				fmt.Println("  /exit - Exit program")
 				fmt.Println("  (Messages without / are sent as chat messages)")
@@ -470,12 +849,10 @@ func (p *P2PChat) RunCLI() {
 					p.UDPSocket.Close()
 				}
 				// Close all TCP connections
-				p.NodeMutex.Lock()
-				for addr, conn := range p.TCPListeners {
-					conn.Close()
-					delete(p.TCPListeners, addr)
+				p.Conns.CloseAll()
+				for _, room := range p.roomList() {
+					room.close()
 				}
-				p.NodeMutex.Unlock()
 				os.Exit(0)
 
 			default:
@@ -483,14 +860,15 @@ func (p *P2PChat) RunCLI() {
 				fmt.Println("Type '/help' for available commands")
 			}
 		} else {
-			// Process as chat message
-			if p.Room.ID == "" {
+			// Process as chat message in the active room
+			room := p.ActiveRoom()
+			if room == nil {
 				fmt.Println("Please create or join a room first!")
 				continue
 			}
 
 			// Send the entire input as a message
-			if err := p.SendMessage(input); err != nil {
+			if err := room.SendMessage(input); err != nil {
 				fmt.Printf("Failed to send message: %v\n", err)
 				continue
 			}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Connection pool
+//
+// Members keep one long-lived TCP connection per peer and send every frame
+// for that peer over it: messages and their acknowledgements, heartbeats,
+// history and file transfer requests. A connection is opened on first use
+// and authenticated both ways with a connHello exchange, in which each end
+// signs the nonce the other picked with its identity key. Both ends then
+// send requests over the same connection. Each request carries an ID, and
+// the other end answers it with exactly one reply frame (see expectsReply)
+// repeating that ID. A request that times out is forgotten on its own, and
+// a reply arriving after that is dropped, so a slow reply, e.g. to a large
+// chunk request, doesn't cost the connection.
+//
+// A peer that can't be dialled over TCP, e.g. because it is behind a NAT,
+// is reached over a punched UDP stream instead, or through a relay if
+// punching fails (see Fallback, holepunch.go and tunnel.go).
+//
+// A connection that fails is reopened on next use. While reconnecting
+// keeps failing, attempts back off from connInitialBackoff to
+// connMaxBackoff; sends in between fail at once and the outbox retries
+// them later. Connections nobody used for connIdleTimeout are closed.
+//
+// Join handshakes use a connection of their own, since the joiner can't
+// prove it belongs in the room yet.
+
+// Connection pool parameters
+const (
+	connDialTimeout    = 5 * time.Second
+	connRequestTimeout = 10 * time.Second
+	connInitialBackoff = 500 * time.Millisecond
+	connMaxBackoff     = 30 * time.Second
+	connIdleTimeout    = 2 * time.Minute
+)
+
+var errConnClosed = errors.New("connection closed")
+
+// connHello authenticates one end of a pooled connection
+type connHello struct {
+	NodeID    string `json:"node_id"`
+	PublicKey string `json:"public_key"`
+	Address   string `json:"address"`              // Address the node listens on
+	Nonce     string `json:"nonce"`                // Picked by this end
+	PeerNonce string `json:"peer_nonce,omitempty"` // Picked by the other end
+	Signature string `json:"signature,omitempty"`  // Covers both nonces
+}
+
+// Bytes covered by a connection hello signature
+func connHelloSigningBytes(hello connHello) []byte {
+	hello.Signature = ""
+	data, _ := json.Marshal(hello)
+	return data
+}
+
+// pooledConn is an authenticated connection to one peer
+type pooledConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	peer   connHello // Verified hello of the other end
+
+	writeMu sync.Mutex // Serialises frames written to conn
+
+	mu       sync.Mutex
+	nextID   uint32                 // Last request ID used
+	waiting  map[uint32]chan *Frame // Our requests awaiting a reply, by ID
+	inbox    []*Frame               // Requests from the peer awaiting handling
+	wake     chan struct{}
+	closed   bool
+	lastUsed time.Time
+}
+
+func newPooledConn(conn net.Conn, reader *bufio.Reader, peer connHello) *pooledConn {
+	return &pooledConn{
+		conn:     conn,
+		reader:   reader,
+		peer:     peer,
+		waiting:  make(map[uint32]chan *Frame),
+		wake:     make(chan struct{}, 1),
+		lastUsed: time.Now(),
+	}
+}
+
+// Write one frame, with the ID of the request it answers or 0
+func (pc *pooledConn) write(frameType byte, id uint32, payload []byte) error {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+
+	pc.mu.Lock()
+	closed := pc.closed
+	pc.lastUsed = time.Now()
+	pc.mu.Unlock()
+	if closed {
+		return errConnClosed
+	}
+
+	pc.conn.SetWriteDeadline(time.Now().Add(connRequestTimeout))
+	if err := writeFrameID(pc.conn, frameType, id, payload); err != nil {
+		pc.close()
+		return err
+	}
+	return nil
+}
+
+// Send a request and wait for its reply
+func (pc *pooledConn) request(frameType byte, payload []byte, timeout time.Duration) (*Frame, error) {
+	reply := make(chan *Frame, 1)
+
+	pc.mu.Lock()
+	if pc.closed {
+		pc.mu.Unlock()
+		return nil, errConnClosed
+	}
+	pc.nextID++
+	if pc.nextID == 0 {
+		pc.nextID++ // 0 marks frames that aren't replies
+	}
+	id := pc.nextID
+	pc.waiting[id] = reply
+	pc.mu.Unlock()
+
+	if err := pc.write(frameType, id, payload); err != nil {
+		pc.forget(id)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case frame, ok := <-reply:
+		if !ok {
+			return nil, errConnClosed
+		}
+		return frame, nil
+	case <-timer.C:
+		pc.forget(id)
+		return nil, fmt.Errorf("no reply within %s", timeout)
+	}
+}
+
+// Stop waiting for the reply to a request
+func (pc *pooledConn) forget(id uint32) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	delete(pc.waiting, id)
+}
+
+// Hand a reply to the request with its ID. Replies nobody waits for any
+// more are dropped.
+func (pc *pooledConn) deliver(frame *Frame) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.lastUsed = time.Now()
+	if reply, ok := pc.waiting[frame.ID]; ok {
+		reply <- frame
+		delete(pc.waiting, frame.ID)
+	}
+}
+
+// Queue a request from the peer for handling
+func (pc *pooledConn) enqueue(frame *Frame) {
+	pc.mu.Lock()
+	pc.inbox = append(pc.inbox, frame)
+	pc.lastUsed = time.Now()
+	pc.mu.Unlock()
+
+	select {
+	case pc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Take the next request from the peer, waiting for one. Returns nil once
+// the connection is closed.
+func (pc *pooledConn) next() *Frame {
+	for {
+		pc.mu.Lock()
+		if len(pc.inbox) > 0 {
+			frame := pc.inbox[0]
+			pc.inbox = pc.inbox[1:]
+			pc.mu.Unlock()
+			return frame
+		}
+		closed := pc.closed
+		pc.mu.Unlock()
+		if closed {
+			return nil
+		}
+		<-pc.wake
+	}
+}
+
+// Close the connection, failing requests still waiting for a reply
+func (pc *pooledConn) close() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	pc.conn.Close()
+	for id, reply := range pc.waiting {
+		close(reply)
+		delete(pc.waiting, id)
+	}
+
+	select {
+	case pc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Check whether the connection was closed
+func (pc *pooledConn) isClosed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.closed
+}
+
+// Time since a frame was last sent or received
+func (pc *pooledConn) idle() time.Duration {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return time.Since(pc.lastUsed)
+}
+
+// peerLink is the pool's entry for one peer address
+type peerLink struct {
+	dialMu   sync.Mutex // Held while connecting
+	conn     *pooledConn
+	dialing  bool
+	failures int // Failed attempts in a row
+	retryAt  time.Time
+	lastErr  error
+}
+
+// ConnManager keeps the pooled connections to peers
+type ConnManager struct {
+	mu    sync.Mutex
+	links map[string]*peerLink // Peer listening address -> link
+	conns map[*pooledConn]bool // Every open connection, incoming ones included
+
+	identity  *Identity
+	localAddr func() string
+	// Returns the ID of the room member listening on addr, if any
+	memberAt func(addr string) (string, bool)
+	// Handles a request from a peer and returns the reply to send, if any
+	handler func(frame *Frame, remoteAddr string) (byte, []byte)
+
+	// Opens a connection to a peer that can't be dialled directly, if set
+	Fallback func(addr string) (net.Conn, error)
+}
+
+// NewConnManager creates an empty connection pool
+func NewConnManager(identity *Identity, localAddr func() string, memberAt func(string) (string, bool),
+	handler func(*Frame, string) (byte, []byte)) *ConnManager {
+	return &ConnManager{
+		links:     make(map[string]*peerLink),
+		conns:     make(map[*pooledConn]bool),
+		identity:  identity,
+		localAddr: localAddr,
+		memberAt:  memberAt,
+		handler:   handler,
+	}
+}
+
+// Send a frame to a peer without waiting for a reply
+func (m *ConnManager) Send(addr string, frameType byte, payload []byte) error {
+	pc, err := m.get(addr)
+	if err != nil {
+		return err
+	}
+	return pc.write(frameType, 0, payload)
+}
+
+// Request sends a frame to a peer and returns its reply
+func (m *ConnManager) Request(addr string, frameType byte, payload []byte, timeout time.Duration) (*Frame, error) {
+	pc, err := m.get(addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.request(frameType, payload, timeout)
+}
+
+// SendWithAck sends a frame to a peer and waits for it to acknowledge ackID
+func (m *ConnManager) SendWithAck(addr string, frameType byte, payload []byte, ackID string) error {
+	frame, err := m.Request(addr, frameType, payload, connRequestTimeout)
+	if err != nil {
+		return fmt.Errorf("no acknowledgement: %w", err)
+	}
+	if frame.Type != FrameAck || string(frame.Payload) != ackID {
+		return fmt.Errorf("unexpected acknowledgement")
+	}
+	return nil
+}
+
+// Get the open connection to a peer, connecting if there is none
+func (m *ConnManager) get(addr string) (*pooledConn, error) {
+	m.mu.Lock()
+	link, ok := m.links[addr]
+	if !ok {
+		link = &peerLink{}
+		m.links[addr] = link
+	}
+	m.mu.Unlock()
+
+	link.dialMu.Lock()
+	defer link.dialMu.Unlock()
+
+	m.mu.Lock()
+	if link.conn != nil && !link.conn.isClosed() {
+		pc := link.conn
+		m.mu.Unlock()
+		return pc, nil
+	}
+	if wait := time.Until(link.retryAt); wait > 0 {
+		err := fmt.Errorf("reconnecting in %s: %v", wait.Round(100*time.Millisecond), link.lastErr)
+		m.mu.Unlock()
+		return nil, err
+	}
+	link.dialing = true
+	m.mu.Unlock()
+
+	pc, err := m.dial(addr)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link.dialing = false
+	if err != nil {
+		link.failures++
+		link.lastErr = err
+		backoff := min(connInitialBackoff<<(link.failures-1), connMaxBackoff)
+		link.retryAt = time.Now().Add(backoff)
+		return nil, err
+	}
+	link.failures = 0
+	link.lastErr = nil
+
+	// The peer may have connected to us in the meantime
+	if link.conn != nil && !link.conn.isClosed() {
+		pc.close()
+		return link.conn, nil
+	}
+	link.conn = pc
+	m.conns[pc] = true
+	go m.serve(pc)
+	return pc, nil
+}
+
+// A new hello for the local end of a connection
+func (m *ConnManager) localHello(peerNonce string) connHello {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	hello := connHello{
+		NodeID:    m.identity.ID,
+		PublicKey: m.identity.EncodedPublicKey(),
+		Address:   m.localAddr(),
+		Nonce:     base64.StdEncoding.EncodeToString(nonce),
+		PeerNonce: peerNonce,
+	}
+	if peerNonce != "" {
+		hello.Signature = m.identity.Sign(connHelloSigningBytes(hello))
+	}
+	return hello
+}
+
+// Read a connection hello
+func readConnHello(reader *bufio.Reader) (connHello, error) {
+	var hello connHello
+	frame, err := readFrame(reader)
+	if err != nil {
+		return hello, err
+	}
+	if frame.Type != FrameConnHello {
+		return hello, fmt.Errorf("unexpected frame type 0x%02x during connection handshake", frame.Type)
+	}
+	if err := json.Unmarshal(frame.Payload, &hello); err != nil {
+		return hello, fmt.Errorf("invalid connection hello: %v", err)
+	}
+	return hello, nil
+}
+
+// Connect to a peer and authenticate both ends
+func (m *ConnManager) dial(addr string) (*pooledConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, connDialTimeout)
+	if err != nil && m.Fallback != nil {
+		var fallbackErr error
+		if conn, fallbackErr = m.Fallback(addr); fallbackErr != nil {
+			return nil, fmt.Errorf("%v; %v", err, fallbackErr)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(connDialTimeout))
+	reader := bufio.NewReader(conn)
+
+	fail := func(err error) (*pooledConn, error) {
+		conn.Close()
+		return nil, err
+	}
+
+	// Our nonce, which the peer signs
+	hello := m.localHello("")
+	data, _ := json.Marshal(hello)
+	if err := writeFrame(conn, FrameConnHello, data); err != nil {
+		return fail(err)
+	}
+
+	reply, err := readConnHello(reader)
+	if err != nil {
+		return fail(err)
+	}
+	if reply.PeerNonce != hello.Nonce || !verifySignature(reply.NodeID, reply.PublicKey, reply.Signature, connHelloSigningBytes(reply)) {
+		return fail(fmt.Errorf("peer failed to authenticate"))
+	}
+	if nodeID, ok := m.memberAt(addr); ok && nodeID != reply.NodeID {
+		return fail(fmt.Errorf("peer is node %s, expected %s", shortID(reply.NodeID), shortID(nodeID)))
+	}
+
+	// Sign the peer's nonce in return
+	proof := hello
+	proof.PeerNonce = reply.Nonce
+	proof.Signature = m.identity.Sign(connHelloSigningBytes(proof))
+	data, _ = json.Marshal(proof)
+	if err := writeFrame(conn, FrameConnHello, data); err != nil {
+		return fail(err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return newPooledConn(conn, reader, reply), nil
+}
+
+// Authenticate a connection a peer opened with hello and serve it until it
+// closes. The connection is used for our own frames to the peer too if the
+// peer is a room member.
+func (m *ConnManager) accept(conn net.Conn, reader *bufio.Reader, helloPayload []byte) {
+	remoteAddr := conn.RemoteAddr().String()
+	conn.SetDeadline(time.Now().Add(connDialTimeout))
+
+	var hello connHello
+	if err := json.Unmarshal(helloPayload, &hello); err != nil {
+		fmt.Printf("Invalid connection hello from %s: %v\n", remoteAddr, err)
+		return
+	}
+
+	reply := m.localHello(hello.Nonce)
+	data, _ := json.Marshal(reply)
+	if err := writeFrame(conn, FrameConnHello, data); err != nil {
+		return
+	}
+
+	proof, err := readConnHello(reader)
+	if err != nil {
+		fmt.Printf("Failed to authenticate connection from %s: %v\n", remoteAddr, err)
+		return
+	}
+	if proof.NodeID != hello.NodeID || proof.PeerNonce != reply.Nonce ||
+		!verifySignature(proof.NodeID, proof.PublicKey, proof.Signature, connHelloSigningBytes(proof)) {
+		fmt.Printf("Failed to authenticate connection from %s: invalid signature\n", remoteAddr)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	pc := newPooledConn(conn, reader, proof)
+	nodeID, member := m.memberAt(proof.Address)
+	m.mu.Lock()
+	m.conns[pc] = true
+	if member && nodeID == proof.NodeID {
+		link, ok := m.links[proof.Address]
+		if !ok {
+			link = &peerLink{}
+			m.links[proof.Address] = link
+		}
+		if link.conn == nil || link.conn.isClosed() {
+			link.conn = pc
+			link.failures = 0
+			link.retryAt = time.Time{}
+		}
+	}
+	m.mu.Unlock()
+
+	m.serve(pc)
+}
+
+// Read frames from a connection until it closes, handing replies to our
+// requests and handling the peer's requests in the order they arrive
+func (m *ConnManager) serve(pc *pooledConn) {
+	go func() {
+		for frame := pc.next(); frame != nil; frame = pc.next() {
+			replyType, reply := m.handler(frame, pc.peer.Address)
+			if expectsReply(frame.Type) {
+				pc.write(replyType, frame.ID, reply)
+			}
+		}
+	}()
+
+	for {
+		frame, err := readFrame(pc.reader)
+		if err != nil {
+			break
+		}
+		if isReplyFrame(frame.Type) {
+			pc.deliver(frame)
+		} else {
+			pc.enqueue(frame)
+		}
+	}
+
+	pc.close()
+	m.mu.Lock()
+	delete(m.conns, pc)
+	m.mu.Unlock()
+}
+
+// CloseIdle closes connections nobody used for connIdleTimeout
+func (m *ConnManager) CloseIdle() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for pc := range m.conns {
+		if pc.idle() > connIdleTimeout {
+			pc.close()
+		}
+	}
+}
+
+// CloseAll closes every connection, e.g. when the network services stop
+func (m *ConnManager) CloseAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for pc := range m.conns {
+		pc.close()
+	}
+	m.links = make(map[string]*peerLink)
+}
+
+// Connected reports whether there is an open connection to a peer
+func (m *ConnManager) Connected(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link, ok := m.links[addr]
+	return ok && link.conn != nil && !link.conn.isClosed()
+}
+
+// State describes the connection to a peer, for /list
+func (m *ConnManager) State(addr string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, ok := m.links[addr]
+	switch {
+	case !ok:
+		return "not connected"
+	case link.conn != nil && !link.conn.isClosed():
+		switch conn := link.conn.conn.(type) {
+		case *udpStream:
+			return "connected over a punched UDP path"
+		case *tunnelConn:
+			return "connected through relay " + conn.relay
+		}
+		return "connected"
+	case link.dialing:
+		return "connecting"
+	case time.Now().Before(link.retryAt):
+		return fmt.Sprintf("reconnecting in %s", time.Until(link.retryAt).Round(time.Second))
+	default:
+		return "not connected"
+	}
+}
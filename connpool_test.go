@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connection pool for the test identity for seed that knows no members and
+// handles no requests
+func testConnManager(t *testing.T, seed byte) *ConnManager {
+	m := NewConnManager(testIdentity(t, seed), func() string { return "" },
+		func(string) (string, bool) { return "", false },
+		func(*Frame, string) (byte, []byte) { return FrameAck, nil })
+	t.Cleanup(m.CloseAll)
+	return m
+}
+
+// Pooled connection over an in-memory pipe, served by m. Returns the far end.
+func pipeConn(m *ConnManager) (*pooledConn, net.Conn) {
+	local, remote := net.Pipe()
+	pc := newPooledConn(local, bufio.NewReader(local), connHello{})
+	go m.serve(pc)
+	return pc, remote
+}
+
+func TestRequestTimeoutKeepsConnection(t *testing.T) {
+	addr := servePeer(t, testIdentity(t, 133), func(frame *Frame, remoteAddr string) (byte, []byte) {
+		if string(frame.Payload) == "slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return FrameAck, frame.Payload
+	})
+	m := testConnManager(t, 134)
+	pc, err := m.get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Request(addr, FrameMessage, []byte("slow"), 50*time.Millisecond); err == nil {
+		t.Fatal("slow request didn't time out")
+	}
+
+	// The late reply to the slow request isn't taken for this one's
+	frame, err := m.Request(addr, FrameMessage, []byte("fast"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame.Payload) != "fast" {
+		t.Fatalf("got the reply %q", frame.Payload)
+	}
+	if again, _ := m.get(addr); again != pc || pc.isClosed() {
+		t.Fatal("timeout closed the connection")
+	}
+}
+
+func TestRepliesMatchedByID(t *testing.T) {
+	pc, remote := pipeConn(testConnManager(t, 135))
+	defer remote.Close()
+
+	// The peer answers both requests, the second one first
+	go func() {
+		reader := bufio.NewReader(remote)
+		var requests []*Frame
+		for range 2 {
+			frame, err := readFrame(reader)
+			if err != nil {
+				return
+			}
+			requests = append(requests, frame)
+		}
+		for i := len(requests) - 1; i >= 0; i-- {
+			writeFrameID(remote, FrameAck, requests[i].ID, requests[i].Payload)
+		}
+	}()
+
+	replies := make(chan string, 2)
+	for _, payload := range []string{"first", "second"} {
+		go func() {
+			frame, err := pc.request(FrameMessage, []byte(payload), time.Second)
+			if err != nil {
+				replies <- err.Error()
+				return
+			}
+			replies <- payload + ":" + string(frame.Payload)
+		}()
+	}
+	for range 2 {
+		if reply := <-replies; reply != "first:first" && reply != "second:second" {
+			t.Fatalf("got %s", reply)
+		}
+	}
+}
+
+func TestCloseFailsWaitingRequests(t *testing.T) {
+	pc, remote := pipeConn(testConnManager(t, 136))
+	defer remote.Close()
+	go readFrame(remote) // Take the request without answering it
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := pc.request(FrameMessage, []byte("unanswered"), time.Minute)
+		done <- err
+	}()
+	if !eventually(time.Second, func() bool { pc.mu.Lock(); defer pc.mu.Unlock(); return len(pc.waiting) == 1 }) {
+		t.Fatal("request never sent")
+	}
+	pc.close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errConnClosed) {
+			t.Fatalf("got %v, want errConnClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request still waiting after the connection closed")
+	}
+	if _, err := pc.request(FrameMessage, nil, time.Second); !errors.Is(err, errConnClosed) {
+		t.Fatalf("request on a closed connection got %v", err)
+	}
+}
+
+func TestReconnectBacksOff(t *testing.T) {
+	m := testConnManager(t, 137)
+	addr := deadAddress(t)
+
+	if _, err := m.Request(addr, FrameMessage, nil, time.Second); err == nil {
+		t.Fatal("request to a dead address succeeded")
+	}
+	_, err := m.Request(addr, FrameMessage, nil, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "reconnecting in") {
+		t.Fatalf("second attempt got %v, want it held back", err)
+	}
+	if state := m.State(addr); !strings.HasPrefix(state, "reconnecting in") {
+		t.Fatalf("state %q", state)
+	}
+}
@@ -1,95 +1,152 @@
 package main
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"io"
 )
 
-// Encrypt data with AES
-func encryptAES(key, data []byte) ([]byte, error) {
+// Envelope layout: version (1) | key epoch (4) | nonce (12) | AES-GCM ciphertext + tag
+//
+// The version byte, key epoch and room ID are bound as associated data, so an
+// envelope can't be replayed into another room or epoch, or reinterpreted by
+// a peer speaking a different protocol version.
+const envelopeHeaderLength = 5
+
+// Build the associated data for an envelope
+func envelopeAD(version byte, epoch uint32, roomID string) []byte {
+	ad := make([]byte, 0, envelopeHeaderLength+len(roomID))
+	ad = append(ad, version)
+	ad = append(ad, uint32ToBytes(epoch)...)
+	ad = append(ad, roomID...)
+	return ad
+}
+
+// Read the key epoch an envelope was sealed under
+func envelopeEpoch(envelope []byte) (uint32, error) {
+	if len(envelope) < envelopeHeaderLength {
+		return 0, fmt.Errorf("envelope too short")
+	}
+	return bytesToUint32(envelope[1:envelopeHeaderLength]), nil
+}
+
+// Create an AES-GCM AEAD from a room key
+func newAEAD(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	// Create CBC encrypter
-	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+// Seal data into an authenticated envelope for roomID under the given key epoch
+func sealEnvelope(key []byte, epoch uint32, roomID string, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
 		return nil, err
 	}
 
-	// PKCS7 padding
-	data = pkcs7Pad(data, aes.BlockSize)
-
-	mode := cipher.NewCBCEncrypter(block, iv)
-	ciphertext := make([]byte, len(data))
-	mode.CryptBlocks(ciphertext, data)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
 
-	// Append IV to ciphertext
-	result := append(iv, ciphertext...)
-	return result, nil
+	envelope := make([]byte, 0, envelopeHeaderLength+len(nonce)+len(plaintext)+aead.Overhead())
+	envelope = append(envelope, ProtocolVersion)
+	envelope = append(envelope, uint32ToBytes(epoch)...)
+	envelope = append(envelope, nonce...)
+	return aead.Seal(envelope, nonce, plaintext, envelopeAD(ProtocolVersion, epoch, roomID)), nil
 }
 
-// Decrypt data with AES
-func decryptAES(key, data []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// Open an authenticated envelope for roomID
+func openEnvelope(key []byte, roomID string, envelope []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(data) < aes.BlockSize {
-		return nil, fmt.Errorf("ciphertext too short")
+	if len(envelope) < envelopeHeaderLength+aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("envelope too short")
 	}
 
-	// Extract IV
-	iv := data[:aes.BlockSize]
-	ciphertext := data[aes.BlockSize:]
-
-	if len(ciphertext)%aes.BlockSize != 0 {
-		return nil, fmt.Errorf("ciphertext length not multiple of block size")
+	version := envelope[0]
+	if version != ProtocolVersion {
+		return nil, fmt.Errorf("%w: envelope v%d, this node speaks v%d", ErrUnsupportedVersion, version, ProtocolVersion)
 	}
 
-	mode := cipher.NewCBCDecrypter(block, iv)
-	plaintext := make([]byte, len(ciphertext))
-	mode.CryptBlocks(plaintext, ciphertext)
+	epoch := bytesToUint32(envelope[1:envelopeHeaderLength])
+	nonce := envelope[envelopeHeaderLength : envelopeHeaderLength+aead.NonceSize()]
+	ciphertext := envelope[envelopeHeaderLength+aead.NonceSize():]
 
-	// Remove PKCS7 padding
-	plaintext, err = pkcs7Unpad(plaintext, aes.BlockSize)
+	plaintext, err := aead.Open(nil, nonce, ciphertext, envelopeAD(version, epoch, roomID))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("message authentication failed (wrong room key or tampered data)")
 	}
 
 	return plaintext, nil
 }
 
-// PKCS7 padding
-func pkcs7Pad(data []byte, blockSize int) []byte {
-	padding := blockSize - len(data)%blockSize
-	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
-	return append(data, padtext...)
+// Derive the wrapping key for a sealed box
+func sealedBoxKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := make([]byte, 0, len(ephemeral)+len(recipient))
+	salt = append(salt, ephemeral...)
+	salt = append(salt, recipient...)
+	return hkdf.Key(sha256.New, shared, salt, "gochatp2p sealed box", 32)
 }
 
-// PKCS7 unpadding
-func pkcs7Unpad(data []byte, blockSize int) ([]byte, error) {
-	if len(data) == 0 {
-		return nil, fmt.Errorf("data is empty")
+// Seal data so only the owner of the X25519 key recipientKey (base64) can
+// open it. The result is the ephemeral public key followed by an envelope
+// whose associated data is bound to context.
+func sealForRecipient(recipientKey, context string, plaintext []byte) ([]byte, error) {
+	recipient, err := decodeX25519PublicKey(recipientKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient key: %v", err)
 	}
 
-	padding := int(data[len(data)-1])
-	if padding > blockSize || padding == 0 {
-		return nil, fmt.Errorf("invalid padding")
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
 	}
 
-	// Validate padding
-	for i := len(data) - padding; i < len(data); i++ {
-		if data[i] != byte(padding) {
-			return nil, fmt.Errorf("invalid padding")
-		}
+	key, err := sealedBoxKey(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := sealEnvelope(key, 0, context, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(ephemeral.PublicKey().Bytes(), envelope...), nil
+}
+
+// Open a sealed box addressed to the local node
+func (id *Identity) OpenSealed(context string, sealed []byte) ([]byte, error) {
+	if len(sealed) < 32 {
+		return nil, fmt.Errorf("sealed box too short")
 	}
 
-	return data[:(len(data) - padding)], nil
-}
\ No newline at end of file
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed[:32])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := id.KeyExchange.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := sealedBoxKey(shared, ephemeral.Bytes(), id.KeyExchange.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return openEnvelope(key, context, sealed[32:])
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// Deterministic identity for tests
+func testIdentity(t *testing.T, seed byte) *Identity {
+	t.Helper()
+	s := make([]byte, 32)
+	s[0] = seed
+	id, err := newIdentityFromSeed(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 16)
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       []byte
+		epoch     uint32
+		roomID    string
+		plaintext []byte
+	}{
+		{"empty", testKey(1), 0, "room", nil},
+		{"text", testKey(2), 7, "room", []byte("hello room")},
+		{"aes-256", bytes.Repeat([]byte{3}, 32), 1 << 31, "another room", []byte{0, 1, 2}},
+		{"large", testKey(4), 1, "room", bytes.Repeat([]byte("x"), 64<<10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := sealEnvelope(tt.key, tt.epoch, tt.roomID, tt.plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if envelope[0] != ProtocolVersion {
+				t.Fatalf("version byte %d, want %d", envelope[0], ProtocolVersion)
+			}
+			epoch, err := envelopeEpoch(envelope)
+			if err != nil || epoch != tt.epoch {
+				t.Fatalf("envelopeEpoch = %d, %v; want %d", epoch, err, tt.epoch)
+			}
+
+			plaintext, err := openEnvelope(tt.key, tt.roomID, envelope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plaintext, tt.plaintext) {
+				t.Fatalf("plaintext mismatch")
+			}
+		})
+	}
+}
+
+func TestEnvelopeNoncesDiffer(t *testing.T) {
+	a, _ := sealEnvelope(testKey(1), 0, "room", []byte("same"))
+	b, _ := sealEnvelope(testKey(1), 0, "room", []byte("same"))
+	if bytes.Equal(a, b) {
+		t.Fatal("two seals of the same plaintext are identical")
+	}
+}
+
+func TestOpenEnvelopeRejectsBadInput(t *testing.T) {
+	key := testKey(1)
+	envelope, err := sealEnvelope(key, 5, "room", []byte("secret message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := func(i int, b byte) []byte {
+		data := append([]byte(nil), envelope...)
+		data[i] ^= b
+		return data
+	}
+
+	tests := []struct {
+		name     string
+		key      []byte
+		roomID   string
+		envelope []byte
+		want     error
+	}{
+		{"wrong key", testKey(2), "room", envelope, nil},
+		{"wrong room", key, "other room", envelope, nil},
+		{"version byte", key, "room", modified(0, 1), ErrUnsupportedVersion},
+		{"epoch", key, "room", modified(1, 1), nil},
+		{"nonce", key, "room", modified(envelopeHeaderLength, 1), nil},
+		{"ciphertext", key, "room", modified(envelopeHeaderLength+12, 0x80), nil},
+		{"tag", key, "room", modified(len(envelope)-1, 1), nil},
+		{"truncated tag", key, "room", envelope[:len(envelope)-1], nil},
+		{"header only", key, "room", envelope[:envelopeHeaderLength], nil},
+		{"empty", key, "room", nil, nil},
+		{"trailing byte", key, "room", append(append([]byte(nil), envelope...), 0), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, err := openEnvelope(tt.key, tt.roomID, tt.envelope)
+			if err == nil {
+				t.Fatalf("opened to %q", plaintext)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvelopeEpochTooShort(t *testing.T) {
+	if _, err := envelopeEpoch(make([]byte, envelopeHeaderLength-1)); err == nil {
+		t.Fatal("read an epoch from a truncated header")
+	}
+}
+
+func TestSealedBoxRoundTrip(t *testing.T) {
+	recipient := testIdentity(t, 1)
+	tests := []struct {
+		name      string
+		context   string
+		plaintext []byte
+	}{
+		{"empty", "dm:a:b", nil},
+		{"room key", "rekey:room:1:node", testKey(9)},
+		{"text", "dm:a:b", []byte("for your eyes only")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := sealForRecipient(recipient.EncodedKeyExchangeKey(), tt.context, tt.plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := recipient.OpenSealed(tt.context, sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plaintext, tt.plaintext) {
+				t.Fatalf("plaintext mismatch")
+			}
+		})
+	}
+}
+
+func TestOpenSealedRejectsBadInput(t *testing.T) {
+	recipient := testIdentity(t, 1)
+	other := testIdentity(t, 2)
+	sealed, err := sealForRecipient(recipient.EncodedKeyExchangeKey(), "ctx", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := func(i int) []byte {
+		data := append([]byte(nil), sealed...)
+		data[i] ^= 1
+		return data
+	}
+
+	tests := []struct {
+		name    string
+		id      *Identity
+		context string
+		sealed  []byte
+	}{
+		{"wrong recipient", other, "ctx", sealed},
+		{"wrong context", recipient, "other ctx", sealed},
+		{"ephemeral key", recipient, "ctx", modified(0)},
+		{"ciphertext", recipient, "ctx", modified(len(sealed) - 1)},
+		{"truncated", recipient, "ctx", sealed[:len(sealed)-1]},
+		{"key only", recipient, "ctx", sealed[:32]},
+		{"too short", recipient, "ctx", sealed[:31]},
+		{"empty", recipient, "ctx", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if plaintext, err := tt.id.OpenSealed(tt.context, tt.sealed); err == nil {
+				t.Fatalf("opened to %q", plaintext)
+			}
+		})
+	}
+}
+
+func TestSealForRecipientRejectsBadKey(t *testing.T) {
+	for _, key := range []string{"", "not base64!", "AAAA"} {
+		if _, err := sealForRecipient(key, "ctx", []byte("x")); err == nil {
+			t.Errorf("sealed to invalid key %q", key)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// Number of message IDs remembered for duplicate suppression
+const seenCacheSize = 4096
+
+// SeenCache remembers recently seen message IDs in a bounded FIFO
+type SeenCache struct {
+	mu    sync.Mutex
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+// NewSeenCache creates a seen-cache holding up to capacity IDs
+func NewSeenCache(capacity int) *SeenCache {
+	return &SeenCache{
+		ids:   make(map[string]struct{}, capacity),
+		order: make([]string, 0, capacity),
+	}
+}
+
+// MarkSeen records id and reports whether it was new. Once the cache is full
+// the oldest ID is evicted.
+func (c *SeenCache) MarkSeen(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.ids[id]; ok {
+		return false
+	}
+
+	if len(c.order) < cap(c.order) {
+		c.order = append(c.order, id)
+	} else {
+		delete(c.ids, c.order[c.next])
+		c.order[c.next] = id
+		c.next = (c.next + 1) % len(c.order)
+	}
+	c.ids[id] = struct{}{}
+	return true
+}
+
+// Generate a random message ID
+func newMessageID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Key a message is deduplicated under: IDs are only unique per origin
+func messageKey(message Message) string {
+	return message.SenderID + ":" + message.ID
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSeenCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		ids      []string
+		want     []bool
+	}{
+		{"new ids", 4, []string{"a", "b", "c"}, []bool{true, true, true}},
+		{"duplicate", 4, []string{"a", "b", "a", "b"}, []bool{true, true, false, false}},
+		{"oldest evicted", 2, []string{"a", "b", "c", "a"}, []bool{true, true, true, true}},
+		{"newest kept", 2, []string{"a", "b", "c", "c", "b"}, []bool{true, true, true, false, false}},
+		{"eviction wraps", 2, []string{"a", "b", "c", "d", "e", "d"}, []bool{true, true, true, true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewSeenCache(tt.capacity)
+			for i, id := range tt.ids {
+				if got := cache.MarkSeen(id); got != tt.want[i] {
+					t.Fatalf("MarkSeen(%q) #%d = %v, want %v", id, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSeenCacheStaysBounded(t *testing.T) {
+	cache := NewSeenCache(100)
+	for i := 0; i < 1000; i++ {
+		cache.MarkSeen(fmt.Sprint(i))
+	}
+	if len(cache.ids) != 100 || len(cache.order) != 100 {
+		t.Fatalf("cache holds %d ids, %d in order; want 100", len(cache.ids), len(cache.order))
+	}
+	if cache.MarkSeen("999") {
+		t.Fatal("most recent id was evicted")
+	}
+	if !cache.MarkSeen("0") {
+		t.Fatal("oldest id was not evicted")
+	}
+}
+
+func TestMessageKey(t *testing.T) {
+	a := Message{ID: "1", SenderID: "alice"}
+	b := Message{ID: "1", SenderID: "bob"}
+	if messageKey(a) == messageKey(b) {
+		t.Fatal("same ID from different senders shares a key")
+	}
+	if messageKey(a) != messageKey(Message{ID: "1", SenderID: "alice", Content: "edited"}) {
+		t.Fatal("key depends on content")
+	}
+}
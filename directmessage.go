@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Direct messages
+//
+// A DirectMessage is signed by its sender and sealed to the recipient's
+// X25519 key, so only the recipient can read it. The sealed box travels in a
+// directEnvelope that only names the sender and recipient; the envelope is
+// sealed under the room key like every other frame. A SuperNode relaying the
+// envelope can see who is talking to whom, but not what is said.
+//
+// Direct messages are sent straight to the recipient. If that fails (or the
+// sender is a regular node in SuperNode mode), they are routed through a
+// SuperNode. They are never added to the room history, so they aren't
+// synced to other members or included in saved transcripts.
+
+// DirectMessage is a private message between two room members
+type DirectMessage struct {
+	ID          string `json:"id"`
+	RoomID      string `json:"room_id"`
+	Sender      string `json:"sender"`
+	SenderID    string `json:"sender_id"`
+	RecipientID string `json:"recipient_id"`
+	Timestamp   string `json:"timestamp"`
+	SentAt      int64  `json:"sent_at"`
+	Content     string `json:"content"`
+	PublicKey   string `json:"public_key"`
+	Signature   string `json:"signature"`
+}
+
+// directEnvelope routes a sealed DirectMessage to its recipient
+type directEnvelope struct {
+	ID          string `json:"id"`
+	SenderID    string `json:"sender_id"`
+	RecipientID string `json:"recipient_id"`
+	Sealed      []byte `json:"sealed"` // DirectMessage sealed to the recipient
+}
+
+// Key a direct message is deduplicated and acknowledged under
+func (e directEnvelope) key() string {
+	return "dm:" + e.SenderID + ":" + e.ID
+}
+
+// Key a relay deduplicates a direct message under. The envelope's ID is
+// picked by whoever sent the frame and the relay can't open the sealed box,
+// so the whole envelope is hashed: a forged envelope reusing the ID of a
+// real message can't get the real one dropped.
+func (e directEnvelope) relayKey() string {
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return "dm-relay:" + hex.EncodeToString(sum[:])
+}
+
+// Context the sealed box of a direct message is bound to
+func directMessageContext(roomID, recipientID string) string {
+	return "dm:" + roomID + ":" + recipientID
+}
+
+// Bytes covered by a direct message signature
+func directMessageSigningBytes(message DirectMessage) []byte {
+	message.Signature = ""
+	data, _ := json.Marshal(message)
+	return data
+}
+
+// SendDirectMessage sends a private message to one room member
+func (r *RoomSession) SendDirectMessage(query, content string) error {
+	recipient, err := r.findRoomNode(query)
+	if err != nil {
+		return err
+	}
+	if recipient.ID == r.LocalNode.ID {
+		return fmt.Errorf("can't send a direct message to yourself")
+	}
+	if recipient.KexKey == "" {
+		return fmt.Errorf("%s has no key exchange key", recipient.Nickname)
+	}
+
+	now := time.Now()
+	message := DirectMessage{
+		ID:          newMessageID(),
+		RoomID:      r.Room.ID,
+		Sender:      r.LocalNode.Nickname,
+		SenderID:    r.LocalNode.ID,
+		RecipientID: recipient.ID,
+		Timestamp:   now.Format("2006-01-02 15:04:05"),
+		SentAt:      now.UnixMilli(),
+		Content:     content,
+		PublicKey:   r.Identity.EncodedPublicKey(),
+	}
+	message.Signature = r.Identity.Sign(directMessageSigningBytes(message))
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealForRecipient(recipient.KexKey, directMessageContext(r.Room.ID, recipient.ID), data)
+	if err != nil {
+		return err
+	}
+
+	envelope := directEnvelope{
+		ID:          message.ID,
+		SenderID:    message.SenderID,
+		RecipientID: recipient.ID,
+		Sealed:      sealed,
+	}
+	seal, err := r.roomSealer(envelope)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] %s[DM] Me -> %s: %s\n", message.Timestamp, r.roomTag(), recipient.Nickname, content)
+
+	// Regular nodes in SuperNode mode go through their SuperNode
+	if r.SuperNodeMgr.ShouldEnableSuperNodeMode(len(r.Room.Nodes)) && !r.SuperNodeMgr.IsLocalNodeSuperNode() {
+		if superNode := r.SuperNodeMgr.GetBestSuperNodeForConnection(); superNode != nil && superNode.ID != recipient.ID {
+			r.Outbox.Enqueue(superNode.NodeInfo, envelope.key(), FrameDirectMessage, seal)
+			return nil
+		}
+	}
+
+	r.Outbox.Enqueue(recipient, envelope.key(), FrameDirectMessage, seal)
+	return nil
+}
+
+// Handle a direct message frame: deliver it if it's for us, relay it if
+// we're a SuperNode. Returns the key to acknowledge, or "" if the frame was
+// invalid.
+func (r *RoomSession) handleDirectMessage(data []byte, remoteAddr string) string {
+	var envelope directEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		fmt.Printf("Invalid direct message from %s: %v\n", remoteAddr, err)
+		return ""
+	}
+	if envelope.ID == "" || envelope.SenderID == "" {
+		return ""
+	}
+
+	if envelope.RecipientID != r.LocalNode.ID {
+		return r.relayDirectMessage(envelope)
+	}
+
+	data, err := r.Identity.OpenSealed(directMessageContext(r.Room.ID, r.LocalNode.ID), envelope.Sealed)
+	if err != nil {
+		fmt.Printf("Failed to decrypt direct message from %s: %v\n", shortID(envelope.SenderID), err)
+		return ""
+	}
+
+	var message DirectMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		fmt.Printf("Invalid direct message from %s: %v\n", remoteAddr, err)
+		return ""
+	}
+	if message.ID != envelope.ID || message.SenderID != envelope.SenderID ||
+		message.RecipientID != r.LocalNode.ID || message.RoomID != r.Room.ID {
+		fmt.Printf("[System] Warning: dropping direct message with mismatched header from %s\n", remoteAddr)
+		return ""
+	}
+
+	// Only a message that opened counts as seen, so a forged envelope can't
+	// suppress the real one. Duplicates are still acknowledged so the
+	// sender stops retrying.
+	if !r.SeenMessages.MarkSeen(envelope.key()) {
+		return envelope.key()
+	}
+
+	r.onNodeSeen(message.SenderID)
+
+	if !verifySignature(message.SenderID, message.PublicKey, message.Signature, directMessageSigningBytes(message)) {
+		fmt.Printf("[%s] %s[DM] %s [unverified] -> Me: %s\n", message.Timestamp, r.roomTag(), message.Sender, message.Content)
+	} else {
+		fmt.Printf("[%s] %s[DM] %s -> Me: %s\n", message.Timestamp, r.roomTag(), message.Sender, message.Content)
+	}
+	return envelope.key()
+}
+
+// Relay a direct message addressed to another member. Only SuperNodes relay;
+// the sealed box is passed on unopened.
+func (r *RoomSession) relayDirectMessage(envelope directEnvelope) string {
+	if !r.SuperNodeMgr.IsLocalNodeSuperNode() {
+		return ""
+	}
+	recipient, ok := r.findRoomNodeByID(envelope.RecipientID)
+	if !ok {
+		return ""
+	}
+	seal, err := r.roomSealer(envelope)
+	if err != nil {
+		return ""
+	}
+	if !r.SeenMessages.MarkSeen(envelope.relayKey()) {
+		return envelope.key()
+	}
+
+	r.Outbox.Enqueue(recipient, envelope.key(), FrameDirectMessage, seal)
+	return envelope.key()
+}
+
+// Route one of our own direct messages through a SuperNode after direct
+// delivery to the recipient failed
+func (r *RoomSession) rerouteDirectMessage(node NodeInfo, payload []byte) {
+	var envelope directEnvelope
+	if err := r.openRoomJSON(payload, &envelope); err != nil || envelope.SenderID != r.LocalNode.ID {
+		return
+	}
+
+	superNode := r.SuperNodeMgr.GetBestSuperNodeForConnection()
+	if superNode == nil || superNode.ID == node.ID || superNode.ID == r.LocalNode.ID {
+		fmt.Printf("[System] Direct message to %s could not be delivered\n", node.Nickname)
+		return
+	}
+
+	seal, err := r.roomSealer(envelope)
+	if err != nil {
+		return
+	}
+	fmt.Printf("[System] %s is unreachable, sending direct message through %s\n", node.Nickname, superNode.Nickname)
+	r.Outbox.Enqueue(superNode.NodeInfo, envelope.key(), FrameDirectMessage, seal)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Direct message envelope from the local node of room to recipient, built
+// the way SendDirectMessage builds it
+func testDirectEnvelope(t *testing.T, room *RoomSession, recipient NodeInfo, content string) directEnvelope {
+	t.Helper()
+	message := DirectMessage{
+		ID:          newMessageID(),
+		RoomID:      room.Room.ID,
+		Sender:      room.LocalNode.Nickname,
+		SenderID:    room.LocalNode.ID,
+		RecipientID: recipient.ID,
+		SentAt:      time.Now().UnixMilli(),
+		Content:     content,
+		PublicKey:   room.Identity.EncodedPublicKey(),
+	}
+	message.Signature = room.Identity.Sign(directMessageSigningBytes(message))
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealForRecipient(recipient.KexKey, directMessageContext(room.Room.ID, recipient.ID), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return directEnvelope{ID: message.ID, SenderID: message.SenderID, RecipientID: recipient.ID, Sealed: sealed}
+}
+
+func TestHandleDirectMessage(t *testing.T) {
+	rooms := testRoom(t, "dm", testNode(t, 82), testNode(t, 83), testNode(t, 84))
+	sender, recipient := rooms[0], rooms[1]
+	recipientNode, _ := sender.findRoomNodeByID(recipient.LocalNode.ID)
+	otherNode, _ := sender.findRoomNodeByID(rooms[2].LocalNode.ID)
+
+	valid := testDirectEnvelope(t, sender, recipientNode, "hello")
+	otherSender := testDirectEnvelope(t, sender, recipientNode, "hello")
+	otherSender.SenderID = rooms[2].LocalNode.ID
+	otherID := testDirectEnvelope(t, sender, recipientNode, "hello")
+	otherID.ID = newMessageID()
+	// Sealed to another member, then readdressed
+	misaddressed := testDirectEnvelope(t, sender, otherNode, "hello")
+	misaddressed.RecipientID = recipient.LocalNode.ID
+	tampered := testDirectEnvelope(t, sender, recipientNode, "hello")
+	tampered.Sealed[len(tampered.Sealed)-1] ^= 1
+
+	tests := []struct {
+		name     string
+		envelope directEnvelope
+		ok       bool
+	}{
+		{"header names another sender", otherSender, false},
+		{"header carries another ID", otherID, false},
+		{"sealed to another member", misaddressed, false},
+		{"tampered", tampered, false},
+		{"valid", valid, true},
+		{"duplicate is still acknowledged", valid, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.envelope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := recipient.handleDirectMessage(data, sender.LocalNode.Address)
+			if want := map[bool]string{true: tt.envelope.key()}[tt.ok]; got != want {
+				t.Fatalf("handleDirectMessage = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// Keys of the direct messages waiting in an outbox
+func queuedDirectMessages(o *Outbox) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var keys []string
+	for _, queue := range o.queues {
+		for _, item := range queue.items {
+			if item.frameType == FrameDirectMessage {
+				keys = append(keys, item.key)
+			}
+		}
+	}
+	return keys
+}
+
+func TestSendDirectMessage(t *testing.T) {
+	rooms := testRoom(t, "dm-send", testNode(t, 85), testNode(t, 86))
+	if err := rooms[0].SendDirectMessage(rooms[1].LocalNode.Nickname, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	// Other frames, like election results, may still be waiting to be retried
+	if !eventually(time.Second, func() bool { return len(queuedDirectMessages(rooms[0].Outbox)) == 0 }) {
+		t.Fatal("direct message was never acknowledged")
+	}
+	if err := rooms[0].SendDirectMessage(rooms[0].LocalNode.Nickname, "hello"); err == nil {
+		t.Fatal("sent a direct message to ourselves")
+	}
+}
+
+func TestRelayDedupesOnEnvelope(t *testing.T) {
+	rooms := testRoom(t, "dm-relay", testNode(t, 87), testNode(t, 88))
+	sender, relay := rooms[0], rooms[1]
+
+	// The recipient only records what the relay passes on
+	recipientID := testIdentity(t, 89)
+	recipientNode := testJoiner(t, 89, "dm-relay")
+	envelope := testDirectEnvelope(t, sender, recipientNode, "hello")
+	peer := newAckingPeerAs(t, recipientID, envelope.key())
+	recipientNode.Address = peer.addr
+	recipientID.SignNodeInfo(&recipientNode)
+	if !relay.addRoomNode(recipientNode) {
+		t.Fatal("recipient not added")
+	}
+	relay.SuperNodeMgr.SetLocalNodeAsSuperNode(true)
+
+	// A forged envelope reusing the real message's ID arrives first
+	forged := envelope
+	forged.Sealed = []byte("forged")
+
+	for _, e := range []directEnvelope{forged, envelope, envelope} {
+		data, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := relay.handleDirectMessage(data, sender.LocalNode.Address); got != envelope.key() {
+			t.Fatalf("relay acknowledged %q, want %q", got, envelope.key())
+		}
+	}
+
+	if !eventually(5*time.Second, func() bool { return len(peer.received()) == 2 }) {
+		t.Fatalf("recipient received %d frames, want the forged and the real one", len(peer.received()))
+	}
+	time.Sleep(200 * time.Millisecond)
+	received := peer.received()
+	if len(received) != 2 {
+		t.Fatalf("recipient received %d frames, the duplicate was relayed", len(received))
+	}
+	var relayed directEnvelope
+	if err := relay.openRoomJSON([]byte(received[1]), &relayed); err != nil {
+		t.Fatal(err)
+	}
+	if string(relayed.Sealed) != string(envelope.Sealed) {
+		t.Fatal("real message was not relayed")
+	}
+}
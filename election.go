@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SuperNode election
+//
+// Every member ranks the members that may become SuperNodes the same way
+// (see SuperNodeManager.rankCandidates), so members with the same view of the
+// room elect the same SuperNodes. The best-ranked candidate coordinates: it
+// re-runs the election whenever a member joins, leaves or is dropped, and
+// announces the result to every member under a new term.
+//
+// Like in the bully algorithm, members only adopt results from the member
+// they rank first, and a later result from it (a higher term) replaces its
+// earlier one. Terms are based on the clock, so they keep increasing when a
+// coordinator restarts. A coordinator that receives a result from a
+// lower-ranked member answers with its own; other members leave such
+// results, and ones electing members they don't rank, unacknowledged, so
+// the sender retries until every member sees the same members.
+//
+// Only members that proved to us that they hold the room key are ranked. A
+// coordinator that has never announced a result, and still hasn't
+// electionResultTimeout after a membership change, is skipped until it does,
+// and the next candidate runs the election instead.
+
+// How long members wait for the coordinator to announce an election
+const electionResultTimeout = 10 * time.Second
+
+// electionNotice announces the SuperNodes elected for a term
+type electionNotice struct {
+	RoomID     string   `json:"room_id"`
+	Term       uint64   `json:"term"`
+	SuperNodes []string `json:"super_nodes"` // Best-ranked first
+	IssuerID   string   `json:"issuer_id"`
+	PublicKey  string   `json:"public_key"`
+	Signature  string   `json:"signature"`
+}
+
+// Key an election notice is acknowledged under
+func (n electionNotice) key() string {
+	return "election:" + n.IssuerID + ":" + strconv.FormatUint(n.Term, 10)
+}
+
+// Bytes covered by an election notice signature
+func electionSigningBytes(notice electionNotice) []byte {
+	notice.Signature = ""
+	data, _ := json.Marshal(notice)
+	return data
+}
+
+// Re-run the SuperNode election and announce the result, if the local node
+// coordinates elections
+func (r *RoomSession) runElection() {
+	if coordinator := r.SuperNodeMgr.ElectionCoordinator(); coordinator != r.LocalNode.ID {
+		if coordinator != "" {
+			r.awaitElection(coordinator)
+		}
+		return
+	}
+
+	term, _ := r.SuperNodeMgr.Term()
+	notice := electionNotice{
+		RoomID:     r.Room.ID,
+		Term:       max(term+1, uint64(time.Now().UnixMilli())),
+		SuperNodes: r.SuperNodeMgr.ElectSuperNodes(),
+		IssuerID:   r.LocalNode.ID,
+		PublicKey:  r.Identity.EncodedPublicKey(),
+	}
+	notice.Signature = r.Identity.Sign(electionSigningBytes(notice))
+	r.applyElection(notice)
+
+	seal, err := r.roomSealer(notice)
+	if err != nil {
+		fmt.Printf("Failed to encode election result: %v\n", err)
+		return
+	}
+
+	r.NodeMutex.RLock()
+	defer r.NodeMutex.RUnlock()
+	for _, node := range r.Room.Nodes {
+		if node.ID == r.LocalNode.ID {
+			continue
+		}
+		r.Outbox.Enqueue(node, notice.key(), FrameElection, seal)
+	}
+}
+
+// Wait for the coordinator to announce an election. If it has announced
+// none and nobody else's result arrives in time, skip it and run the
+// election again. A coordinator that announced and then went quiet is left
+// to the failure detector.
+func (r *RoomSession) awaitElection(coordinator string) {
+	since := time.Now()
+	time.AfterFunc(electionResultTimeout, func() {
+		if r.findRoom(r.Room.ID) != r || r.SuperNodeMgr.Settled(coordinator, since) ||
+			r.SuperNodeMgr.ElectionCoordinator() != coordinator {
+			return
+		}
+		fmt.Printf("[System] %s%s announced no election result in time, passing the election to the next candidate\n",
+			r.roomTag(), r.electionIssuerName(coordinator))
+		r.SuperNodeMgr.MarkStalled(coordinator)
+		r.runElection()
+	})
+}
+
+// Handle an election result from a member. Returns the key to acknowledge,
+// or "" if the notice was invalid or its issuer isn't known yet.
+func (r *RoomSession) handleElection(data []byte, remoteAddr string) string {
+	var notice electionNotice
+	if err := json.Unmarshal(data, &notice); err != nil {
+		fmt.Printf("Invalid election result from %s: %v\n", remoteAddr, err)
+		return ""
+	}
+	if notice.RoomID != r.Room.ID || notice.IssuerID == r.LocalNode.ID {
+		return ""
+	}
+	if !verifySignature(notice.IssuerID, notice.PublicKey, notice.Signature, electionSigningBytes(notice)) {
+		fmt.Printf("[System] Warning: ignoring unverified election result from %s\n", remoteAddr)
+		return ""
+	}
+
+	// Results from members we haven't heard of yet are retried by the sender
+	if _, ok := r.findRoomNodeByID(notice.IssuerID); !ok {
+		return ""
+	}
+	r.SuperNodeMgr.ClearStalled(notice.IssuerID)
+
+	// Only the coordinator's results count. One from a lower-ranked member
+	// is overruled if we coordinate; otherwise it may be from the successor
+	// of a coordinator we haven't noticed is gone yet, so it's left for the
+	// sender to retry.
+	if coordinator := r.SuperNodeMgr.ElectionCoordinator(); notice.IssuerID != coordinator {
+		if coordinator == r.LocalNode.ID {
+			r.runElection()
+			return notice.key()
+		}
+		return ""
+	}
+	if !r.SuperNodeMgr.ValidElection(notice.SuperNodes) {
+		fmt.Printf("[System] Warning: ignoring election result from %s, which elects members this node doesn't rank\n", r.electionIssuerName(notice.IssuerID))
+		return ""
+	}
+
+	// Older results from the coordinator are acknowledged but not adopted
+	r.applyElection(notice)
+	return notice.key()
+}
+
+// Adopt an election result and report the new SuperNodes. Returns false if
+// a better result was already adopted.
+func (r *RoomSession) applyElection(notice electionNotice) bool {
+	adopted, changed := r.SuperNodeMgr.ApplyElection(notice.Term, notice.IssuerID, notice.SuperNodes)
+	if !changed {
+		return adopted
+	}
+
+	names := make([]string, 0, len(notice.SuperNodes))
+	for _, nodeID := range notice.SuperNodes {
+		if nodeID == r.LocalNode.ID {
+			names = append(names, "you")
+		} else if node, ok := r.findRoomNodeByID(nodeID); ok {
+			names = append(names, node.Nickname)
+		} else {
+			names = append(names, shortID(nodeID))
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, "none")
+	}
+	fmt.Printf("[System] %sSuperNodes elected by %s: %s\n", r.roomTag(), r.electionIssuerName(notice.IssuerID), strings.Join(names, ", "))
+	return true
+}
+
+// Name of the member that ran an election, for display
+func (r *RoomSession) electionIssuerName(issuerID string) string {
+	if issuerID == r.LocalNode.ID {
+		return "you"
+	}
+	if node, ok := r.findRoomNodeByID(issuerID); ok {
+		return node.Nickname
+	}
+	return shortID(issuerID)
+}
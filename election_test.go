@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Election result signed by room's local node
+func testElection(room *RoomSession, term uint64, superNodes []string) electionNotice {
+	notice := electionNotice{
+		RoomID:     room.Room.ID,
+		Term:       term,
+		SuperNodes: superNodes,
+		IssuerID:   room.LocalNode.ID,
+		PublicKey:  room.Identity.EncodedPublicKey(),
+	}
+	notice.Signature = room.Identity.Sign(electionSigningBytes(notice))
+	return notice
+}
+
+// Send heartbeats until every member has verified every other one, as it
+// would within a heartbeat interval of joining
+func exchangeHeartbeats(t *testing.T, rooms []*RoomSession) {
+	t.Helper()
+	verifiedAll := func() bool {
+		for _, room := range rooms {
+			room.SuperNodeMgr.mu.RLock()
+			count := len(room.SuperNodeMgr.verified)
+			room.SuperNodeMgr.mu.RUnlock()
+			if count != len(rooms)-1 {
+				return false
+			}
+		}
+		return true
+	}
+	for _, room := range rooms {
+		room.sendHeartbeats()
+	}
+	if !eventually(5*time.Second, verifiedAll) {
+		t.Fatal("members never verified each other")
+	}
+}
+
+func TestHandleElection(t *testing.T) {
+	rooms := testRoom(t, "election", testNode(t, 107), testNode(t, 108), testNode(t, 109))
+	exchangeHeartbeats(t, rooms)
+
+	// Pick a member that doesn't coordinate, its coordinator and the third member
+	var member, coordinator, other *RoomSession
+	for _, room := range rooms {
+		if id := room.SuperNodeMgr.ElectionCoordinator(); id != "" && id != room.LocalNode.ID {
+			member = room
+			break
+		}
+	}
+	if member == nil {
+		t.Fatal("every member coordinates")
+	}
+	for _, room := range rooms {
+		switch room.LocalNode.ID {
+		case member.LocalNode.ID:
+		case member.SuperNodeMgr.ElectionCoordinator():
+			coordinator = room
+		default:
+			other = room
+		}
+	}
+
+	elected := member.SuperNodeMgr.ElectSuperNodes()
+	term := uint64(time.Now().UnixMilli()) + 1000
+	forged := testElection(other, term, elected)
+	forged.IssuerID = coordinator.LocalNode.ID
+
+	tests := []struct {
+		name   string
+		notice electionNotice
+		ok     bool
+	}{
+		{"not the coordinator", testElection(other, term, elected), false},
+		{"signed by another member", forged, false},
+		{"elects a stranger", testElection(coordinator, term, []string{strings.Repeat("f", 64)}), false},
+		{"elects too many", testElection(coordinator, term, append(elected, other.LocalNode.ID)), false},
+		{"elects nobody", testElection(coordinator, term, nil), false},
+		{"valid", testElection(coordinator, term, elected), true},
+		{"older result from the coordinator", testElection(coordinator, term-1, elected), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.notice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := member.handleElection(data, "test")
+			if want := map[bool]string{true: tt.notice.key()}[tt.ok]; got != want {
+				t.Fatalf("handleElection = %q, want %q", got, want)
+			}
+		})
+	}
+	if got, issuer := member.SuperNodeMgr.Term(); got != term || issuer != coordinator.LocalNode.ID {
+		t.Fatalf("term %d by %s, want the valid result", got, shortID(issuer))
+	}
+}
+
+func TestCoordinatorOverrulesLowerRanked(t *testing.T) {
+	rooms := testRoom(t, "election-overrule", testNode(t, 110), testNode(t, 111))
+	exchangeHeartbeats(t, rooms)
+	var coordinator, member *RoomSession
+	for _, room := range rooms {
+		if room.SuperNodeMgr.ElectionCoordinator() == room.LocalNode.ID {
+			coordinator = room
+		} else {
+			member = room
+		}
+	}
+	if coordinator == nil || member == nil {
+		t.Fatal("no single coordinator")
+	}
+
+	before, _ := coordinator.SuperNodeMgr.Term()
+	notice := testElection(member, uint64(time.Now().UnixMilli())+1000, []string{member.LocalNode.ID})
+	data, err := json.Marshal(notice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := coordinator.handleElection(data, "test"); got != notice.key() {
+		t.Fatalf("handleElection = %q, want it acknowledged", got)
+	}
+	term, issuer := coordinator.SuperNodeMgr.Term()
+	if issuer != coordinator.LocalNode.ID || term <= before {
+		t.Fatal("coordinator adopted a lower-ranked member's result instead of announcing its own")
+	}
+	if !eventually(5*time.Second, func() bool { _, issuer := member.SuperNodeMgr.Term(); return issuer == coordinator.LocalNode.ID }) {
+		t.Fatal("member never adopted the coordinator's result")
+	}
+}
@@ -0,0 +1,889 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File transfer parameters
+const (
+	maxFileChunkSize     = 512 * 1024 // Chunks must fit in one frame once encoded and encrypted
+	maxFileChunks        = 1 << 20    // Chunks per file, bounding a download's chunk list and bookkeeping
+	manifestPageSize     = 16384      // Chunk hashes per manifest page
+	chunkRequestTimeout  = 30 * time.Second
+	downloadMaxAttempts  = 5
+	downloadRetryBackoff = 2 * time.Second
+)
+
+// fileOffer announces a file a member shares with the room. The file is
+// identified by the SHA-256 of its content.
+type fileOffer struct {
+	RoomID    string `json:"room_id"`
+	FileHash  string `json:"file_hash"` // Hex SHA-256 of the whole file
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	ChunkSize int    `json:"chunk_size"`
+	ListHash  string `json:"list_hash"` // Hex SHA-256 of the concatenated chunk hashes
+	SenderID  string `json:"sender_id"`
+	Sender    string `json:"sender"`
+	Address   string `json:"address"`
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"`
+}
+
+// Number of chunks in the offered file
+func (o fileOffer) chunkCount() int {
+	return int((o.Size + int64(o.ChunkSize) - 1) / int64(o.ChunkSize))
+}
+
+// Check that a download of the offered file stays within MAX_FILE_SIZE and
+// maxFileChunks
+func (o fileOffer) checkLimits() error {
+	if o.Size > AppConfig.MaxFileSize {
+		return fmt.Errorf("%s is larger than MAX_FILE_SIZE (%s)", formatBytes(o.Size), formatBytes(AppConfig.MaxFileSize))
+	}
+	if o.chunkCount() > maxFileChunks {
+		return fmt.Errorf("%d chunks is more than the limit of %d", o.chunkCount(), maxFileChunks)
+	}
+	return nil
+}
+
+// Length of chunk index
+func (o fileOffer) chunkLength(index int) int64 {
+	return min(int64(o.ChunkSize), o.Size-int64(index)*int64(o.ChunkSize))
+}
+
+// Bytes covered by a file offer signature
+func fileOfferSigningBytes(offer fileOffer) []byte {
+	offer.Signature = ""
+	data, _ := json.Marshal(offer)
+	return data
+}
+
+// fileAccept tells the sender a member is about to download a file
+type fileAccept struct {
+	FileHash string `json:"file_hash"`
+	NodeID   string `json:"node_id"`
+}
+
+// manifestRequest asks for a page of a file's chunk hashes
+type manifestRequest struct {
+	FileHash string `json:"file_hash"`
+	Start    int    `json:"start"`
+}
+
+// manifestPage carries consecutive chunk hashes, starting at Start
+type manifestPage struct {
+	FileHash string `json:"file_hash"`
+	Start    int    `json:"start"`
+	Hashes   []byte `json:"hashes"` // Concatenated 32-byte SHA-256 hashes
+}
+
+// chunkRequest asks for one chunk of a file. Chunks are content-addressed:
+// the server only answers with data matching Hash.
+type chunkRequest struct {
+	FileHash string `json:"file_hash"`
+	Index    int    `json:"index"`
+	Hash     string `json:"hash"` // Hex SHA-256 of the chunk content
+	NodeID   string `json:"node_id"`
+}
+
+// chunkData carries one chunk of a file
+type chunkData struct {
+	FileHash string `json:"file_hash"`
+	Index    int    `json:"index"`
+	Data     []byte `json:"data"`
+}
+
+// sharedFile is a local file offered to the room
+type sharedFile struct {
+	offer  fileOffer
+	path   string
+	hashes []byte
+}
+
+// Download states
+type downloadState int
+
+const (
+	downloadActive downloadState = iota
+	downloadInterrupted
+	downloadComplete
+	downloadFailed
+	downloadPaused
+	downloadCanceled
+)
+
+func (s downloadState) String() string {
+	switch s {
+	case downloadInterrupted:
+		return "interrupted"
+	case downloadComplete:
+		return "complete"
+	case downloadFailed:
+		return "failed"
+	case downloadPaused:
+		return "paused"
+	case downloadCanceled:
+		return "canceled"
+	default:
+		return "active"
+	}
+}
+
+// download is a file being received from a room member
+type download struct {
+	offer    fileOffer
+	hashes   []byte
+	have     []bool // Chunks verified and written to the partial file
+	done     int64  // Verified bytes
+	state    downloadState
+	partPath string // Partial file, named by content hash so it can be resumed
+	metaPath string // Offer and chunk hashes of the partial file
+	savePath string // Final path once complete
+	seedOnly bool   // Fetched by a SuperNode to seed, not requested by the user
+	notified bool   // Sender was told about the download
+	worker   bool   // A runDownload goroutine is fetching or stopping
+
+	started  time.Time
+	rate     float64         // Smoothed bytes per second
+	lastDone int64           // done at the last rate sample
+	peers    map[string]bool // Members chunks are currently fetched from
+}
+
+// File the download's verified chunks can be read from
+func (d *download) dataPath() string {
+	if d.state == downloadComplete {
+		return d.savePath
+	}
+	return d.partPath
+}
+
+// downloadMeta is saved next to a partial file so a later offer of the same
+// file resumes it instead of starting over
+type downloadMeta struct {
+	Offer  fileOffer `json:"offer"`
+	Hashes []byte    `json:"hashes"`
+}
+
+// FileTransfers tracks files shared by the local node, offers received from
+// other members and downloads
+type FileTransfers struct {
+	mu        sync.Mutex
+	shared    map[string]*sharedFile // File hash -> shared file
+	offers    map[string]fileOffer   // File hash -> offer not yet accepted
+	downloads map[string]*download   // File hash -> download
+	uploads   map[string]*upload     // File hash + peer -> chunks served
+	monitor   bool                   // Progress monitor is running
+
+	peakUpload int64 // Best upload rate seen, bytes per second
+}
+
+// NewFileTransfers creates an empty transfer registry
+func NewFileTransfers() *FileTransfers {
+	return &FileTransfers{
+		shared:    make(map[string]*sharedFile),
+		offers:    make(map[string]fileOffer),
+		downloads: make(map[string]*download),
+		uploads:   make(map[string]*upload),
+	}
+}
+
+// Find an offer by file hash prefix. Ambiguous prefixes fail.
+func (ft *FileTransfers) findOffer(idPrefix string) (fileOffer, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	var matches []fileOffer
+	for hash, offer := range ft.offers {
+		if strings.HasPrefix(hash, idPrefix) {
+			matches = append(matches, offer)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return fileOffer{}, fmt.Errorf("no file offer with ID %s", idPrefix)
+	case 1:
+		return matches[0], nil
+	default:
+		return fileOffer{}, fmt.Errorf("file ID %s is ambiguous", idPrefix)
+	}
+}
+
+// Find where the local node can read a file's chunks from: a file it
+// shared, or one it is downloading or has downloaded. have is nil if every
+// chunk is available.
+func (ft *FileTransfers) source(fileHash string) (offer fileOffer, path string, hashes []byte, have []bool, ok bool) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	if shared, found := ft.shared[fileHash]; found {
+		return shared.offer, shared.path, shared.hashes, nil, true
+	}
+	d, found := ft.downloads[fileHash]
+	if !found || d.hashes == nil || (d.have == nil && d.state != downloadComplete) {
+		return fileOffer{}, "", nil, nil, false
+	}
+	if d.state == downloadComplete {
+		return d.offer, d.dataPath(), d.hashes, nil, true
+	}
+	return d.offer, d.dataPath(), d.hashes, append([]bool(nil), d.have...), true
+}
+
+// Hash a file in one pass, returning its content hash and chunk hashes
+func hashFile(path string, chunkSize int) (string, []byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	whole := sha256.New()
+	var hashes []byte
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			whole.Write(buf[:n])
+			sum := sha256.Sum256(buf[:n])
+			hashes = append(hashes, sum[:]...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return hex.EncodeToString(whole.Sum(nil)), hashes, nil
+}
+
+// Hex SHA-256 of a chunk hash list
+func chunkListHash(hashes []byte) string {
+	sum := sha256.Sum256(hashes)
+	return hex.EncodeToString(sum[:])
+}
+
+// Human-readable byte count
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// Strip any directory from an offered file name
+func safeFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == ".." || name == "/" || name == "" {
+		return "file"
+	}
+	return name
+}
+
+// Pick a path in dir for name that doesn't overwrite an existing file
+func uniquePath(dir, name string) string {
+	path := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return path
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+}
+
+// Encrypt a value as JSON under the room key
+func (r *RoomSession) sealRoomJSON(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return r.Keyring.Seal(r.Room.ID, data)
+}
+
+// Encode a JSON value for the outbox, which seals it under the room key
+// current at each delivery attempt
+func (r *RoomSession) roomSealer(v any) (func() ([]byte, error), error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return func() ([]byte, error) { return r.Keyring.Seal(r.Room.ID, data) }, nil
+}
+
+// Decrypt a JSON value sealed under the room key
+func (r *RoomSession) openRoomJSON(payload []byte, v any) error {
+	data, err := r.Keyring.Open(r.Room.ID, payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// OfferFile shares a local file with every room member
+func (r *RoomSession) OfferFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("file does not exist: %s", path)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("cannot send directory: %s", path)
+	}
+
+	if info.Size() > AppConfig.MaxFileSize {
+		return fmt.Errorf("%s is larger than MAX_FILE_SIZE (%s)", path, formatBytes(AppConfig.MaxFileSize))
+	}
+
+	// Use bigger chunks than configured if the file would need too many
+	chunkSize := min(max(AppConfig.FileChunkSize, 1), maxFileChunkSize)
+	chunkSize = max(chunkSize, int((info.Size()+maxFileChunks-1)/maxFileChunks))
+	if chunkSize > maxFileChunkSize {
+		return fmt.Errorf("%s is too large to send", path)
+	}
+	fileHash, hashes, err := hashFile(path, chunkSize)
+	if err != nil {
+		return err
+	}
+
+	offer := fileOffer{
+		RoomID:    r.Room.ID,
+		FileHash:  fileHash,
+		Name:      info.Name(),
+		Size:      info.Size(),
+		ChunkSize: chunkSize,
+		ListHash:  chunkListHash(hashes),
+		SenderID:  r.LocalNode.ID,
+		Sender:    r.LocalNode.Nickname,
+		Address:   r.LocalNode.Address,
+		PublicKey: r.Identity.EncodedPublicKey(),
+	}
+	offer.Signature = r.Identity.Sign(fileOfferSigningBytes(offer))
+
+	r.Files.mu.Lock()
+	r.Files.shared[fileHash] = &sharedFile{offer: offer, path: path, hashes: hashes}
+	r.Files.mu.Unlock()
+
+	seal, err := r.roomSealer(offer)
+	if err != nil {
+		return err
+	}
+
+	r.NodeMutex.RLock()
+	recipients := 0
+	for _, node := range r.Room.Nodes {
+		if node.ID == r.LocalNode.ID {
+			continue
+		}
+		r.Outbox.Enqueue(node, fileHash, FrameFileOffer, seal)
+		recipients++
+	}
+	r.NodeMutex.RUnlock()
+
+	fmt.Printf("[File] Offered %s (%s, %d chunks) to %d member(s), file ID %s\n",
+		offer.Name, formatBytes(offer.Size), offer.chunkCount(), recipients, shortID(fileHash))
+	return nil
+}
+
+// Handle a file offer from another member. Returns the key to acknowledge.
+func (r *RoomSession) handleFileOffer(data []byte, remoteAddr string) string {
+	var offer fileOffer
+	if err := json.Unmarshal(data, &offer); err != nil {
+		fmt.Printf("Invalid file offer from %s: %v\n", remoteAddr, err)
+		return ""
+	}
+	if offer.RoomID != r.Room.ID || offer.SenderID == r.LocalNode.ID {
+		return ""
+	}
+	if !verifySignature(offer.SenderID, offer.PublicKey, offer.Signature, fileOfferSigningBytes(offer)) {
+		fmt.Printf("[System] Warning: ignoring unverified file offer from %s\n", remoteAddr)
+		return ""
+	}
+	if _, err := hex.DecodeString(offer.FileHash); err != nil || len(offer.FileHash) != 2*sha256.Size ||
+		offer.ChunkSize <= 0 || offer.ChunkSize > maxFileChunkSize || offer.Size < 0 {
+		fmt.Printf("[System] Warning: ignoring malformed file offer from %s\n", offer.Sender)
+		return ""
+	}
+	if err := offer.checkLimits(); err != nil {
+		fmt.Printf("[File] Ignoring %s from %s: %v\n", safeFileName(offer.Name), offer.Sender, err)
+		return offer.FileHash
+	}
+
+	r.Files.mu.Lock()
+	_, known := r.Files.offers[offer.FileHash]
+	_, downloading := r.Files.downloads[offer.FileHash]
+	r.Files.offers[offer.FileHash] = offer
+	r.Files.mu.Unlock()
+
+	if !known && !downloading {
+		fmt.Printf("[File] %s%s offers %s (%s). Type /accept %s to download\n",
+			r.roomTag(), offer.Sender, safeFileName(offer.Name), formatBytes(offer.Size), shortID(offer.FileHash))
+
+		// SuperNodes fetch offered files so they can serve them to the room
+		if r.SuperNodeMgr.IsLocalNodeSuperNode() {
+			if err := r.startSeeding(offer); err != nil {
+				fmt.Printf("[File] Failed to seed %s: %v\n", offer.Name, err)
+			}
+		}
+	}
+	return offer.FileHash
+}
+
+// Handle a member starting a download. Returns the file hash if the file is
+// still shared, or "" to refuse.
+func (r *RoomSession) handleFileAccept(data []byte, remoteAddr string) string {
+	var accept fileAccept
+	if err := json.Unmarshal(data, &accept); err != nil {
+		return ""
+	}
+
+	r.Files.mu.Lock()
+	shared, ok := r.Files.shared[accept.FileHash]
+	r.Files.mu.Unlock()
+	if !ok {
+		return ""
+	}
+
+	who := remoteAddr
+	if node, ok := r.findRoomNodeByID(accept.NodeID); ok {
+		who = node.Nickname
+	}
+	fmt.Printf("[File] %s is downloading %s\n", who, shared.offer.Name)
+	return accept.FileHash
+}
+
+// Answer a request for a page of chunk hashes
+func (r *RoomSession) handleManifestRequest(data []byte) []byte {
+	var request manifestRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil
+	}
+
+	_, _, hashes, _, ok := r.Files.source(request.FileHash)
+	if !ok || request.Start < 0 || request.Start*sha256.Size > len(hashes) {
+		return nil
+	}
+
+	start := request.Start * sha256.Size
+	end := min(start+manifestPageSize*sha256.Size, len(hashes))
+	response, err := r.sealRoomJSON(manifestPage{
+		FileHash: request.FileHash,
+		Start:    request.Start,
+		Hashes:   hashes[start:end],
+	})
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// Answer a request for one chunk. Only chunks whose content matches the
+// requested hash are served; otherwise the reply carries no data.
+func (r *RoomSession) handleChunkRequest(data []byte) []byte {
+	var request chunkRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil
+	}
+
+	response := chunkData{FileHash: request.FileHash, Index: request.Index}
+	if chunk := r.readChunk(request); chunk != nil {
+		response.Data = chunk
+	}
+
+	sealed, err := r.sealRoomJSON(response)
+	if err != nil {
+		return nil
+	}
+	return sealed
+}
+
+// Read a requested chunk from local storage and check it against its hash
+func (r *RoomSession) readChunk(request chunkRequest) []byte {
+	offer, path, hashes, have, ok := r.Files.source(request.FileHash)
+	if !ok || request.Index < 0 || request.Index >= offer.chunkCount() {
+		return nil
+	}
+	if have != nil && !have[request.Index] {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	data := make([]byte, offer.chunkLength(request.Index))
+	if _, err := file.ReadAt(data, int64(request.Index)*int64(offer.ChunkSize)); err != nil {
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+	expected := hashes[request.Index*sha256.Size : (request.Index+1)*sha256.Size]
+	if !bytes.Equal(sum[:], expected) || (request.Hash != "" && request.Hash != hex.EncodeToString(expected)) {
+		return nil
+	}
+
+	peer := shortID(request.NodeID)
+	if node, ok := r.findRoomNodeByID(request.NodeID); ok {
+		peer = node.Nickname
+	}
+	r.Files.recordUpload(request.FileHash, offer.Name, peer, len(data))
+	return data
+}
+
+// AcceptFile starts, or resumes, downloading an offered file
+func (r *RoomSession) AcceptFile(idPrefix string) error {
+	offer, err := r.Files.findOffer(idPrefix)
+	if err != nil {
+		return err
+	}
+
+	r.Files.mu.Lock()
+	if d, ok := r.Files.downloads[offer.FileHash]; ok && d.state == downloadCanceled {
+		delete(r.Files.downloads, offer.FileHash)
+	}
+	if d, ok := r.Files.downloads[offer.FileHash]; ok {
+		state, seedOnly := d.state, d.seedOnly
+		d.seedOnly = false
+		if state == downloadInterrupted || state == downloadFailed || state == downloadPaused {
+			d.state = downloadActive
+			if state != downloadPaused {
+				d.have = nil // Recheck the partial file before continuing
+			}
+		}
+		r.Files.mu.Unlock()
+
+		switch {
+		case state == downloadComplete && seedOnly:
+			// Already fetched to seed; hand the seed copy to the user, who
+			// keeps serving it from there
+			savePath := uniquePath(AppConfig.FileSaveDir, safeFileName(offer.Name))
+			if err := os.Rename(d.savePath, savePath); err != nil {
+				if err := copyFile(d.savePath, savePath); err != nil {
+					return err
+				}
+				os.Remove(d.savePath)
+			}
+			r.Files.mu.Lock()
+			d.savePath = savePath
+			r.Files.mu.Unlock()
+			fmt.Printf("[File] Saved %s to %s (verified)\n", offer.Name, savePath)
+			return nil
+		case state == downloadComplete:
+			return fmt.Errorf("%s was already saved to %s", d.offer.Name, d.savePath)
+		case state == downloadActive && seedOnly:
+			fmt.Printf("[File] Downloading %s (%s), it will be saved when complete\n", safeFileName(offer.Name), formatBytes(offer.Size))
+			return nil
+		case state == downloadActive:
+			return fmt.Errorf("%s is already downloading", d.offer.Name)
+		}
+		r.startWorker(d)
+		return nil
+	}
+	r.Files.mu.Unlock()
+
+	if err := r.startDownload(offer, false); err != nil {
+		return err
+	}
+	fmt.Printf("[File] Downloading %s (%s) offered by %s\n", safeFileName(offer.Name), formatBytes(offer.Size), offer.Sender)
+	return nil
+}
+
+// Register a download for an offer and start fetching it
+func (r *RoomSession) startDownload(offer fileOffer, seedOnly bool) error {
+	if err := os.MkdirAll(AppConfig.FileSaveDir, 0700); err != nil {
+		return err
+	}
+
+	d := &download{
+		offer:    offer,
+		partPath: filepath.Join(AppConfig.FileSaveDir, offer.FileHash[:16]+".part"),
+		metaPath: filepath.Join(AppConfig.FileSaveDir, offer.FileHash[:16]+".meta"),
+		seedOnly: seedOnly,
+		started:  time.Now(),
+		peers:    make(map[string]bool),
+	}
+
+	// Pick up the chunk hashes of an earlier, interrupted download
+	if data, err := os.ReadFile(d.metaPath); err == nil {
+		var meta downloadMeta
+		if json.Unmarshal(data, &meta) == nil && meta.Offer.FileHash == offer.FileHash &&
+			chunkListHash(meta.Hashes) == offer.ListHash {
+			d.hashes = meta.Hashes
+		}
+	}
+
+	r.Files.mu.Lock()
+	if _, exists := r.Files.downloads[offer.FileHash]; exists {
+		r.Files.mu.Unlock()
+		return fmt.Errorf("%s is already downloading", offer.Name)
+	}
+	r.Files.downloads[offer.FileHash] = d
+	r.Files.mu.Unlock()
+
+	r.startWorker(d)
+	return nil
+}
+
+// Directory the room's seed copies are kept in until the user accepts them
+func (r *RoomSession) seedDir() string {
+	sum := sha256.Sum256([]byte(r.Room.ID))
+	return filepath.Join(AppConfig.FileSaveDir, ".seed", hex.EncodeToString(sum[:8]))
+}
+
+// Bytes of seed copies held or being fetched across every room
+func (p *P2PChat) seedBytes() int64 {
+	var total int64
+	for _, room := range p.roomList() {
+		room.Files.mu.Lock()
+		for _, d := range room.Files.downloads {
+			if d.seedOnly && d.state != downloadFailed && d.state != downloadCanceled {
+				total += d.offer.Size
+			}
+		}
+		room.Files.mu.Unlock()
+	}
+	return total
+}
+
+// Fetch an offered file to seed it, unless that would take the seed copies
+// of every room past SEED_MAX_SIZE
+func (r *RoomSession) startSeeding(offer fileOffer) error {
+	r.seedMu.Lock()
+	defer r.seedMu.Unlock()
+	if AppConfig.SeedMaxSize <= 0 || r.seedBytes()+offer.Size > AppConfig.SeedMaxSize {
+		return nil
+	}
+	return r.startDownload(offer, true)
+}
+
+// Copy a file to a new path
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// Update a download's state
+func (r *RoomSession) setDownloadState(d *download, state downloadState) {
+	r.Files.mu.Lock()
+	d.state = state
+	r.Files.mu.Unlock()
+}
+
+// Fetch a file's chunk hashes page by page and check them against the offer
+func (r *RoomSession) fetchManifest(d *download, addr string) error {
+	count := d.offer.chunkCount()
+	hashes := make([]byte, 0, count*sha256.Size)
+
+	for start := 0; start < count; start += manifestPageSize {
+		request, err := r.sealRoomJSON(manifestRequest{FileHash: d.offer.FileHash, Start: start})
+		if err != nil {
+			return err
+		}
+		frame, err := r.Conns.Request(addr, FrameManifestRequest, request, chunkRequestTimeout)
+		if err != nil {
+			return err
+		}
+		if frame.Type != FrameManifestPage {
+			return fmt.Errorf("unexpected reply to manifest request")
+		}
+
+		var page manifestPage
+		if err := r.openRoomJSON(frame.Payload, &page); err != nil {
+			return err
+		}
+		if page.FileHash != d.offer.FileHash || page.Start != start ||
+			len(page.Hashes) != min(manifestPageSize, count-start)*sha256.Size {
+			return fmt.Errorf("invalid manifest page")
+		}
+		hashes = append(hashes, page.Hashes...)
+	}
+
+	if chunkListHash(hashes) != d.offer.ListHash {
+		return fmt.Errorf("chunk list doesn't match the offer")
+	}
+	r.Files.mu.Lock()
+	d.hashes = hashes
+	r.Files.mu.Unlock()
+
+	// Remember the chunk list so the download can resume after a restart
+	data, err := json.Marshal(downloadMeta{Offer: d.offer, Hashes: hashes})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(d.metaPath, data, 0600)
+}
+
+// Open or create the partial file and find chunks already verified in it
+func (r *RoomSession) checkPartialFile(d *download) error {
+	if err := d.offer.checkLimits(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(d.partPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := file.Truncate(d.offer.Size); err != nil {
+		return err
+	}
+
+	have := make([]bool, d.offer.chunkCount())
+	var done int64
+	buf := make([]byte, d.offer.ChunkSize)
+	for index := range have {
+		chunk := buf[:d.offer.chunkLength(index)]
+		if _, err := file.ReadAt(chunk, int64(index)*int64(d.offer.ChunkSize)); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(chunk)
+		if bytes.Equal(sum[:], d.hashes[index*sha256.Size:(index+1)*sha256.Size]) {
+			have[index] = true
+			done += int64(len(chunk))
+		}
+	}
+
+	if done > 0 {
+		fmt.Printf("[File] Resuming %s, %s already received\n", d.offer.Name, formatBytes(done))
+	}
+	r.Files.mu.Lock()
+	d.have = have
+	d.done = done
+	r.Files.mu.Unlock()
+	return nil
+}
+
+// Verify a completed download and move it into the save directory
+func (r *RoomSession) finishDownload(d *download) {
+	if !r.Files.isRunning(d) {
+		r.stopDownload(d)
+		return
+	}
+
+	file, err := os.Open(d.partPath)
+	if err != nil {
+		fmt.Printf("[File] Failed to open %s: %v\n", d.partPath, err)
+		r.setDownloadState(d, downloadFailed)
+		return
+	}
+	whole := sha256.New()
+	_, err = io.Copy(whole, file)
+	file.Close()
+
+	if err != nil || hex.EncodeToString(whole.Sum(nil)) != d.offer.FileHash {
+		fmt.Printf("[File] %s failed whole-file verification, discarding it\n", d.offer.Name)
+		os.Remove(d.partPath)
+		os.Remove(d.metaPath)
+		r.setDownloadState(d, downloadFailed)
+		return
+	}
+
+	// Seed copies are kept out of sight until the user accepts the file
+	r.Files.mu.Lock()
+	seedOnly := d.seedOnly
+	r.Files.mu.Unlock()
+	saveDir := AppConfig.FileSaveDir
+	if seedOnly {
+		saveDir = r.seedDir()
+		if err := os.MkdirAll(saveDir, 0700); err != nil {
+			fmt.Printf("[File] Failed to save %s: %v\n", d.offer.Name, err)
+			r.setDownloadState(d, downloadFailed)
+			return
+		}
+	}
+
+	savePath := uniquePath(saveDir, safeFileName(d.offer.Name))
+	if err := os.Rename(d.partPath, savePath); err != nil {
+		fmt.Printf("[File] Failed to save %s: %v\n", d.offer.Name, err)
+		r.setDownloadState(d, downloadFailed)
+		return
+	}
+	os.Remove(d.metaPath)
+
+	r.Files.mu.Lock()
+	d.state = downloadComplete
+	d.savePath = savePath
+	r.Files.mu.Unlock()
+
+	if seedOnly {
+		fmt.Printf("[File] Seeding %s for the room\n", d.offer.Name)
+		return
+	}
+	fmt.Printf("[File] Saved %s from %s to %s (verified)\n", d.offer.Name, d.offer.Sender, savePath)
+}
+
+// Resume interrupted downloads from a node that came back
+func (r *RoomSession) resumeDownloadsFrom(nodeID string) {
+	r.Files.mu.Lock()
+	var resumed []*download
+	for _, d := range r.Files.downloads {
+		if d.state == downloadInterrupted && d.offer.SenderID == nodeID {
+			d.state = downloadActive
+			resumed = append(resumed, d)
+		}
+	}
+	r.Files.mu.Unlock()
+
+	for _, d := range resumed {
+		fmt.Printf("[File] %s is back, resuming %s\n", d.offer.Sender, d.offer.Name)
+		r.startWorker(d)
+	}
+}
+
+// Print file offers that haven't been accepted yet
+func (r *RoomSession) printFileOffers() {
+	r.Files.mu.Lock()
+	var offers []fileOffer
+	for hash, offer := range r.Files.offers {
+		if d, ok := r.Files.downloads[hash]; !ok || d.seedOnly {
+			offers = append(offers, offer)
+		}
+	}
+	r.Files.mu.Unlock()
+
+	if len(offers) == 0 {
+		fmt.Println("No pending file offers")
+		return
+	}
+
+	sort.Slice(offers, func(i, j int) bool { return offers[i].Name < offers[j].Name })
+	fmt.Println("Pending file offers:")
+	for _, offer := range offers {
+		fmt.Printf("  %s  %s (%s) from %s\n", shortID(offer.FileHash), safeFileName(offer.Name), formatBytes(offer.Size), offer.Sender)
+	}
+}
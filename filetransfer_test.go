@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write size random bytes to a new file in dir
+func testFile(t *testing.T, dir, name string, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// Download of a local file split into chunkSize chunks, with its chunk
+// hashes already known
+func testDownload(t *testing.T, path string, chunkSize int) *download {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileHash, hashes, err := hashFile(path, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	return &download{
+		offer:    fileOffer{FileHash: fileHash, Name: info.Name(), Size: info.Size(), ChunkSize: chunkSize, ListHash: chunkListHash(hashes)},
+		hashes:   hashes,
+		partPath: filepath.Join(dir, "file.part"),
+		metaPath: filepath.Join(dir, "file.meta"),
+		peers:    make(map[string]bool),
+	}
+}
+
+func TestReadChunkServesOnlyVerifiedData(t *testing.T) {
+	room := testRoom(t, "serve-chunks", testNode(t, 70))[0]
+	path, data := testFile(t, t.TempDir(), "shared.bin", 3*AppConfig.FileChunkSize)
+	if err := room.OfferFile(path); err != nil {
+		t.Fatal(err)
+	}
+	d := testDownload(t, path, AppConfig.FileChunkSize)
+
+	// Damage chunk 1 on disk after it was offered
+	data[AppConfig.FileChunkSize] ^= 1
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func(index int) string { return hex.EncodeToString(d.hashes[index*sha256.Size : (index+1)*sha256.Size]) }
+	tests := []struct {
+		name    string
+		request chunkRequest
+		served  bool
+	}{
+		{"intact chunk", chunkRequest{FileHash: d.offer.FileHash, Index: 0, Hash: hash(0)}, true},
+		{"damaged chunk", chunkRequest{FileHash: d.offer.FileHash, Index: 1, Hash: hash(1)}, false},
+		{"hash of another chunk", chunkRequest{FileHash: d.offer.FileHash, Index: 2, Hash: hash(0)}, false},
+		{"index out of range", chunkRequest{FileHash: d.offer.FileHash, Index: 3}, false},
+		{"unknown file", chunkRequest{FileHash: strings.Repeat("0", 64), Index: 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := room.readChunk(tt.request); (got != nil) != tt.served {
+				t.Fatalf("served = %v, want %v", got != nil, tt.served)
+			}
+		})
+	}
+}
+
+func TestRequestChunkRejectsBadData(t *testing.T) {
+	room := testRoom(t, "bad-chunks", testNode(t, 71))[0]
+	path, data := testFile(t, t.TempDir(), "file.bin", 2*AppConfig.FileChunkSize)
+	d := testDownload(t, path, AppConfig.FileChunkSize)
+
+	tests := []struct {
+		name  string
+		reply chunkData
+		ok    bool
+	}{
+		{"matching chunk", chunkData{FileHash: d.offer.FileHash, Index: 0, Data: data[:AppConfig.FileChunkSize]}, true},
+		{"other chunk's data", chunkData{FileHash: d.offer.FileHash, Index: 0, Data: data[AppConfig.FileChunkSize:]}, false},
+		{"wrong index", chunkData{FileHash: d.offer.FileHash, Index: 1, Data: data[:AppConfig.FileChunkSize]}, false},
+		{"no data", chunkData{FileHash: d.offer.FileHash, Index: 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := servePeer(t, testIdentity(t, 50), func(*Frame, string) (byte, []byte) {
+				sealed, _ := room.sealRoomJSON(tt.reply)
+				return FrameChunkData, sealed
+			})
+			got, err := room.requestChunk(d, addr, 0)
+			if (err == nil) != tt.ok {
+				t.Fatalf("requestChunk error = %v, want success %v", err, tt.ok)
+			}
+			if tt.ok && !bytes.Equal(got, data[:AppConfig.FileChunkSize]) {
+				t.Fatal("returned data doesn't match the chunk")
+			}
+		})
+	}
+}
+
+func TestCheckPartialFileResumes(t *testing.T) {
+	room := testRoom(t, "partial", testNode(t, 72))[0]
+	path, data := testFile(t, t.TempDir(), "file.bin", 10)
+	d := testDownload(t, path, 4) // Chunks of 4, 4 and 2 bytes
+
+	// Chunks 0 and 2 arrived intact, chunk 1 never did
+	partial := append([]byte(nil), data...)
+	copy(partial[4:8], make([]byte, 4))
+	if err := os.WriteFile(d.partPath, partial, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := room.checkPartialFile(d); err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{true, false, true}; !slices.Equal(d.have, want) {
+		t.Fatalf("have = %v, want %v", d.have, want)
+	}
+	if d.done != 6 {
+		t.Fatalf("done = %d, want 6", d.done)
+	}
+
+	// A missing partial file starts from nothing
+	os.Remove(d.partPath)
+	if err := room.checkPartialFile(d); err != nil {
+		t.Fatal(err)
+	}
+	if d.done != 0 || !slices.Equal(d.have, []bool{false, false, false}) {
+		t.Fatalf("fresh partial file has = %v, done %d", d.have, d.done)
+	}
+}
+
+// Wait for a member to receive the offer of fileHash, then accept it and wait
+// for the download to complete. Returns the saved file.
+func acceptAndWait(t *testing.T, room *RoomSession, fileHash string) string {
+	t.Helper()
+	if !eventually(5*time.Second, func() bool { _, err := room.Files.findOffer(fileHash); return err == nil }) {
+		t.Fatal("offer never arrived")
+	}
+	if err := room.AcceptFile(fileHash); err != nil {
+		t.Fatal(err)
+	}
+	var d *download
+	if !eventually(10*time.Second, func() bool {
+		room.Files.mu.Lock()
+		defer room.Files.mu.Unlock()
+		d = room.Files.downloads[fileHash]
+		return d != nil && d.state == downloadComplete && !d.seedOnly
+	}) {
+		t.Fatal("download never completed")
+	}
+	t.Cleanup(func() { os.Remove(d.savePath) })
+	return d.savePath
+}
+
+func TestFileTransferResumesPartialFile(t *testing.T) {
+	rooms := testRoom(t, "transfer", testNode(t, 73), testNode(t, 74))
+	path, data := testFile(t, t.TempDir(), "transfer.bin", 3*AppConfig.FileChunkSize+100)
+	fileHash, _, err := hashFile(path, AppConfig.FileChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave the first chunk from an earlier attempt, which the download keeps
+	partPath := filepath.Join(AppConfig.FileSaveDir, fileHash[:16]+".part")
+	if err := os.WriteFile(partPath, data[:AppConfig.FileChunkSize], 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(partPath) })
+
+	if err := rooms[0].OfferFile(path); err != nil {
+		t.Fatal(err)
+	}
+	saved := acceptAndWait(t, rooms[1], fileHash)
+
+	got, err := os.ReadFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("saved file differs from the offered one")
+	}
+	if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+		t.Fatal("partial file left behind")
+	}
+
+	rooms[0].Files.mu.Lock()
+	var served int64
+	for _, u := range rooms[0].Files.uploads {
+		served += u.bytes
+	}
+	rooms[0].Files.mu.Unlock()
+	if want := int64(len(data) - AppConfig.FileChunkSize); served != want {
+		t.Fatalf("sender served %d bytes, want %d without the chunk already received", served, want)
+	}
+}
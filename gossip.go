@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Gossip dissemination
+//
+// In gossip mode a message is pushed to GOSSIP_FANOUT random members, and
+// every member that receives it for the first time pushes it on to
+// GOSSIP_FANOUT more, until it has been passed on GOSSIP_TTL times. No
+// member has to be elected to relay, but pushing alone can miss a few
+// members, so members that take part in gossip also pull: once per
+// heartbeat interval they send a random member the keys of the messages
+// they have from the last gossipPullWindow, and get back the ones they lack.
+//
+// The mode is chosen per room by each sender with /mode. Members forward
+// and pull gossip whatever their own mode is.
+
+// Message dissemination modes, see /mode
+const (
+	modeAuto   = "auto"   // Direct, or through SuperNodes once the room is large
+	modeDirect = "direct" // Always send to every member directly
+	modeGossip = "gossip" // Push to random members, which pass it on
+)
+
+// Check whether s is a dissemination mode
+func validMode(s string) bool {
+	return s == modeAuto || s == modeDirect || s == modeGossip
+}
+
+// Gossip limits
+const (
+	gossipPullWindow = 2 * time.Minute // How far back pulls look for missing messages
+	gossipDigestMax  = 500             // Most message keys sent in one pull
+)
+
+// gossipEnvelope carries a message from member to member
+type gossipEnvelope struct {
+	From    string  `json:"from"` // Member that pushed it
+	TTL     int     `json:"ttl"`  // Pushes left, including this one
+	Message Message `json:"message"`
+}
+
+// gossipPull lists the recent messages a member already has
+type gossipPull struct {
+	Keys []string `json:"keys"`
+}
+
+// gossipState tracks when a room last saw gossip
+type gossipState struct {
+	mu       sync.Mutex
+	lastSeen time.Time
+}
+
+// Record gossip traffic in the room
+func (g *gossipState) touch() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lastSeen = time.Now()
+}
+
+// Check whether gossip was seen within the pull window
+func (g *gossipState) recent() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return time.Since(g.lastSeen) < gossipPullWindow
+}
+
+// Push a message to up to GOSSIP_FANOUT random members other than the
+// sender and the member it came from
+func (r *RoomSession) gossipMessage(message Message, ttl int, from string) {
+	if ttl <= 0 {
+		return
+	}
+	r.Gossip.touch()
+
+	envelope := gossipEnvelope{From: r.LocalNode.ID, TTL: ttl, Message: message}
+	seal, err := r.roomSealer(envelope)
+	if err != nil {
+		fmt.Printf("Failed to encode gossip: %v\n", err)
+		return
+	}
+
+	r.NodeMutex.RLock()
+	var targets []NodeInfo
+	for _, node := range r.Room.Nodes {
+		if node.ID == r.LocalNode.ID || node.ID == message.SenderID || node.ID == from {
+			continue
+		}
+		targets = append(targets, node)
+	}
+	r.NodeMutex.RUnlock()
+
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	if len(targets) > AppConfig.GossipFanout {
+		targets = targets[:AppConfig.GossipFanout]
+	}
+	for _, node := range targets {
+		r.Outbox.Enqueue(node, messageKey(message), FrameGossip, seal)
+	}
+}
+
+// Handle a message pushed by a member. Returns the key to acknowledge, or
+// "" if the frame was invalid.
+func (r *RoomSession) handleGossipFrame(data []byte, remoteAddr string) string {
+	var envelope gossipEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		fmt.Printf("Invalid gossip from %s: %v\n", remoteAddr, err)
+		return ""
+	}
+	message := envelope.Message
+	if message.RoomID != r.Room.ID {
+		return ""
+	}
+	if message.ID == "" || message.SenderID == "" {
+		fmt.Printf("Dropping message without ID from %s\n", remoteAddr)
+		return ""
+	}
+	r.Gossip.touch()
+
+	// Duplicates are still acknowledged so the sender stops retrying, but
+	// not pushed on again
+	if !r.SeenMessages.MarkSeen(messageKey(message)) {
+		return messageKey(message)
+	}
+
+	r.onNodeSeen(message.SenderID)
+	r.gossipMessage(message, envelope.TTL-1, envelope.From)
+	r.displayMessage(message)
+	return messageKey(message)
+}
+
+// Pull messages we're missing from a random member, if the room uses gossip
+func (r *RoomSession) pullGossip() {
+	if r.Mode != modeGossip && !r.Gossip.recent() {
+		return
+	}
+
+	r.NodeMutex.RLock()
+	var members []NodeInfo
+	for _, node := range r.Room.Nodes {
+		if node.ID != r.LocalNode.ID {
+			members = append(members, node)
+		}
+	}
+	r.NodeMutex.RUnlock()
+	if len(members) == 0 {
+		return
+	}
+	node := members[rand.Intn(len(members))]
+
+	var pull gossipPull
+	recent := r.History.Between(time.Now().Add(-gossipPullWindow), time.Time{})
+	if len(recent) > gossipDigestMax {
+		recent = recent[len(recent)-gossipDigestMax:]
+	}
+	for _, message := range recent {
+		pull.Keys = append(pull.Keys, messageKey(message))
+	}
+	payload, err := r.sealRoomJSON(pull)
+	if err != nil {
+		return
+	}
+
+	// Pulls repeat every interval, so failures are not reported
+	frame, err := r.Conns.Request(node.Address, FrameGossipPull, payload, connRequestTimeout)
+	if err != nil || frame.Type != FrameHistoryResponse {
+		return
+	}
+	var response historyResponse
+	if err := r.openRoomJSON(frame.Payload, &response); err != nil {
+		return
+	}
+
+	var missing []Message
+	for _, message := range response.Messages {
+		if message.RoomID != r.Room.ID || message.ID == "" || message.SenderID == "" {
+			continue
+		}
+		if r.SeenMessages.MarkSeen(messageKey(message)) {
+			missing = append(missing, message)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return messageBefore(missing[i], missing[j]) })
+	for _, message := range missing {
+		r.displayMessage(message)
+	}
+}
+
+// Answer a pull with the recent messages the member doesn't have
+func (r *RoomSession) handleGossipPull(data []byte, remoteAddr string) []byte {
+	var pull gossipPull
+	if err := json.Unmarshal(data, &pull); err != nil {
+		fmt.Printf("Invalid gossip pull from %s: %v\n", remoteAddr, err)
+		return nil
+	}
+
+	has := make(map[string]bool, len(pull.Keys))
+	for _, key := range pull.Keys {
+		has[key] = true
+	}
+	var missing []Message
+	for _, message := range r.History.Between(time.Now().Add(-gossipPullWindow), time.Time{}) {
+		if !has[messageKey(message)] {
+			missing = append(missing, message)
+		}
+	}
+	return r.sealHistoryResponse(missing)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// Members the gossip frames waiting in an outbox are for
+func queuedGossip(o *Outbox) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var nodeIDs []string
+	for _, queue := range o.queues {
+		for _, item := range queue.items {
+			if item.frameType == FrameGossip {
+				nodeIDs = append(nodeIDs, item.node.ID)
+			}
+		}
+	}
+	return nodeIDs
+}
+
+// Address nothing listens on, so frames to it stay queued
+func deadAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestHandleGossipFrame(t *testing.T) {
+	room := testRoom(t, "gossip-frame", testNode(t, 119))[0]
+	addr := deadAddress(t)
+	for seed := byte(120); seed < 125; seed++ {
+		room.addRoomNode(NodeInfo{ID: testIdentity(t, seed).ID, Nickname: fmt.Sprint("node", seed), Address: addr})
+	}
+	message := testSignedMessage(t, 120, "gossip-frame", "pushed", time.Now().UnixMilli())
+	envelope := func(edit func(*gossipEnvelope)) []byte {
+		e := gossipEnvelope{From: testIdentity(t, 121).ID, TTL: 2, Message: message}
+		edit(&e)
+		data, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	keep := func(*gossipEnvelope) {}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		acked  bool
+		pushed int // Gossip frames queued in total afterwards
+	}{
+		{"other room", envelope(func(e *gossipEnvelope) { e.Message.RoomID = "elsewhere" }), false, 0},
+		{"no ID", envelope(func(e *gossipEnvelope) { e.Message.ID = "" }), false, 0},
+		{"last push", envelope(func(e *gossipEnvelope) { e.Message.ID = "last"; e.TTL = 1 }), true, 0},
+		{"first copy", envelope(keep), true, AppConfig.GossipFanout},
+		{"duplicate", envelope(keep), true, AppConfig.GossipFanout},
+	}
+	for _, tt := range tests {
+		got := room.handleGossipFrame(tt.data, "test")
+		if (got != "") != tt.acked {
+			t.Fatalf("%s: acknowledged %q", tt.name, got)
+		}
+		if queued := queuedGossip(room.Outbox); len(queued) != tt.pushed {
+			t.Fatalf("%s: %d gossip frames queued, want %d", tt.name, len(queued), tt.pushed)
+		}
+	}
+	if got := len(room.History.Since(0, "", 10)); got != 1 {
+		t.Fatalf("logged %d messages, want only the first copy", got)
+	}
+
+	// Neither the sender nor the member it came from is pushed to again
+	for _, nodeID := range queuedGossip(room.Outbox) {
+		if nodeID == message.SenderID || nodeID == testIdentity(t, 121).ID {
+			t.Fatal("gossip pushed back to where it came from")
+		}
+	}
+}
+
+func TestGossipReachesEveryMember(t *testing.T) {
+	var nodes []*P2PChat
+	for seed := byte(125); seed < 130; seed++ {
+		nodes = append(nodes, testNode(t, seed))
+	}
+	rooms := testRoom(t, "gossip", nodes...)
+	sender := rooms[0]
+	sender.Mode = modeGossip
+
+	// The sender pushes to three of the four members, and each of them
+	// pushes on to the other three, so the fourth hears it second hand
+	if err := sender.SendMessage("spread the word"); err != nil {
+		t.Fatal(err)
+	}
+	for _, room := range rooms[1:] {
+		received := func() bool { last, ok := room.History.Last(); return ok && last.Content == "spread the word" }
+		if !eventually(5*time.Second, received) {
+			t.Fatalf("%s never received the gossip", room.LocalNode.Nickname)
+		}
+	}
+}
+
+func TestPullGossip(t *testing.T) {
+	rooms := testRoom(t, "gossip-pull", testNode(t, 130), testNode(t, 131))
+	holder, puller := rooms[0], rooms[1]
+	now := time.Now().UnixMilli()
+	shared := testSignedMessage(t, 130, "gossip-pull", "shared", now-2)
+	missed := testSignedMessage(t, 130, "gossip-pull", "missed", now-1)
+	old := testSignedMessage(t, 130, "gossip-pull", "old", now-2*gossipPullWindow.Milliseconds())
+	for _, message := range []Message{old, shared, missed} {
+		holder.displayMessage(message)
+	}
+	puller.displayMessage(shared)
+	puller.SeenMessages.MarkSeen(messageKey(shared))
+
+	// Only recent messages the puller lacks are sent back
+	pull, err := json.Marshal(gossipPull{Keys: []string{messageKey(shared)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response historyResponse
+	if err := holder.openRoomJSON(holder.handleGossipPull(pull, "test"), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Messages) != 1 || response.Messages[0].ID != "missed" {
+		t.Fatalf("pull answered with %v, want only the missed message", response.Messages)
+	}
+
+	// Rooms not using gossip don't pull
+	puller.pullGossip()
+	if puller.History.Contains(missed) {
+		t.Fatal("pulled in a room without gossip")
+	}
+	puller.Mode = modeGossip
+	puller.pullGossip()
+	if !puller.History.Contains(missed) {
+		t.Fatal("missed message not pulled")
+	}
+	if puller.History.Contains(old) {
+		t.Fatal("pulled a message older than the pull window")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Heartbeats and failure detection
+//
+// Every member sends a heartbeat to every other member of each room it is in
+// once per heartbeat interval. Any verified traffic from a member counts as a
+// beat. A member that misses HeartbeatSuspect beats in a row is marked
+// suspect, and one that misses HeartbeatDead beats is marked offline: it
+// stays in the room and SuperNodes hold messages for it, but it no longer
+// ranks in elections. A member still silent once held messages would have
+// expired (OfflineMaxAge later) is dropped from the room.
+//
+// Dropped members are not rekeyed out: they were not removed on purpose,
+// and their next heartbeat adds them back.
+
+// heartbeat tells a member that the sender is still alive
+type heartbeat struct {
+	Node      NodeInfo     `json:"node"`    // Signed node info, so a dropped member can be added back
+	SentAt    int64        `json:"sent_at"` // Unix milliseconds
+	Capacity  nodeCapacity `json:"capacity"`
+	Signature string       `json:"signature"`
+}
+
+// Bytes covered by a heartbeat signature
+func heartbeatSigningBytes(beat heartbeat) []byte {
+	beat.Signature = ""
+	data, _ := json.Marshal(beat)
+	return data
+}
+
+// nodeHealth is what the failure detector believes about a member
+type nodeHealth int
+
+// Dropped members are forgotten rather than tracked
+const (
+	nodeAlive nodeHealth = iota
+	nodeSuspect
+	nodeOffline
+)
+
+// FailureDetector counts missed heartbeats per member
+type FailureDetector struct {
+	mu        sync.Mutex
+	lastHeard map[string]time.Time
+	health    map[string]nodeHealth // Members that aren't alive
+}
+
+// NewFailureDetector creates an empty failure detector
+func NewFailureDetector() *FailureDetector {
+	return &FailureDetector{
+		lastHeard: make(map[string]time.Time),
+		health:    make(map[string]nodeHealth),
+	}
+}
+
+// Heard records traffic from a member. Returns the state it was in before.
+func (fd *FailureDetector) Heard(nodeID string) nodeHealth {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	fd.lastHeard[nodeID] = time.Now()
+	was := fd.health[nodeID]
+	delete(fd.health, nodeID)
+	return was
+}
+
+// Health returns the state of a member
+func (fd *FailureDetector) Health(nodeID string) nodeHealth {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.health[nodeID]
+}
+
+// Reset forgets when members were last heard, e.g. after the local node's
+// own services were down and it couldn't hear anyone
+func (fd *FailureDetector) Reset() {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.lastHeard = make(map[string]time.Time)
+	fd.health = make(map[string]nodeHealth)
+}
+
+// Check the current members against the silence limits. Returns the members
+// that just became suspect, those that just went offline, and those silent
+// long enough to drop. Members not heard from yet are tracked from the
+// first check.
+func (fd *FailureDetector) Check(members []string, suspectAfter, offlineAfter, dropAfter time.Duration) (suspect, offline, dead []string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	now := time.Now()
+	current := make(map[string]bool, len(members))
+	for _, nodeID := range members {
+		current[nodeID] = true
+
+		lastHeard, ok := fd.lastHeard[nodeID]
+		if !ok {
+			fd.lastHeard[nodeID] = now
+			continue
+		}
+
+		silent := now.Sub(lastHeard)
+		switch {
+		case silent >= dropAfter:
+			dead = append(dead, nodeID)
+			delete(fd.lastHeard, nodeID)
+			delete(fd.health, nodeID)
+		case silent >= offlineAfter && fd.health[nodeID] != nodeOffline:
+			fd.health[nodeID] = nodeOffline
+			offline = append(offline, nodeID)
+		case silent >= suspectAfter && fd.health[nodeID] == nodeAlive:
+			fd.health[nodeID] = nodeSuspect
+			suspect = append(suspect, nodeID)
+		}
+	}
+
+	// Forget members that left or were removed
+	for nodeID := range fd.lastHeard {
+		if !current[nodeID] {
+			delete(fd.lastHeard, nodeID)
+			delete(fd.health, nodeID)
+		}
+	}
+	return suspect, offline, dead
+}
+
+// Send heartbeats and check liveness in every room until done is closed
+func (p *P2PChat) runHeartbeats(done <-chan struct{}) {
+	ticker := time.NewTicker(AppConfig.HeartbeatInterval)
+	defer ticker.Stop()
+
+	// Silence from before the services started isn't the members' fault
+	for _, room := range p.roomList() {
+		room.Health.Reset()
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if !p.Running {
+			return
+		}
+
+		p.Conns.CloseIdle()
+		for _, room := range p.roomList() {
+			room.sendHeartbeats()
+			room.checkLiveness()
+			room.rebalanceSuperNode()
+			go room.pullGossip()
+		}
+	}
+}
+
+// Send a heartbeat to every other member of the room, measuring the round
+// trip time to each as the time it takes to acknowledge
+func (r *RoomSession) sendHeartbeats() {
+	capacity := r.localCapacity()
+	r.SuperNodeMgr.SetLocalCapacity(capacity)
+
+	beat := heartbeat{
+		Node:     r.localNodeInfo(),
+		SentAt:   time.Now().UnixMilli(),
+		Capacity: capacity,
+	}
+	beat.Signature = r.Identity.Sign(heartbeatSigningBytes(beat))
+
+	payload, err := r.sealRoomJSON(beat)
+	if err != nil {
+		return
+	}
+
+	r.NodeMutex.RLock()
+	defer r.NodeMutex.RUnlock()
+	for _, node := range r.Room.Nodes {
+		if node.ID == r.LocalNode.ID {
+			continue
+		}
+		// Missed heartbeats are what the receiver's failure detector looks
+		// for, so errors are not reported here
+		go func(node NodeInfo) {
+			start := time.Now()
+			if _, err := r.Conns.Request(node.Address, FrameHeartbeat, payload, heartbeatSuspectAfter()); err == nil {
+				r.SuperNodeMgr.RecordRTT(node.ID, time.Since(start))
+			}
+		}(node)
+	}
+}
+
+// Handle a heartbeat from a member, adding it back if it had been dropped
+// after going offline
+func (r *RoomSession) handleHeartbeat(data []byte, remoteAddr string) {
+	var beat heartbeat
+	if err := json.Unmarshal(data, &beat); err != nil {
+		fmt.Printf("Invalid heartbeat from %s: %v\n", remoteAddr, err)
+		return
+	}
+	node := beat.Node
+	if node.ID == r.LocalNode.ID || node.RoomID != r.Room.ID {
+		return
+	}
+	if !verifyNodeInfo(node) || !verifySignature(node.ID, node.PublicKey, beat.Signature, heartbeatSigningBytes(beat)) {
+		return
+	}
+
+	// A heartbeat older than the offline limit says nothing about the node now
+	if time.Since(time.UnixMilli(beat.SentAt)) > heartbeatOfflineAfter() {
+		return
+	}
+
+	if r.addRoomNode(node) {
+		r.SuperNodeMgr.UpdateCapacity(node.ID, beat.Capacity)
+		r.onNodeSeen(node.ID)
+
+		// A member first heard from directly may now rank in elections
+		if r.SuperNodeMgr.MarkVerified(node.ID) {
+			r.runElection()
+		}
+	}
+}
+
+// Mark silent members suspect or offline, and drop those that stayed
+// offline past OfflineMaxAge along with anything held for them
+func (r *RoomSession) checkLiveness() {
+	r.NodeMutex.RLock()
+	members := make([]string, 0, len(r.Room.Nodes))
+	for _, node := range r.Room.Nodes {
+		if node.ID != r.LocalNode.ID {
+			members = append(members, node.ID)
+		}
+	}
+	r.NodeMutex.RUnlock()
+
+	suspect, offline, dead := r.Health.Check(members, heartbeatSuspectAfter(), heartbeatOfflineAfter(), heartbeatDropAfter())
+	for _, nodeID := range suspect {
+		if node, ok := r.findRoomNodeByID(nodeID); ok {
+			fmt.Printf("[System] %sNode %s (%s) missed %d heartbeats and is suspected to be down\n",
+				r.roomTag(), node.Nickname, shortID(node.ID), AppConfig.HeartbeatSuspect)
+		}
+	}
+	if len(offline) > 0 {
+		for _, nodeID := range offline {
+			r.SuperNodeMgr.MarkOffline(nodeID)
+			if node, ok := r.findRoomNodeByID(nodeID); ok {
+				fmt.Printf("[System] %sNode %s (%s) stopped responding and is offline; messages for it are held\n",
+					r.roomTag(), node.Nickname, shortID(node.ID))
+			}
+		}
+		// An offline SuperNode is replaced
+		r.runElection()
+	}
+	for _, nodeID := range dead {
+		r.OfflineStore.Take(nodeID)
+		if node, ok := r.dropRoomNode(nodeID); ok {
+			fmt.Printf("[System] %sNode %s (%s) was offline for %s and was dropped from the room\n",
+				r.roomTag(), node.Nickname, shortID(node.ID), AppConfig.OfflineMaxAge)
+		}
+	}
+}
+
+// How long a member can stay silent before it's suspect
+func heartbeatSuspectAfter() time.Duration {
+	return time.Duration(AppConfig.HeartbeatSuspect) * AppConfig.HeartbeatInterval
+}
+
+// How long a member can stay silent before it's offline
+func heartbeatOfflineAfter() time.Duration {
+	return time.Duration(AppConfig.HeartbeatDead) * AppConfig.HeartbeatInterval
+}
+
+// How long a member can stay silent before it's dropped: once offline,
+// until messages held for it would have expired
+func heartbeatDropAfter() time.Duration {
+	return heartbeatOfflineAfter() + AppConfig.OfflineMaxAge
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// Pretend a member was last heard from d ago
+func silence(fd *FailureDetector, nodeID string, d time.Duration) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.lastHeard[nodeID] = time.Now().Add(-d)
+}
+
+func TestFailureDetectorCheck(t *testing.T) {
+	fd := NewFailureDetector()
+	members := []string{"a", "b"}
+	check := func() (suspect, offline, dead []string) {
+		return fd.Check(members, time.Second, 10*time.Second, time.Minute)
+	}
+
+	// Members are tracked from the first check
+	if suspect, offline, dead := check(); suspect != nil || offline != nil || dead != nil {
+		t.Fatalf("first check reported %v %v %v", suspect, offline, dead)
+	}
+
+	tests := []struct {
+		name                   string
+		silent                 time.Duration
+		suspect, offline, dead []string
+		health                 nodeHealth
+	}{
+		{"quiet", 500 * time.Millisecond, nil, nil, nil, nodeAlive},
+		{"suspect", 2 * time.Second, []string{"a"}, nil, nil, nodeSuspect},
+		{"still suspect", 3 * time.Second, nil, nil, nil, nodeSuspect},
+		{"offline", 10 * time.Second, nil, []string{"a"}, nil, nodeOffline},
+		{"still offline", 30 * time.Second, nil, nil, nil, nodeOffline},
+		{"dropped", time.Minute, nil, nil, []string{"a"}, nodeAlive},
+	}
+	for _, tt := range tests {
+		silence(fd, "a", tt.silent)
+		silence(fd, "b", 0)
+		suspect, offline, dead := check()
+		if !slices.Equal(suspect, tt.suspect) || !slices.Equal(offline, tt.offline) || !slices.Equal(dead, tt.dead) {
+			t.Fatalf("%s: got %v %v %v, want %v %v %v", tt.name, suspect, offline, dead, tt.suspect, tt.offline, tt.dead)
+		}
+		if got := fd.Health("a"); got != tt.health {
+			t.Fatalf("%s: health = %d, want %d", tt.name, got, tt.health)
+		}
+	}
+
+	// A member silent past the offline limit on its first check goes
+	// straight to offline, and hearing from it again clears that
+	silence(fd, "b", 20*time.Second)
+	if _, offline, _ := check(); !slices.Equal(offline, []string{"b"}) {
+		t.Fatalf("offline = %v, want b", offline)
+	}
+	if was := fd.Heard("b"); was != nodeOffline {
+		t.Fatalf("Heard returned %d, want offline", was)
+	}
+	if fd.Health("b") != nodeAlive {
+		t.Fatal("member still offline after it was heard")
+	}
+
+	// Members no longer in the room are forgotten
+	members = []string{"b"}
+	check()
+	fd.mu.Lock()
+	_, tracked := fd.lastHeard["a"]
+	fd.mu.Unlock()
+	if tracked {
+		t.Fatal("member that left is still tracked")
+	}
+}
+
+func TestOfflineMemberIsHeldForThenDropped(t *testing.T) {
+	rooms := testRoom(t, "offline", testNode(t, 101), testNode(t, 102))
+	room, member := rooms[0], rooms[1]
+	id := member.LocalNode.ID
+	verified := func() bool {
+		room.SuperNodeMgr.mu.RLock()
+		defer room.SuperNodeMgr.mu.RUnlock()
+		return room.SuperNodeMgr.verified[id]
+	}
+
+	silence(room.Health, id, heartbeatOfflineAfter())
+	room.checkLiveness()
+	if _, ok := room.findRoomNodeByID(id); !ok {
+		t.Fatal("offline member was dropped right away")
+	}
+	if !room.isNodeOffline(id) || verified() {
+		t.Fatal("member not marked offline")
+	}
+	room.OfflineStore.Hold(id, testSignedMessage(t, 103, "offline", "held", 1))
+
+	// Still offline just short of OFFLINE_MAX_AGE later
+	silence(room.Health, id, heartbeatDropAfter()-time.Second)
+	room.checkLiveness()
+	if _, ok := room.findRoomNodeByID(id); !ok || room.OfflineStore.Count(id) != 1 {
+		t.Fatal("offline member dropped before OFFLINE_MAX_AGE")
+	}
+
+	// A heartbeat brings it back and delivers what was held
+	member.sendHeartbeats()
+	if !eventually(5*time.Second, func() bool { return room.Health.Health(id) == nodeAlive && verified() }) {
+		t.Fatal("member still offline after a heartbeat")
+	}
+	if !eventually(5*time.Second, func() bool { last, ok := member.History.Last(); return ok && last.ID == "held" }) {
+		t.Fatal("held message never delivered")
+	}
+
+	// Silent past OFFLINE_MAX_AGE, it's dropped along with anything held
+	room.OfflineStore.Hold(id, testSignedMessage(t, 103, "offline", "expired", 2))
+	silence(room.Health, id, heartbeatDropAfter())
+	room.checkLiveness()
+	if _, ok := room.findRoomNodeByID(id); ok {
+		t.Fatal("member still listed after OFFLINE_MAX_AGE")
+	}
+	if room.OfflineStore.Count(id) != 0 {
+		t.Fatal("messages still held for a dropped member")
+	}
+}
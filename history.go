@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// History limits
+const (
+	historyLogLimit    = 10000 // Messages kept in memory per room
+	historyMaxResponse = 500   // Most messages sent in one history reply
+)
+
+// MessageLog is the ordered in-memory log of every message displayed in the room
+type MessageLog struct {
+	mu       sync.RWMutex
+	messages []Message // Ordered by SentAt, then ID
+	keys     map[string]struct{}
+}
+
+// NewMessageLog creates an empty message log
+func NewMessageLog() *MessageLog {
+	return &MessageLog{keys: make(map[string]struct{})}
+}
+
+// Order messages by send time, breaking ties by ID
+func messageBefore(a, b Message) bool {
+	if a.SentAt != b.SentAt {
+		return a.SentAt < b.SentAt
+	}
+	return messageKey(a) < messageKey(b)
+}
+
+// Add inserts a message in order. Returns false if it was already logged.
+func (l *MessageLog) Add(message Message) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := messageKey(message)
+	if _, ok := l.keys[key]; ok {
+		return false
+	}
+	l.keys[key] = struct{}{}
+
+	// Messages almost always arrive in order, so search from the end
+	i := len(l.messages)
+	for i > 0 && messageBefore(message, l.messages[i-1]) {
+		i--
+	}
+	l.messages = append(l.messages, Message{})
+	copy(l.messages[i+1:], l.messages[i:])
+	l.messages[i] = message
+
+	// Forget the oldest messages past the limit
+	if len(l.messages) > historyLogLimit {
+		for _, old := range l.messages[:len(l.messages)-historyLogLimit] {
+			delete(l.keys, messageKey(old))
+		}
+		l.messages = append([]Message(nil), l.messages[len(l.messages)-historyLogLimit:]...)
+	}
+	return true
+}
+
+// Contains reports whether a message is already logged
+func (l *MessageLog) Contains(message Message) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.keys[messageKey(message)]
+	return ok
+}
+
+// Since returns up to limit of the newest messages after the message with
+// afterKey or, if that isn't logged, sent after the given time (unix milliseconds)
+func (l *MessageLog) Since(sentAfter int64, afterKey string, limit int) []Message {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	// The key pins an exact position, so messages sent in the same
+	// millisecond after it are kept. The time only applies without it.
+	start := -1
+	if afterKey != "" {
+		for i := len(l.messages) - 1; i >= 0; i-- {
+			if messageKey(l.messages[i]) == afterKey {
+				start = i + 1
+				break
+			}
+		}
+	}
+	if start < 0 {
+		start = 0
+		for start < len(l.messages) && l.messages[start].SentAt <= sentAfter {
+			start++
+		}
+	}
+
+	if len(l.messages)-start > limit {
+		start = len(l.messages) - limit
+	}
+	return append([]Message(nil), l.messages[start:]...)
+}
+
+// Between returns the logged messages sent in [from, to], oldest first.
+// A zero from or to leaves that end of the range open.
+func (l *MessageLog) Between(from, to time.Time) []Message {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var result []Message
+	for _, message := range l.messages {
+		sentAt := time.UnixMilli(message.SentAt)
+		if (!from.IsZero() && sentAt.Before(from)) || (!to.IsZero() && sentAt.After(to)) {
+			continue
+		}
+		result = append(result, message)
+	}
+	return result
+}
+
+// Last returns the newest logged message, if any
+func (l *MessageLog) Last() (Message, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.messages) == 0 {
+		return Message{}, false
+	}
+	return l.messages[len(l.messages)-1], true
+}
+
+// historyRequest asks a member for messages after a point in the room's history
+type historyRequest struct {
+	SentAfter int64  `json:"sent_after,omitempty"` // Unix milliseconds
+	AfterKey  string `json:"after_key,omitempty"`  // Origin-qualified message ID
+	Limit     int    `json:"limit"`
+}
+
+// historyResponse carries the requested messages, oldest first
+type historyResponse struct {
+	Messages []Message `json:"messages"`
+}
+
+// Ask a member for the messages we're missing and merge them into our log
+func (r *RoomSession) SyncHistory(node NodeInfo) error {
+	request := historyRequest{Limit: AppConfig.HistorySyncLimit}
+	if last, ok := r.History.Last(); ok {
+		request.SentAfter = last.SentAt
+		request.AfterKey = messageKey(last)
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	sealed, err := r.Keyring.Seal(r.Room.ID, data)
+	if err != nil {
+		return err
+	}
+
+	frame, err := r.Conns.Request(node.Address, FrameHistoryRequest, sealed, connRequestTimeout)
+	if err != nil {
+		return err
+	}
+	if frame.Type != FrameHistoryResponse {
+		return fmt.Errorf("unexpected reply to history request")
+	}
+
+	responseData, err := r.Keyring.Open(r.Room.ID, frame.Payload)
+	if err != nil {
+		return err
+	}
+	var response historyResponse
+	if err := json.Unmarshal(responseData, &response); err != nil {
+		return fmt.Errorf("invalid history response: %v", err)
+	}
+
+	// Keep only messages for this room we haven't seen yet, in order
+	var missing []Message
+	for _, message := range response.Messages {
+		if message.RoomID != r.Room.ID || message.ID == "" || r.History.Contains(message) {
+			continue
+		}
+		missing = append(missing, message)
+	}
+	sort.Slice(missing, func(i, j int) bool { return messageBefore(missing[i], missing[j]) })
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	fmt.Printf("--- %d earlier message(s) from %s ---\n", len(missing), node.Nickname)
+	for _, message := range missing {
+		r.SeenMessages.MarkSeen(messageKey(message))
+		r.displayMessage(message)
+	}
+	fmt.Println("--- end of history ---")
+	return nil
+}
+
+// Answer a history request on the connection it arrived on
+func (r *RoomSession) handleHistoryRequest(data []byte, remoteAddr string) []byte {
+	var request historyRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil
+	}
+	if request.Limit <= 0 || request.Limit > historyMaxResponse {
+		request.Limit = historyMaxResponse
+	}
+
+	return r.sealHistoryResponse(r.History.Since(request.SentAfter, request.AfterKey, request.Limit))
+}
+
+// Seal a historyResponse carrying messages, oldest first. The oldest half,
+// rounded up, is dropped until the sealed reply fits in a frame. Returns nil
+// on failure.
+func (r *RoomSession) sealHistoryResponse(messages []Message) []byte {
+	for {
+		sealed, err := r.sealRoomJSON(historyResponse{Messages: messages})
+		if err != nil {
+			return nil
+		}
+		if len(sealed) <= MaxFrameSize || len(messages) == 0 {
+			return sealed
+		}
+		messages = messages[(len(messages)+1)/2:]
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Message for roomID signed by the test identity for seed
+func testSignedMessage(t *testing.T, seed byte, roomID string, id string, sentAt int64) Message {
+	t.Helper()
+	message := Message{ID: id, RoomID: roomID, Sender: fmt.Sprint("node", seed), SentAt: sentAt, Content: "message " + id}
+	testIdentity(t, seed).SignMessage(&message)
+	return message
+}
+
+func TestMessageLogSince(t *testing.T) {
+	log := NewMessageLog()
+	// Three messages share a millisecond; keys order them a < b < c
+	for _, message := range []Message{
+		{ID: "early", SenderID: "x", SentAt: 1},
+		{ID: "a", SenderID: "x", SentAt: 5},
+		{ID: "b", SenderID: "x", SentAt: 5},
+		{ID: "c", SenderID: "x", SentAt: 5},
+		{ID: "late", SenderID: "x", SentAt: 9},
+	} {
+		log.Add(message)
+	}
+
+	tests := []struct {
+		name      string
+		sentAfter int64
+		afterKey  string
+		limit     int
+		want      string
+	}{
+		{"everything", 0, "", 10, "[early a b c late]"},
+		{"after a time", 1, "", 10, "[a b c late]"},
+		{"after a key in a shared millisecond", 5, messageKey(Message{ID: "a", SenderID: "x"}), 10, "[b c late]"},
+		{"after the last key", 9, messageKey(Message{ID: "late", SenderID: "x"}), 10, "[]"},
+		{"unknown key falls back to the time", 5, "missing", 10, "[late]"},
+		{"limit keeps the newest", 0, "", 2, "[c late]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ids []string
+			for _, message := range log.Since(tt.sentAfter, tt.afterKey, tt.limit) {
+				ids = append(ids, message.ID)
+			}
+			if got := fmt.Sprint(ids); got != tt.want {
+				t.Fatalf("Since = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisplayMessageLogsOnlyVerified(t *testing.T) {
+	rooms := testRoom(t, "display", testNode(t, 60))
+	room := rooms[0]
+
+	// Claims our ID but is signed by another key
+	forged := testSignedMessage(t, 61, "display", "forged", 1)
+	forged.SenderID = room.LocalNode.ID
+	unsigned := Message{ID: "unsigned", RoomID: "display", SenderID: "someone", SentAt: 2}
+
+	tests := []struct {
+		name    string
+		message Message
+		logged  bool
+	}{
+		{"our own message", testSignedMessage(t, 60, "display", "own", 3), true},
+		{"another member's message", testSignedMessage(t, 61, "display", "other", 4), true},
+		{"our ID with another key", forged, false},
+		{"unsigned", unsigned, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			room.displayMessage(tt.message)
+			if got := room.History.Contains(tt.message); got != tt.logged {
+				t.Fatalf("logged = %v, want %v", got, tt.logged)
+			}
+		})
+	}
+}
+
+func TestSyncHistory(t *testing.T) {
+	a, b := testNode(t, 62), testNode(t, 63)
+	if err := a.CreateRoom("sync", "correct-horse-battery"); err != nil {
+		t.Fatal(err)
+	}
+	roomA := a.findRoom("sync")
+	roomA.displayMessage(testSignedMessage(t, 62, "sync", "1", 10))
+	roomA.displayMessage(testSignedMessage(t, 62, "sync", "2", 10))
+	// A member serving a message it never verified must not get it logged
+	roomA.History.Add(Message{ID: "forged", RoomID: "sync", SenderID: a.LocalNode.ID, SentAt: 11})
+
+	// Joining syncs history from the member
+	if err := b.JoinRoom("sync", "correct-horse-battery", a.LocalNode.Address); err != nil {
+		t.Fatal(err)
+	}
+	roomB := b.findRoom("sync")
+	if !eventually(5*time.Second, func() bool { return memberCount(roomB) == 2 }) {
+		t.Fatal("joiner never learned about the member")
+	}
+	for _, id := range []string{"1", "2"} {
+		if !roomB.History.Contains(Message{ID: id, SenderID: a.LocalNode.ID}) {
+			t.Fatalf("message %s was not synced", id)
+		}
+	}
+	if roomB.History.Contains(Message{ID: "forged", SenderID: a.LocalNode.ID}) {
+		t.Fatal("unverified message was logged")
+	}
+
+	// Messages sent in the same millisecond as our newest one still arrive
+	last, _ := roomB.History.Last()
+	roomA.displayMessage(testSignedMessage(t, 62, "sync", "3", last.SentAt))
+	roomA.displayMessage(testSignedMessage(t, 62, "sync", "4", last.SentAt))
+	if err := roomB.SyncHistory(a.LocalNode); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"3", "4"} {
+		if !roomB.History.Contains(Message{ID: id, SenderID: a.LocalNode.ID}) {
+			t.Fatalf("message %s sent alongside the last synced one was skipped", id)
+		}
+	}
+}
+
+func TestSealHistoryResponseFitsFrame(t *testing.T) {
+	room := testRoom(t, "history-size", testNode(t, 132))[0]
+	var messages []Message
+	for i := range 5 {
+		messages = append(messages, Message{ID: fmt.Sprint(i), Content: strings.Repeat("x", MaxFrameSize/4)})
+	}
+
+	var response historyResponse
+	if err := room.openRoomJSON(room.sealHistoryResponse(messages), &response); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, message := range response.Messages {
+		ids = append(ids, message.ID)
+	}
+	if got := fmt.Sprint(ids); got != "[3 4]" {
+		t.Fatalf("reply kept %s, want the newest that fit", got)
+	}
+
+	// A single message too large for a frame leaves an empty reply
+	huge := []Message{{ID: "huge", Content: strings.Repeat("x", MaxFrameSize)}}
+	if err := room.openRoomJSON(room.sealHistoryResponse(huge), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Messages) != 0 {
+		t.Fatal("oversized message sent anyway")
+	}
+}
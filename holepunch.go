@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Hole punching
+//
+// Members behind a NAT can't accept TCP connections from outside it. When
+// the pool can't dial a member directly, it punches a UDP path instead:
+//
+//  1. Every node opens a UDP socket, the punch socket, on PUNCH_PORT and
+//     asks a STUN server for the public address the socket maps to. The
+//     socket's local and public addresses are the node's candidates, which
+//     its signed NodeInfo advertises.
+//  2. The node that wants to connect picks a session number and sends a
+//     rendezvousOffer to a member it already has a connection to,
+//     SuperNodes first. The member passes the offer on over its own
+//     connection to the target.
+//  3. Both ends send punch packets for the session to every candidate of the
+//     other for up to punchTimeout. Each end's packets open its own NAT for
+//     the other's, and the first packet for the session that gets through
+//     fixes the path.
+//  4. The ends run a udpStream over the path, which the pool authenticates
+//     with the usual connHello exchange.
+//
+// Session numbers only travel sealed under the room key. NATs that map
+// every destination to a different port usually defeat punching.
+
+// Hole punching parameters
+const (
+	punchTimeout       = 5 * time.Second
+	punchInterval      = 100 * time.Millisecond
+	rendezvousAttempts = 3 // Members asked to introduce us before giving up
+)
+
+// Packet kinds on the punch socket. STUN messages, which share the socket,
+// start with two zero bits.
+const (
+	udpPunch    byte = 0xC1 // Hole punching probe
+	udpPunchAck byte = 0xC2 // Answer to a probe once the path is open
+	udpData     byte = 0xC3 // Stream segment, or a bare acknowledgement if empty
+	udpClose    byte = 0xC4 // Stream close, numbered like the segment after the last
+)
+
+// rendezvousOffer asks the target to punch a hole to the sender, or to meet
+// it at a relay (see tunnel.go)
+type rendezvousOffer struct {
+	Session   string   `json:"session"`              // Punch session number or tunnel ID, hex
+	From      NodeInfo `json:"from"`                 // Signed node info of the sender, with its candidates
+	TargetID  string   `json:"target_id"`            // Member to punch to
+	Relay     string   `json:"relay,omitempty"`      // Relay to meet at instead of punching
+	RelayBind []byte   `json:"relay_bind,omitempty"` // Bind frame payload to send the relay
+}
+
+// punchAttempt waits for the first packet of a session from the peer
+type punchAttempt struct {
+	done chan *udpStream
+}
+
+// PunchSocket is the UDP socket holes are punched through. It carries STUN
+// requests, punch probes and every punched stream.
+type PunchSocket struct {
+	conn *net.UDPConn
+
+	mu         sync.Mutex
+	candidates []string
+	attempts   map[uint64]*punchAttempt
+	streams    map[uint64]*udpStream
+	stun       map[[12]byte]chan []byte // STUN transaction ID -> waiting request
+}
+
+// ListenPunchSocket opens the punch socket on port, 0 to pick any
+func ListenPunchSocket(port int) (*PunchSocket, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	ps := &PunchSocket{
+		conn:     conn,
+		attempts: make(map[uint64]*punchAttempt),
+		streams:  make(map[uint64]*udpStream),
+		stun:     make(map[[12]byte]chan []byte),
+	}
+	ps.candidates = []string{fmt.Sprintf("%s:%d", getLocalIP(), conn.LocalAddr().(*net.UDPAddr).Port)}
+	go ps.readLoop()
+	return ps, nil
+}
+
+// Candidates returns the addresses peers may reach the socket at
+func (ps *PunchSocket) Candidates() []string {
+	if ps == nil {
+		return nil
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return append([]string(nil), ps.candidates...)
+}
+
+// Add an address peers may reach the socket at, e.g. its STUN mapping
+func (ps *PunchSocket) addCandidate(addr string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, candidate := range ps.candidates {
+		if candidate == addr {
+			return
+		}
+	}
+	ps.candidates = append(ps.candidates, addr)
+}
+
+// Send a packet, ignoring errors: every packet may be lost anyway
+func (ps *PunchSocket) send(packet []byte, addr *net.UDPAddr) {
+	ps.conn.WriteToUDP(packet, addr)
+}
+
+// Read packets and hand them to STUN requests, punch attempts and streams
+// until the socket is closed
+func (ps *PunchSocket) readLoop() {
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := ps.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		packet := append([]byte(nil), buffer[:n]...)
+		if isSTUNPacket(packet) {
+			ps.deliverSTUN(packet)
+			continue
+		}
+		if n < udpHeaderSize {
+			continue
+		}
+		ps.handlePacket(packet, addr)
+	}
+}
+
+// Handle a punch or stream packet
+func (ps *PunchSocket) handlePacket(packet []byte, addr *net.UDPAddr) {
+	kind := packet[0]
+	session := uint64(bytesToUint32(packet[1:5]))<<32 | uint64(bytesToUint32(packet[5:9]))
+
+	ps.mu.Lock()
+	stream := ps.streams[session]
+	if attempt, ok := ps.attempts[session]; ok && stream == nil {
+		// The first packet of the session from the peer: the hole is open
+		delete(ps.attempts, session)
+		stream = newUDPStream(ps, session, addr)
+		ps.streams[session] = stream
+		attempt.done <- stream
+	}
+	ps.mu.Unlock()
+	if stream == nil {
+		return
+	}
+
+	switch kind {
+	case udpPunch:
+		// The peer is still probing and needs a packet back
+		ps.send(udpStreamPacket(udpPunchAck, session, 0, 0, nil), addr)
+	case udpData, udpClose:
+		if addr.String() != stream.remote.String() {
+			return
+		}
+		stream.receive(kind, bytesToUint32(packet[9:13]), bytesToUint32(packet[13:17]), packet[udpHeaderSize:])
+	}
+}
+
+// Forget a closed stream
+func (ps *PunchSocket) removeStream(session uint64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.streams, session)
+}
+
+// Start probing every candidate for session
+func (ps *PunchSocket) punch(session uint64, candidates []string) *punchAttempt {
+	attempt := &punchAttempt{done: make(chan *udpStream, 1)}
+	ps.mu.Lock()
+	ps.attempts[session] = attempt
+	ps.mu.Unlock()
+
+	var targets []*net.UDPAddr
+	for _, candidate := range candidates {
+		if addr, err := net.ResolveUDPAddr("udp", candidate); err == nil {
+			targets = append(targets, addr)
+		}
+	}
+
+	go func() {
+		probe := udpStreamPacket(udpPunch, session, 0, 0, nil)
+		for deadline := time.Now().Add(punchTimeout); time.Now().Before(deadline); {
+			ps.mu.Lock()
+			_, pending := ps.attempts[session]
+			ps.mu.Unlock()
+			if !pending {
+				return
+			}
+			for _, addr := range targets {
+				ps.send(probe, addr)
+			}
+			time.Sleep(punchInterval)
+		}
+	}()
+	return attempt
+}
+
+// Wait up to punchTimeout for a punch attempt to open a stream
+func (ps *PunchSocket) wait(session uint64, attempt *punchAttempt) (*udpStream, error) {
+	timer := time.NewTimer(punchTimeout)
+	defer timer.Stop()
+	select {
+	case stream := <-attempt.done:
+		return stream, nil
+	case <-timer.C:
+	}
+
+	// The hole may have opened just as we gave up
+	if stream := ps.cancel(session, attempt); stream != nil {
+		return stream, nil
+	}
+	return nil, fmt.Errorf("no packets got through within %s", punchTimeout)
+}
+
+// Stop a punch attempt. Returns the stream if the hole opened after all.
+func (ps *PunchSocket) cancel(session uint64, attempt *punchAttempt) *udpStream {
+	ps.mu.Lock()
+	delete(ps.attempts, session)
+	ps.mu.Unlock()
+
+	select {
+	case stream := <-attempt.done:
+		return stream
+	default:
+		return nil
+	}
+}
+
+// Pick a random punch session number
+func newPunchSession() uint64 {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return uint64(bytesToUint32(b[0:4]))<<32 | uint64(bytesToUint32(b[4:8]))
+}
+
+// Punch a hole to target and open a UDP stream over it
+func (r *RoomSession) dialPunched(target NodeInfo) (net.Conn, error) {
+	if r.Punch == nil {
+		return nil, fmt.Errorf("hole punching is unavailable")
+	}
+	if len(target.Candidates) == 0 {
+		return nil, fmt.Errorf("node %s advertises no hole punching candidates", shortID(target.ID))
+	}
+
+	session := newPunchSession()
+	offer := rendezvousOffer{
+		Session:  strconv.FormatUint(session, 16),
+		From:     r.localNodeInfo(),
+		TargetID: target.ID,
+	}
+
+	// Start probing first, so the target's first probes find us waiting
+	attempt := r.Punch.punch(session, target.Candidates)
+	if err := r.introduce(offer); err != nil {
+		if stream := r.Punch.cancel(session, attempt); stream != nil {
+			stream.Close()
+		}
+		return nil, err
+	}
+
+	stream, err := r.Punch.wait(session, attempt)
+	if err != nil {
+		return nil, fmt.Errorf("hole punching to node %s failed: %v", shortID(target.ID), err)
+	}
+	fmt.Printf("[System] %sPunched a UDP path to %s (%s)\n", r.roomTag(), target.Nickname, stream.remote)
+	return stream, nil
+}
+
+// Have a member pass a rendezvous offer on to its target
+func (r *RoomSession) introduce(offer rendezvousOffer) error {
+	payload, err := r.sealRoomJSON(offer)
+	if err != nil {
+		return err
+	}
+	for _, via := range r.rendezvousMembers(offer.TargetID) {
+		if r.Conns.SendWithAck(via.Address, FrameRendezvous, payload, "rendezvous:"+offer.Session) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no member could introduce us to node %s", shortID(offer.TargetID))
+}
+
+// Members that can introduce us to targetID: those we already have a
+// connection to, SuperNodes first. Opening a new connection could need a
+// rendezvous of its own.
+func (r *RoomSession) rendezvousMembers(targetID string) []NodeInfo {
+	superNodes := make(map[string]bool)
+	for _, sn := range r.SuperNodeMgr.GetSuperNodes() {
+		superNodes[sn.ID] = true
+	}
+
+	r.NodeMutex.RLock()
+	var preferred, others []NodeInfo
+	for _, node := range r.Room.Nodes {
+		if node.ID == r.LocalNode.ID || node.ID == targetID || !r.Conns.Connected(node.Address) {
+			continue
+		}
+		if superNodes[node.ID] {
+			preferred = append(preferred, node)
+		} else {
+			others = append(others, node)
+		}
+	}
+	r.NodeMutex.RUnlock()
+
+	members := append(preferred, others...)
+	if len(members) > rendezvousAttempts {
+		members = members[:rendezvousAttempts]
+	}
+	return members
+}
+
+// Handle a rendezvous offer: pass it on to its target, or punch a hole to
+// the sender if we are the target. Returns the key to acknowledge, or "" if
+// the offer can't be passed on.
+func (r *RoomSession) handleRendezvous(data []byte, remoteAddr string) string {
+	var offer rendezvousOffer
+	if err := json.Unmarshal(data, &offer); err != nil {
+		fmt.Printf("Invalid rendezvous offer from %s: %v\n", remoteAddr, err)
+		return ""
+	}
+	if offer.Session == "" || !verifyNodeInfo(offer.From) || offer.From.RoomID != r.Room.ID {
+		fmt.Printf("Invalid rendezvous offer from %s\n", remoteAddr)
+		return ""
+	}
+	ack := "rendezvous:" + offer.Session
+
+	if offer.TargetID != r.LocalNode.ID {
+		// Only pass it on over a connection we already have, for the same
+		// reason rendezvousMembers only picks those
+		target, ok := r.findRoomNodeByID(offer.TargetID)
+		if !ok || !r.Conns.Connected(target.Address) {
+			return ""
+		}
+		payload, err := r.Keyring.Seal(r.Room.ID, data)
+		if err != nil {
+			return ""
+		}
+		if err := r.Conns.SendWithAck(target.Address, FrameRendezvous, payload, ack); err != nil {
+			return ""
+		}
+		return ack
+	}
+
+	if _, ok := r.findRoomNodeByID(offer.From.ID); !ok {
+		return ""
+	}
+	if offer.Relay != "" {
+		go r.joinTunnel(offer)
+		return ack
+	}
+	session, err := strconv.ParseUint(offer.Session, 16, 64)
+	if err != nil || r.Punch == nil || len(offer.From.Candidates) == 0 {
+		return ""
+	}
+	attempt := r.Punch.punch(session, offer.From.Candidates)
+	go func() {
+		stream, err := r.Punch.wait(session, attempt)
+		if err != nil {
+			fmt.Printf("Hole punching to %s failed: %v\n", offer.From.Nickname, err)
+			return
+		}
+		// The sender opens a pooled connection over the stream
+		r.handleConnection(stream)
+	}()
+	return ack
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Identity is the long-term Ed25519 keypair of the local node, plus an
+// X25519 key derived from the same seed that peers use to encrypt to us
+type Identity struct {
+	ID          string
+	PublicKey   ed25519.PublicKey
+	PrivateKey  ed25519.PrivateKey
+	KeyExchange *ecdh.PrivateKey
+}
+
+// Derive a node ID from its public key (first 16 bytes of SHA-256, hex encoded)
+func nodeIDFromPublicKey(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:16])
+}
+
+// Build an identity from an Ed25519 seed
+func newIdentityFromSeed(seed []byte) (*Identity, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("identity seed length incorrect, should be %d bytes", ed25519.SeedSize)
+	}
+
+	priv := ed25519.NewKeyFromSeed(seed)
+	pub := priv.Public().(ed25519.PublicKey)
+
+	kexSeed, err := hkdf.Key(sha256.New, seed, nil, "gochatp2p x25519", 32)
+	if err != nil {
+		return nil, err
+	}
+	kex, err := ecdh.X25519().NewPrivateKey(kexSeed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		ID:          nodeIDFromPublicKey(pub),
+		PublicKey:   pub,
+		PrivateKey:  priv,
+		KeyExchange: kex,
+	}, nil
+}
+
+// Load the identity from path, generating and saving a new one on first start
+func loadOrCreateIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity file %s: %v", path, err)
+		}
+		return newIdentityFromSeed(seed)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// First start: generate a new keypair
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+
+	identity, err := newIdentityFromSeed(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(seed) + "\n"
+	if err := os.WriteFile(path, []byte(encoded), 0600); err != nil {
+		return nil, fmt.Errorf("failed to save identity to %s: %v", path, err)
+	}
+
+	fmt.Printf("Generated new node identity %s (saved to %s)\n", identity.ID, path)
+	return identity, nil
+}
+
+// Sign arbitrary data with the node's private key
+func (id *Identity) Sign(data []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(id.PrivateKey, data))
+}
+
+// EncodedPublicKey returns the base64 public key as advertised to peers
+func (id *Identity) EncodedPublicKey() string {
+	return base64.StdEncoding.EncodeToString(id.PublicKey)
+}
+
+// EncodedKeyExchangeKey returns the base64 X25519 public key as advertised to peers
+func (id *Identity) EncodedKeyExchangeKey() string {
+	return base64.StdEncoding.EncodeToString(id.KeyExchange.PublicKey().Bytes())
+}
+
+// Verify that signature was made over data by the owner of nodeID.
+// The public key must hash to nodeID, so IDs can't be claimed by other keys.
+func verifySignature(nodeID, publicKey, signature string, data []byte) bool {
+	if publicKey == "" || signature == "" {
+		return false
+	}
+
+	pub, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	if nodeIDFromPublicKey(pub) != nodeID {
+		return false
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	return ed25519.Verify(pub, data, sig)
+}
+
+// Bytes covered by a message signature (the message without its signature)
+func messageSigningBytes(message Message) []byte {
+	message.Signature = ""
+	data, _ := json.Marshal(message)
+	return data
+}
+
+// Sign a message as the local node
+func (id *Identity) SignMessage(message *Message) {
+	message.SenderID = id.ID
+	message.PublicKey = id.EncodedPublicKey()
+	message.Signature = id.Sign(messageSigningBytes(*message))
+}
+
+// Verify a message signature
+func verifyMessage(message Message) bool {
+	return verifySignature(message.SenderID, message.PublicKey, message.Signature, messageSigningBytes(message))
+}
+
+// Bytes covered by a node info signature
+func nodeInfoSigningBytes(nodeInfo NodeInfo) []byte {
+	nodeInfo.Signature = ""
+	data, _ := json.Marshal(nodeInfo)
+	return data
+}
+
+// Sign node info as the local node
+func (id *Identity) SignNodeInfo(nodeInfo *NodeInfo) {
+	nodeInfo.ID = id.ID
+	nodeInfo.PublicKey = id.EncodedPublicKey()
+	nodeInfo.KexKey = id.EncodedKeyExchangeKey()
+	nodeInfo.Signature = id.Sign(nodeInfoSigningBytes(*nodeInfo))
+}
+
+// Verify a node info signature
+func verifyNodeInfo(nodeInfo NodeInfo) bool {
+	return verifySignature(nodeInfo.ID, nodeInfo.PublicKey, nodeInfo.Signature, nodeInfoSigningBytes(nodeInfo))
+}
+
+// Short form of a node ID for display
+func shortID(nodeID string) string {
+	if len(nodeID) > 8 {
+		return nodeID[:8]
+	}
+	return nodeID
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// Join handshake
+//
+// Joining a room is a four-message exchange over TCP, modelled on the
+// Noise NNpsk0 pattern:
+//
+//	joiner -> member  JoinHello      {room ID, joiner ephemeral X25519 key}
+//	member -> joiner  JoinChallenge  {member ephemeral X25519 key}
+//	joiner -> member  JoinConfirm    seal(joinerKey, joiner NodeInfo)
+//	member -> joiner  JoinAccept     seal(memberKey, room key + node list)
+//
+// Both session keys are derived with HKDF from the ephemeral ECDH secret and
+// a PBKDF2-stretched room passphrase, so only someone who knows the passphrase
+// can produce JoinConfirm or read JoinAccept. The room key itself is only ever
+// sent inside JoinAccept and is never shown to the user.
+//
+// This is not a PAKE: anyone who answers a join, such as a fake member
+// answering the discovery broadcast, sees a JoinConfirm and can guess the
+// passphrase offline against it. The PBKDF2 stretching slows each guess, so
+// passphrases must be long; generated ones have about 56 bits of entropy.
+
+// Join handshake parameters
+const (
+	joinPSKIterations  = 200000
+	joinHandshakeInfo  = "gochatp2p join v2"
+	joinTimeout        = 15 * time.Second
+	minPassphraseLen   = 16
+	passphraseWordsLen = 8
+)
+
+// Words used to generate human-friendly room passphrases
+var passphraseWords = []string{
+	"amber", "anchor", "apple", "arrow", "aspen", "atlas", "autumn", "badge",
+	"bamboo", "banner", "basin", "beacon", "berry", "birch", "blaze", "bloom",
+	"bolt", "breeze", "brick", "brook", "cabin", "cactus", "canal", "candle",
+	"canyon", "cedar", "chalk", "cherry", "cider", "cliff", "cloud", "clover",
+	"cobalt", "comet", "coral", "cotton", "crane", "creek", "crystal", "dawn",
+	"delta", "desert", "dune", "eagle", "echo", "ember", "falcon", "fern",
+	"fjord", "flint", "forest", "fossil", "galaxy", "garnet", "geyser", "glacier",
+	"granite", "grove", "harbor", "hazel", "heron", "hollow", "honey", "island",
+	"ivory", "jade", "jasmine", "juniper", "kettle", "lagoon", "lantern", "lemon",
+	"lilac", "linen", "lotus", "maple", "marble", "meadow", "mesa", "meteor",
+	"mint", "mist", "moss", "nectar", "nova", "oasis", "olive", "onyx",
+	"orbit", "orchid", "otter", "pebble", "pepper", "pine", "planet", "plume",
+	"prairie", "quartz", "quill", "raven", "reef", "ridge", "river", "robin",
+	"saffron", "sage", "sierra", "silver", "slate", "spruce", "summit", "swift",
+	"thistle", "thunder", "tide", "timber", "topaz", "tulip", "tundra", "valley",
+	"velvet", "violet", "walnut", "willow", "winter", "yarrow", "zenith", "zephyr",
+}
+
+// Join handshake messages
+type joinHello struct {
+	RoomID    string `json:"room_id"`
+	Ephemeral string `json:"ephemeral"`
+}
+
+type joinChallenge struct {
+	Ephemeral string `json:"ephemeral"`
+}
+
+type joinAccept struct {
+	RoomKey   string     `json:"room_key"`
+	Epoch     uint32     `json:"epoch"`
+	CreatorID string     `json:"creator_id"`
+	Nodes     []NodeInfo `json:"nodes"`
+	Removed   []string   `json:"removed,omitempty"` // Nodes removed from the room
+}
+
+type joinReject struct {
+	Reason string `json:"reason"`
+}
+
+// Generate a random human-friendly passphrase such as
+// "cedar-otter-mint-reef-delta-comet-fern-tide"
+func generatePassphrase() (string, error) {
+	words := make([]string, passphraseWordsLen)
+	for i := range words {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(passphraseWords))))
+		if err != nil {
+			return "", err
+		}
+		words[i] = passphraseWords[n.Int64()]
+	}
+	return strings.Join(words, "-"), nil
+}
+
+// Stretch a room passphrase into a pre-shared key
+func derivePassphraseKey(roomID, passphrase string) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, []byte("gochatp2p-room:"+roomID), joinPSKIterations, 32)
+}
+
+// Derive the directional handshake keys for one join session
+func deriveJoinKeys(psk, shared, joinerEphemeral, memberEphemeral []byte, roomID string) (joinerKey, memberKey []byte, err error) {
+	transcript := sha256.New()
+	transcript.Write([]byte(roomID))
+	transcript.Write(joinerEphemeral)
+	transcript.Write(memberEphemeral)
+
+	secret := make([]byte, 0, len(shared)+len(psk))
+	secret = append(secret, shared...)
+	secret = append(secret, psk...)
+
+	okm, err := hkdf.Key(sha256.New, secret, transcript.Sum(nil), joinHandshakeInfo, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return okm[:32], okm[32:], nil
+}
+
+// Decode a base64 X25519 public key
+func decodeX25519PublicKey(encoded string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// Read a frame and make sure it has the expected type, surfacing rejections
+func readHandshakeFrame(reader *bufio.Reader, expected byte) ([]byte, error) {
+	frame, err := readFrame(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if frame.Type == FrameJoinReject {
+		var reject joinReject
+		json.Unmarshal(frame.Payload, &reject)
+		return nil, fmt.Errorf("join rejected: %s", reject.Reason)
+	}
+	if frame.Type != expected {
+		return nil, fmt.Errorf("unexpected frame type 0x%02x during join handshake", frame.Type)
+	}
+
+	return frame.Payload, nil
+}
+
+// Run the joiner side of the handshake against a room member
+func (p *P2PChat) performJoinHandshake(memberAddr, roomID string, psk []byte, localNode NodeInfo) (*joinAccept, error) {
+	conn, err := net.DialTimeout("tcp", memberAddr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(joinTimeout))
+	reader := bufio.NewReader(conn)
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// JoinHello
+	hello, _ := json.Marshal(joinHello{
+		RoomID:    roomID,
+		Ephemeral: base64.StdEncoding.EncodeToString(ephemeral.PublicKey().Bytes()),
+	})
+	if err := writeFrame(conn, FrameJoinHello, hello); err != nil {
+		return nil, err
+	}
+
+	// JoinChallenge
+	payload, err := readHandshakeFrame(reader, FrameJoinChallenge)
+	if err != nil {
+		return nil, err
+	}
+	var challenge joinChallenge
+	if err := json.Unmarshal(payload, &challenge); err != nil {
+		return nil, fmt.Errorf("invalid join challenge: %v", err)
+	}
+	memberEphemeral, err := decodeX25519PublicKey(challenge.Ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("invalid member ephemeral key: %v", err)
+	}
+
+	shared, err := ephemeral.ECDH(memberEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	joinerKey, memberKey, err := deriveJoinKeys(psk, shared, ephemeral.PublicKey().Bytes(), memberEphemeral.Bytes(), roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	// JoinConfirm proves we know the passphrase and introduces us
+	nodeData, _ := json.Marshal(localNode)
+	confirm, err := sealEnvelope(joinerKey, 0, roomID, nodeData)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(conn, FrameJoinConfirm, confirm); err != nil {
+		return nil, err
+	}
+
+	// JoinAccept carries the room key
+	payload, err = readHandshakeFrame(reader, FrameJoinAccept)
+	if err != nil {
+		return nil, err
+	}
+	acceptData, err := openEnvelope(memberKey, roomID, payload)
+	if err != nil {
+		return nil, fmt.Errorf("member failed to authenticate: %v", err)
+	}
+	var accept joinAccept
+	if err := json.Unmarshal(acceptData, &accept); err != nil {
+		return nil, fmt.Errorf("invalid join accept: %v", err)
+	}
+
+	return &accept, nil
+}
+
+// Run the member side of the handshake on an incoming connection
+func (p *P2PChat) handleJoinRequest(conn net.Conn, reader *bufio.Reader, helloPayload []byte) {
+	conn.SetDeadline(time.Now().Add(joinTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	reject := func(reason string) {
+		data, _ := json.Marshal(joinReject{Reason: reason})
+		writeFrame(conn, FrameJoinReject, data)
+	}
+
+	var hello joinHello
+	if err := json.Unmarshal(helloPayload, &hello); err != nil {
+		reject("invalid hello")
+		return
+	}
+	room := p.findRoom(hello.RoomID)
+	if room == nil {
+		reject("not a member of this room")
+		return
+	}
+	room.admitJoiner(conn, reader, hello, reject)
+}
+
+// Run the rest of the member side of the handshake for a room we're in
+func (r *RoomSession) admitJoiner(conn net.Conn, reader *bufio.Reader, hello joinHello, reject func(string)) {
+	remoteAddr := conn.RemoteAddr().String()
+
+	joinerEphemeral, err := decodeX25519PublicKey(hello.Ephemeral)
+	if err != nil {
+		reject("invalid ephemeral key")
+		return
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		reject("internal error")
+		return
+	}
+
+	// JoinChallenge
+	challenge, _ := json.Marshal(joinChallenge{
+		Ephemeral: base64.StdEncoding.EncodeToString(ephemeral.PublicKey().Bytes()),
+	})
+	if err := writeFrame(conn, FrameJoinChallenge, challenge); err != nil {
+		return
+	}
+
+	shared, err := ephemeral.ECDH(joinerEphemeral)
+	if err != nil {
+		reject("invalid ephemeral key")
+		return
+	}
+	joinerKey, memberKey, err := deriveJoinKeys(r.currentJoinPSK(), shared, joinerEphemeral.Bytes(), ephemeral.PublicKey().Bytes(), hello.RoomID)
+	if err != nil {
+		reject("internal error")
+		return
+	}
+
+	// JoinConfirm
+	payload, err := readHandshakeFrame(reader, FrameJoinConfirm)
+	if err != nil {
+		fmt.Printf("[System] Join handshake from %s failed: %v\n", remoteAddr, err)
+		return
+	}
+	nodeData, err := openEnvelope(joinerKey, hello.RoomID, payload)
+	if err != nil {
+		fmt.Printf("[System] Rejected join attempt from %s: wrong passphrase\n", remoteAddr)
+		reject("authentication failed")
+		return
+	}
+
+	var joiner NodeInfo
+	if err := json.Unmarshal(nodeData, &joiner); err != nil || !verifyNodeInfo(joiner) || joiner.RoomID != hello.RoomID {
+		reject("invalid node info")
+		return
+	}
+	if err := checkVersion(joiner.Version); err != nil {
+		reject(err.Error())
+		return
+	}
+
+	if r.isRemoved(joiner.ID) {
+		fmt.Printf("[System] Refused join from %s (%s): removed from the room\n", joiner.Nickname, shortID(joiner.ID))
+		reject("you were removed from this room")
+		return
+	}
+	r.SuperNodeMgr.MarkVerified(joiner.ID)
+	if !r.addRoomNode(joiner) {
+		reject("room is full")
+		return
+	}
+
+	// JoinAccept
+	epoch, key := r.Keyring.Current()
+	r.NodeMutex.RLock()
+	accept := joinAccept{
+		RoomKey:   base64.StdEncoding.EncodeToString(key),
+		Epoch:     epoch,
+		CreatorID: r.Room.CreatorID,
+		Nodes:     append([]NodeInfo(nil), r.Room.Nodes...),
+	}
+	r.NodeMutex.RUnlock()
+	accept.Removed = r.removedIDs()
+
+	acceptData, _ := json.Marshal(accept)
+	sealed, err := sealEnvelope(memberKey, 0, hello.RoomID, acceptData)
+	if err != nil {
+		return
+	}
+	if err := writeFrame(conn, FrameJoinAccept, sealed); err != nil {
+		fmt.Printf("[System] Failed to complete join for %s: %v\n", joiner.Nickname, err)
+		return
+	}
+
+	// Introduce the new node to the rest of the room
+	r.announceNode(joiner)
+}
+
+// Wait for a UDP broadcast from a member of roomID
+func (p *P2PChat) waitForRoomMember(roomID string, timeout time.Duration) (NodeInfo, error) {
+	candidates := make(chan NodeInfo, 1)
+
+	p.roomsMu.Lock()
+	p.pendingJoinRoom = roomID
+	p.joinCandidates = candidates
+	p.roomsMu.Unlock()
+
+	defer func() {
+		p.roomsMu.Lock()
+		p.pendingJoinRoom = ""
+		p.joinCandidates = nil
+		p.roomsMu.Unlock()
+	}()
+
+	select {
+	case node := <-candidates:
+		return node, nil
+	case <-time.After(timeout):
+		return NodeInfo{}, fmt.Errorf("no member of room %s found on the local network", roomID)
+	}
+}
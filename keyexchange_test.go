@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Signed node info for a joiner of roomID
+func testJoiner(t *testing.T, seed byte, roomID string) NodeInfo {
+	t.Helper()
+	node := NodeInfo{
+		Address:  fmt.Sprintf("127.0.0.1:%d", 24000+int(seed)),
+		Nickname: fmt.Sprint("joiner", seed),
+		Version:  ProtocolVersion,
+		RoomID:   roomID,
+	}
+	testIdentity(t, seed).SignNodeInfo(&node)
+	return node
+}
+
+func TestJoinHandshake(t *testing.T) {
+	member := testNode(t, 100)
+	if err := member.CreateRoom("handshake", "correct-horse-battery"); err != nil {
+		t.Fatal(err)
+	}
+	room := member.findRoom("handshake")
+	room.denyNodes([]string{testIdentity(t, 3).ID})
+
+	legacy := testJoiner(t, 4, "handshake")
+	legacy.Version = 0
+	testIdentity(t, 4).SignNodeInfo(&legacy)
+
+	tests := []struct {
+		name       string
+		roomID     string
+		passphrase string
+		joiner     NodeInfo
+		reject     string // Expected rejection, empty if the join succeeds
+	}{
+		{"right passphrase", "handshake", "correct-horse-battery", testJoiner(t, 1, "handshake"), ""},
+		{"wrong passphrase", "handshake", "wrong-horse-battery", testJoiner(t, 2, "handshake"), "authentication failed"},
+		{"removed member", "handshake", "correct-horse-battery", testJoiner(t, 3, "handshake"), "removed"},
+		{"old protocol", "handshake", "correct-horse-battery", legacy, "legacy"},
+		{"unknown room", "elsewhere", "correct-horse-battery", testJoiner(t, 5, "elsewhere"), "not a member"},
+		{"node info for another room", "handshake", "correct-horse-battery", testJoiner(t, 6, "elsewhere"), "invalid node info"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			psk, err := derivePassphraseKey(tt.roomID, tt.passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			accept, err := (&P2PChat{}).performJoinHandshake(member.LocalNode.Address, tt.roomID, psk, tt.joiner)
+
+			if tt.reject != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.reject) {
+					t.Fatalf("got %v, want a rejection containing %q", err, tt.reject)
+				}
+				if _, ok := room.findRoomNodeByID(tt.joiner.ID); ok {
+					t.Fatal("rejected joiner was added to the room")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			epoch, key := room.Keyring.Current()
+			if accept.RoomKey != base64.StdEncoding.EncodeToString(key) || accept.Epoch != epoch {
+				t.Fatal("accept does not carry the current room key")
+			}
+			if accept.CreatorID != member.LocalNode.ID || len(accept.Removed) != 1 {
+				t.Fatalf("accept = creator %s, removed %v", accept.CreatorID, accept.Removed)
+			}
+			if _, ok := room.findRoomNodeByID(tt.joiner.ID); !ok {
+				t.Fatal("joiner was not added to the room")
+			}
+		})
+	}
+}
+
+func TestDeriveJoinKeys(t *testing.T) {
+	psk, _ := derivePassphraseKey("room", "correct-horse-battery")
+	other, _ := derivePassphraseKey("room", "wrong-horse-battery")
+	joinerKey, memberKey, err := deriveJoinKeys(psk, []byte("shared"), []byte("joiner"), []byte("member"), "room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(joinerKey) == string(memberKey) {
+		t.Fatal("both directions use the same key")
+	}
+
+	tests := []struct {
+		name                    string
+		psk, shared, jEph, mEph []byte
+		roomID                  string
+	}{
+		{"passphrase", other, []byte("shared"), []byte("joiner"), []byte("member"), "room"},
+		{"shared secret", psk, []byte("other"), []byte("joiner"), []byte("member"), "room"},
+		{"joiner ephemeral", psk, []byte("shared"), []byte("other"), []byte("member"), "room"},
+		{"member ephemeral", psk, []byte("shared"), []byte("joiner"), []byte("other"), "room"},
+		{"room", psk, []byte("shared"), []byte("joiner"), []byte("member"), "other room"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j, m, err := deriveJoinKeys(tt.psk, tt.shared, tt.jEph, tt.mEph, tt.roomID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(j) == string(joinerKey) || string(m) == string(memberKey) {
+				t.Fatal("keys do not depend on this input")
+			}
+		})
+	}
+}
+
+func TestGeneratePassphrase(t *testing.T) {
+	if len(passphraseWords) != 128 {
+		t.Fatalf("%d passphrase words, entropy estimate assumes 128", len(passphraseWords))
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		passphrase, err := generatePassphrase()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if words := strings.Split(passphrase, "-"); len(words) != passphraseWordsLen {
+			t.Fatalf("%q has %d words, want %d", passphrase, len(words), passphraseWordsLen)
+		}
+		if len(passphrase) < minPassphraseLen {
+			t.Fatalf("generated passphrase %q is below the minimum length", passphrase)
+		}
+		if seen[passphrase] {
+			t.Fatalf("generated %q twice", passphrase)
+		}
+		seen[passphrase] = true
+	}
+}
+
+func TestRemoveReplacesPassphrase(t *testing.T) {
+	member := testNode(t, 100)
+	if err := member.CreateRoom("removal", "correct-horse-battery"); err != nil {
+		t.Fatal(err)
+	}
+	room := member.findRoom("removal")
+
+	join := func(seed byte, passphrase string) error {
+		psk, err := derivePassphraseKey("removal", passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = (&P2PChat{}).performJoinHandshake(member.LocalNode.Address, "removal", psk, testJoiner(t, seed, "removal"))
+		return err
+	}
+
+	if err := join(7, "correct-horse-battery"); err != nil {
+		t.Fatal(err)
+	}
+	removed := testIdentity(t, 7).ID
+	room.dropRoomNode(removed)
+	if err := room.Rekey([]string{removed}); err != nil {
+		t.Fatal(err)
+	}
+	passphrase := room.Room.Passphrase
+	if passphrase == "" || passphrase == "correct-horse-battery" {
+		t.Fatalf("passphrase after removal = %q", passphrase)
+	}
+
+	tests := []struct {
+		name       string
+		seed       byte
+		passphrase string
+		ok         bool
+	}{
+		{"removed identity", 7, passphrase, false},
+		{"new identity with old passphrase", 8, "correct-horse-battery", false},
+		{"new passphrase", 9, passphrase, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := join(tt.seed, tt.passphrase); (err == nil) != tt.ok {
+				t.Fatalf("join error = %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestKeyringSealOpen(t *testing.T) {
+	kr := NewRoomKeyring(testKey(1), 0, "creator")
+	envelope, err := kr.Seal("room", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epoch, _ := envelopeEpoch(envelope); epoch != 0 {
+		t.Fatalf("sealed under epoch %d, want 0", epoch)
+	}
+	plaintext, err := kr.Open("room", envelope)
+	if err != nil || string(plaintext) != "hello" {
+		t.Fatalf("Open = %q, %v", plaintext, err)
+	}
+	if _, err := kr.Open("other room", envelope); err == nil {
+		t.Fatal("opened an envelope sealed for another room")
+	}
+	if _, err := kr.Open("room", envelope[:3]); err == nil {
+		t.Fatal("opened a truncated envelope")
+	}
+}
+
+func TestKeyringEpochRollover(t *testing.T) {
+	kr := NewRoomKeyring(testKey(1), 0, "creator")
+	old, err := kr.Seal("room", []byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kr.Install(1, testKey(2), "coordinator")
+	epoch, key := kr.Current()
+	if epoch != 1 || !bytes.Equal(key, testKey(2)) || kr.Issuer() != "coordinator" {
+		t.Fatalf("current = %d %x by %s", epoch, key, kr.Issuer())
+	}
+	current, err := kr.Seal("room", []byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epoch, _ := envelopeEpoch(current); epoch != 1 {
+		t.Fatalf("sealed under epoch %d after rollover, want 1", epoch)
+	}
+
+	tests := []struct {
+		name     string
+		envelope []byte
+		want     string
+	}{
+		{"current epoch", current, "after"},
+		{"retired epoch in grace", old, "before"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, err := kr.Open("room", tt.envelope)
+			if err != nil || string(plaintext) != tt.want {
+				t.Fatalf("Open = %q, %v; want %q", plaintext, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyringRejectsUnknownAndExpiredEpochs(t *testing.T) {
+	kr := NewRoomKeyring(testKey(1), 0, "creator")
+	old, _ := kr.Seal("room", []byte("before"))
+	kr.Install(1, testKey(2), "coordinator")
+
+	// An epoch we never received
+	future, _ := sealEnvelope(testKey(3), 2, "room", []byte("future"))
+	if _, err := kr.Open("room", future); err == nil {
+		t.Fatal("opened an envelope from an unknown epoch")
+	}
+
+	// An envelope claiming the retired epoch but sealed under another key
+	forged, _ := sealEnvelope(testKey(9), 0, "room", []byte("forged"))
+	if _, err := kr.Open("room", forged); err == nil {
+		t.Fatal("opened an envelope sealed under a different key")
+	}
+
+	// Past the grace period the retired epoch is refused, and forgotten at
+	// the next rollover
+	kr.mu.Lock()
+	kr.retired[0] = time.Now().Add(-time.Second)
+	kr.mu.Unlock()
+	if _, err := kr.Open("room", old); err == nil {
+		t.Fatal("opened an envelope from an expired epoch")
+	}
+	kr.Install(2, testKey(3), "coordinator")
+	kr.mu.RLock()
+	_, kept := kr.keys[0]
+	kr.mu.RUnlock()
+	if kept {
+		t.Fatal("expired key still held after rollover")
+	}
+
+	// Once its epoch is installed, the earlier unknown envelope opens
+	if _, err := kr.Open("room", future); err != nil {
+		t.Fatalf("installed epoch: %v", err)
+	}
+}
+
+func TestKeyringReinstallCurrentEpoch(t *testing.T) {
+	kr := NewRoomKeyring(testKey(1), 4, "creator")
+	kr.Install(4, testKey(1), "creator")
+	kr.mu.RLock()
+	retired := len(kr.retired)
+	kr.mu.RUnlock()
+	if retired != 0 {
+		t.Fatalf("reinstalling the current epoch retired %d keys", retired)
+	}
+}
+
+// Create a room on the first node and join the others to it
+func testRoom(t *testing.T, roomID string, nodes ...*P2PChat) []*RoomSession {
+	t.Helper()
+	if err := nodes[0].CreateRoom(roomID, "correct-horse-battery"); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes[1:] {
+		if err := node.JoinRoom(roomID, "correct-horse-battery", nodes[0].LocalNode.Address); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rooms := make([]*RoomSession, len(nodes))
+	for i, node := range nodes {
+		rooms[i] = node.findRoom(roomID)
+	}
+	// Wait for every member to learn about every other one
+	for _, room := range rooms {
+		room := room
+		if !eventually(5*time.Second, func() bool { return memberCount(room) == len(nodes) }) {
+			t.Fatalf("%s knows %d members, want %d", room.LocalNode.Nickname, memberCount(room), len(nodes))
+		}
+	}
+	return rooms
+}
+
+// Number of members a room session lists, itself included
+func memberCount(room *RoomSession) int {
+	room.NodeMutex.RLock()
+	defer room.NodeMutex.RUnlock()
+	return len(room.Room.Nodes)
+}
+
+func TestRemoveRekeysRemainingMembers(t *testing.T) {
+	rooms := testRoom(t, "rekey", testNode(t, 1), testNode(t, 2), testNode(t, 3))
+	creator, member, removed := rooms[0], rooms[1], rooms[2]
+
+	creator.dropRoomNode(removed.LocalNode.ID)
+	if err := creator.Rekey([]string{removed.LocalNode.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !creator.Outbox.Wait(rekeyNotice{IssuerID: creator.LocalNode.ID, Epoch: 1}.key(), 5*time.Second) {
+		t.Fatal("rekey notice was never acknowledged")
+	}
+	if epoch, _ := member.Keyring.Current(); epoch != 1 {
+		t.Fatalf("remaining member is at epoch %d after acknowledging the rekey", epoch)
+	}
+	_, creatorKey := creator.Keyring.Current()
+	_, memberKey := member.Keyring.Current()
+	if !bytes.Equal(creatorKey, memberKey) {
+		t.Fatal("remaining member installed a different key")
+	}
+	if !bytes.Equal(member.currentJoinPSK(), creator.currentJoinPSK()) {
+		t.Fatal("remaining member still checks joins against the old passphrase")
+	}
+	if !member.isRemoved(removed.LocalNode.ID) {
+		t.Fatal("remaining member doesn't know about the removal")
+	}
+	if _, ok := member.findRoomNodeByID(removed.LocalNode.ID); ok {
+		t.Fatal("remaining member still lists the removed node")
+	}
+
+	if epoch, _ := removed.Keyring.Current(); epoch != 0 {
+		t.Fatalf("removed member reached epoch %d", epoch)
+	}
+}
+
+func TestOnlyCreatorRekeys(t *testing.T) {
+	rooms := testRoom(t, "rekey-authority", testNode(t, 104), testNode(t, 105), testNode(t, 106))
+	creator, superNode, member := rooms[0], rooms[1], rooms[2]
+	superNode.SuperNodeMgr.SetLocalNodeAsSuperNode(true)
+	member.SuperNodeMgr.SetAsSuperNode(superNode.LocalNode.ID)
+
+	if err := superNode.Rekey(nil); err == nil {
+		t.Fatal("a SuperNode rotated the room key")
+	}
+
+	// A signed removal from a SuperNode is ignored
+	notice := rekeyNotice{
+		RoomID:    member.Room.ID,
+		Epoch:     1,
+		Keys:      map[string]string{},
+		Removed:   []string{creator.LocalNode.ID},
+		IssuerID:  superNode.LocalNode.ID,
+		PublicKey: superNode.Identity.EncodedPublicKey(),
+	}
+	notice.Signature = superNode.Identity.Sign(rekeySigningBytes(notice))
+	data, err := json.Marshal(notice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := member.handleRekey(data, superNode.LocalNode.Address); got != "" {
+		t.Fatalf("acknowledged a SuperNode's rekey as %q", got)
+	}
+	if member.isRemoved(creator.LocalNode.ID) {
+		t.Fatal("a SuperNode removed a member")
+	}
+
+	// Only the creator rotates the key when a member leaves
+	superNode.removeRoomNode(member.LocalNode.ID)
+	if epoch, _ := superNode.Keyring.Current(); epoch != 0 {
+		t.Fatal("a SuperNode rotated the key after a leave")
+	}
+	creator.removeRoomNode(member.LocalNode.ID)
+	if epoch, _ := creator.Keyring.Current(); epoch != 1 {
+		t.Fatal("the creator didn't rotate the key after a leave")
+	}
+}
@@ -33,15 +33,34 @@ import (
 
 // Config holds the application configuration
 type Config struct {
-	TCPPort           int
-	UDPPort           int
-	BroadcastTimeout  time.Duration
-	DefaultNickname   string
-	DefaultAdjectives []string
-	DefaultNouns      []string
-	MaxNodes          int
-	FileChunkSize     int
-	NoSuperNode       bool
+	TCPPort            int
+	UDPPort            int
+	PunchPort          int      // UDP port for hole punching, 0 to pick any
+	RelayMaxTunnels    int      // Tunnels relayed for other members at once, 0 to never relay
+	RelayServers       []string // Standalone relays to fall back to, see tunnel.go
+	BroadcastTimeout   time.Duration
+	DefaultNickname    string
+	DefaultAdjectives  []string
+	DefaultNouns       []string
+	MaxNodes           int
+	FileChunkSize      int
+	NoSuperNode        bool
+	IdentityFile       string
+	OfflineMaxMessages int
+	OfflineMaxAge      time.Duration
+	HistorySyncLimit   int
+	DataDir            string
+	StoreMaxMessages   int // Messages kept in each room's store, 0 for all
+	FileSaveDir        string
+	SeedMaxSize        int64
+	MaxFileSize        int64 // Largest file offered or downloaded
+	HeartbeatInterval  time.Duration
+	HeartbeatSuspect   int   // Missed heartbeats before a member is suspect
+	HeartbeatDead      int   // Missed heartbeats before a member is marked offline
+	UploadBandwidth    int64 // Bytes per second advertised to peers, 0 to measure
+	MessageMode        string
+	GossipFanout       int // Members each gossiped message is pushed to
+	GossipTTL          int // Times a gossiped message is pushed on
 }
 
 // AppConfig holds the application-wide configuration instance
@@ -53,6 +72,7 @@ func LoadConfig() *Config {
 		// Set default values
 		TCPPort:          8080,
 		UDPPort:          8081,
+		PunchPort:        8082,
 		BroadcastTimeout: 5 * time.Second,
 		DefaultAdjectives: []string{
 			"Cool", "Smart", "Fast", "Lucky", "Brave",
@@ -65,6 +85,22 @@ func LoadConfig() *Config {
 		MaxNodes:      100,
 		FileChunkSize: 1024,
 		NoSuperNode:   false, // default is false
+		IdentityFile:  "identity.key",
+
+		OfflineMaxMessages: 200,
+		OfflineMaxAge:      10 * time.Minute,
+		HistorySyncLimit:   100,
+		DataDir:            "data",
+		FileSaveDir:        "downloads",
+		SeedMaxSize:        64 << 20,
+		MaxFileSize:        4 << 30,
+		HeartbeatInterval:  2 * time.Second,
+		HeartbeatSuspect:   3,
+		HeartbeatDead:      15,
+		MessageMode:        modeAuto,
+		GossipFanout:       3,
+		GossipTTL:          6,
+		RelayMaxTunnels:    16,
 	}
 
 	// Try to read config from file
@@ -99,6 +135,10 @@ func LoadConfig() *Config {
 			if port, err := strconv.Atoi(value); err == nil {
 				config.UDPPort = port
 			}
+		case "PUNCH_PORT":
+			if port, err := strconv.Atoi(value); err == nil && port >= 0 {
+				config.PunchPort = port
+			}
 		case "BROADCAST_TIMEOUT":
 			if dur, err := time.ParseDuration(value); err == nil {
 				config.BroadcastTimeout = dur
@@ -125,6 +165,79 @@ func LoadConfig() *Config {
 			}
 		case "NO_SUPER_NODE":
 			config.NoSuperNode = strings.ToLower(value) == "true"
+		case "OFFLINE_MAX_MESSAGES":
+			if maxMessages, err := strconv.Atoi(value); err == nil && maxMessages >= 0 {
+				config.OfflineMaxMessages = maxMessages
+			}
+		case "OFFLINE_MAX_AGE":
+			if dur, err := time.ParseDuration(value); err == nil {
+				config.OfflineMaxAge = dur
+			}
+		case "HISTORY_SYNC_LIMIT":
+			if limit, err := strconv.Atoi(value); err == nil && limit >= 0 {
+				config.HistorySyncLimit = limit
+			}
+		case "SEED_MAX_SIZE":
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil && size >= 0 {
+				config.SeedMaxSize = size
+			}
+		case "MAX_FILE_SIZE":
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil && size >= 0 {
+				config.MaxFileSize = size
+			}
+		case "HEARTBEAT_INTERVAL":
+			if dur, err := time.ParseDuration(value); err == nil && dur > 0 {
+				config.HeartbeatInterval = dur
+			}
+		case "HEARTBEAT_SUSPECT":
+			if beats, err := strconv.Atoi(value); err == nil && beats > 0 {
+				config.HeartbeatSuspect = beats
+			}
+		case "HEARTBEAT_DEAD":
+			if beats, err := strconv.Atoi(value); err == nil && beats > 0 {
+				config.HeartbeatDead = beats
+			}
+		case "UPLOAD_BANDWIDTH":
+			if bandwidth, err := strconv.ParseInt(value, 10, 64); err == nil && bandwidth >= 0 {
+				config.UploadBandwidth = bandwidth
+			}
+		case "MESSAGE_MODE":
+			if mode := strings.ToLower(value); validMode(mode) {
+				config.MessageMode = mode
+			}
+		case "GOSSIP_FANOUT":
+			if fanout, err := strconv.Atoi(value); err == nil && fanout > 0 {
+				config.GossipFanout = fanout
+			}
+		case "GOSSIP_TTL":
+			if ttl, err := strconv.Atoi(value); err == nil && ttl > 0 {
+				config.GossipTTL = ttl
+			}
+		case "RELAY_MAX_TUNNELS":
+			if tunnels, err := strconv.Atoi(value); err == nil && tunnels >= 0 {
+				config.RelayMaxTunnels = tunnels
+			}
+		case "RELAY_SERVERS":
+			config.RelayServers = nil
+			for _, server := range strings.Split(value, ",") {
+				if server = strings.TrimSpace(server); server != "" {
+					config.RelayServers = append(config.RelayServers, server)
+				}
+			}
+		case "FILE_SAVE_DIR":
+			if value != "" {
+				config.FileSaveDir = value
+			}
+		case "DATA_DIR":
+			config.DataDir = value
+		case "STORE_MAX_MESSAGES":
+			if limit, err := strconv.Atoi(value); err == nil && limit >= 0 {
+				config.StoreMaxMessages = limit
+			}
+		case "IDENTITY_FILE":
+			if value != "" {
+				config.IdentityFile = value
+			}
 		}
 	}
 
@@ -134,6 +247,20 @@ func LoadConfig() *Config {
 // Main entry point
 func main() {
 	AppConfig = LoadConfig()
+
+	// "p2pchat relay [address]" runs a standalone relay instead of the chat
+	if len(os.Args) > 1 && os.Args[1] == "relay" {
+		addr := defaultRelayServerAddr
+		if len(os.Args) > 2 {
+			addr = os.Args[2]
+		}
+		if err := runRelayServer(addr); err != nil {
+			fmt.Printf("Relay server failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	chat := NewP2PChat()
 	chat.RunCLI()
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMain loads the default configuration once. Nodes started by tests read
+// AppConfig from their goroutines, so tests must never reassign it.
+func TestMain(m *testing.M) {
+	AppConfig = LoadConfig()
+	AppConfig.DataDir = "" // Tests that need a store open one themselves
+
+	saveDir, err := os.MkdirTemp("", "p2pchat-downloads")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	AppConfig.FileSaveDir = saveDir
+
+	code := m.Run()
+	os.RemoveAll(saveDir)
+	os.Exit(code)
+}
+
+// Start a client listening on an ephemeral loopback port. It isn't in any
+// room yet and runs no heartbeats or UDP services.
+func testNode(t *testing.T, seed byte) *P2PChat {
+	t.Helper()
+	id := testIdentity(t, seed)
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &P2PChat{
+		Identity:          id,
+		SeenMessages:      NewSeenCache(seenCacheSize),
+		Rooms:             make(map[string]*RoomSession),
+		StartedAt:         time.Now(),
+		NATType:           natUnknown,
+		TCPListener:       listener,
+		incompatibleNodes: make(map[string]bool),
+		unverifiedNodes:   make(map[string]bool),
+	}
+	p.LocalNode = NodeInfo{
+		ID:        id.ID,
+		Nickname:  fmt.Sprint("node", seed),
+		Address:   listener.Addr().String(),
+		PublicKey: id.EncodedPublicKey(),
+		Version:   ProtocolVersion,
+	}
+	p.Conns = NewConnManager(id, func() string { return p.LocalNode.Address }, p.memberAt, p.handleFrame)
+	p.Tunnels = NewTunnelRelay(AppConfig.RelayMaxTunnels)
+	p.Outbox = NewOutbox(func() bool { return p.Running }, p.Conns)
+	p.Outbox.OnFailure = p.onDeliveryFailure
+	p.Running = true
+
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go p.handleConnection(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		p.Conns.CloseAll()
+	})
+	return p
+}
+
+// Poll cond until it holds or timeout passes
+func eventually(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); ; time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+	}
+}
+
+func TestLoadConfigRejectsNegativeLimits(t *testing.T) {
+	defaults := LoadConfig()
+	tests := []struct {
+		line string
+		get  func(*Config) int64
+	}{
+		{"OFFLINE_MAX_MESSAGES=-1", func(c *Config) int64 { return int64(c.OfflineMaxMessages) }},
+		{"HISTORY_SYNC_LIMIT=-5", func(c *Config) int64 { return int64(c.HistorySyncLimit) }},
+		{"SEED_MAX_SIZE=-1", func(c *Config) int64 { return c.SeedMaxSize }},
+		{"MAX_FILE_SIZE=-1", func(c *Config) int64 { return c.MaxFileSize }},
+		{"STORE_MAX_MESSAGES=-1", func(c *Config) int64 { return int64(c.StoreMaxMessages) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			if err := os.WriteFile("config", []byte(tt.line+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := tt.get(LoadConfig()), tt.get(defaults); got != want {
+				t.Fatalf("%s gave %d, want the default %d", tt.line, got, want)
+			}
+		})
+	}
+}
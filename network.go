@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -37,23 +39,25 @@ func (p *P2PChat) StartUDPBroadcast() error {
 	p.Running = true
 
 	// Start broadcast receiving goroutine
-	go p.listenForBroadcasts()
+	go p.listenForBroadcasts(socket)
 
-	// If room creator, start broadcasting own info
-	if len(p.Room.Nodes) > 0 && p.Room.Nodes[0].Address == p.LocalNode.Address {
-		go p.broadcastNodeInfo()
-	}
+	// Every member broadcasts its own info so nodes joining a room can find
+	// a member to run the join handshake with
+	go p.broadcastNodeInfo(socket)
 
 	return nil
 }
 
-// Listen for UDP broadcasts
-func (p *P2PChat) listenForBroadcasts() {
+// Listen for UDP broadcasts until the socket is closed
+func (p *P2PChat) listenForBroadcasts(socket *net.UDPConn) {
 	buffer := make([]byte, 1024)
 
 	for p.Running {
-		n, addr, err := p.UDPSocket.ReadFromUDP(buffer)
+		n, addr, err := socket.ReadFromUDP(buffer)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if p.Running {
 				fmt.Printf("Error reading UDP broadcast: %v\n", err)
 			}
@@ -66,6 +70,20 @@ func (p *P2PChat) listenForBroadcasts() {
 			continue
 		}
 
+		// Ignore our own broadcasts
+		if nodeInfo.ID == p.LocalNode.ID {
+			continue
+		}
+
+		// Only accept announcements signed by the key the node ID is derived from
+		if !verifyNodeInfo(nodeInfo) {
+			if !p.unverifiedNodes[nodeInfo.ID] {
+				p.unverifiedNodes[nodeInfo.ID] = true
+				fmt.Printf("[System] Warning: ignoring unverified announcement from %s (%s)\n", nodeInfo.Nickname, addr.String())
+			}
+			continue
+		}
+
 		// Ensure NoSuperNode field has a default value if not present
 		if nodeInfo.ID == "" {
 			nodeInfo.NoSuperNode = false
@@ -76,80 +94,139 @@ func (p *P2PChat) listenForBroadcasts() {
 			nodeInfo.Address = addr.String()
 		}
 
-		// Check if node is in room
-		isRoomNode := false
-		for _, node := range p.Room.Nodes {
-			if node.ID == nodeInfo.ID {
-				isRoomNode = true
-				break
+		// Skip peers we can't talk to, warning once per node
+		if err := checkVersion(nodeInfo.Version); err != nil {
+			if !p.incompatibleNodes[nodeInfo.ID] {
+				p.incompatibleNodes[nodeInfo.ID] = true
+				fmt.Printf("[System] Ignoring node %s (%s): %v\n", nodeInfo.Nickname, nodeInfo.Address, err)
 			}
+			continue
 		}
 
-		// Add to room if not already present and not self
-		if !isRoomNode && nodeInfo.ID != p.LocalNode.Address {
-			p.NodeMutex.Lock()
-			// Check if node limit is reached
-			if len(p.Room.Nodes) >= AppConfig.MaxNodes {
-				fmt.Printf("[System] Node limit (%d) reached, ignoring new node %s (%s)\n",
-					AppConfig.MaxNodes, nodeInfo.Nickname, nodeInfo.Address)
-				p.NodeMutex.Unlock()
-				continue
-			}
-			p.Room.Nodes = append(p.Room.Nodes, nodeInfo)
-			p.NodeMutex.Unlock()
-
-			// Add node to SuperNode manager
-			p.SuperNodeMgr.AddNode(nodeInfo)
-
-			// If this is the room creator and we don't have a SuperNode yet, select one
-			if len(p.Room.Nodes) == 2 && p.SuperNodeMgr.GetSuperNodes() == nil { // Local node + 1 other node
-				// For the first few nodes, select one as SuperNode (not the local node if it has NoSuperNode enabled)
-				if len(p.Room.Nodes) <= 5 {
-					// Select initial SuperNode from first 5 nodes
-					selectedSuperNodeID := p.SuperNodeMgr.SelectInitialSuperNode()
-					if selectedSuperNodeID != "" {
-						fmt.Printf("[System] Selected %s as initial SuperNode\n", selectedSuperNodeID)
-					}
-				}
+		// Hand members of a room we're trying to join to the join handshake
+		p.roomsMu.RLock()
+		if p.joinCandidates != nil && nodeInfo.RoomID == p.pendingJoinRoom {
+			select {
+			case p.joinCandidates <- nodeInfo:
+			default:
 			}
+		}
+		p.roomsMu.RUnlock()
+
+		// Broadcasts carry the room ID in the clear and prove nothing about
+		// the passphrase, so they never make a node a member. Members are
+		// only added by the join handshake, room-sealed announcements and
+		// room-sealed heartbeats.
+	}
+}
 
-			fmt.Printf("[System] Node %s (%s) joined the room\n", nodeInfo.Nickname, nodeInfo.Address)
+// Add a node to the room if not already present. Returns false if the
+// node limit was reached or the node was removed from the room.
+func (r *RoomSession) addRoomNode(nodeInfo NodeInfo) bool {
+	r.NodeMutex.Lock()
+	if r.removed[nodeInfo.ID] {
+		r.NodeMutex.Unlock()
+		return false
+	}
+	// Check if node is in room
+	for _, node := range r.Room.Nodes {
+		if node.ID == nodeInfo.ID {
+			r.NodeMutex.Unlock()
+			return true
 		}
 	}
+
+	// Check if node limit is reached
+	if len(r.Room.Nodes) >= AppConfig.MaxNodes {
+		fmt.Printf("[System] Node limit (%d) reached, ignoring new node %s (%s)\n",
+			AppConfig.MaxNodes, nodeInfo.Nickname, nodeInfo.Address)
+		r.NodeMutex.Unlock()
+		return false
+	}
+	r.Room.Nodes = append(r.Room.Nodes, nodeInfo)
+	r.NodeMutex.Unlock()
+
+	// Add node to SuperNode manager
+	r.SuperNodeMgr.AddNode(nodeInfo)
+
+	fmt.Printf("[System] %sNode %s (%s) joined the room\n", r.roomTag(), nodeInfo.Nickname, nodeInfo.Address)
+	r.saveRoomState()
+	r.runElection()
+	return true
 }
 
-// Broadcast node info
-func (p *P2PChat) broadcastNodeInfo() {
-	ticker := time.NewTicker(AppConfig.BroadcastTimeout)
-	defer ticker.Stop()
+// Tell every other room member about a newly admitted node
+func (r *RoomSession) announceNode(nodeInfo NodeInfo) {
+	data, err := json.Marshal(nodeInfo)
+	if err != nil {
+		return
+	}
+	sealed, err := r.Keyring.Seal(r.Room.ID, data)
+	if err != nil {
+		fmt.Printf("Failed to encrypt node announcement: %v\n", err)
+		return
+	}
+
+	r.NodeMutex.RLock()
+	defer r.NodeMutex.RUnlock()
+	for _, node := range r.Room.Nodes {
+		if node.ID == r.LocalNode.ID || node.ID == nodeInfo.ID {
+			continue
+		}
+		go func(nodeAddr string) {
+			if err := r.Conns.Send(nodeAddr, FrameNodeAnnounce, sealed); err != nil {
+				fmt.Printf("Failed to announce node to %s: %v\n", nodeAddr, err)
+			}
+		}(node.Address)
+	}
+}
 
-	nodeInfo := NodeInfo{
-		ID:       p.LocalNode.Address,
-		Address:  p.LocalNode.Address,
-		Nickname: p.LocalNode.Nickname,
+// Handle an announcement of a newly admitted node
+func (r *RoomSession) handleNodeAnnounce(data []byte, remoteAddr string) {
+	var nodeInfo NodeInfo
+	if err := json.Unmarshal(data, &nodeInfo); err != nil || !verifyNodeInfo(nodeInfo) {
+		fmt.Printf("Invalid node announcement from %s\n", remoteAddr)
+		return
+	}
+	if nodeInfo.ID == r.LocalNode.ID || nodeInfo.RoomID != r.Room.ID {
+		return
 	}
 
+	r.addRoomNode(nodeInfo)
+}
+
+// Broadcast node info until the socket is closed
+func (p *P2PChat) broadcastNodeInfo(socket *net.UDPConn) {
+	ticker := time.NewTicker(AppConfig.BroadcastTimeout)
+	defer ticker.Stop()
+
 	for range ticker.C {
 		if !p.Running {
 			break
 		}
 
-		data, err := json.Marshal(nodeInfo)
-		if err != nil {
-			continue
-		}
-
 		// Broadcast to local network
 		broadcastAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("255.255.255.255:%d", AppConfig.UDPPort))
 		if err != nil {
 			continue
 		}
 
-		// Set socket broadcast permission
-		p.UDPSocket.SetWriteDeadline(time.Now().Add(time.Second))
-		_, err = p.UDPSocket.WriteToUDP(data, broadcastAddr)
-		if err != nil {
-			// May be Windows doesn't allow broadcast, try other approaches
+		// Announce ourselves once per room we're in
+		for _, room := range p.roomList() {
+			data, err := json.Marshal(room.localNodeInfo())
+			if err != nil {
+				continue
+			}
+
+			// Set socket broadcast permission
+			socket.SetWriteDeadline(time.Now().Add(time.Second))
+			_, err = socket.WriteToUDP(data, broadcastAddr)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				// May be Windows doesn't allow broadcast, try other approaches
+			}
 		}
 	}
 }
@@ -165,16 +242,25 @@ func (p *P2PChat) StartTCPListener() error {
 	if err != nil {
 		return err
 	}
+	p.TCPListener = listener
 
 	fmt.Printf("TCP listener started on port %d\n", AppConfig.TCPPort)
 
+	// Heartbeats stop with the listener
+	done := make(chan struct{})
+	go p.runHeartbeats(done)
+
 	// Start accepting connections goroutine
 	go func() {
 		defer listener.Close()
+		defer close(done)
 
 		for p.Running {
 			conn, err := listener.AcceptTCP()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				if p.Running {
 					fmt.Printf("Error accepting TCP connection: %v\n", err)
 				}
@@ -182,138 +268,209 @@ func (p *P2PChat) StartTCPListener() error {
 			}
 
 			// Handle received message
-			go p.handleTCPConnection(conn)
+			go p.handleConnection(conn)
 		}
 	}()
 
 	return nil
 }
 
-// Handle TCP connection
-func (p *P2PChat) handleTCPConnection(conn *net.TCPConn) {
+// Stop the UDP and TCP services, e.g. after leaving the last room. They are
+// started again by the next /create, /join or /reopen.
+func (p *P2PChat) stopServices() {
+	if p.UDPSocket != nil {
+		p.UDPSocket.Close()
+		p.UDPSocket = nil
+	}
+	if p.TCPListener != nil {
+		p.TCPListener.Close()
+		p.TCPListener = nil
+	}
+	p.Conns.CloseAll()
+}
+
+// Handle a connection a peer opened, over TCP or a punched UDP stream
+func (p *P2PChat) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
 	// Get the remote address to identify sender
 	remoteAddr := conn.RemoteAddr().String()
 
-	buffer := make([]byte, 4096)
+	reader := bufio.NewReader(conn)
 	for p.Running {
-		n, err := conn.Read(buffer)
+		frame, err := readFrame(reader)
 		if err != nil {
 			if err != io.EOF {
-				fmt.Printf("Error reading TCP connection from %s: %v\n", remoteAddr, err)
+				fmt.Printf("Error reading connection from %s: %v\n", remoteAddr, err)
 			}
+			// The stream can't be resynchronised after a bad frame
 			break
 		}
 
-		// Decrypt message
-		decryptedData, err := decryptAES(p.MessageKey, buffer[:n])
-		if err != nil {
-			fmt.Printf("Failed to decrypt message from %s: %v\n", remoteAddr, err)
+		switch frame.Type {
+		case FrameJoinHello:
+			p.handleJoinRequest(conn, reader, frame.Payload)
 			continue
+		case FrameConnHello:
+			// The peer wants a pooled connection, which serves until it closes
+			p.Conns.accept(conn, reader, frame.Payload)
+			return
+		case FrameTunnelBind:
+			// The peer wants us to relay a tunnel, which serves until it closes
+			p.handleTunnelBind(conn, reader, frame.Payload)
+			return
 		}
 
-		// Parse message
-		var message Message
-		if err := json.Unmarshal(decryptedData, &message); err != nil {
-			fmt.Printf("Invalid message format from %s: %v\n", remoteAddr, err)
-			continue
+		replyType, reply := p.handleFrame(frame, remoteAddr)
+		if expectsReply(frame.Type) {
+			writeFrame(conn, replyType, reply)
 		}
+	}
+}
 
-		// Check if message is for current room
-		if message.RoomID != p.Room.ID {
-			continue
-		}
+// Handle a frame from a peer. Returns the reply to send if the frame is a
+// request (see expectsReply): an empty FrameAck if it was refused.
+func (p *P2PChat) handleFrame(frame *Frame, remoteAddr string) (byte, []byte) {
+	// Every frame is sealed under the key of the room it belongs to. It's
+	// opened once here and handlers get the plaintext.
+	room, data := p.openRoomPayload(frame.Payload)
+	if room == nil {
+		fmt.Printf("Failed to decrypt frame 0x%02x from %s: not sealed for any room we're in\n", frame.Type, remoteAddr)
+		return FrameAck, nil
+	}
 
+	switch frame.Type {
+	case FrameMessage:
+		return FrameAck, []byte(room.handleMessageFrame(data, remoteAddr))
+	case FrameRelay:
+		return FrameAck, []byte(room.handleRelayFrame(data, remoteAddr))
+	case FrameGossip:
+		return FrameAck, []byte(room.handleGossipFrame(data, remoteAddr))
+	case FrameGossipPull:
+		return replyOrRefuse(FrameHistoryResponse, room.handleGossipPull(data, remoteAddr))
+	case FrameDirectMessage:
+		return FrameAck, []byte(room.handleDirectMessage(data, remoteAddr))
+	case FrameLeave:
+		return FrameAck, []byte(room.handleLeaveNotice(data, remoteAddr))
+	case FrameElection:
+		return FrameAck, []byte(room.handleElection(data, remoteAddr))
+	case FrameHeartbeat:
+		room.handleHeartbeat(data, remoteAddr)
+		return FrameAck, nil
+	case FrameHold:
+		return FrameAck, []byte(room.handleHoldRequest(data, remoteAddr))
+	case FrameHistoryRequest:
+		return replyOrRefuse(FrameHistoryResponse, room.handleHistoryRequest(data, remoteAddr))
+	case FrameFileOffer:
+		return FrameAck, []byte(room.handleFileOffer(data, remoteAddr))
+	case FrameFileAccept:
+		return FrameAck, []byte(room.handleFileAccept(data, remoteAddr))
+	case FrameManifestRequest:
+		return replyOrRefuse(FrameManifestPage, room.handleManifestRequest(data))
+	case FrameChunkRequest:
+		return replyOrRefuse(FrameChunkData, room.handleChunkRequest(data))
+	case FrameHaveRequest:
+		return replyOrRefuse(FrameHaveResponse, room.handleHaveRequest(data))
+	case FrameRendezvous:
+		return FrameAck, []byte(room.handleRendezvous(data, remoteAddr))
+	case FrameNodeAnnounce:
+		room.handleNodeAnnounce(data, remoteAddr)
+	case FrameRekey:
+		return FrameAck, []byte(room.handleRekey(data, remoteAddr))
+	default:
+		fmt.Printf("Unknown frame type 0x%02x from %s\n", frame.Type, remoteAddr)
+	}
+	return FrameAck, nil
+}
 
+// Reply with response, or refuse with an empty FrameAck if there is none
+func replyOrRefuse(frameType byte, response []byte) (byte, []byte) {
+	if response == nil {
+		return FrameAck, nil
+	}
+	return frameType, response
+}
 
-		// In SuperNode mode, if this is a SuperNode, forward to other nodes
-		if p.SuperNodeMgr.ShouldEnableSuperNodeMode(len(p.Room.Nodes)) {
-			if p.SuperNodeMgr.IsLocalNodeSuperNode() {
-				// This is a SuperNode, forward the message to appropriate nodes
-				p.NodeMutex.RLock()
-
-				// Forward to all regular nodes
-				for _, node := range p.Room.Nodes {
-					if node.Address == p.LocalNode.Address || node.Address == remoteAddr {
-						continue // Don't send back to sender or to self
-					}
-
-					// Check if it's a regular node (not another SuperNode)
-					superNodeInfo := p.SuperNodeMgr.GetNode(node.Address)
-					if superNodeInfo != nil && superNodeInfo.IsSuperNode {
-						continue // Skip other SuperNodes to avoid loops
-					}
-
-					// Send to regular node
-					go func(nodeAddr string) {
-						forwardConn, err := net.DialTimeout("tcp", nodeAddr, 5*time.Second)
-						if err != nil {
-							fmt.Printf("Failed to connect to node %s for message forwarding: %v\n", nodeAddr, err)
-							return
-						}
-						defer forwardConn.Close()
-
-						// Re-encrypt and send the message
-						forwardData, err := json.Marshal(message)
-						if err != nil {
-							fmt.Printf("Failed to re-serialize message: %v\n", err)
-							return
-						}
-
-						encryptedForwardData, err := encryptAES(p.MessageKey, forwardData)
-						if err != nil {
-							fmt.Printf("Failed to re-encrypt message: %v\n", err)
-							return
-						}
-
-						_, err = forwardConn.Write(encryptedForwardData)
-						if err != nil {
-							fmt.Printf("Failed to forward message to node %s: %v\n", nodeAddr, err)
-						}
-					}(node.Address)
-				}
+// Handle an encrypted chat message frame. Returns the key to acknowledge,
+// or "" if the message was invalid.
+func (r *RoomSession) handleMessageFrame(data []byte, remoteAddr string) string {
+	// Parse message
+	var message Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		fmt.Printf("Invalid message format from %s: %v\n", remoteAddr, err)
+		return ""
+	}
 
-				// Forward to other SuperNodes too (for redundancy)
-				otherSuperNodes := p.SuperNodeMgr.GetSuperNodes()
-				for _, superNode := range otherSuperNodes {
-					if superNode.Address == p.LocalNode.Address || superNode.Address == remoteAddr {
-						continue // Don't send to self or back to sender
-					}
-
-					go func(nodeAddr string) {
-						forwardConn, err := net.DialTimeout("tcp", nodeAddr, 5*time.Second)
-						if err != nil {
-							fmt.Printf("Failed to connect to SuperNode %s for message forwarding: %v\n", nodeAddr, err)
-							return
-						}
-						defer forwardConn.Close()
-
-						// Re-encrypt and send the message
-						forwardData, err := json.Marshal(message)
-						if err != nil {
-							fmt.Printf("Failed to re-serialize message: %v\n", err)
-							return
-						}
-
-						encryptedForwardData, err := encryptAES(p.MessageKey, forwardData)
-						if err != nil {
-							fmt.Printf("Failed to re-encrypt message: %v\n", err)
-							return
-						}
-
-						_, err = forwardConn.Write(encryptedForwardData)
-						if err != nil {
-							fmt.Printf("Failed to forward message to SuperNode %s: %v\n", nodeAddr, err)
-						}
-					}(superNode.Address)
-				}
+	// Check if message is for current room
+	if message.RoomID != r.Room.ID {
+		return ""
+	}
 
-				p.NodeMutex.RUnlock()
-			}
+	// Drop messages already displayed or delivered via another path
+	if message.ID == "" || message.SenderID == "" {
+		fmt.Printf("Dropping message without ID from %s\n", remoteAddr)
+		return ""
+	}
+	// Duplicates are still acknowledged so the sender stops retrying
+	if !r.SeenMessages.MarkSeen(messageKey(message)) {
+		return messageKey(message)
+	}
+
+	// Hearing from the sender means it's online
+	r.onNodeSeen(message.SenderID)
+
+	// Display message locally
+	r.displayMessage(message)
+	return messageKey(message)
+}
+
+// Queue a message for forwarding to another node, re-encrypted
+func (r *RoomSession) forwardMessage(message Message, node NodeInfo) {
+	seal, err := r.roomSealer(message)
+	if err != nil {
+		fmt.Printf("Failed to re-serialize message: %v\n", err)
+		return
+	}
+
+	r.Outbox.Enqueue(node, messageKey(message), FrameMessage, seal)
+}
+
+// Log and display a message. A message whose signature doesn't verify is
+// shown flagged, but never logged, stored or served to other members.
+func (r *RoomSession) displayMessage(message Message) {
+	if !verifyMessage(message) {
+		fmt.Printf("[%s] %s%s [unverified]: %s\n", message.Timestamp, r.roomTag(), message.Sender, message.Content)
+		return
+	}
+
+	if r.History.Add(message) && r.Store != nil {
+		if err := r.Store.AppendMessage(message); err != nil {
+			fmt.Printf("Failed to save message: %v\n", err)
 		}
+	}
 
-		// Display message locally if it's not a duplicate
-		fmt.Printf("[%s] %s: %s\n", message.Timestamp, message.Sender, message.Content)
+	// Node IDs are derived from public keys, so a verified message with our
+	// ID was signed with our key
+	if message.SenderID == r.LocalNode.ID {
+		fmt.Printf("[%s] %sMe: %s\n", message.Timestamp, r.roomTag(), message.Content)
+		return
 	}
+
+	// Flag nickname collisions with a different identity already in the room
+	r.NodeMutex.RLock()
+	impersonating := false
+	for _, node := range r.Room.Nodes {
+		if node.Nickname == message.Sender && node.ID != message.SenderID {
+			impersonating = true
+			break
+		}
+	}
+	r.NodeMutex.RUnlock()
+
+	if impersonating {
+		fmt.Printf("[%s] %s%s#%s [nickname in use by another node]: %s\n", message.Timestamp, r.roomTag(), message.Sender, shortID(message.SenderID), message.Content)
+		return
+	}
+
+	fmt.Printf("[%s] %s%s: %s\n", message.Timestamp, r.roomTag(), message.Sender, message.Content)
 }
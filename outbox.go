@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retry parameters for outgoing frames
+const (
+	outboxInitialBackoff = 500 * time.Millisecond
+	outboxMaxBackoff     = 30 * time.Second
+	outboxMaxAttempts    = 6
+	outboxTrackedLimit   = 100 // Own messages whose delivery status is kept
+	outboxQueueLimit     = 256 // Frames queued per peer before the oldest is dropped
+	outboxWaitInterval   = 50 * time.Millisecond
+)
+
+// DeliveryStatus is the delivery state of a message for one recipient
+type DeliveryStatus int
+
+const (
+	StatusPending DeliveryStatus = iota
+	StatusDelivered
+	StatusFailed
+)
+
+func (s DeliveryStatus) String() string {
+	switch s {
+	case StatusDelivered:
+		return "delivered"
+	case StatusFailed:
+		return "failed"
+	default:
+		return "pending"
+	}
+}
+
+// MessageStatus tracks per-recipient delivery of one of our own messages
+type MessageStatus struct {
+	Key        string
+	ID         string
+	Preview    string
+	Created    time.Time
+	Recipients map[string]DeliveryStatus // Recipient label -> status
+}
+
+// Summary counts recipients per status
+func (ms *MessageStatus) Summary() (pending, delivered, failed int) {
+	for _, status := range ms.Recipients {
+		switch status {
+		case StatusDelivered:
+			delivered++
+		case StatusFailed:
+			failed++
+		default:
+			pending++
+		}
+	}
+	return
+}
+
+// outboundItem is a frame waiting to be acknowledged by one peer
+type outboundItem struct {
+	key       string
+	frameType byte
+	seal      func() ([]byte, error) // Builds the payload for each attempt
+	payload   []byte                 // Payload of the latest attempt
+	node      NodeInfo
+	recipient string // Label used in status and errors
+	tracked   bool
+	attempts  int
+	retryAt   time.Time // When the next attempt is due
+}
+
+// peerQueue delivers frames to one peer. Frames are tried oldest first, but
+// one waiting to be retried doesn't hold up the frames behind it.
+type peerQueue struct {
+	addr    string
+	items   []*outboundItem
+	running bool
+	wake    chan struct{} // Signalled when a frame is queued
+}
+
+// Pick the oldest frame that is due. If none is, returns how long until the
+// first one is.
+func (q *peerQueue) next(now time.Time) (*outboundItem, time.Duration) {
+	wait := outboxMaxBackoff
+	for _, item := range q.items {
+		if !item.retryAt.After(now) {
+			return item, 0
+		}
+		wait = min(wait, item.retryAt.Sub(now))
+	}
+	return nil, wait
+}
+
+// Remove a frame from the queue. Returns false if it was already gone.
+func (q *peerQueue) remove(item *outboundItem) bool {
+	for i, queued := range q.items {
+		if queued == item {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Outbox queues outgoing frames per peer and retries them with exponential
+// backoff until the peer acknowledges them
+type Outbox struct {
+	mu       sync.Mutex
+	queues   map[string]*peerQueue // Peer address -> queue
+	statuses map[string]*MessageStatus
+	order    []string // Tracked message keys, oldest first
+	running  func() bool
+	conns    *ConnManager
+
+	// Called when a frame is given up on after all retries
+	OnFailure func(node NodeInfo, frameType byte, payload []byte)
+}
+
+// NewOutbox creates an outbox that delivers over conns and whose workers
+// stop once running returns false
+func NewOutbox(running func() bool, conns *ConnManager) *Outbox {
+	return &Outbox{
+		queues:   make(map[string]*peerQueue),
+		statuses: make(map[string]*MessageStatus),
+		running:  running,
+		conns:    conns,
+	}
+}
+
+// Track starts recording per-recipient delivery status for one of our own messages
+func (o *Outbox) Track(message Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := messageKey(message)
+	preview := message.Content
+	if runes := []rune(preview); len(runes) > 40 {
+		preview = string(runes[:40]) + "..."
+	}
+	o.statuses[key] = &MessageStatus{
+		Key:        key,
+		ID:         message.ID,
+		Preview:    preview,
+		Created:    time.Now(),
+		Recipients: make(map[string]DeliveryStatus),
+	}
+	o.order = append(o.order, key)
+
+	// Forget the oldest tracked messages
+	for len(o.order) > outboxTrackedLimit {
+		delete(o.statuses, o.order[0])
+		o.order = o.order[1:]
+	}
+}
+
+// Enqueue a frame for delivery to a node. key is the ID the node acknowledges.
+// seal builds the payload afresh for every attempt, so a retry after a rekey
+// is sealed under the new room key.
+func (o *Outbox) Enqueue(node NodeInfo, key string, frameType byte, seal func() ([]byte, error)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	item := &outboundItem{
+		key:       key,
+		frameType: frameType,
+		seal:      seal,
+		node:      node,
+		recipient: nodeLabel(node),
+	}
+	if status, ok := o.statuses[key]; ok {
+		item.tracked = true
+		status.Recipients[item.recipient] = StatusPending
+	}
+
+	queue, ok := o.queues[node.Address]
+	if !ok {
+		queue = &peerQueue{addr: node.Address, wake: make(chan struct{}, 1)}
+		o.queues[node.Address] = queue
+	}
+
+	// Don't let an unreachable peer pile up frames without limit
+	if len(queue.items) >= outboxQueueLimit {
+		dropped := queue.items[0]
+		queue.items = queue.items[1:]
+		o.setStatus(dropped, StatusFailed)
+		fmt.Printf("[System] Too many frames queued for %s, dropped the oldest\n", dropped.recipient)
+	}
+	queue.items = append(queue.items, item)
+
+	if !queue.running {
+		queue.running = true
+		go o.deliver(queue)
+	}
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Deliver queued frames to one peer until its queue is empty, then forget
+// the queue. Each frame is retried on its own schedule and given up on
+// after outboxMaxAttempts.
+func (o *Outbox) deliver(queue *peerQueue) {
+	for {
+		o.mu.Lock()
+		if len(queue.items) == 0 || !o.running() {
+			queue.running = false
+			if len(queue.items) == 0 && o.queues[queue.addr] == queue {
+				delete(o.queues, queue.addr)
+			}
+			o.mu.Unlock()
+			return
+		}
+		item, wait := queue.next(time.Now())
+		o.mu.Unlock()
+
+		// Everything is waiting to be retried: sleep until the first frame
+		// is due or a new one is queued
+		if item == nil {
+			select {
+			case <-queue.wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		payload, err := item.seal()
+		if err == nil {
+			err = o.conns.SendWithAck(queue.addr, item.frameType, payload, item.key)
+		}
+
+		o.mu.Lock()
+		if payload != nil {
+			item.payload = payload
+		}
+		item.attempts++
+		attempts := item.attempts
+		if err != nil && attempts < outboxMaxAttempts {
+			// Exponential backoff before retrying this frame
+			backoff := min(outboxInitialBackoff<<(attempts-1), outboxMaxBackoff)
+			item.retryAt = time.Now().Add(backoff)
+		}
+		o.mu.Unlock()
+
+		if err == nil {
+			o.finish(queue, item, StatusDelivered)
+			continue
+		}
+
+		if attempts >= outboxMaxAttempts {
+			fmt.Printf("[System] Delivery to %s failed after %d attempts: %v\n", item.recipient, attempts, err)
+			if o.finish(queue, item, StatusFailed) && o.OnFailure != nil && item.payload != nil {
+				o.OnFailure(item.node, item.frameType, item.payload)
+			}
+		}
+	}
+}
+
+// Wait until every frame queued under key has been delivered or given up
+// on. Returns false if some are still queued after timeout.
+func (o *Outbox) Wait(key string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if !o.pending(key) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(outboxWaitInterval)
+	}
+}
+
+// Check whether any frame queued under key is still waiting for delivery
+func (o *Outbox) pending(key string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, queue := range o.queues {
+		for _, item := range queue.items {
+			if item.key == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Take a frame off its queue and record its final status. Returns false if
+// the frame was already dropped to make room.
+func (o *Outbox) finish(queue *peerQueue, item *outboundItem, status DeliveryStatus) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !queue.remove(item) {
+		return false
+	}
+	o.setStatus(item, status)
+	return true
+}
+
+// Record the delivery status of a tracked frame. The caller holds o.mu.
+func (o *Outbox) setStatus(item *outboundItem, status DeliveryStatus) {
+	if item.tracked {
+		if ms, ok := o.statuses[item.key]; ok {
+			ms.Recipients[item.recipient] = status
+		}
+	}
+}
+
+// Recent returns up to n tracked messages, newest first
+func (o *Outbox) Recent(n int) []MessageStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var result []MessageStatus
+	for i := len(o.order) - 1; i >= 0 && len(result) < n; i-- {
+		result = append(result, o.copyStatus(o.statuses[o.order[i]]))
+	}
+	return result
+}
+
+// Lookup finds a tracked message by ID prefix
+func (o *Outbox) Lookup(idPrefix string) (MessageStatus, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i := len(o.order) - 1; i >= 0; i-- {
+		ms := o.statuses[o.order[i]]
+		if strings.HasPrefix(ms.ID, idPrefix) {
+			return o.copyStatus(ms), true
+		}
+	}
+	return MessageStatus{}, false
+}
+
+// Copy a status so callers can read it without holding the lock
+func (o *Outbox) copyStatus(ms *MessageStatus) MessageStatus {
+	result := *ms
+	result.Recipients = make(map[string]DeliveryStatus, len(ms.Recipients))
+	for recipient, status := range ms.Recipients {
+		result.Recipients[recipient] = status
+	}
+	return result
+}
+
+// Print delivery status for recent messages, or details for one message
+func (p *P2PChat) printDeliveryStatus(idPrefix string) {
+	if idPrefix != "" {
+		ms, ok := p.Outbox.Lookup(idPrefix)
+		if !ok {
+			fmt.Printf("No sent message with ID %s\n", idPrefix)
+			return
+		}
+
+		fmt.Printf("Message %s: %s\n", shortID(ms.ID), ms.Preview)
+		recipients := make([]string, 0, len(ms.Recipients))
+		for recipient := range ms.Recipients {
+			recipients = append(recipients, recipient)
+		}
+		sort.Strings(recipients)
+		for _, recipient := range recipients {
+			fmt.Printf("  %s: %s\n", recipient, ms.Recipients[recipient])
+		}
+		return
+	}
+
+	recent := p.Outbox.Recent(10)
+	if len(recent) == 0 {
+		fmt.Println("No messages sent yet")
+		return
+	}
+
+	fmt.Println("Recently sent messages:")
+	for _, ms := range recent {
+		pending, delivered, failed := ms.Summary()
+		fmt.Printf("  %s [%s] %s - %d delivered, %d pending, %d failed\n",
+			shortID(ms.ID), ms.Created.Format("15:04:05"), ms.Preview, delivered, pending, failed)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// Accept pooled connections on a loopback port as id, answering frames with
+// handler. Returns the address.
+func servePeer(t *testing.T, id *Identity, handler func(*Frame, string) (byte, []byte)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	addr := listener.Addr().String()
+	conns := NewConnManager(id, func() string { return addr },
+		func(string) (string, bool) { return "", false }, handler)
+	t.Cleanup(conns.CloseAll)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				reader := bufio.NewReader(conn)
+				frame, err := readFrame(reader)
+				if err != nil || frame.Type != FrameConnHello {
+					conn.Close()
+					return
+				}
+				conns.accept(conn, reader, frame.Payload)
+			}()
+		}
+	}()
+	return addr
+}
+
+// ackingPeer acknowledges every frame with a fixed key, recording the
+// payloads it receives
+type ackingPeer struct {
+	addr string
+
+	mu       sync.Mutex
+	payloads []string
+}
+
+func newAckingPeer(t *testing.T, ackKey string) *ackingPeer {
+	return newAckingPeerAs(t, testIdentity(t, 50), ackKey)
+}
+
+// Acking peer with the given identity, for peers that must pass as a member
+func newAckingPeerAs(t *testing.T, id *Identity, ackKey string) *ackingPeer {
+	peer := &ackingPeer{}
+	peer.addr = servePeer(t, id, func(frame *Frame, remoteAddr string) (byte, []byte) {
+		peer.mu.Lock()
+		peer.payloads = append(peer.payloads, string(frame.Payload))
+		peer.mu.Unlock()
+		return FrameAck, []byte(ackKey)
+	})
+	return peer
+}
+
+func (p *ackingPeer) received() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.payloads...)
+}
+
+// Outbox delivering over a fresh connection pool until the test ends
+func newTestOutbox(t *testing.T) *Outbox {
+	var stopped atomic.Bool
+	t.Cleanup(func() { stopped.Store(true) })
+	conns := NewConnManager(testIdentity(t, 51), func() string { return "" },
+		func(string) (string, bool) { return "", false },
+		func(*Frame, string) (byte, []byte) { return FrameAck, nil })
+	t.Cleanup(conns.CloseAll)
+	return NewOutbox(func() bool { return !stopped.Load() }, conns)
+}
+
+// Wait briefly for the outbox to drop every peer queue
+func outboxIdle(o *Outbox) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		o.mu.Lock()
+		idle := len(o.queues) == 0
+		o.mu.Unlock()
+		if idle {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOutboxDelivers(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+	}{
+		{"single frame", 1},
+		{"frames in order", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := newAckingPeer(t, "key")
+			outbox := newTestOutbox(t)
+			node := NodeInfo{ID: "peer", Address: peer.addr}
+
+			var want []string
+			for i := 0; i < tt.count; i++ {
+				payload := fmt.Sprint("frame ", i)
+				want = append(want, payload)
+				outbox.Enqueue(node, "key", FrameMessage, func() ([]byte, error) { return []byte(payload), nil })
+			}
+			if !outbox.Wait("key", 5*time.Second) {
+				t.Fatal("frames still queued")
+			}
+
+			got := peer.received()
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("peer received %q, want %q", got, want)
+			}
+			if !outboxIdle(outbox) {
+				t.Fatal("empty peer queue was not dropped")
+			}
+		})
+	}
+}
+
+func TestOutboxResealsEachAttempt(t *testing.T) {
+	peer := newAckingPeer(t, "key")
+	outbox := newTestOutbox(t)
+
+	// The first attempt fails to seal; the retry seals afresh
+	var attempts atomic.Int32
+	seal := func() ([]byte, error) {
+		n := attempts.Add(1)
+		if n == 1 {
+			return nil, errors.New("room key unavailable")
+		}
+		return []byte(fmt.Sprint("attempt ", n)), nil
+	}
+	outbox.Enqueue(NodeInfo{ID: "peer", Address: peer.addr}, "key", FrameMessage, seal)
+	if !outbox.Wait("key", 5*time.Second) {
+		t.Fatal("frame still queued")
+	}
+
+	if got := peer.received(); len(got) != 1 || got[0] != "attempt 2" {
+		t.Fatalf("peer received %q, want the payload sealed on the retry", got)
+	}
+	if attempts.Load() != 2 {
+		t.Fatalf("sealed %d times, want 2", attempts.Load())
+	}
+	if !outboxIdle(outbox) {
+		t.Fatal("empty peer queue was not dropped")
+	}
+}
+
+func TestOutboxWaitTimesOut(t *testing.T) {
+	// Nothing listens here, so the frame stays queued between retries
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	outbox := newTestOutbox(t)
+	outbox.Enqueue(NodeInfo{ID: "peer", Address: addr}, "key", FrameMessage, func() ([]byte, error) { return []byte("x"), nil })
+	if outbox.Wait("key", 100*time.Millisecond) {
+		t.Fatal("Wait reported an undeliverable frame as done")
+	}
+	if !outbox.Wait("other key", 0) {
+		t.Fatal("Wait blocked on a key that was never queued")
+	}
+}
+
+func TestOutboxRetryDoesNotBlockQueue(t *testing.T) {
+	peer := newAckingPeer(t, "key")
+	outbox := newTestOutbox(t)
+	node := NodeInfo{ID: "peer", Address: peer.addr}
+
+	// The first frame can't be sealed yet and waits to be retried
+	outbox.Enqueue(node, "stuck", FrameMessage, func() ([]byte, error) { return nil, errors.New("not yet") })
+	outbox.Enqueue(node, "key", FrameMessage, func() ([]byte, error) { return []byte("second"), nil })
+
+	if !outbox.Wait("key", outboxInitialBackoff/2) {
+		t.Fatal("frame behind a retrying one was held up")
+	}
+	if got := peer.received(); len(got) != 1 || got[0] != "second" {
+		t.Fatalf("peer received %q", got)
+	}
+	if !outbox.pending("stuck") {
+		t.Fatal("retrying frame was given up on early")
+	}
+}
+
+func TestOutboxQueueLimit(t *testing.T) {
+	// Nothing listens here, so frames stay queued
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	outbox := newTestOutbox(t)
+	node := NodeInfo{ID: "peer", Nickname: "peer", Address: addr}
+	first := Message{ID: "first", SenderID: "me", Content: "first"}
+	outbox.Track(first)
+	outbox.Enqueue(node, messageKey(first), FrameMessage, func() ([]byte, error) { return []byte("x"), nil })
+	for i := 0; i < outboxQueueLimit; i++ {
+		outbox.Enqueue(node, fmt.Sprint("key", i), FrameMessage, func() ([]byte, error) { return []byte("x"), nil })
+	}
+
+	outbox.mu.Lock()
+	queued := len(outbox.queues[addr].items)
+	outbox.mu.Unlock()
+	if queued != outboxQueueLimit {
+		t.Fatalf("%d frames queued, want %d", queued, outboxQueueLimit)
+	}
+	if outbox.pending(messageKey(first)) {
+		t.Fatal("oldest frame was not dropped")
+	}
+	status, _ := outbox.Lookup("first")
+	if _, _, failed := status.Summary(); failed != 1 {
+		t.Fatalf("dropped frame status = %v, want failed", status.Recipients)
+	}
+}
+
+func TestOutboxPreviewKeepsRunesWhole(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"short", "short"},
+		{strings.Repeat("a", 40), strings.Repeat("a", 40)},
+		{strings.Repeat("a", 41), strings.Repeat("a", 40) + "..."},
+		{strings.Repeat("你", 41), strings.Repeat("你", 40) + "..."},
+		{strings.Repeat("a", 39) + "你好", strings.Repeat("a", 39) + "你..."},
+	}
+	for _, tt := range tests {
+		outbox := NewOutbox(func() bool { return false }, nil)
+		outbox.Track(Message{ID: "id", SenderID: "me", Content: tt.content})
+		status, _ := outbox.Lookup("id")
+		if status.Preview != tt.want || !utf8.ValidString(status.Preview) {
+			t.Errorf("preview of %q = %q, want %q", tt.content, status.Preview, tt.want)
+		}
+	}
+}
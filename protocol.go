@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Wire protocol constants
+//
+// Every TCP frame is laid out as:
+//
+//	+----------------+---------+------+--------------------+------------------+
+//	| length (4, BE) | version | type | request ID (4, BE) | payload (length) |
+//	+----------------+---------+------+--------------------+------------------+
+//
+// The length field counts payload bytes only, so a reader always knows
+// exactly how much to consume before the next frame starts. On pooled
+// connections a request carries an ID its reply repeats; elsewhere it is 0.
+const (
+	ProtocolVersion   = 4 // v4: frames carry a request ID (v3: key epochs, v2: AES-GCM, v1: unauthenticated AES-CBC)
+	FrameHeaderLength = 10
+	MaxFrameSize      = 1 << 20 // 1 MiB payload limit
+)
+
+// Frame types
+const (
+	FrameMessage      byte = 0x01 // Encrypted chat Message
+	FrameNodeAnnounce byte = 0x02 // Encrypted NodeInfo of a newly admitted member
+	FrameRekey        byte = 0x03 // Signed rekeyNotice with a new room key per member, sealed under the old key
+	FrameAck          byte = 0x04 // Acknowledges a delivered frame by its message key
+	FrameHold         byte = 0x05 // Asks a SuperNode to hold a message for an offline member
+
+	FrameHistoryRequest  byte = 0x06 // Encrypted historyRequest
+	FrameHistoryResponse byte = 0x07 // Encrypted historyResponse
+
+	FrameFileOffer       byte = 0x08 // Encrypted, signed fileOffer
+	FrameFileAccept      byte = 0x09 // Encrypted fileAccept, acknowledged by the sender
+	FrameManifestRequest byte = 0x0A // Encrypted manifestRequest
+	FrameManifestPage    byte = 0x0B // Encrypted manifestPage
+	FrameChunkRequest    byte = 0x0C // Encrypted chunkRequest
+	FrameChunkData       byte = 0x0D // Encrypted chunkData
+	FrameHaveRequest     byte = 0x0E // Encrypted haveRequest
+	FrameHaveResponse    byte = 0x0F // Encrypted haveResponse
+
+	FrameJoinHello     byte = 0x10 // Join handshake: joiner ephemeral key
+	FrameJoinChallenge byte = 0x11 // Join handshake: member ephemeral key
+	FrameJoinConfirm   byte = 0x12 // Join handshake: joiner proof of passphrase
+	FrameJoinAccept    byte = 0x13 // Join handshake: room key and node list
+	FrameJoinReject    byte = 0x14 // Join handshake: reason for rejection
+
+	FrameDirectMessage byte = 0x15 // Encrypted directEnvelope with a DirectMessage sealed to the recipient
+	FrameLeave         byte = 0x16 // Encrypted, signed leaveNotice
+	FrameHeartbeat     byte = 0x17 // Encrypted, signed heartbeat
+	FrameElection      byte = 0x18 // Encrypted, signed electionNotice
+	FrameRelay         byte = 0x19 // Encrypted relayEnvelope to pass along the SuperNode tree
+	FrameGossip        byte = 0x1A // Encrypted gossipEnvelope to push on to random members
+	FrameGossipPull    byte = 0x1B // Encrypted gossipPull, answered with a historyResponse
+	FrameConnHello     byte = 0x1C // Signed connHello authenticating a pooled connection
+	FrameRendezvous    byte = 0x1D // Encrypted rendezvousOffer to pass on to the member it names
+	FrameTunnelBind    byte = 0x1E // tunnelBind asking a relay to join a tunnel, encrypted unless for a relay server
+	FrameTunnelReady   byte = 0x1F // Relay joined both ends of a tunnel
+)
+
+// Frame errors
+var (
+	ErrFrameTooLarge      = errors.New("frame exceeds maximum size")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+// Frame is a single decoded protocol frame
+type Frame struct {
+	Version byte
+	Type    byte
+	ID      uint32 // Request ID a reply repeats, 0 if none
+	Payload []byte
+}
+
+// Check whether a frame is a reply to a request
+func isReplyFrame(frameType byte) bool {
+	switch frameType {
+	case FrameAck, FrameHistoryResponse, FrameManifestPage, FrameChunkData, FrameHaveResponse:
+		return true
+	}
+	return false
+}
+
+// Check whether a frame is a request answered with exactly one reply. A
+// request that is refused or can't be handled is answered with an empty
+// FrameAck.
+func expectsReply(frameType byte) bool {
+	switch frameType {
+	case FrameMessage, FrameRekey, FrameRelay, FrameGossip, FrameGossipPull, FrameDirectMessage, FrameLeave,
+		FrameElection, FrameHeartbeat, FrameHold, FrameHistoryRequest, FrameFileOffer, FrameFileAccept,
+		FrameManifestRequest, FrameChunkRequest, FrameHaveRequest, FrameRendezvous:
+		return true
+	}
+	return false
+}
+
+// Check that a peer advertising peerVersion speaks our protocol version.
+// Frames and envelopes are only accepted at exactly ProtocolVersion, so
+// there is nothing to negotiate: any other version is rejected up front.
+// Peers that predate version advertising report 0.
+func checkVersion(peerVersion int) error {
+	switch {
+	case peerVersion == ProtocolVersion:
+		return nil
+	case peerVersion == 0:
+		return fmt.Errorf("%w: peer uses the legacy unversioned protocol", ErrUnsupportedVersion)
+	default:
+		return fmt.Errorf("%w: peer speaks v%d, this node speaks v%d", ErrUnsupportedVersion, peerVersion, ProtocolVersion)
+	}
+}
+
+// Encode a frame into its wire representation
+func encodeFrame(frameType byte, id uint32, payload []byte) ([]byte, error) {
+	if len(payload) > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrFrameTooLarge, len(payload), MaxFrameSize)
+	}
+
+	buf := make([]byte, 0, FrameHeaderLength+len(payload))
+	buf = append(buf, uint32ToBytes(uint32(len(payload)))...)
+	buf = append(buf, ProtocolVersion, frameType)
+	buf = append(buf, uint32ToBytes(id)...)
+	buf = append(buf, payload...)
+	return buf, nil
+}
+
+// Write a single frame without a request ID to w
+func writeFrame(w io.Writer, frameType byte, payload []byte) error {
+	return writeFrameID(w, frameType, 0, payload)
+}
+
+// Write a single frame with a request ID to w
+func writeFrameID(w io.Writer, frameType byte, id uint32, payload []byte) error {
+	data, err := encodeFrame(frameType, id, payload)
+	if err != nil {
+		return err
+	}
+
+	// Write header and payload in one call so concurrent writers can't interleave
+	_, err = w.Write(data)
+	return err
+}
+
+// Read a single frame from r
+func readFrame(r io.Reader) (*Frame, error) {
+	header := make([]byte, FrameHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := bytesToUint32(header[0:4])
+	if length > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrFrameTooLarge, length, MaxFrameSize)
+	}
+
+	frame := &Frame{
+		Version: header[4],
+		Type:    header[5],
+		ID:      bytesToUint32(header[6:10]),
+	}
+	if frame.Version != ProtocolVersion {
+		return nil, fmt.Errorf("%w: peer speaks v%d, this node speaks v%d", ErrUnsupportedVersion, frame.Version, ProtocolVersion)
+	}
+
+	frame.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return frame, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		frameType byte
+		payload   []byte
+	}{
+		{"empty", FrameAck, nil},
+		{"small", FrameMessage, []byte("hello")},
+		{"binary", FrameChunkData, []byte{0, 1, 2, 0xff, 0xfe}},
+		{"max size", FrameChunkData, bytes.Repeat([]byte{'x'}, MaxFrameSize)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeFrame(&buf, tt.frameType, tt.payload); err != nil {
+				t.Fatalf("writeFrame: %v", err)
+			}
+			if buf.Len() != FrameHeaderLength+len(tt.payload) {
+				t.Fatalf("encoded %d bytes, want %d", buf.Len(), FrameHeaderLength+len(tt.payload))
+			}
+
+			frame, err := readFrame(&buf)
+			if err != nil {
+				t.Fatalf("readFrame: %v", err)
+			}
+			if frame.Version != ProtocolVersion || frame.Type != tt.frameType {
+				t.Fatalf("got v%d type %#x, want v%d type %#x", frame.Version, frame.Type, ProtocolVersion, tt.frameType)
+			}
+			if !bytes.Equal(frame.Payload, tt.payload) {
+				t.Fatalf("payload mismatch")
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("%d bytes left over", buf.Len())
+			}
+		})
+	}
+}
+
+func TestFrameSequence(t *testing.T) {
+	var buf bytes.Buffer
+	payloads := [][]byte{[]byte("one"), nil, []byte("three")}
+	for i, payload := range payloads {
+		if err := writeFrameID(&buf, byte(i+1), uint32(i), payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, payload := range payloads {
+		frame, err := readFrame(&buf)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if frame.Type != byte(i+1) || frame.ID != uint32(i) || !bytes.Equal(frame.Payload, payload) {
+			t.Fatalf("frame %d: got type %#x ID %d payload %q", i, frame.Type, frame.ID, frame.Payload)
+		}
+	}
+	if _, err := readFrame(&buf); err != io.EOF {
+		t.Fatalf("after last frame: got %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrameRejectsBadInput(t *testing.T) {
+	valid, err := encodeFrame(FrameMessage, 0, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withVersion := func(version byte) []byte {
+		data := append([]byte(nil), valid...)
+		data[4] = version
+		return data
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, io.EOF},
+		{"truncated header", valid[:3], io.ErrUnexpectedEOF},
+		{"truncated payload", valid[:len(valid)-1], io.ErrUnexpectedEOF},
+		{"header only", valid[:FrameHeaderLength], io.ErrUnexpectedEOF},
+		{"oversized", append(uint32ToBytes(MaxFrameSize+1), ProtocolVersion, FrameMessage, 0, 0, 0, 0), ErrFrameTooLarge},
+		{"old version", withVersion(ProtocolVersion - 1), ErrUnsupportedVersion},
+		{"unversioned", withVersion(0), ErrUnsupportedVersion},
+		{"newer version", withVersion(ProtocolVersion + 1), ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := readFrame(bytes.NewReader(tt.data))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got frame %v, err %v; want %v", frame, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeFrameTooLarge(t *testing.T) {
+	if _, err := encodeFrame(FrameChunkData, 0, make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, FrameChunkData, make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("wrote %d bytes of an oversized frame", buf.Len())
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	tests := []struct {
+		version int
+		ok      bool
+	}{
+		{ProtocolVersion, true},
+		{0, false},
+		{ProtocolVersion - 1, false},
+		{ProtocolVersion + 1, false},
+	}
+	for _, tt := range tests {
+		err := checkVersion(tt.version)
+		if tt.ok && err != nil {
+			t.Errorf("checkVersion(%d) = %v, want nil", tt.version, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("checkVersion(%d) = %v, want ErrUnsupportedVersion", tt.version, err)
+		}
+	}
+}
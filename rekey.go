@@ -0,0 +1,449 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long envelopes sealed under a superseded room key are still accepted
+const rekeyGracePeriod = 30 * time.Second
+
+// RoomKeyring holds the current room key and recently retired ones, indexed
+// by epoch, so in-flight messages sealed before a rekey still open.
+type RoomKeyring struct {
+	mu      sync.RWMutex
+	epoch   uint32
+	issuer  string // Node that issued the current epoch
+	keys    map[uint32][]byte
+	retired map[uint32]time.Time // When superseded epochs stop being accepted
+}
+
+// NewRoomKeyring creates a keyring whose current key is key at epoch
+func NewRoomKeyring(key []byte, epoch uint32, issuer string) *RoomKeyring {
+	return &RoomKeyring{
+		epoch:   epoch,
+		issuer:  issuer,
+		keys:    map[uint32][]byte{epoch: key},
+		retired: make(map[uint32]time.Time),
+	}
+}
+
+// Current returns the current epoch and key
+func (kr *RoomKeyring) Current() (uint32, []byte) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.epoch, kr.keys[kr.epoch]
+}
+
+// Issuer returns the node that issued the current epoch
+func (kr *RoomKeyring) Issuer() string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.issuer
+}
+
+// Install makes key the current key at epoch, retiring the previous one
+func (kr *RoomKeyring) Install(epoch uint32, key []byte, issuer string) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	now := time.Now()
+	if epoch != kr.epoch {
+		kr.retired[kr.epoch] = now.Add(rekeyGracePeriod)
+	}
+	kr.epoch = epoch
+	kr.issuer = issuer
+	kr.keys[epoch] = key
+	delete(kr.retired, epoch)
+
+	// Forget keys whose grace period is over
+	for e, deadline := range kr.retired {
+		if now.After(deadline) {
+			delete(kr.keys, e)
+			delete(kr.retired, e)
+		}
+	}
+}
+
+// key returns the key for epoch if it is current or still in its grace period
+func (kr *RoomKeyring) key(epoch uint32) ([]byte, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	key, ok := kr.keys[epoch]
+	if !ok {
+		return nil, false
+	}
+	if deadline, retired := kr.retired[epoch]; retired && time.Now().After(deadline) {
+		return nil, false
+	}
+	return key, true
+}
+
+// Seal data under the current room key
+func (kr *RoomKeyring) Seal(roomID string, plaintext []byte) ([]byte, error) {
+	epoch, key := kr.Current()
+	return sealEnvelope(key, epoch, roomID, plaintext)
+}
+
+// Open an envelope sealed under the current or a recently retired room key
+func (kr *RoomKeyring) Open(roomID string, envelope []byte) ([]byte, error) {
+	epoch, err := envelopeEpoch(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := kr.key(epoch)
+	if !ok {
+		return nil, fmt.Errorf("no room key for epoch %d (expired or not yet received)", epoch)
+	}
+	return openEnvelope(key, roomID, envelope)
+}
+
+// rekeyNotice distributes a new room key, encrypted to each remaining member.
+// It is sealed under the room key it replaces.
+type rekeyNotice struct {
+	RoomID    string            `json:"room_id"`
+	Epoch     uint32            `json:"epoch"`
+	Keys      map[string]string `json:"keys"`              // Node ID -> sealed room key (base64)
+	Removed   []string          `json:"removed,omitempty"` // Every node removed from the room so far
+	IssuerID  string            `json:"issuer_id"`
+	PublicKey string            `json:"public_key"`
+	Signature string            `json:"signature"`
+}
+
+// rekeySecret is what a rekey notice seals to each member
+type rekeySecret struct {
+	Key     []byte `json:"key"`
+	JoinPSK []byte `json:"join_psk,omitempty"` // Replacement stretched passphrase, set when a member was removed
+}
+
+// Key the recipients of a rekey notice acknowledge it under
+func (n rekeyNotice) key() string {
+	return "rekey:" + n.IssuerID + ":" + strconv.FormatUint(uint64(n.Epoch), 10)
+}
+
+// Bytes covered by a rekey notice signature
+func rekeySigningBytes(notice rekeyNotice) []byte {
+	notice.Signature = ""
+	data, _ := json.Marshal(notice)
+	return data
+}
+
+// Associated data context for a room key sealed to one member
+func rekeyContext(roomID string, epoch uint32, nodeID string) string {
+	return fmt.Sprintf("rekey:%s:%d:%s", roomID, epoch, nodeID)
+}
+
+// Check whether nodeID may issue rekeys and removals: only the room
+// creator. SuperNodes are chosen by an election any member can sway, so
+// they aren't trusted to lock members out.
+func (r *RoomSession) isRekeyAuthority(nodeID string) bool {
+	return nodeID == r.Room.CreatorID
+}
+
+// Rekey generates a new room key and distributes it to every remaining
+// member. Nodes listed in removed are excluded, dropped by every peer and
+// refused if they try to join again. A removed node still knows the
+// passphrase and could rejoin under a new identity, so removing anyone also
+// replaces the passphrase.
+func (r *RoomSession) Rekey(removed []string) error {
+	if !r.isRekeyAuthority(r.LocalNode.ID) {
+		return fmt.Errorf("only the room creator can rotate the room key")
+	}
+	r.denyNodes(removed)
+
+	key := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	secret := rekeySecret{Key: key}
+	var passphrase string
+	if len(removed) > 0 {
+		var err error
+		if passphrase, err = generatePassphrase(); err != nil {
+			return err
+		}
+		if secret.JoinPSK, err = derivePassphraseKey(r.Room.ID, passphrase); err != nil {
+			return err
+		}
+	}
+	secretData, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+
+	currentEpoch, _ := r.Keyring.Current()
+	notice := rekeyNotice{
+		RoomID:  r.Room.ID,
+		Epoch:   currentEpoch + 1,
+		Keys:    make(map[string]string),
+		Removed: r.removedIDs(),
+	}
+
+	// Encrypt the new key to each remaining member. The member list only
+	// holds nodes admitted by the join handshake or vouched for under the
+	// room key, never ones that were merely heard broadcasting.
+	r.NodeMutex.RLock()
+	var recipients []NodeInfo
+	for _, node := range r.Room.Nodes {
+		if node.ID == r.LocalNode.ID || r.removed[node.ID] {
+			continue
+		}
+		if node.KexKey == "" {
+			fmt.Printf("[System] Warning: %s has no key exchange key and will not receive the new room key\n", node.Nickname)
+			continue
+		}
+		sealed, err := sealForRecipient(node.KexKey, rekeyContext(notice.RoomID, notice.Epoch, node.ID), secretData)
+		if err != nil {
+			fmt.Printf("[System] Failed to encrypt room key for %s: %v\n", node.Nickname, err)
+			continue
+		}
+		notice.Keys[node.ID] = base64.StdEncoding.EncodeToString(sealed)
+		recipients = append(recipients, node)
+	}
+	r.NodeMutex.RUnlock()
+
+	notice.IssuerID = r.LocalNode.ID
+	notice.PublicKey = r.Identity.EncodedPublicKey()
+	notice.Signature = r.Identity.Sign(rekeySigningBytes(notice))
+
+	// Seal under the key being replaced, so only members can read or send it
+	data, err := r.sealRoomJSON(notice)
+	if err != nil {
+		return err
+	}
+
+	r.Keyring.Install(notice.Epoch, key, r.LocalNode.ID)
+	if secret.JoinPSK != nil {
+		r.setJoinPassphrase(passphrase, secret.JoinPSK)
+	}
+	r.saveRoomState()
+
+	// Members that miss the notice would be locked out once the old key
+	// expires, so it is retried until acknowledged. It stays sealed under
+	// the old key, which is what recipients still hold.
+	seal := func() ([]byte, error) { return data, nil }
+	for _, node := range recipients {
+		r.Outbox.Enqueue(node, notice.key(), FrameRekey, seal)
+	}
+
+	fmt.Printf("[System] Room key rotated (epoch %d, %d members)\n", notice.Epoch, len(recipients)+1)
+	if secret.JoinPSK != nil {
+		fmt.Printf("[System] Room passphrase changed to %s; the old one no longer lets anyone join. Share the new one with the people you want to invite\n", passphrase)
+	}
+
+	// The new key reshuffles the candidate ranks
+	r.runElection()
+	return nil
+}
+
+// Handle a rekey notice from the room creator. Returns the key to
+// acknowledge, or "" if the notice was invalid.
+func (r *RoomSession) handleRekey(data []byte, remoteAddr string) string {
+	var notice rekeyNotice
+	if err := json.Unmarshal(data, &notice); err != nil {
+		fmt.Printf("Invalid rekey notice from %s: %v\n", remoteAddr, err)
+		return ""
+	}
+	if notice.RoomID != r.Room.ID {
+		return ""
+	}
+	if !verifySignature(notice.IssuerID, notice.PublicKey, notice.Signature, rekeySigningBytes(notice)) {
+		fmt.Printf("[System] Warning: ignoring unverified rekey notice from %s\n", remoteAddr)
+		return ""
+	}
+	if !r.isRekeyAuthority(notice.IssuerID) {
+		fmt.Printf("[System] Warning: ignoring rekey from %s, which is not the room creator\n", shortID(notice.IssuerID))
+		return ""
+	}
+
+	// Removals stand even if the key in the notice is stale
+	for _, nodeID := range notice.Removed {
+		if nodeID == r.LocalNode.ID {
+			fmt.Println("[System] You were removed from the room; you will no longer receive messages")
+			return notice.key()
+		}
+	}
+	r.denyNodes(notice.Removed)
+	for _, nodeID := range notice.Removed {
+		if node, ok := r.dropRoomNode(nodeID); ok {
+			fmt.Printf("[System] Node %s was removed from the room\n", node.Nickname)
+		}
+	}
+	if len(notice.Removed) > 0 {
+		r.saveRoomState()
+	}
+
+	// Concurrent rekeys for the same epoch are resolved in favour of the lower issuer ID
+	currentEpoch, _ := r.Keyring.Current()
+	if notice.Epoch < currentEpoch ||
+		(notice.Epoch == currentEpoch && notice.IssuerID >= r.Keyring.Issuer()) {
+		return notice.key()
+	}
+
+	encoded, ok := notice.Keys[r.LocalNode.ID]
+	if !ok {
+		fmt.Println("[System] Warning: room key was rotated but no key was included for this node")
+		return notice.key()
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return notice.key()
+	}
+	secretData, err := r.Identity.OpenSealed(rekeyContext(notice.RoomID, notice.Epoch, r.LocalNode.ID), sealed)
+	var secret rekeySecret
+	if err == nil {
+		err = json.Unmarshal(secretData, &secret)
+	}
+	if err == nil && len(secret.Key) != 16 {
+		err = fmt.Errorf("invalid key length %d", len(secret.Key))
+	}
+	if err != nil {
+		fmt.Printf("[System] Failed to decrypt new room key: %v\n", err)
+		return notice.key()
+	}
+
+	r.Keyring.Install(notice.Epoch, secret.Key, notice.IssuerID)
+	if len(secret.JoinPSK) > 0 {
+		r.setJoinPassphrase("", secret.JoinPSK)
+	}
+	r.saveRoomState()
+	fmt.Printf("[System] Room key rotated by %s (epoch %d)\n", shortID(notice.IssuerID), notice.Epoch)
+	if len(secret.JoinPSK) > 0 {
+		fmt.Printf("[System] The room passphrase was changed after a removal; ask %s for the new one before inviting anyone\n", shortID(notice.IssuerID))
+	}
+	r.runElection()
+	return notice.key()
+}
+
+// Drop a node from the room without rotating the key
+func (r *RoomSession) dropRoomNode(nodeID string) (NodeInfo, bool) {
+	r.NodeMutex.Lock()
+	var removed NodeInfo
+	found := false
+	for i, node := range r.Room.Nodes {
+		if node.ID == nodeID {
+			removed = node
+			found = true
+			r.Room.Nodes = append(r.Room.Nodes[:i], r.Room.Nodes[i+1:]...)
+			break
+		}
+	}
+	r.NodeMutex.Unlock()
+
+	if found {
+		r.SuperNodeMgr.HandleNodeLeave(nodeID)
+		r.saveRoomState()
+		r.runElection()
+	}
+	return removed, found
+}
+
+// Drop a node that left the room. If this node is the room creator, the
+// room key is rotated so the node can't read future traffic. Unlike /remove, this
+// doesn't stop it from joining again.
+func (r *RoomSession) removeRoomNode(nodeID string) (NodeInfo, bool) {
+	node, ok := r.dropRoomNode(nodeID)
+	if !ok {
+		return node, false
+	}
+
+	if r.isRekeyAuthority(r.LocalNode.ID) {
+		if err := r.Rekey(nil); err != nil {
+			fmt.Printf("[System] Failed to rotate room key: %v\n", err)
+		}
+	}
+	return node, true
+}
+
+// Add nodes to the room's removed list, which the join handshake checks.
+// The caller saves the room state.
+func (r *RoomSession) denyNodes(nodeIDs []string) {
+	r.NodeMutex.Lock()
+	defer r.NodeMutex.Unlock()
+	for _, nodeID := range nodeIDs {
+		r.removed[nodeID] = true
+	}
+}
+
+// Replace the passphrase join handshakes are checked against. passphrase is
+// empty on members that were only sent the stretched key.
+func (r *RoomSession) setJoinPassphrase(passphrase string, psk []byte) {
+	r.NodeMutex.Lock()
+	defer r.NodeMutex.Unlock()
+	r.Room.Passphrase = passphrase
+	r.joinPSK = psk
+}
+
+// Stretched passphrase join handshakes are currently checked against
+func (r *RoomSession) currentJoinPSK() []byte {
+	r.NodeMutex.RLock()
+	defer r.NodeMutex.RUnlock()
+	return r.joinPSK
+}
+
+// Check whether a node was removed from the room
+func (r *RoomSession) isRemoved(nodeID string) bool {
+	r.NodeMutex.RLock()
+	defer r.NodeMutex.RUnlock()
+	return r.removed[nodeID]
+}
+
+// IDs of every node removed from the room, sorted
+func (r *RoomSession) removedIDs() []string {
+	r.NodeMutex.RLock()
+	defer r.NodeMutex.RUnlock()
+	ids := make([]string, 0, len(r.removed))
+	for nodeID := range r.removed {
+		ids = append(ids, nodeID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Find a room node by exact ID
+func (r *RoomSession) findRoomNodeByID(nodeID string) (NodeInfo, bool) {
+	r.NodeMutex.RLock()
+	defer r.NodeMutex.RUnlock()
+	for _, node := range r.Room.Nodes {
+		if node.ID == nodeID {
+			return node, true
+		}
+	}
+	return NodeInfo{}, false
+}
+
+// Find a room node by nickname or node ID prefix. Ambiguous queries fail.
+func (r *RoomSession) findRoomNode(query string) (NodeInfo, error) {
+	r.NodeMutex.RLock()
+	defer r.NodeMutex.RUnlock()
+
+	var matches []NodeInfo
+	for _, node := range r.Room.Nodes {
+		if node.Nickname == query || (len(query) >= 4 && len(node.ID) >= len(query) && node.ID[:len(query)] == query) {
+			matches = append(matches, node)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return NodeInfo{}, fmt.Errorf("no node matching %q in room", query)
+	case 1:
+		return matches[0], nil
+	default:
+		ids := make([]string, len(matches))
+		for i, node := range matches {
+			ids[i] = shortID(node.ID)
+		}
+		sort.Strings(ids)
+		return NodeInfo{}, fmt.Errorf("%q is ambiguous, use a node ID (%v)", query, ids)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SuperNode relay
+//
+// In SuperNode mode every regular node relays through one SuperNode, and
+// the SuperNodes form a tree (see SuperNodeManager.TreeNeighbors). A message
+// travels up to the sender's SuperNode in a FrameRelay, is passed along the
+// tree to every other SuperNode, and each SuperNode delivers it to its own
+// regular nodes in a plain FrameMessage, which is never forwarded again. A
+// tree has no loops, so every member gets each message once.
+//
+// When a SuperNode can't be reached, the frames it should have relayed fall
+// back to direct delivery (see holdUndelivered). Members drop the duplicates
+// this can cause.
+
+// relayEnvelope carries a message along the SuperNode tree
+type relayEnvelope struct {
+	Via     string  `json:"via"` // Member the relay frame came from
+	Message Message `json:"message"`
+}
+
+// Handle a message relayed by a member. Returns the key to acknowledge, or
+// "" if the frame was invalid.
+func (r *RoomSession) handleRelayFrame(data []byte, remoteAddr string) string {
+	var envelope relayEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		fmt.Printf("Invalid relayed message from %s: %v\n", remoteAddr, err)
+		return ""
+	}
+	message := envelope.Message
+	if message.RoomID != r.Room.ID {
+		return ""
+	}
+	if message.ID == "" || message.SenderID == "" {
+		fmt.Printf("Dropping message without ID from %s\n", remoteAddr)
+		return ""
+	}
+	// Duplicates are still acknowledged so the sender stops retrying
+	if !r.SeenMessages.MarkSeen(messageKey(message)) {
+		return messageKey(message)
+	}
+
+	r.onNodeSeen(message.SenderID)
+	r.relayMessage(message, envelope.Via)
+	r.displayMessage(message)
+	return messageKey(message)
+}
+
+// Pass a message on from the local node, which received it from via. A
+// SuperNode passes it along the tree and delivers it to its own regular
+// nodes; a node that was sent a relay frame without being a SuperNode (yet)
+// delivers it to every member itself.
+func (r *RoomSession) relayMessage(message Message, via string) {
+	if !r.SuperNodeMgr.IsLocalNodeSuperNode() {
+		r.NodeMutex.RLock()
+		defer r.NodeMutex.RUnlock()
+		for _, node := range r.Room.Nodes {
+			if node.ID == r.LocalNode.ID || node.ID == message.SenderID || node.ID == via {
+				continue
+			}
+			r.forwardMessage(message, node)
+		}
+		return
+	}
+
+	envelope := relayEnvelope{Via: r.LocalNode.ID, Message: message}
+	seal, err := r.roomSealer(envelope)
+	if err != nil {
+		fmt.Printf("Failed to encode relayed message: %v\n", err)
+		return
+	}
+	for _, node := range r.SuperNodeMgr.TreeNeighbors() {
+		if node.ID == via {
+			continue
+		}
+		r.Outbox.Enqueue(node, messageKey(message), FrameRelay, seal)
+	}
+
+	for _, node := range r.SuperNodeMgr.ServedNodes() {
+		if node.ID == message.SenderID || node.ID == via {
+			continue
+		}
+		// Hold messages for members that have gone quiet
+		if r.isNodeOffline(node.ID) {
+			r.OfflineStore.Hold(node.ID, message)
+			continue
+		}
+		r.forwardMessage(message, node)
+	}
+}
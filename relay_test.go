@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// SuperNode manager for local in a room where elected were elected in that
+// order and regular are the other members
+func treeManager(local string, elected []string, regular ...string) *SuperNodeManager {
+	sm := NewSuperNodeManager(NodeInfo{ID: local}, NewRoomKeyring(testKey(1), 0, "creator"), 0, 0, false)
+	for _, nodeID := range append(slices.Clone(elected), regular...) {
+		if nodeID != local {
+			sm.AddNode(NodeInfo{ID: nodeID})
+		}
+	}
+	sm.ApplyElection(1, "coordinator", elected)
+	return sm
+}
+
+// IDs of nodes
+func nodeIDs(nodes []NodeInfo) []string {
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ID
+	}
+	return ids
+}
+
+func TestTreeNeighbors(t *testing.T) {
+	var elected []string
+	for i := 0; i < 14; i++ {
+		elected = append(elected, fmt.Sprintf("s%02d", i))
+	}
+
+	tests := []struct {
+		local string
+		want  []string
+	}{
+		{"s00", []string{"s01", "s02", "s03"}},
+		{"s01", []string{"s00", "s04", "s05", "s06"}},
+		{"s03", []string{"s00", "s10", "s11", "s12"}},
+		{"s04", []string{"s01", "s13"}},
+		{"s13", []string{"s04"}},
+	}
+	for _, tt := range tests {
+		if got := nodeIDs(treeManager(tt.local, elected).TreeNeighbors()); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: neighbors %v, want %v", tt.local, got, tt.want)
+		}
+	}
+	if got := treeManager("regular", elected, "regular").TreeNeighbors(); got != nil {
+		t.Errorf("regular node has tree neighbors %v", nodeIDs(got))
+	}
+
+	// The links every SuperNode sees form one tree: as many links as
+	// SuperNodes less one, all reachable from the root
+	links := make(map[string][]string)
+	count := 0
+	for _, local := range elected {
+		for _, neighbor := range nodeIDs(treeManager(local, elected).TreeNeighbors()) {
+			links[local] = append(links[local], neighbor)
+			count++
+		}
+	}
+	if count != 2*(len(elected)-1) {
+		t.Fatalf("%d links, want %d", count/2, len(elected)-1)
+	}
+	reached := map[string]bool{elected[0]: true}
+	for queue := []string{elected[0]}; len(queue) > 0; queue = queue[1:] {
+		for _, neighbor := range links[queue[0]] {
+			if !slices.Contains(links[neighbor], queue[0]) {
+				t.Fatalf("%s links to %s but not back", queue[0], neighbor)
+			}
+			if !reached[neighbor] {
+				reached[neighbor] = true
+				queue = append(queue, neighbor)
+			}
+		}
+	}
+	if len(reached) != len(elected) {
+		t.Fatalf("%d of %d SuperNodes reachable from the root", len(reached), len(elected))
+	}
+
+	// SuperNodes that left are skipped
+	sm := treeManager("s00", elected)
+	sm.HandleNodeLeave("s02")
+	if got := nodeIDs(sm.TreeNeighbors()); !slices.Equal(got, []string{"s01", "s03", "s04"}) {
+		t.Fatalf("neighbors after s02 left: %v", got)
+	}
+}
+
+func TestServedNodes(t *testing.T) {
+	elected := []string{"root", "child"}
+	regular := []string{"on-root", "on-child", "unattached", "switched"}
+	attach := func(sm *SuperNodeManager) {
+		sm.UpdateCapacity("on-root", nodeCapacity{SuperNode: "root"})
+		sm.UpdateCapacity("on-child", nodeCapacity{SuperNode: "child"})
+		sm.UpdateCapacity("switched", nodeCapacity{SuperNode: "child"})
+		sm.UpdateCapacity("switched", nodeCapacity{SuperNode: "root"})
+	}
+
+	tests := []struct {
+		local string
+		want  []string
+	}{
+		{"root", []string{"on-root", "unattached", "switched"}},
+		{"child", []string{"on-child", "switched"}}, // switched is still in its grace period
+		{"on-root", nil},
+	}
+	for _, tt := range tests {
+		sm := treeManager(tt.local, elected, regular...)
+		attach(sm)
+		got := nodeIDs(sm.ServedNodes())
+		slices.Sort(got)
+		slices.Sort(tt.want)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s serves %v, want %v", tt.local, got, tt.want)
+		}
+	}
+
+	// Once the grace period is over, only the new SuperNode serves it
+	sm := treeManager("child", elected, regular...)
+	attach(sm)
+	sm.mu.Lock()
+	for i := range sm.supernodes {
+		sm.supernodes[i].switchedAt = time.Now().Add(-attachmentGrace)
+	}
+	sm.mu.Unlock()
+	if got := nodeIDs(sm.ServedNodes()); !slices.Equal(got, []string{"on-child"}) {
+		t.Fatalf("child serves %v after the grace period", got)
+	}
+}
+
+func TestRelayTreeDeliversToEveryMember(t *testing.T) {
+	var nodes []*P2PChat
+	for seed := byte(112); seed < 119; seed++ {
+		nodes = append(nodes, testNode(t, seed))
+	}
+	rooms := testRoom(t, "relay-tree", nodes...)
+
+	// Elect three SuperNodes everywhere, superseding any real election
+	superNodes := []*RoomSession{rooms[0], rooms[1], rooms[2]}
+	elected := []string{rooms[0].LocalNode.ID, rooms[1].LocalNode.ID, rooms[2].LocalNode.ID}
+	for _, room := range rooms {
+		_, issuer := room.SuperNodeMgr.Term()
+		if issuer == "" {
+			issuer = room.LocalNode.ID
+		}
+		room.SuperNodeMgr.ApplyElection(math.MaxUint64, issuer, elected)
+	}
+	for _, room := range superNodes {
+		if !room.SuperNodeMgr.IsLocalNodeSuperNode() {
+			t.Fatal("SuperNode not elected")
+		}
+	}
+
+	// A regular node's message goes up to its SuperNode and along the tree
+	sender := rooms[len(rooms)-1]
+	if err := sender.SendMessage("through the tree"); err != nil {
+		t.Fatal(err)
+	}
+	if sender.SuperNodeMgr.AttachedSuperNode() == "" {
+		t.Fatal("sender didn't relay through a SuperNode")
+	}
+	for _, room := range rooms[:len(rooms)-1] {
+		received := func() bool { last, ok := room.History.Last(); return ok && last.Content == "through the tree" }
+		if !eventually(5*time.Second, received) {
+			t.Fatalf("%s never received the message", room.LocalNode.Nickname)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Leave notices older than this are ignored, so a recorded notice can't be
+// replayed to remove a member who has since rejoined
+const leaveNoticeMaxAge = 5 * time.Minute
+
+// How long leaving waits for members to acknowledge the leave notice
+const leaveFlushTimeout = 5 * time.Second
+
+// RoomSession is the state of one room the client is a member of. Every room
+// has its own key, member list and SuperNode manager; the identity, sockets
+// and outbox are shared by all rooms through the embedded client.
+type RoomSession struct {
+	*P2PChat
+
+	Room         RoomInfo
+	Keyring      *RoomKeyring
+	NodeMutex    sync.RWMutex
+	SuperNodeMgr *SuperNodeManager
+	OfflineStore *OfflineStore
+	History      *MessageLog
+	Store        *MessageStore // Nil if persistence is off
+	Files        *FileTransfers
+	Health       *FailureDetector
+	Gossip       *gossipState
+	Mode         string // Dissemination mode for our messages, see /mode
+
+	// Node IDs removed with /remove, refused if they try to join again.
+	// Guarded by NodeMutex.
+	removed map[string]bool
+
+	// Stretched room passphrase used to authenticate join handshakes,
+	// replaced when a member is removed. Guarded by NodeMutex.
+	joinPSK []byte
+}
+
+// Create an empty session for roomID
+func (p *P2PChat) newRoomSession(roomID, passphrase string, psk []byte) *RoomSession {
+	return &RoomSession{
+		P2PChat:      p,
+		Room:         RoomInfo{ID: roomID, Passphrase: passphrase},
+		OfflineStore: NewOfflineStore(AppConfig.OfflineMaxMessages, AppConfig.OfflineMaxAge),
+		History:      NewMessageLog(),
+		Files:        NewFileTransfers(),
+		Health:       NewFailureDetector(),
+		Gossip:       &gossipState{},
+		Mode:         AppConfig.MessageMode,
+		joinPSK:      psk,
+		removed:      make(map[string]bool),
+	}
+}
+
+// Register a room session and make it the active room
+func (p *P2PChat) addRoom(room *RoomSession) {
+	p.roomsMu.Lock()
+	defer p.roomsMu.Unlock()
+	p.Rooms[room.Room.ID] = room
+	p.activeRoom = room
+}
+
+// Find a room session by room ID
+func (p *P2PChat) findRoom(roomID string) *RoomSession {
+	p.roomsMu.RLock()
+	defer p.roomsMu.RUnlock()
+	return p.Rooms[roomID]
+}
+
+// ActiveRoom returns the room chat messages and commands apply to, or nil if
+// the client isn't in any room
+func (p *P2PChat) ActiveRoom() *RoomSession {
+	p.roomsMu.RLock()
+	defer p.roomsMu.RUnlock()
+	return p.activeRoom
+}
+
+// Snapshot the room sessions, ordered by room ID
+func (p *P2PChat) roomList() []*RoomSession {
+	p.roomsMu.RLock()
+	defer p.roomsMu.RUnlock()
+
+	rooms := make([]*RoomSession, 0, len(p.Rooms))
+	for _, room := range p.Rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Room.ID < rooms[j].Room.ID })
+	return rooms
+}
+
+// Check whether the client is in more than one room, so output needs a room tag
+func (p *P2PChat) multiRoom() bool {
+	p.roomsMu.RLock()
+	defer p.roomsMu.RUnlock()
+	return len(p.Rooms) > 1
+}
+
+// Find the room whose key opens a sealed payload and return it with the
+// plaintext. Frames don't name their room, so each room key is tried in turn.
+func (p *P2PChat) openRoomPayload(payload []byte) (*RoomSession, []byte) {
+	for _, room := range p.roomList() {
+		if data, err := room.Keyring.Open(room.Room.ID, payload); err == nil {
+			return room, data
+		}
+	}
+	return nil, nil
+}
+
+// SwitchRoom makes another joined room the active one
+func (p *P2PChat) SwitchRoom(roomID string) error {
+	p.roomsMu.Lock()
+	defer p.roomsMu.Unlock()
+
+	room, ok := p.Rooms[roomID]
+	if !ok {
+		return fmt.Errorf("you are not in room %s", roomID)
+	}
+	p.activeRoom = room
+	return nil
+}
+
+// LeaveRoom tells the members of a room that we're leaving and forgets its
+// session. If it was the active room, another joined room becomes active;
+// after the last room is left, the network services are stopped.
+func (p *P2PChat) LeaveRoom(roomID string) error {
+	room := p.findRoom(roomID)
+	if room == nil {
+		return fmt.Errorf("you are not in room %s", roomID)
+	}
+
+	// Wait for the members to acknowledge the notice while the connections
+	// are still up, since stopping the services would cut the retries off
+	if key, ok := room.announceLeave(); ok && !p.Outbox.Wait(key, leaveFlushTimeout) {
+		fmt.Println("[System] Not every member acknowledged the leave; they will drop this node once its heartbeats stop")
+	}
+
+	p.roomsMu.Lock()
+	if p.Rooms[roomID] != room {
+		p.roomsMu.Unlock()
+		return fmt.Errorf("you are not in room %s", roomID)
+	}
+	delete(p.Rooms, roomID)
+	if p.activeRoom == room {
+		p.activeRoom = nil
+		for _, other := range p.Rooms {
+			if p.activeRoom == nil || other.Room.ID < p.activeRoom.Room.ID {
+				p.activeRoom = other
+			}
+		}
+	}
+	last := len(p.Rooms) == 0
+	p.roomsMu.Unlock()
+
+	room.close()
+	if last {
+		p.stopServices()
+	}
+	return nil
+}
+
+// leaveNotice announces that a member is leaving a room
+type leaveNotice struct {
+	RoomID    string `json:"room_id"`
+	NodeID    string `json:"node_id"`
+	LeftAt    int64  `json:"left_at"` // Unix milliseconds
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"`
+}
+
+// Key a leave notice is acknowledged under
+func (n leaveNotice) key() string {
+	return "leave:" + n.NodeID + ":" + strconv.FormatInt(n.LeftAt, 10)
+}
+
+// Bytes covered by a leave notice signature
+func leaveSigningBytes(notice leaveNotice) []byte {
+	notice.Signature = ""
+	data, _ := json.Marshal(notice)
+	return data
+}
+
+// Tell every other member that the local node is leaving the room. Returns
+// the key the notices are acknowledged under, or false if none were sent.
+func (r *RoomSession) announceLeave() (string, bool) {
+	notice := leaveNotice{
+		RoomID:    r.Room.ID,
+		NodeID:    r.LocalNode.ID,
+		LeftAt:    time.Now().UnixMilli(),
+		PublicKey: r.Identity.EncodedPublicKey(),
+	}
+	notice.Signature = r.Identity.Sign(leaveSigningBytes(notice))
+
+	seal, err := r.roomSealer(notice)
+	if err != nil {
+		fmt.Printf("Failed to encode leave notice: %v\n", err)
+		return "", false
+	}
+
+	r.NodeMutex.RLock()
+	defer r.NodeMutex.RUnlock()
+	sent := false
+	for _, node := range r.Room.Nodes {
+		if node.ID == r.LocalNode.ID {
+			continue
+		}
+		r.Outbox.Enqueue(node, notice.key(), FrameLeave, seal)
+		sent = true
+	}
+	return notice.key(), sent
+}
+
+// Handle a member's leave notice: drop it from the room, which rotates the
+// room key if we created the room and elects a new SuperNode if it was the
+// last one. Returns the key to acknowledge, or "" if the notice was invalid.
+func (r *RoomSession) handleLeaveNotice(data []byte, remoteAddr string) string {
+	var notice leaveNotice
+	if err := json.Unmarshal(data, &notice); err != nil {
+		fmt.Printf("Invalid leave notice from %s: %v\n", remoteAddr, err)
+		return ""
+	}
+	if notice.RoomID != r.Room.ID || notice.NodeID == r.LocalNode.ID {
+		return ""
+	}
+	if !verifySignature(notice.NodeID, notice.PublicKey, notice.Signature, leaveSigningBytes(notice)) {
+		fmt.Printf("[System] Warning: ignoring unverified leave notice from %s\n", remoteAddr)
+		return ""
+	}
+
+	// Stale notices are acknowledged so the sender stops retrying, but ignored
+	if time.Since(time.UnixMilli(notice.LeftAt)) > leaveNoticeMaxAge {
+		return notice.key()
+	}
+
+	r.OfflineStore.Take(notice.NodeID)
+	if node, ok := r.removeRoomNode(notice.NodeID); ok {
+		fmt.Printf("[System] %sNode %s (%s) left the room\n", r.roomTag(), node.Nickname, shortID(node.ID))
+	}
+	return notice.key()
+}
+
+// Stop a room's downloads, delete its seed copies and close its store
+func (r *RoomSession) close() {
+	// Seed copies only serve this room, so they're deleted. Running seed
+	// downloads delete their partial files once their workers stop.
+	r.Files.mu.Lock()
+	var stale []*download
+	for hash, d := range r.Files.downloads {
+		switch {
+		case d.seedOnly:
+			if d.state != downloadActive {
+				stale = append(stale, d)
+			}
+			d.state = downloadCanceled
+			delete(r.Files.downloads, hash)
+		case d.state == downloadActive:
+			d.state = downloadPaused
+		}
+	}
+	r.Files.mu.Unlock()
+	for _, d := range stale {
+		os.Remove(d.partPath)
+		os.Remove(d.metaPath)
+	}
+	os.RemoveAll(r.seedDir())
+
+	if r.Store != nil {
+		r.Store.Close()
+		r.Store = nil
+	}
+}
+
+// Print the rooms the client is in
+func (p *P2PChat) printRooms() {
+	rooms := p.roomList()
+	if len(rooms) == 0 {
+		fmt.Println("You are not in any room")
+		return
+	}
+
+	active := p.ActiveRoom()
+	fmt.Printf("Rooms (%d):\n", len(rooms))
+	for _, room := range rooms {
+		room.NodeMutex.RLock()
+		nodes := len(room.Room.Nodes)
+		room.NodeMutex.RUnlock()
+
+		var flags []string
+		if room == active {
+			flags = append(flags, "active")
+		}
+		if room.SuperNodeMgr.IsLocalNodeSuperNode() {
+			flags = append(flags, "SuperNode")
+		}
+		if room.Mode != modeAuto {
+			flags = append(flags, room.Mode)
+		}
+		status := ""
+		if len(flags) > 0 {
+			status = " (" + strings.Join(flags, ", ") + ")"
+		}
+		fmt.Printf("  %s - %d nodes%s\n", room.Room.ID, nodes, status)
+	}
+}
+
+// Prefix for output about a room, so messages from rooms other than the
+// active one can be told apart
+func (r *RoomSession) roomTag() string {
+	if !r.multiRoom() {
+		return ""
+	}
+	return "#" + r.Room.ID + " "
+}
+
+// ID of the room member listening on addr, in any room
+func (p *P2PChat) memberAt(addr string) (string, bool) {
+	_, node, ok := p.memberInfoAt(addr)
+	return node.ID, ok
+}
+
+// The room member listening on addr, in any room, and its room
+func (p *P2PChat) memberInfoAt(addr string) (*RoomSession, NodeInfo, bool) {
+	for _, room := range p.roomList() {
+		room.NodeMutex.RLock()
+		for _, node := range room.Room.Nodes {
+			if node.Address == addr && node.ID != p.LocalNode.ID {
+				room.NodeMutex.RUnlock()
+				return room, node, true
+			}
+		}
+		room.NodeMutex.RUnlock()
+	}
+	return nil, NodeInfo{}, false
+}
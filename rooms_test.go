@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestOpenRoomPayload(t *testing.T) {
+	a, b := testNode(t, 90), testNode(t, 91)
+	alpha := testRoom(t, "alpha", a, b)
+	beta := testRoom(t, "beta", a, b)
+	other := testRoom(t, "other", testNode(t, 92))[0]
+
+	tests := []struct {
+		name   string
+		sealer *RoomSession
+		want   *RoomSession
+	}{
+		{"first room", alpha[0], alpha[1]},
+		{"second room", beta[0], beta[1]},
+		{"room we're not in", other, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := tt.sealer.Keyring.Seal(tt.sealer.Room.ID, []byte(tt.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			room, data := b.openRoomPayload(payload)
+			if room != tt.want {
+				t.Fatal("payload opened for the wrong room")
+			}
+			if tt.want != nil && string(data) != tt.name {
+				t.Fatalf("plaintext = %q, want %q", data, tt.name)
+			}
+		})
+	}
+
+	// A payload sealed under one room's key with another room's ID in its
+	// associated data opens for neither
+	forged, err := sealEnvelope(roomKey(alpha[0]), 0, "beta", []byte("forged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room, _ := b.openRoomPayload(forged); room != nil {
+		t.Fatalf("forged payload opened for %s", room.Room.ID)
+	}
+	if kind, reply := b.handleFrame(&Frame{Type: FrameMessage, Payload: forged}, "test"); kind != FrameAck || len(reply) != 0 {
+		t.Fatal("forged frame was acknowledged")
+	}
+}
+
+// Current key of a room
+func roomKey(room *RoomSession) []byte {
+	_, key := room.Keyring.Current()
+	return key
+}
+
+func TestMessagesStayInTheirRoom(t *testing.T) {
+	a, b := testNode(t, 93), testNode(t, 94)
+	alpha := testRoom(t, "alpha", a, b)
+	beta := testRoom(t, "beta", a, b)
+
+	for i, sender := range []*RoomSession{alpha[0], beta[0]} {
+		if err := sender.SendMessage(sender.Room.ID); err != nil {
+			t.Fatal(err)
+		}
+		receiver := []*RoomSession{alpha[1], beta[1]}[i]
+		if !eventually(5*time.Second, func() bool { last, ok := receiver.History.Last(); return ok && last.Content == sender.Room.ID }) {
+			t.Fatalf("message sent in %s never reached the member", sender.Room.ID)
+		}
+	}
+	for _, room := range []*RoomSession{alpha[1], beta[1]} {
+		if got := len(room.History.Since(0, "", 10)); got != 1 {
+			t.Fatalf("%s logged %d messages, want only its own", room.Room.ID, got)
+		}
+	}
+}
+
+func TestLeaveRoom(t *testing.T) {
+	a, b, c := testNode(t, 95), testNode(t, 96), testNode(t, 97)
+	rooms := testRoom(t, "leave", a, b, c)
+	other := testRoom(t, "stay", a, c)
+
+	if err := c.LeaveRoom("leave"); err != nil {
+		t.Fatal(err)
+	}
+	for _, room := range rooms[:2] {
+		if _, ok := room.findRoomNodeByID(c.LocalNode.ID); ok {
+			t.Fatalf("%s still lists the member that left", room.LocalNode.Nickname)
+		}
+	}
+	if c.findRoom("leave") != nil {
+		t.Fatal("left room is still joined")
+	}
+	if c.ActiveRoom() != other[1] {
+		t.Fatal("the remaining room didn't become active")
+	}
+	if c.TCPListener == nil {
+		t.Fatal("services stopped while still in a room")
+	}
+	if err := c.LeaveRoom("leave"); err == nil {
+		t.Fatal("left a room twice")
+	}
+
+	// Leaving the last room stops the services
+	if err := c.LeaveRoom("stay"); err != nil {
+		t.Fatal(err)
+	}
+	if c.ActiveRoom() != nil || c.TCPListener != nil {
+		t.Fatal("services still running after leaving every room")
+	}
+	if _, ok := other[0].findRoomNodeByID(c.LocalNode.ID); ok {
+		t.Fatal("member that left the last room is still listed")
+	}
+}
+
+func TestHandleLeaveNotice(t *testing.T) {
+	rooms := testRoom(t, "leave-notice", testNode(t, 98), testNode(t, 99))
+	room, leaver := rooms[0], rooms[1]
+	other := testIdentity(t, 100)
+
+	notice := func(edit func(*leaveNotice), signer *Identity) leaveNotice {
+		n := leaveNotice{
+			RoomID:    room.Room.ID,
+			NodeID:    leaver.LocalNode.ID,
+			LeftAt:    time.Now().UnixMilli(),
+			PublicKey: leaver.Identity.EncodedPublicKey(),
+		}
+		edit(&n)
+		n.Signature = signer.Sign(leaveSigningBytes(n))
+		return n
+	}
+	keep := func(*leaveNotice) {}
+
+	tests := []struct {
+		name    string
+		notice  leaveNotice
+		acked   bool
+		removed bool
+	}{
+		{"other room", notice(func(n *leaveNotice) { n.RoomID = "elsewhere" }, leaver.Identity), false, false},
+		{"ourselves", notice(func(n *leaveNotice) { n.NodeID = room.LocalNode.ID }, leaver.Identity), false, false},
+		{"signed by another key", notice(func(n *leaveNotice) { n.PublicKey = other.EncodedPublicKey() }, other), false, false},
+		{"stale", notice(func(n *leaveNotice) { n.LeftAt -= 2 * leaveNoticeMaxAge.Milliseconds() }, leaver.Identity), true, false},
+		{"valid", notice(keep, leaver.Identity), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.notice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := room.handleLeaveNotice(data, leaver.LocalNode.Address)
+			if want := map[bool]string{true: tt.notice.key()}[tt.acked]; got != want {
+				t.Fatalf("handleLeaveNotice = %q, want %q", got, want)
+			}
+			if _, listed := room.findRoomNodeByID(leaver.LocalNode.ID); listed == tt.removed {
+				t.Fatalf("member listed = %v after the notice", listed)
+			}
+		})
+	}
+}
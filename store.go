@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Store file layout: a sequence of records, each a 4-byte big-endian length
+// followed by an envelope sealed under the store key. The store key is
+// derived from the room passphrase, so it survives room key rotations and
+// can be reopened after a restart.
+const storeRecordLimit = MaxFrameSize
+
+// storeRecord is one entry in the store: a message or a room state snapshot
+type storeRecord struct {
+	Message *Message    `json:"message,omitempty"`
+	Room    *storedRoom `json:"room,omitempty"`
+}
+
+// storedRoom is what a restarted client needs to rejoin the room
+type storedRoom struct {
+	CreatorID string     `json:"creator_id"`
+	RoomKey   string     `json:"room_key"` // Base64 current room key
+	Epoch     uint32     `json:"epoch"`
+	Issuer    string     `json:"issuer"`
+	Nodes     []NodeInfo `json:"nodes"`
+	Mode      string     `json:"mode,omitempty"`
+	Removed   []string   `json:"removed,omitempty"`
+	JoinPSK   string     `json:"join_psk,omitempty"` // Base64 stretched passphrase joins are checked against
+}
+
+// MessageStore is an append-only, encrypted on-disk log of one room's
+// messages and state
+type MessageStore struct {
+	mu      sync.Mutex
+	path    string
+	roomID  string
+	key     []byte
+	file    *os.File
+	records int // Records in the file, including superseded ones
+}
+
+// Path of the store file for a room. The room ID is hashed so it can't
+// escape the data directory and isn't visible in the file name.
+func storePath(dir, roomID string) string {
+	sum := sha256.Sum256([]byte(roomID))
+	return filepath.Join(dir, "room_"+hex.EncodeToString(sum[:8])+".store")
+}
+
+// Derive the store key from the stretched room passphrase
+func deriveStoreKey(psk []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, psk, nil, "gochatp2p message store", 32)
+}
+
+// Associated data context for store records
+func storeContext(roomID string) string {
+	return "store:" + roomID
+}
+
+// OpenMessageStore opens or creates the store for a room and returns the last
+// saved room state (nil if none) and the saved messages, oldest first.
+// Superseded records are compacted away. If keep is positive, only the
+// newest keep messages are retained; otherwise every message is.
+func OpenMessageStore(dir, roomID string, psk []byte, keep int) (*MessageStore, *storedRoom, []Message, error) {
+	key, err := deriveStoreKey(psk)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, nil, err
+	}
+
+	store := &MessageStore{path: storePath(dir, roomID), roomID: roomID, key: key}
+	file, err := os.OpenFile(store.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	store.file = file
+
+	room, messages, err := store.load()
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+
+	if keep > 0 && len(messages) > keep {
+		fmt.Printf("[System] Dropping %d saved messages beyond the STORE_MAX_MESSAGES limit of %d\n", len(messages)-keep, keep)
+		messages = messages[len(messages)-keep:]
+	}
+
+	// Rewrite the file if it holds superseded room states, duplicates or
+	// messages past the retention limit
+	live := len(messages)
+	if room != nil {
+		live++
+	}
+	if store.records > live {
+		if err := store.Compact(room, messages); err != nil {
+			fmt.Printf("Failed to compact message store: %v\n", err)
+		}
+	}
+
+	return store, room, messages, nil
+}
+
+// Read every record in the store. A torn record at the end of the file (from
+// a crash mid-write) is truncated away.
+func (s *MessageStore) load() (*storedRoom, []Message, error) {
+	reader := bufio.NewReader(s.file)
+	var messages []Message
+	seen := make(map[string]bool)
+	var room *storedRoom
+	var offset int64
+
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if err != io.EOF {
+				fmt.Println("[System] Message store ends with a partial record, truncating it")
+			}
+			break
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		if length > storeRecordLimit {
+			fmt.Println("[System] Message store has a corrupt record, truncating it")
+			break
+		}
+		envelope := make([]byte, length)
+		if _, err := io.ReadFull(reader, envelope); err != nil {
+			fmt.Println("[System] Message store ends with a partial record, truncating it")
+			break
+		}
+
+		data, err := openEnvelope(s.key, storeContext(s.roomID), envelope)
+		if err != nil {
+			if s.records == 0 {
+				return nil, nil, fmt.Errorf("can't open saved room (wrong passphrase?)")
+			}
+			fmt.Println("[System] Message store has a corrupt record, truncating it")
+			break
+		}
+
+		var record storeRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			fmt.Println("[System] Message store has a corrupt record, truncating it")
+			break
+		}
+		if record.Room != nil {
+			room = record.Room
+		}
+		if record.Message != nil && !seen[messageKey(*record.Message)] {
+			seen[messageKey(*record.Message)] = true
+			messages = append(messages, *record.Message)
+		}
+
+		s.records++
+		offset += int64(len(header) + len(envelope))
+	}
+
+	// Drop anything after the last good record and append from there
+	if err := s.file.Truncate(offset); err != nil {
+		return nil, nil, err
+	}
+	if _, err := s.file.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	// Every message is kept, however many there are; retention is up to
+	// the caller
+	sort.SliceStable(messages, func(i, j int) bool { return messageBefore(messages[i], messages[j]) })
+	return room, messages, nil
+}
+
+// Encode and seal one record
+func (s *MessageStore) encodeRecord(record storeRecord) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := sealEnvelope(s.key, 0, storeContext(s.roomID), data)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope) > storeRecordLimit {
+		return nil, fmt.Errorf("record too large")
+	}
+	return append(uint32ToBytes(uint32(len(envelope))), envelope...), nil
+}
+
+// Append a record to the end of the store
+func (s *MessageStore) append(record storeRecord) error {
+	data, err := s.encodeRecord(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errors.New("message store is closed")
+	}
+	if _, err := s.file.Write(data); err != nil {
+		return err
+	}
+	s.records++
+	return nil
+}
+
+// AppendMessage records a message
+func (s *MessageStore) AppendMessage(message Message) error {
+	return s.append(storeRecord{Message: &message})
+}
+
+// SaveRoom records a room state snapshot, superseding earlier ones
+func (s *MessageStore) SaveRoom(room storedRoom) error {
+	return s.append(storeRecord{Room: &room})
+}
+
+// Compact rewrites the store with only the given room state and messages.
+// The new file replaces the old one atomically.
+func (s *MessageStore) Compact(room *storedRoom, messages []Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	records := 0
+	write := func(record storeRecord) error {
+		data, err := s.encodeRecord(record)
+		if err != nil {
+			return err
+		}
+		records++
+		_, err = writer.Write(data)
+		return err
+	}
+
+	if room != nil {
+		err = write(storeRecord{Room: room})
+	}
+	for i := 0; err == nil && i < len(messages); i++ {
+		err = write(storeRecord{Message: &messages[i]})
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Continue appending to the compacted file
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.records = records
+	return nil
+}
+
+// Close the store file
+func (s *MessageStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Snapshot the room state into the store, if persistence is on
+func (r *RoomSession) saveRoomState() {
+	if r.Store == nil {
+		return
+	}
+
+	epoch, key := r.Keyring.Current()
+	room := storedRoom{
+		CreatorID: r.Room.CreatorID,
+		RoomKey:   base64.StdEncoding.EncodeToString(key),
+		Epoch:     epoch,
+		Issuer:    r.Keyring.Issuer(),
+		Mode:      r.Mode,
+		Removed:   r.removedIDs(),
+	}
+	r.NodeMutex.RLock()
+	room.JoinPSK = base64.StdEncoding.EncodeToString(r.joinPSK)
+	for _, node := range r.Room.Nodes {
+		if node.ID != r.LocalNode.ID {
+			room.Nodes = append(room.Nodes, node)
+		}
+	}
+	r.NodeMutex.RUnlock()
+
+	if err := r.Store.SaveRoom(room); err != nil {
+		fmt.Printf("Failed to save room state: %v\n", err)
+	}
+}
+
+// Open the room's store and load its saved messages into the history.
+// Returns the last saved room state, if any. Persistence is off if DATA_DIR is empty.
+func (r *RoomSession) openRoomStore(roomID string, psk []byte) (*storedRoom, error) {
+	if AppConfig.DataDir == "" {
+		return nil, nil
+	}
+
+	store, room, messages, err := OpenMessageStore(AppConfig.DataDir, roomID, psk, AppConfig.StoreMaxMessages)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, message := range messages {
+		r.History.Add(message)
+		r.SeenMessages.MarkSeen(messageKey(message))
+	}
+	r.Store = store
+	return room, nil
+}
+
+// ReopenRoom reopens a room saved by an earlier session and makes it the
+// active room. The saved room key is refreshed with a join handshake if any
+// saved member is reachable.
+func (p *P2PChat) ReopenRoom(roomID, passphrase string) error {
+	if AppConfig.DataDir == "" {
+		return fmt.Errorf("message store is disabled (DATA_DIR is empty)")
+	}
+	if p.findRoom(roomID) != nil {
+		return fmt.Errorf("you are already in room %s", roomID)
+	}
+	if _, err := os.Stat(storePath(AppConfig.DataDir, roomID)); err != nil {
+		return fmt.Errorf("no saved room %s", roomID)
+	}
+
+	psk, err := derivePassphraseKey(roomID, passphrase)
+	if err != nil {
+		return err
+	}
+	room := p.newRoomSession(roomID, passphrase, psk)
+	saved, err := room.openRoomStore(roomID, psk)
+	if err != nil {
+		return err
+	}
+	if saved == nil {
+		room.Store.Close()
+		return fmt.Errorf("saved room %s has no room state", roomID)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(saved.RoomKey)
+	if err != nil || len(key) != 16 {
+		room.Store.Close()
+		return fmt.Errorf("saved room key is invalid")
+	}
+
+	room.Room.CreatorID = saved.CreatorID
+	if validMode(saved.Mode) {
+		room.Mode = saved.Mode
+	}
+	room.Keyring = NewRoomKeyring(key, saved.Epoch, saved.Issuer)
+	room.denyNodes(saved.Removed)
+
+	// The store stays under the passphrase it was created with, but the
+	// passphrase members check may have been replaced since
+	if joinPSK, err := base64.StdEncoding.DecodeString(saved.JoinPSK); err == nil && len(joinPSK) == len(psk) && !bytes.Equal(joinPSK, psk) {
+		room.setJoinPassphrase("", joinPSK)
+		psk = joinPSK
+	}
+	room.SuperNodeMgr = NewSuperNodeManager(p.LocalNode, room.Keyring, AppConfig.TCPPort, AppConfig.UDPPort, AppConfig.NoSuperNode)
+
+	localNode := room.localNodeInfo()
+	room.Room.Nodes = []NodeInfo{localNode}
+	for _, node := range saved.Nodes {
+		if node.ID == p.LocalNode.ID || !verifyNodeInfo(node) {
+			continue
+		}
+		room.Room.Nodes = append(room.Room.Nodes, node)
+		room.SuperNodeMgr.AddNode(node)
+	}
+	p.addRoom(room)
+	room.runElection()
+
+	fmt.Printf("Reopened room %s with %d saved messages\n", roomID, len(room.History.Since(0, "", historyLogLimit)))
+	for _, message := range room.History.Since(0, "", 10) {
+		fmt.Printf("[%s] %s: %s\n", message.Timestamp, room.transcriptSender(message), message.Content)
+	}
+
+	// The room key may have been rotated while we were away
+	for _, node := range saved.Nodes {
+		accept, err := p.performJoinHandshake(node.Address, roomID, psk, localNode)
+		if err != nil {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(accept.RoomKey)
+		if err != nil || len(key) != 16 {
+			continue
+		}
+		if currentEpoch, _ := room.Keyring.Current(); accept.Epoch >= currentEpoch {
+			room.Keyring.Install(accept.Epoch, key, accept.CreatorID)
+		}
+		room.denyNodes(accept.Removed)
+		for _, member := range accept.Nodes {
+			if member.ID != p.LocalNode.ID && verifyNodeInfo(member) {
+				room.addRoomNode(member)
+			}
+		}
+		room.saveRoomState()
+
+		if err := room.SyncHistory(node); err != nil {
+			fmt.Printf("Failed to fetch chat history: %v\n", err)
+		}
+		return nil
+	}
+
+	fmt.Println("[System] No saved member is reachable; using the saved room key")
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func testMessage(i int) Message {
+	return Message{ID: fmt.Sprint(i), RoomID: "room", Sender: "alice", SenderID: "alice-id", SentAt: int64(1000 + i), Content: fmt.Sprint("message ", i)}
+}
+
+func testPSK(t *testing.T, pass string) []byte {
+	t.Helper()
+	psk, err := derivePassphraseKey("room", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return psk
+}
+
+// Write a store with the given room state and messages, then close it
+func writeTestStore(t *testing.T, dir string, psk []byte, room *storedRoom, messages []Message) {
+	t.Helper()
+	store, _, _, err := OpenMessageStore(dir, "room", psk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if room != nil {
+		if err := store.SaveRoom(*room); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, message := range messages {
+		if err := store.AppendMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMessageStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	psk := testPSK(t, "correct-horse-battery")
+	room := &storedRoom{CreatorID: "alice-id", RoomKey: "a2V5", Epoch: 3, Issuer: "bob-id", Removed: []string{"mallory-id"}}
+	newer := *room
+	newer.Epoch = 4
+
+	// Written out of order, with a duplicate and a superseded room state
+	messages := []Message{testMessage(2), testMessage(1), testMessage(3), testMessage(2)}
+	writeTestStore(t, dir, psk, room, messages[:2])
+	writeTestStore(t, dir, psk, &newer, messages[2:])
+
+	store, gotRoom, got, err := OpenMessageStore(dir, "room", psk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if gotRoom == nil || gotRoom.Epoch != 4 || gotRoom.Issuer != "bob-id" || len(gotRoom.Removed) != 1 {
+		t.Fatalf("room state = %+v, want the latest snapshot", gotRoom)
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d messages, want 3", len(got))
+	}
+	for i, message := range got {
+		if message != testMessage(i+1) {
+			t.Fatalf("message %d = %+v", i, message)
+		}
+	}
+	if store.records != 4 {
+		t.Fatalf("%d records after compaction, want 4", store.records)
+	}
+}
+
+func TestMessageStoreRejectsWrongPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	writeTestStore(t, dir, testPSK(t, "correct-horse-battery"), nil, []Message{testMessage(1)})
+
+	if _, _, _, err := OpenMessageStore(dir, "room", testPSK(t, "wrong-horse-battery"), 0); err == nil {
+		t.Fatal("opened the store with the wrong passphrase")
+	}
+
+	// Records are bound to the room ID too
+	if err := os.Rename(storePath(dir, "room"), storePath(dir, "other")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := OpenMessageStore(dir, "other", testPSK(t, "correct-horse-battery"), 0); err == nil {
+		t.Fatal("opened a store written for another room")
+	}
+}
+
+func TestMessageStoreTruncatesDamagedTail(t *testing.T) {
+	psk := testPSK(t, "correct-horse-battery")
+	tests := []struct {
+		name   string
+		damage func(data []byte) []byte
+	}{
+		{"partial header", func(data []byte) []byte { return append(data, 0, 0) }},
+		{"partial record", func(data []byte) []byte { return data[:len(data)-5] }},
+		{"tampered record", func(data []byte) []byte { data[len(data)-1] ^= 1; return data }},
+		{"oversized length", func(data []byte) []byte { return append(data, uint32ToBytes(storeRecordLimit+1)...) }},
+		{"garbage", func(data []byte) []byte { return append(data, []byte("\x00\x00\x00\x03abc")...) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestStore(t, dir, psk, nil, []Message{testMessage(1), testMessage(2)})
+			path := storePath(dir, "room")
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.damage(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			store, _, got, err := OpenMessageStore(dir, "room", psk, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Appends land after the last good record
+			if err := store.AppendMessage(testMessage(3)); err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+			if len(got) == 0 || got[0] != testMessage(1) {
+				t.Fatalf("lost the records before the damage: %+v", got)
+			}
+
+			store, _, got, err = OpenMessageStore(dir, "room", psk, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+			if last := got[len(got)-1]; last != testMessage(3) {
+				t.Fatalf("last message after reopening = %+v", last)
+			}
+		})
+	}
+}
+
+func TestMessageStoreRetention(t *testing.T) {
+	psk := testPSK(t, "correct-horse-battery")
+	var messages []Message
+	for i := 0; i < historyLogLimit+5; i++ {
+		messages = append(messages, testMessage(i))
+	}
+
+	tests := []struct {
+		name string
+		keep int
+		want int
+	}{
+		{"unlimited keeps everything", 0, len(messages)},
+		{"limit keeps the newest", 10, 10},
+		{"limit above count", len(messages) + 1, len(messages)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestStore(t, dir, psk, &storedRoom{CreatorID: "alice-id"}, messages)
+
+			store, room, got, err := OpenMessageStore(dir, "room", psk, tt.keep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+			if room == nil {
+				t.Fatal("room state lost")
+			}
+			if len(got) != tt.want || got[len(got)-1] != messages[len(messages)-1] {
+				t.Fatalf("kept %d messages, want the newest %d", len(got), tt.want)
+			}
+
+			// The limit is applied to the file, not just the returned slice
+			store, _, got, err = OpenMessageStore(dir, "room", psk, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if len(got) != tt.want || store.records != tt.want+1 {
+				t.Fatalf("reopened with %d messages in %d records, want %d", len(got), store.records, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Store-and-forward
+//
+// A SuperNode holds messages for members it can't currently reach: members
+// whose last broadcast is older than offlineThreshold, or that missed enough
+// heartbeats to be marked offline, are skipped during forwarding, and
+// messages the outbox gave up on are parked here too. When a
+// member shows up again (broadcast or message), its held messages are
+// re-sealed under the current room key and queued for delivery.
+
+// offlineThreshold is how long a member can stay silent before it is treated as offline
+func offlineThreshold() time.Duration {
+	return 3 * AppConfig.BroadcastTimeout
+}
+
+// heldMessage is a message waiting for an offline member
+type heldMessage struct {
+	message Message
+	stored  time.Time
+}
+
+// OfflineStore buffers messages per offline member, bounded by count and age
+type OfflineStore struct {
+	mu          sync.Mutex
+	held        map[string][]heldMessage // Node ID -> messages, oldest first
+	maxMessages int
+	maxAge      time.Duration
+}
+
+// NewOfflineStore creates a store keeping up to maxMessages per member for at most maxAge
+func NewOfflineStore(maxMessages int, maxAge time.Duration) *OfflineStore {
+	return &OfflineStore{
+		held:        make(map[string][]heldMessage),
+		maxMessages: maxMessages,
+		maxAge:      maxAge,
+	}
+}
+
+// Hold buffers a message for nodeID, dropping the oldest once the limit is reached
+func (s *OfflineStore) Hold(nodeID string, message Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := messageKey(message)
+	for _, h := range s.held[nodeID] {
+		if messageKey(h.message) == key {
+			return
+		}
+	}
+
+	held := append(s.pruneLocked(nodeID), heldMessage{message: message, stored: time.Now()})
+	if len(held) > s.maxMessages {
+		held = held[len(held)-s.maxMessages:]
+	}
+	s.held[nodeID] = held
+}
+
+// Take removes and returns every unexpired message held for nodeID
+func (s *OfflineStore) Take(nodeID string) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held := s.pruneLocked(nodeID)
+	delete(s.held, nodeID)
+
+	messages := make([]Message, len(held))
+	for i, h := range held {
+		messages[i] = h.message
+	}
+	return messages
+}
+
+// Count returns how many messages are held for nodeID
+func (s *OfflineStore) Count(nodeID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pruneLocked(nodeID))
+}
+
+// Drop expired messages for nodeID. Caller must hold s.mu.
+func (s *OfflineStore) pruneLocked(nodeID string) []heldMessage {
+	held := s.held[nodeID]
+	cutoff := time.Now().Add(-s.maxAge)
+	i := 0
+	for i < len(held) && held[i].stored.Before(cutoff) {
+		i++
+	}
+	held = held[i:]
+	if len(held) == 0 {
+		delete(s.held, nodeID)
+	} else {
+		s.held[nodeID] = held
+	}
+	return held
+}
+
+// Check whether a member hasn't been heard from recently
+func (r *RoomSession) isNodeOffline(nodeID string) bool {
+	if r.Health.Health(nodeID) == nodeOffline {
+		return true
+	}
+	node := r.SuperNodeMgr.GetNode(nodeID)
+	return node != nil && time.Since(node.LastActive) > offlineThreshold()
+}
+
+// Record that a member is alive and deliver anything held for it
+func (r *RoomSession) onNodeSeen(nodeID string) {
+	r.SuperNodeMgr.UpdateNodeActivity(nodeID)
+	if r.Health.Heard(nodeID) != nodeAlive {
+		if node, ok := r.findRoomNodeByID(nodeID); ok {
+			fmt.Printf("[System] %sNode %s (%s) is responding again\n", r.roomTag(), node.Nickname, shortID(node.ID))
+		}
+	}
+	r.resumeDownloadsFrom(nodeID)
+
+	if r.OfflineStore.Count(nodeID) == 0 {
+		return
+	}
+	node, ok := r.findRoomNodeByID(nodeID)
+	if !ok {
+		return
+	}
+
+	messages := r.OfflineStore.Take(nodeID)
+	fmt.Printf("[System] %s is back, delivering %d held message(s)\n", node.Nickname, len(messages))
+	for _, message := range messages {
+		r.forwardMessage(message, node)
+	}
+}
+
+// Hand a frame the outbox gave up on to the room it was sealed for
+func (p *P2PChat) onDeliveryFailure(node NodeInfo, frameType byte, payload []byte) {
+	if room, _ := p.openRoomPayload(payload); room != nil {
+		room.holdUndelivered(node, frameType, payload)
+	}
+}
+
+// Park a chat message the outbox couldn't deliver. SuperNodes keep it
+// themselves; other nodes hand it to a SuperNode.
+func (r *RoomSession) holdUndelivered(node NodeInfo, frameType byte, payload []byte) {
+	if frameType == FrameDirectMessage {
+		r.rerouteDirectMessage(node, payload)
+		return
+	}
+	if frameType == FrameRelay {
+		r.bypassSuperNode(node, payload)
+		return
+	}
+	if frameType != FrameMessage {
+		return
+	}
+
+	data, err := r.Keyring.Open(r.Room.ID, payload)
+	if err != nil {
+		return
+	}
+	var message Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		return
+	}
+
+	if r.SuperNodeMgr.IsLocalNodeSuperNode() {
+		r.OfflineStore.Hold(node.ID, message)
+		fmt.Printf("[System] Holding message for %s until it comes back online\n", node.Nickname)
+		return
+	}
+
+	superNode := r.SuperNodeMgr.GetBestSuperNodeForConnection()
+	if superNode == nil || superNode.ID == node.ID {
+		return
+	}
+
+	seal, err := r.roomSealer(holdRequest{RecipientID: node.ID, Message: message})
+	if err != nil {
+		return
+	}
+	r.Outbox.Enqueue(superNode.NodeInfo, messageKey(message), FrameHold, seal)
+}
+
+// Deliver a message a SuperNode couldn't be reached to relay straight to
+// every other member. Members that got it along the tree too drop the
+// duplicate.
+func (r *RoomSession) bypassSuperNode(superNode NodeInfo, payload []byte) {
+	var envelope relayEnvelope
+	if err := r.openRoomJSON(payload, &envelope); err != nil {
+		return
+	}
+	message := envelope.Message
+	fmt.Printf("[System] %sSuperNode %s is unreachable, delivering message directly\n", r.roomTag(), superNode.Nickname)
+
+	r.NodeMutex.RLock()
+	defer r.NodeMutex.RUnlock()
+	for _, node := range r.Room.Nodes {
+		if node.ID == r.LocalNode.ID || node.ID == message.SenderID || node.ID == superNode.ID {
+			continue
+		}
+		r.forwardMessage(message, node)
+	}
+}
+
+// holdRequest asks a SuperNode to keep a message for an offline member
+type holdRequest struct {
+	RecipientID string  `json:"recipient_id"`
+	Message     Message `json:"message"`
+}
+
+// Handle a request to hold a message for an offline member. Returns the key
+// to acknowledge, or "" if the request was invalid.
+func (r *RoomSession) handleHoldRequest(data []byte, remoteAddr string) string {
+	var request holdRequest
+	if err := json.Unmarshal(data, &request); err != nil || request.Message.RoomID != r.Room.ID {
+		return ""
+	}
+	if !verifyMessage(request.Message) {
+		return ""
+	}
+
+	key := messageKey(request.Message)
+	if !r.SuperNodeMgr.IsLocalNodeSuperNode() {
+		// Not our job, but acknowledge so the sender doesn't retry forever
+		return key
+	}
+
+	r.OfflineStore.Hold(request.RecipientID, request.Message)
+	return key
+}
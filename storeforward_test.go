@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOfflineStoreHold(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxMessages int
+		hold        []int
+		want        []int
+	}{
+		{"keeps order", 10, []int{1, 2, 3}, []int{1, 2, 3}},
+		{"drops duplicates", 10, []int{1, 2, 1}, []int{1, 2}},
+		{"drops the oldest past the limit", 2, []int{1, 2, 3}, []int{2, 3}},
+		{"zero limit holds nothing", 0, []int{1, 2}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewOfflineStore(tt.maxMessages, time.Minute)
+			for _, i := range tt.hold {
+				store.Hold("bob", testMessage(i))
+			}
+			if store.Count("bob") != len(tt.want) {
+				t.Fatalf("Count = %d, want %d", store.Count("bob"), len(tt.want))
+			}
+			got := store.Take("bob")
+			if fmt.Sprint(got) != fmt.Sprint(testMessages(tt.want...)) {
+				t.Fatalf("Take = %v, want messages %v", got, tt.want)
+			}
+			if store.Count("bob") != 0 || len(store.Take("bob")) != 0 {
+				t.Fatal("messages still held after Take")
+			}
+		})
+	}
+}
+
+func TestOfflineStoreExpiry(t *testing.T) {
+	store := NewOfflineStore(10, time.Minute)
+	store.Hold("bob", testMessage(1))
+	store.Hold("bob", testMessage(2))
+	store.Hold("carol", testMessage(3))
+
+	// Age the first message past the limit
+	store.mu.Lock()
+	store.held["bob"][0].stored = time.Now().Add(-2 * time.Minute)
+	store.mu.Unlock()
+
+	if got := store.Take("bob"); len(got) != 1 || got[0] != testMessage(2) {
+		t.Fatalf("Take = %v, want only the unexpired message", got)
+	}
+	if store.Count("carol") != 1 {
+		t.Fatal("messages for another member were affected")
+	}
+}
+
+// Messages numbered as given
+func testMessages(ids ...int) []Message {
+	messages := make([]Message, len(ids))
+	for i, id := range ids {
+		messages[i] = testMessage(id)
+	}
+	return messages
+}
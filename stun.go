@@ -15,8 +15,8 @@ const (
 	STUNMAGIC_COOKIE    = 0x2112A442
 )
 
-// Get public IP and port using STUN
-func getPublicIPAndPort() (string, int, error) {
+// Get the public IP and port of the punch socket using STUN
+func (ps *PunchSocket) getPublicIPAndPort() (string, int, error) {
 	// Try multiple STUN servers - ordered by reliability
 	stunServers := []string{
 		"stun.l.google.com:19302",    // Google STUN
@@ -42,7 +42,7 @@ func getPublicIPAndPort() (string, int, error) {
 
 	for _, server := range stunServers {
 		fmt.Printf("Trying STUN server: %s\n", server)
-		ip, port, err := sendSTUNRequest(server)
+		ip, port, err := ps.sendSTUNRequest(server)
 		if err == nil {
 			fmt.Printf("Successfully connected to STUN server: %s\n", server)
 			return ip, port, nil
@@ -50,30 +50,18 @@ func getPublicIPAndPort() (string, int, error) {
 		fmt.Printf("STUN server %s request failed: %v\n", server, err)
 	}
 
-	// If all STUN servers fail, return local IP and default port
-	localIP := getLocalIP()
-	fmt.Println("All STUN servers failed, using local IP")
-	return localIP, AppConfig.TCPPort, nil
+	return "", 0, fmt.Errorf("all STUN servers failed")
 }
 
-// Send STUN request and parse response
-func sendSTUNRequest(serverAddr string) (string, int, error) {
+// Send a STUN request from the punch socket and parse the response. The
+// mapping it reports is the one peers reach the socket through.
+func (ps *PunchSocket) sendSTUNRequest(serverAddr string) (string, int, error) {
 	// Resolve server address
-	udpAddr, err := net.ResolveUDPAddr("udp", serverAddr)
+	udpAddr, err := net.ResolveUDPAddr("udp4", serverAddr)
 	if err != nil {
 		return "", 0, err
 	}
 
-	// Create UDP connection
-	conn, err := net.DialUDP("udp", nil, udpAddr)
-	if err != nil {
-		return "", 0, err
-	}
-	defer conn.Close()
-
-	// Set timeout
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-
 	// Create STUN binding request
 	header := STUNHeader{
 		Type:   STUNBindingRequest,
@@ -94,21 +82,50 @@ func sendSTUNRequest(serverAddr string) (string, int, error) {
 	msg = append(msg, uint32ToBytes(header.Cookie)...)
 	msg = append(msg, header.TransactionID[:]...)
 
+	// The read loop hands us the response with our transaction ID
+	response := make(chan []byte, 1)
+	ps.mu.Lock()
+	ps.stun[header.TransactionID] = response
+	ps.mu.Unlock()
+	defer func() {
+		ps.mu.Lock()
+		delete(ps.stun, header.TransactionID)
+		ps.mu.Unlock()
+	}()
+
 	// Send STUN request
-	_, err = conn.Write(msg)
-	if err != nil {
+	if _, err := ps.conn.WriteToUDP(msg, udpAddr); err != nil {
 		return "", 0, err
 	}
 
-	// Read response
-	response := make([]byte, 1024)
-	n, err := conn.Read(response)
-	if err != nil {
-		return "", 0, err
+	// Wait for the response
+	select {
+	case data := <-response:
+		return parseSTUNResponse(data)
+	case <-time.After(5 * time.Second):
+		return "", 0, fmt.Errorf("no response")
 	}
+}
 
-	// Parse response
-	return parseSTUNResponse(response[:n])
+// Check whether a packet on the punch socket is a STUN message rather
+// than one of ours
+func isSTUNPacket(packet []byte) bool {
+	return len(packet) >= STUNHeaderLength && packet[0]&0xC0 == 0 && bytesToUint32(packet[4:8]) == STUNMAGIC_COOKIE
+}
+
+// Hand a STUN response to the request waiting for it
+func (ps *PunchSocket) deliverSTUN(packet []byte) {
+	var transactionID [12]byte
+	copy(transactionID[:], packet[8:STUNHeaderLength])
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if response, ok := ps.stun[transactionID]; ok {
+		select {
+		case response <- packet:
+		default:
+		}
+	}
 }
 
 // STUN header
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"net"
+	"crypto/hmac"
+	"crypto/sha256"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 )
@@ -11,8 +12,17 @@ import (
 // SuperNodeInfo stores information about a SuperNode
 type SuperNodeInfo struct {
 	NodeInfo
-	IsSuperNode bool      `json:"is_super_node"`
-	LastActive  time.Time `json:"last_active"`
+	IsSuperNode bool          `json:"is_super_node"`
+	LastActive  time.Time     `json:"last_active"`
+	FirstSeen   time.Time     `json:"first_seen"` // Since the local node first heard from it, or it came back from offline
+	Capacity    nodeCapacity  `json:"capacity"`   // As last advertised by the node
+	RTT         time.Duration `json:"rtt"`        // Smoothed round trip time measured by the local node
+	Score       float64       `json:"score"`      // capacityScore of Capacity, uptime since FirstSeen and RTT
+
+	// SuperNode the node relayed through before its last switch, still
+	// served for attachmentGrace so no message falls in between
+	prevSuperNode string
+	switchedAt    time.Time
 }
 
 // SuperNodeManager SuperNode manager
@@ -20,23 +30,43 @@ type SuperNodeManager struct {
 	mu            sync.RWMutex
 	supernodes    []SuperNodeInfo
 	localNodeInfo NodeInfo
-	messageKey    []byte
+	keyring       *RoomKeyring
 	tcpPort       int
 	udpPort       int
 	isSuperNode   bool
 	noSuperNode   bool
 	superNodeMode bool // Whether to enable SuperNode mode
+
+	// Latest election result adopted, see ApplyElection
+	term       uint64
+	termIssuer string
+	elected    []string // Elected SuperNodes, best first
+	resultAt   time.Time
+
+	// Members that proved to us directly that they hold the room key, by
+	// the join handshake or a sealed heartbeat. Only they are ranked.
+	verified map[string]bool
+	// Coordinators that let an election go unannounced, skipped in the
+	// ranking until they announce a result
+	stalled map[string]bool
+
+	localCapacity nodeCapacity
+	joinedAt      time.Time // When the local node joined, which members measure its uptime from
+	attachedTo    string    // SuperNode the local node relays through
 }
 
 // NewSuperNodeManager creates a new SuperNode manager
-func NewSuperNodeManager(localNode NodeInfo, messageKey []byte, tcpPort, udpPort int, noSuperNode bool) *SuperNodeManager {
+func NewSuperNodeManager(localNode NodeInfo, keyring *RoomKeyring, tcpPort, udpPort int, noSuperNode bool) *SuperNodeManager {
 	return &SuperNodeManager{
 		localNodeInfo: localNode,
-		messageKey:    messageKey,
+		keyring:       keyring,
 		tcpPort:       tcpPort,
 		udpPort:       udpPort,
 		noSuperNode:   noSuperNode,
 		superNodeMode: true, // Enable SuperNode mode by default
+		verified:      make(map[string]bool),
+		stalled:       make(map[string]bool),
+		joinedAt:      time.Now(),
 	}
 }
 
@@ -96,6 +126,8 @@ func (sm *SuperNodeManager) AddNode(nodeInfo NodeInfo) {
 		NodeInfo:    nodeInfo,
 		IsSuperNode: false, // Default is not a SuperNode
 		LastActive:  time.Now(),
+		FirstSeen:   time.Now(),
+		Score:       capacityScore(nodeCapacity{}, 0, 0),
 	}
 	sm.supernodes = append(sm.supernodes, superNodeInfo)
 }
@@ -182,172 +214,543 @@ func (sm *SuperNodeManager) UpdateNodeActivity(nodeID string) {
 	for i, sn := range sm.supernodes {
 		if sn.ID == nodeID {
 			sm.supernodes[i].LastActive = time.Now()
+			if sn.FirstSeen.IsZero() {
+				sm.supernodes[i].FirstSeen = time.Now()
+			}
 			return
 		}
 	}
 }
 
-// SelectInitialSuperNode randomly selects one as the initial SuperNode from the first 5 nodes
-func (sm *SuperNodeManager) SelectInitialSuperNode() string {
+// SetLocalCapacity records the capacity the local node advertises
+func (sm *SuperNodeManager) SetLocalCapacity(capacity nodeCapacity) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	sm.localCapacity = capacity
+}
 
-	// Select from first 5 nodes
-	var candidates []SuperNodeInfo
-	count := 0
-	for _, sn := range sm.supernodes {
-		if count >= 5 {
-			break
+// UpdateCapacity records the capacity a node advertised and rescores it
+func (sm *SuperNodeManager) UpdateCapacity(nodeID string, capacity nodeCapacity) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for i, sn := range sm.supernodes {
+		if sn.ID == nodeID {
+			if capacity.SuperNode != sn.Capacity.SuperNode {
+				sm.supernodes[i].prevSuperNode = sn.Capacity.SuperNode
+				sm.supernodes[i].switchedAt = time.Now()
+			}
+			sm.supernodes[i].Capacity = capacity
+			sm.rescore(i)
+			return
 		}
-		// Don't select nodes configured with noSuperNode
-		if sn.ID != sm.localNodeInfo.Address {
-			nodeIsNoSuperNode := sm.checkIfNodeIsNoSuperNode(sn.ID)
-			if !nodeIsNoSuperNode {
-				candidates = append(candidates, sn)
-				count++
+	}
+}
+
+// RecordRTT adds a round trip time sample for a node and rescores it
+func (sm *SuperNodeManager) RecordRTT(nodeID string, rtt time.Duration) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for i, sn := range sm.supernodes {
+		if sn.ID == nodeID {
+			// Exponentially smoothed, like TCP's SRTT
+			if sn.RTT == 0 {
+				sm.supernodes[i].RTT = rtt
+			} else {
+				sm.supernodes[i].RTT = (sn.RTT*7 + rtt) / 8
 			}
+			sm.rescore(i)
+			return
 		}
 	}
+}
 
-	if len(candidates) == 0 {
-		return ""
+// Recompute the capacity score of a node. Caller must hold sm.mu.
+func (sm *SuperNodeManager) rescore(i int) {
+	sn := &sm.supernodes[i]
+	var uptime time.Duration
+	if !sn.FirstSeen.IsZero() {
+		uptime = time.Since(sn.FirstSeen)
 	}
+	sn.Score = capacityScore(sn.Capacity, uptime, sn.RTT)
+}
 
-	// Randomly select one (using current time as random source)
-	index := int(time.Now().Unix()) % len(candidates)
-	selectedID := candidates[index].ID
+// Members per SuperNode once a room needs more than one
+const membersPerSuperNode = 10
 
-	// Set as SuperNode
-	for i, sn := range sm.supernodes {
-		if sn.ID == selectedID {
-			sm.supernodes[i].IsSuperNode = true
-			sm.supernodes[i].LastActive = time.Now()
-			if selectedID == sm.localNodeInfo.Address {
-				sm.isSuperNode = true
-			}
-			break
+// superNodeTarget returns how many SuperNodes a room with memberCount members elects
+func superNodeTarget(memberCount int) int {
+	if memberCount < 2 {
+		return 0
+	}
+	return (memberCount + membersPerSuperNode - 1) / membersPerSuperNode
+}
+
+// rankCandidates orders the members that may become SuperNodes by rankKey,
+// which every member sees the same way. The first one coordinates elections.
+// Members that haven't proved they hold the room key, and coordinators that
+// stalled, are left out. Caller must hold sm.mu.
+func (sm *SuperNodeManager) rankCandidates() []string {
+	var candidates []string
+	if !sm.noSuperNode {
+		candidates = append(candidates, sm.localNodeInfo.ID)
+	}
+	for _, sn := range sm.supernodes {
+		if !sn.NoSuperNode && sm.verified[sn.ID] && !sm.stalled[sn.ID] {
+			candidates = append(candidates, sn.ID)
 		}
 	}
+	keys := make(map[string]string, len(candidates))
+	for _, nodeID := range candidates {
+		keys[nodeID] = sm.rankKey(nodeID)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return keys[candidates[i]] < keys[candidates[j]] })
+	return candidates
+}
 
-	return selectedID
+// rankKey is what candidates are ranked by: an HMAC of the node ID under the
+// current room key. Node IDs alone could be ground for a good rank by trying
+// key pairs, but the room key is unknown before joining and every rekey
+// reshuffles the ranks.
+func (sm *SuperNodeManager) rankKey(nodeID string) string {
+	_, key := sm.keyring.Current()
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(nodeID))
+	return string(mac.Sum(nil))
 }
 
-// checkIfNodeIsNoSuperNode checks if the node is configured as noSuperNode
-func (sm *SuperNodeManager) checkIfNodeIsNoSuperNode(nodeID string) bool {
-	nodeInfo := sm.GetNode(nodeID)
-	if nodeInfo != nil {
-		return nodeInfo.NodeInfo.NoSuperNode
+// MarkVerified records that a member proved it holds the room key. Returns
+// true if it hadn't before.
+func (sm *SuperNodeManager) MarkVerified(nodeID string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.verified[nodeID] {
+		return false
 	}
-	return false
+	sm.verified[nodeID] = true
+	return true
 }
 
-// HandleNodeLeave handles the node leave event
-func (sm *SuperNodeManager) HandleNodeLeave(nodeID string) {
+// MarkOffline stops ranking a member that stopped responding until it proves
+// again that it holds the room key
+func (sm *SuperNodeManager) MarkOffline(nodeID string) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	delete(sm.verified, nodeID)
 
-	// Remove node
+	// Its uptime starts over once it's back
 	for i, sn := range sm.supernodes {
 		if sn.ID == nodeID {
-			// If the leaving node is a SuperNode, need to elect a new SuperNode
+			sm.supernodes[i].FirstSeen = time.Time{}
+			sm.rescore(i)
+		}
+	}
+}
+
+// MarkStalled skips a coordinator that announced no result in time
+func (sm *SuperNodeManager) MarkStalled(nodeID string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.stalled[nodeID] = true
+}
+
+// ClearStalled ranks a coordinator again once it announces a result
+func (sm *SuperNodeManager) ClearStalled(nodeID string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	delete(sm.stalled, nodeID)
+}
+
+// Settled reports whether coordinator has announced the result we hold,
+// or any result was adopted after t
+func (sm *SuperNodeManager) Settled(coordinator string, t time.Time) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.termIssuer == coordinator || sm.resultAt.After(t)
+}
+
+// ElectSuperNodes returns the SuperNodes the local view of the room elects:
+// the candidates with the best capacity scores, best first. Sitting
+// SuperNodes get a small bonus so small score changes don't move the role
+// around.
+func (sm *SuperNodeManager) ElectSuperNodes() []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	scores := make(map[string]float64)
+	if !sm.noSuperNode {
+		scores[sm.localNodeInfo.ID] = capacityScore(sm.localCapacity, time.Since(sm.joinedAt), 0)
+		if sm.isSuperNode {
+			scores[sm.localNodeInfo.ID] *= 1.1
+		}
+	}
+	for _, sn := range sm.supernodes {
+		if !sn.NoSuperNode {
+			scores[sn.ID] = sn.Score
 			if sn.IsSuperNode {
-				sm.handleSuperNodeLeave()
+				scores[sn.ID] *= 1.1
 			}
+		}
+	}
 
-			sm.supernodes = append(sm.supernodes[:i], sm.supernodes[i+1:]...)
-			return
+	// Equal scores keep the rank order, which can't be ground out either
+	ranked := sm.rankCandidates()
+	sort.SliceStable(ranked, func(i, j int) bool { return scores[ranked[i]] > scores[ranked[j]] })
+
+	target := superNodeTarget(len(sm.supernodes) + 1) // Other members and the local node
+	if len(ranked) > target {
+		ranked = ranked[:target]
+	}
+	return ranked
+}
+
+// ValidElection reports whether superNodes is a result the local view of the
+// room could have elected: as many distinct SuperNodes as ElectSuperNodes
+// picks, all of them candidates. Capacity scores include RTTs each member
+// measures itself, so the order among candidates isn't checked.
+func (sm *SuperNodeManager) ValidElection(superNodes []string) bool {
+	want := len(sm.ElectSuperNodes())
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	if len(superNodes) != want {
+		return false
+	}
+	candidates := make(map[string]bool)
+	for _, nodeID := range sm.rankCandidates() {
+		candidates[nodeID] = true
+	}
+	for _, nodeID := range superNodes {
+		if !candidates[nodeID] {
+			return false
 		}
+		delete(candidates, nodeID) // Each may be elected once
 	}
+	return true
 }
 
-// handleSuperNodeLeave handles the SuperNode leave event
-func (sm *SuperNodeManager) handleSuperNodeLeave() {
-	// Check if there are other active SuperNodes
-	activeSuperNodes := 0
+// ElectionCoordinator returns the member that runs elections: the
+// best-ranked candidate, or "" if no member may become a SuperNode. A node
+// that has yet to hear from any other member doesn't know who ranks first,
+// so there is none.
+func (sm *SuperNodeManager) ElectionCoordinator() string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	heard := len(sm.supernodes) == 0
 	for _, sn := range sm.supernodes {
-		if sn.IsSuperNode && time.Since(sn.LastActive) < 30*time.Second {
-			activeSuperNodes++
+		heard = heard || sm.verified[sn.ID]
+	}
+	if !heard {
+		return ""
+	}
+	if ranked := sm.rankCandidates(); len(ranked) > 0 {
+		return ranked[0]
+	}
+	return ""
+}
+
+// outranks reports whether candidate a ranks ahead of b. Non-candidates rank
+// behind every candidate. Caller must hold sm.mu.
+func (sm *SuperNodeManager) outranks(a, b string) bool {
+	ranked := sm.rankCandidates()
+	rank := func(nodeID string) int {
+		for i, id := range ranked {
+			if id == nodeID {
+				return i
+			}
 		}
+		return len(ranked)
 	}
+	return rank(a) < rank(b)
+}
+
+// Term returns the current election term and the member that announced it
+func (sm *SuperNodeManager) Term() (uint64, string) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.term, sm.termIssuer
+}
+
+// ApplyElection adopts an election result if it supersedes the current one:
+// it comes from a better-ranked member than the current result (members that
+// left rank last), or from the same member under a higher term. Returns true
+// whether the result was adopted, and whether it changed the SuperNodes.
+func (sm *SuperNodeManager) ApplyElection(term uint64, issuerID string, superNodes []string) (adopted, changed bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 
-	// If no other SuperNodes, need to elect a new one
-	if activeSuperNodes <= 1 { // The leaving SuperNode is also counted
-		sm.selectNewSuperNode()
+	switch {
+	case sm.termIssuer == "":
+	case issuerID == sm.termIssuer:
+		if term <= sm.term {
+			return false, false
+		}
+	case !sm.outranks(issuerID, sm.termIssuer):
+		return false, false
+	}
+	sm.term = term
+	sm.termIssuer = issuerID
+	sm.elected = superNodes
+	sm.resultAt = time.Now()
+
+	elected := make(map[string]bool, len(superNodes))
+	for _, nodeID := range superNodes {
+		elected[nodeID] = true
+	}
+	changed = sm.isSuperNode != elected[sm.localNodeInfo.ID]
+	for i, sn := range sm.supernodes {
+		if sn.IsSuperNode != elected[sn.ID] {
+			sm.supernodes[i].IsSuperNode = elected[sn.ID]
+			changed = true
+		}
+	}
+	sm.isSuperNode = elected[sm.localNodeInfo.ID]
+	if sm.isSuperNode {
+		sm.attachedTo = "" // SuperNodes don't relay through another
 	}
+	return true, changed
 }
 
-// selectNewSuperNode selects a new SuperNode
-func (sm *SuperNodeManager) selectNewSuperNode() {
-	// Select a new SuperNode from active regular nodes
-	timeout := 30 * time.Second
+// HandleNodeLeave removes a node that left the room. The caller re-runs the
+// election, which replaces it if it was a SuperNode.
+func (sm *SuperNodeManager) HandleNodeLeave(nodeID string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	delete(sm.verified, nodeID)
+	delete(sm.stalled, nodeID)
 	for i, sn := range sm.supernodes {
-		if !sn.IsSuperNode &&
-			time.Since(sn.LastActive) < timeout &&
-			sn.ID != sm.localNodeInfo.Address {
-			nodeIsNoSuperNode := sm.checkIfNodeIsNoSuperNode(sn.ID)
-			if !nodeIsNoSuperNode {
-				// Set as SuperNode
-				sm.supernodes[i].IsSuperNode = true
-				sm.supernodes[i].LastActive = time.Now()
-				return
-			}
+		if sn.ID == nodeID {
+			sm.supernodes = append(sm.supernodes[:i], sm.supernodes[i+1:]...)
+			return
 		}
 	}
+}
 
-	// If no suitable regular node and local node is not set as noSuperNode, then local node becomes SuperNode
-	if !sm.noSuperNode && !sm.isSuperNode {
-		sm.isSuperNode = true
+// How many SuperNodes hang below each SuperNode in the relay tree
+const superNodeTreeFanout = 3
+
+// How long a SuperNode keeps serving a regular node that switched away from it
+const attachmentGrace = 5 * time.Second
+
+// Elected SuperNodes that are still members, in election order. This is the
+// order the relay tree is built from. Caller must hold sm.mu.
+func (sm *SuperNodeManager) treeOrder() []string {
+	var order []string
+	for _, nodeID := range sm.elected {
+		if nodeID == sm.localNodeInfo.ID {
+			order = append(order, nodeID)
+			continue
+		}
+		for _, sn := range sm.supernodes {
+			if sn.ID == nodeID {
+				order = append(order, nodeID)
+				break
+			}
+		}
 	}
+	return order
 }
 
-// ForwardMessageToSuperNodes forwards messages to SuperNodes
-func (sm *SuperNodeManager) ForwardMessageToSuperNodes(message Message, messageKey []byte) error {
-	superNodes := sm.GetSuperNodes()
+// TreeNeighbors returns the local SuperNode's parent and children in the
+// relay tree. SuperNodes are laid out in election order as a tree with
+// superNodeTreeFanout children per node, so there is exactly one path
+// between any two of them.
+func (sm *SuperNodeManager) TreeNeighbors() []NodeInfo {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
 
-	for _, superNode := range superNodes {
-		if superNode.Address == sm.localNodeInfo.Address {
-			continue // Don't send to self
+	order := sm.treeOrder()
+	index := -1
+	for i, nodeID := range order {
+		if nodeID == sm.localNodeInfo.ID {
+			index = i
+			break
 		}
+	}
+	if index < 0 {
+		return nil
+	}
 
-		go func(nodeAddr string) {
-			conn, err := net.DialTimeout("tcp", nodeAddr, 5*time.Second)
-			if err != nil {
-				fmt.Printf("Failed to connect to SuperNode %s: %v\n", nodeAddr, err)
-				return
-			}
-			defer conn.Close()
+	var neighborIDs []string
+	if index > 0 {
+		neighborIDs = append(neighborIDs, order[(index-1)/superNodeTreeFanout])
+	}
+	for child := index*superNodeTreeFanout + 1; child <= index*superNodeTreeFanout+superNodeTreeFanout && child < len(order); child++ {
+		neighborIDs = append(neighborIDs, order[child])
+	}
 
-			// Serialize message
-			messageData, err := json.Marshal(message)
-			if err != nil {
-				fmt.Printf("Failed to serialize message: %v\n", err)
-				return
+	var neighbors []NodeInfo
+	for _, nodeID := range neighborIDs {
+		for _, sn := range sm.supernodes {
+			if sn.ID == nodeID {
+				neighbors = append(neighbors, sn.NodeInfo)
+				break
 			}
+		}
+	}
+	return neighbors
+}
 
-			// Encrypt message
-			encryptedData, err := encryptAES(messageKey, messageData)
-			if err != nil {
-				fmt.Printf("Failed to encrypt message: %v\n", err)
-				return
-			}
+// ServedNodes returns the regular nodes the local SuperNode delivers
+// messages to: those relaying through it, or that recently switched away
+// from it. Regular nodes without a SuperNode in the tree are served by the
+// root of the tree.
+func (sm *SuperNodeManager) ServedNodes() []NodeInfo {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
 
-			_, err = conn.Write(encryptedData)
-			if err != nil {
-				fmt.Printf("Failed to send message to SuperNode %s: %v\n", nodeAddr, err)
-			}
-		}(superNode.Address)
+	order := sm.treeOrder()
+	inTree := make(map[string]bool, len(order))
+	for _, nodeID := range order {
+		inTree[nodeID] = true
+	}
+	local := sm.localNodeInfo.ID
+	if !inTree[local] {
+		return nil
 	}
+	isRoot := order[0] == local
 
-	return nil
+	var served []NodeInfo
+	for _, sn := range sm.supernodes {
+		if inTree[sn.ID] {
+			continue
+		}
+		attached := sn.Capacity.SuperNode
+		switch {
+		case attached == local:
+		case !inTree[attached] && isRoot:
+		case sn.prevSuperNode == local && time.Since(sn.switchedAt) < attachmentGrace:
+		default:
+			continue
+		}
+		served = append(served, sn.NodeInfo)
+	}
+	return served
 }
 
-// GetBestSuperNodeForConnection gets the best SuperNode for connection
+// GetBestSuperNodeForConnection returns the SuperNode the local node relays
+// through, picking the best one if it has none yet. The choice sticks until
+// that SuperNode goes away or Rebalance moves off it, so the load each
+// SuperNode carries stays predictable.
 func (sm *SuperNodeManager) GetBestSuperNodeForConnection() *SuperNodeInfo {
-	superNodes := sm.GetSuperNodes()
-	if len(superNodes) == 0 {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sn := sm.activeSuperNode(sm.attachedTo); sn != nil {
+		return sn
+	}
+	best := sm.pickSuperNode("")
+	if best == nil {
+		sm.attachedTo = ""
 		return nil
 	}
+	sm.attachedTo = best.ID
+	return best
+}
+
+// AttachedSuperNode returns the SuperNode the local node relays through, or ""
+func (sm *SuperNodeManager) AttachedSuperNode() string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.attachedTo
+}
 
-	// Return the first SuperNode (can implement more complex load balancing algorithm)
-	return &superNodes[0]
+// SuperNodeLoad returns how many regular nodes relay through a SuperNode
+func (sm *SuperNodeManager) SuperNodeLoad(nodeID string) int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.load(nodeID)
+}
+
+// Rebalance picks a SuperNode if the local node has none, and moves off the
+// current one if it's overloaded and another has room. Returns the old and
+// new SuperNode if the local node switched.
+func (sm *SuperNodeManager) Rebalance() (from, to string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.isSuperNode {
+		return "", ""
+	}
+
+	current := sm.activeSuperNode(sm.attachedTo)
+	if current == nil {
+		if best := sm.pickSuperNode(""); best != nil {
+			sm.attachedTo = best.ID
+			return "", best.ID
+		}
+		return "", ""
+	}
+
+	load := sm.load(current.ID)
+	if load <= superNodeMaxLoad {
+		return "", ""
+	}
+	alternative := sm.pickSuperNode(current.ID)
+	if alternative == nil || sm.load(alternative.ID)+1 >= load {
+		return "", ""
+	}
+
+	// Only as many nodes as the SuperNode is over its limit need to move
+	if rand.Intn(load) >= load-superNodeMaxLoad {
+		return "", ""
+	}
+	sm.attachedTo = alternative.ID
+	return current.ID, alternative.ID
+}
+
+// Find an active SuperNode by ID. Caller must hold sm.mu.
+func (sm *SuperNodeManager) activeSuperNode(nodeID string) *SuperNodeInfo {
+	for _, sn := range sm.supernodes {
+		if sn.ID == nodeID && sn.IsSuperNode && time.Since(sn.LastActive) < 30*time.Second {
+			return &sn
+		}
+	}
+	return nil
+}
+
+// Count the regular nodes relaying through a SuperNode, including the local
+// node. Caller must hold sm.mu.
+func (sm *SuperNodeManager) load(superNodeID string) int {
+	load := 0
+	if sm.attachedTo == superNodeID {
+		load++
+	}
+	for _, sn := range sm.supernodes {
+		if !sn.IsSuperNode && sn.Capacity.SuperNode == superNodeID {
+			load++
+		}
+	}
+	return load
+}
+
+// Pick the best-scoring active SuperNode other than exclude that isn't
+// overloaded, or the least loaded one if all are. Caller must hold sm.mu.
+func (sm *SuperNodeManager) pickSuperNode(exclude string) *SuperNodeInfo {
+	var best, leastLoaded *SuperNodeInfo
+	bestLoad := 0
+	for i, sn := range sm.supernodes {
+		if !sn.IsSuperNode || sn.ID == exclude || time.Since(sn.LastActive) >= 30*time.Second {
+			continue
+		}
+		load := sm.load(sn.ID)
+		if load < superNodeMaxLoad && (best == nil || sn.Score > best.Score) {
+			best = &sm.supernodes[i]
+		}
+		if leastLoaded == nil || load < bestLoad {
+			leastLoaded = &sm.supernodes[i]
+			bestLoad = load
+		}
+	}
+	if best == nil {
+		best = leastLoaded
+	}
+	if best == nil {
+		return nil
+	}
+	pick := *best
+	return &pick
 }
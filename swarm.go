@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Swarm parameters
+const (
+	swarmMaxPeers    = 4 // Peers a download fetches from in parallel
+	haveQueryTimeout = 5 * time.Second
+)
+
+// No reachable member has the chunks a download still needs
+var errNoChunkSources = errors.New("no reachable member has the rest of this file")
+
+// haveRequest asks a member which chunks of a file it can serve
+type haveRequest struct {
+	FileHash string `json:"file_hash"`
+}
+
+// haveResponse lists the chunks a member can serve
+type haveResponse struct {
+	FileHash string `json:"file_hash"`
+	Complete bool   `json:"complete"`         // Every chunk is available
+	Chunks   []byte `json:"chunks,omitempty"` // Bitfield of available chunks, if not complete
+}
+
+// chunkPeer is a member that can serve some chunks of a download
+type chunkPeer struct {
+	node      NodeInfo
+	have      []bool // Nil if the peer has every chunk
+	superNode bool
+}
+
+// Check whether the peer has chunk index
+func (cp *chunkPeer) has(index int) bool {
+	return cp.have == nil || (index < len(cp.have) && cp.have[index])
+}
+
+// Pack chunk flags into a bitfield
+func packBitfield(have []bool) []byte {
+	bits := make([]byte, (len(have)+7)/8)
+	for i, ok := range have {
+		if ok {
+			bits[i/8] |= 1 << (i % 8)
+		}
+	}
+	return bits
+}
+
+// Unpack a bitfield into count chunk flags
+func unpackBitfield(bits []byte, count int) []bool {
+	have := make([]bool, count)
+	for i := range have {
+		have[i] = i/8 < len(bits) && bits[i/8]&(1<<(i%8)) != 0
+	}
+	return have
+}
+
+// Answer a query for the chunks of a file the local node can serve
+func (r *RoomSession) handleHaveRequest(data []byte) []byte {
+	var request haveRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil
+	}
+
+	response := haveResponse{FileHash: request.FileHash}
+	if _, _, _, have, ok := r.Files.source(request.FileHash); ok {
+		if have == nil {
+			response.Complete = true
+		} else {
+			response.Chunks = packBitfield(have)
+		}
+	}
+
+	sealed, err := r.sealRoomJSON(response)
+	if err != nil {
+		return nil
+	}
+	return sealed
+}
+
+// Ask every room member which chunks of a download it can serve. SuperNodes
+// come first, as preferred seeders, then members with the most chunks.
+func (r *RoomSession) findChunkPeers(d *download) []*chunkPeer {
+	r.NodeMutex.RLock()
+	candidates := make([]NodeInfo, 0, len(r.Room.Nodes))
+	senderListed := false
+	for _, node := range r.Room.Nodes {
+		if node.ID == r.LocalNode.ID {
+			continue
+		}
+		senderListed = senderListed || node.ID == d.offer.SenderID
+		candidates = append(candidates, node)
+	}
+	r.NodeMutex.RUnlock()
+	if !senderListed {
+		candidates = append(candidates, NodeInfo{ID: d.offer.SenderID, Address: d.offer.Address, Nickname: d.offer.Sender})
+	}
+
+	request, err := r.sealRoomJSON(haveRequest{FileHash: d.offer.FileHash})
+	if err != nil {
+		return nil
+	}
+
+	count := d.offer.chunkCount()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var peers []*chunkPeer
+	for _, node := range candidates {
+		wg.Add(1)
+		go func(node NodeInfo) {
+			defer wg.Done()
+
+			frame, err := r.Conns.Request(node.Address, FrameHaveRequest, request, haveQueryTimeout)
+			if err != nil || frame.Type != FrameHaveResponse {
+				return
+			}
+			var response haveResponse
+			if err := r.openRoomJSON(frame.Payload, &response); err != nil || response.FileHash != d.offer.FileHash {
+				return
+			}
+
+			peer := &chunkPeer{node: node}
+			if !response.Complete {
+				if len(response.Chunks) == 0 {
+					return
+				}
+				peer.have = unpackBitfield(response.Chunks, count)
+			}
+			if superNode := r.SuperNodeMgr.GetNode(node.ID); superNode != nil {
+				peer.superNode = superNode.IsSuperNode
+			}
+
+			mu.Lock()
+			peers = append(peers, peer)
+			mu.Unlock()
+		}(node)
+	}
+	wg.Wait()
+
+	chunks := func(peer *chunkPeer) int {
+		if peer.have == nil {
+			return count
+		}
+		n := 0
+		for _, ok := range peer.have {
+			if ok {
+				n++
+			}
+		}
+		return n
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].superNode != peers[j].superNode {
+			return peers[i].superNode
+		}
+		return chunks(peers[i]) > chunks(peers[j])
+	})
+	return peers
+}
+
+// Start fetching a download unless its worker is still running. A worker
+// that is stopping carries on instead if it finds the download active again,
+// so a download never has two workers writing its partial file.
+func (r *RoomSession) startWorker(d *download) {
+	r.Files.mu.Lock()
+	defer r.Files.mu.Unlock()
+	if d.worker {
+		return
+	}
+	d.worker = true
+	go r.runDownload(d)
+}
+
+// Worker goroutine of a download, see startWorker
+func (r *RoomSession) runDownload(d *download) {
+	r.startTransferMonitor()
+
+	for {
+		r.fetchWithRetries(d)
+
+		r.Files.mu.Lock()
+		if d.state != downloadActive || !r.Running {
+			d.worker = false
+			r.Files.mu.Unlock()
+			return
+		}
+		r.Files.mu.Unlock()
+	}
+}
+
+// Download a file, retrying with backoff. If members stay unreachable the
+// download is left interrupted and resumes when the sender is seen again.
+func (r *RoomSession) fetchWithRetries(d *download) {
+	for attempt := 1; r.Running; attempt++ {
+		err := r.swarmDownload(d)
+		if err == nil {
+			r.finishDownload(d)
+			return
+		}
+
+		if !r.Files.isRunning(d) {
+			r.stopDownload(d)
+			return
+		}
+		if errors.Is(err, errNoChunkSources) {
+			fmt.Printf("[File] Download of %s failed: %v\n", d.offer.Name, err)
+			r.setDownloadState(d, downloadFailed)
+			return
+		}
+		if attempt >= downloadMaxAttempts {
+			fmt.Printf("[File] Download of %s interrupted (%v); it resumes when %s is back\n", d.offer.Name, err, d.offer.Sender)
+			r.setDownloadState(d, downloadInterrupted)
+			return
+		}
+		time.Sleep(downloadRetryBackoff * time.Duration(attempt))
+		if !r.Files.isRunning(d) {
+			r.stopDownload(d)
+			return
+		}
+	}
+}
+
+// Tell the sender we're downloading its file (best effort)
+func (r *RoomSession) notifySender(d *download) {
+	r.Files.mu.Lock()
+	notified := d.notified
+	r.Files.mu.Unlock()
+	if notified {
+		return
+	}
+	request, err := r.sealRoomJSON(fileAccept{FileHash: d.offer.FileHash, NodeID: r.LocalNode.ID})
+	if err != nil {
+		return
+	}
+	addr := d.offer.Address
+	if node, ok := r.findRoomNodeByID(d.offer.SenderID); ok {
+		addr = node.Address
+	}
+	if r.Conns.SendWithAck(addr, FrameFileAccept, request, d.offer.FileHash) == nil {
+		r.Files.mu.Lock()
+		d.notified = true
+		r.Files.mu.Unlock()
+	}
+}
+
+// Fetch the missing chunks of a download from every member that has them,
+// rarest chunks first
+func (r *RoomSession) swarmDownload(d *download) error {
+	r.notifySender(d)
+
+	peers := r.findChunkPeers(d)
+	if len(peers) == 0 {
+		return fmt.Errorf("no member is reachable")
+	}
+
+	if d.hashes == nil {
+		var err error
+		for _, peer := range peers {
+			if err = r.fetchManifest(d, peer.node.Address); err == nil {
+				break
+			}
+		}
+		if d.hashes == nil {
+			return err
+		}
+	}
+	r.Files.mu.Lock()
+	checked := d.have != nil
+	r.Files.mu.Unlock()
+	if !checked {
+		if err := r.checkPartialFile(d); err != nil {
+			return err
+		}
+	}
+
+	// Count how many peers hold each chunk so the rarest are fetched first
+	count := d.offer.chunkCount()
+	availability := make([]int, count)
+	for _, peer := range peers {
+		for index := range availability {
+			if peer.has(index) {
+				availability[index]++
+			}
+		}
+	}
+	r.Files.mu.Lock()
+	for index, have := range d.have {
+		if !have && availability[index] == 0 {
+			r.Files.mu.Unlock()
+			return errNoChunkSources
+		}
+	}
+	r.Files.mu.Unlock()
+
+	scheduler := &chunkScheduler{d: d, files: r.Files, availability: availability, inFlight: make(map[int]bool)}
+
+	// Fetch from a few peers at a time, moving on to the next ones for
+	// chunks the first peers don't have or failed to deliver
+	var mu sync.Mutex
+	var lastErr error
+	for start := 0; start < len(peers) && scheduler.missing() > 0 && r.Files.isRunning(d); start += swarmMaxPeers {
+		var wg sync.WaitGroup
+		for _, peer := range peers[start:min(len(peers), start+swarmMaxPeers)] {
+			wg.Add(1)
+			go func(peer *chunkPeer) {
+				defer wg.Done()
+				if err := r.fetchChunksFrom(d, peer, scheduler); err != nil {
+					mu.Lock()
+					lastErr = fmt.Errorf("%s: %w", peer.node.Nickname, err)
+					mu.Unlock()
+				}
+			}(peer)
+		}
+		wg.Wait()
+	}
+
+	if missing := scheduler.missing(); missing > 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("%d chunks still missing", missing)
+		}
+		return lastErr
+	}
+	return nil
+}
+
+// chunkScheduler hands out missing chunks to the peers of one download
+type chunkScheduler struct {
+	mu           sync.Mutex
+	d            *download
+	files        *FileTransfers
+	availability []int // Peers holding each chunk
+	inFlight     map[int]bool
+}
+
+// Pick the rarest missing chunk the peer has that no other peer is fetching.
+// Returns -1 if there is none.
+func (cs *chunkScheduler) next(peer *chunkPeer) int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.files.mu.Lock()
+	defer cs.files.mu.Unlock()
+
+	best := -1
+	for index, have := range cs.d.have {
+		if have || cs.inFlight[index] || !peer.has(index) {
+			continue
+		}
+		if best < 0 || cs.availability[index] < cs.availability[best] {
+			best = index
+		}
+	}
+	if best >= 0 {
+		cs.inFlight[best] = true
+	}
+	return best
+}
+
+// Mark a chunk as no longer being fetched
+func (cs *chunkScheduler) release(index int) {
+	cs.mu.Lock()
+	delete(cs.inFlight, index)
+	cs.mu.Unlock()
+}
+
+// Count chunks not yet received
+func (cs *chunkScheduler) missing() int {
+	cs.files.mu.Lock()
+	defer cs.files.mu.Unlock()
+	n := 0
+	for _, have := range cs.d.have {
+		if !have {
+			n++
+		}
+	}
+	return n
+}
+
+// Fetch chunks from one peer until it has none left that we need
+func (r *RoomSession) fetchChunksFrom(d *download, peer *chunkPeer, scheduler *chunkScheduler) error {
+	file, err := os.OpenFile(d.partPath, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r.Files.mu.Lock()
+	d.peers[peer.node.Nickname] = true
+	r.Files.mu.Unlock()
+	defer func() {
+		r.Files.mu.Lock()
+		delete(d.peers, peer.node.Nickname)
+		r.Files.mu.Unlock()
+	}()
+
+	for r.Running {
+		if !r.Files.isRunning(d) {
+			return errTransferStopped
+		}
+		index := scheduler.next(peer)
+		if index < 0 {
+			return nil
+		}
+
+		data, err := r.requestChunk(d, peer.node.Address, index)
+		if err == nil {
+			_, err = file.WriteAt(data, int64(index)*int64(d.offer.ChunkSize))
+		}
+		if err != nil {
+			scheduler.release(index)
+			return err
+		}
+
+		r.Files.mu.Lock()
+		d.have[index] = true
+		d.done += int64(len(data))
+		r.Files.mu.Unlock()
+		scheduler.release(index)
+	}
+	return nil
+}
+
+// Request one chunk from a peer and verify it
+func (r *RoomSession) requestChunk(d *download, addr string, index int) ([]byte, error) {
+	expected := d.hashes[index*sha256.Size : (index+1)*sha256.Size]
+	request, err := r.sealRoomJSON(chunkRequest{
+		FileHash: d.offer.FileHash,
+		Index:    index,
+		Hash:     hex.EncodeToString(expected),
+		NodeID:   r.LocalNode.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	frame, err := r.Conns.Request(addr, FrameChunkRequest, request, chunkRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if frame.Type != FrameChunkData {
+		return nil, fmt.Errorf("unexpected reply to chunk request")
+	}
+
+	var chunk chunkData
+	if err := r.openRoomJSON(frame.Payload, &chunk); err != nil {
+		return nil, err
+	}
+	if chunk.Data == nil {
+		return nil, fmt.Errorf("peer no longer has chunk %d", index)
+	}
+	sum := sha256.Sum256(chunk.Data)
+	if chunk.FileHash != d.offer.FileHash || chunk.Index != index || !bytes.Equal(sum[:], expected) {
+		return nil, fmt.Errorf("chunk %d failed verification", index)
+	}
+	return chunk.Data, nil
+}
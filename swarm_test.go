@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBitfieldRoundTrip(t *testing.T) {
+	for _, have := range [][]bool{
+		{},
+		{true},
+		{false, true, false, true, true, false, false, true},
+		{true, false, false, false, false, false, false, false, true, true},
+	} {
+		bits := packBitfield(have)
+		if len(bits) != (len(have)+7)/8 {
+			t.Fatalf("%v packed into %d bytes", have, len(bits))
+		}
+		if got := unpackBitfield(bits, len(have)); !slices.Equal(got, have) {
+			t.Fatalf("round trip of %v gave %v", have, got)
+		}
+	}
+	if got := unpackBitfield([]byte{0xff}, 10); got[8] || got[9] {
+		t.Fatal("chunks past a short bitfield were reported as held")
+	}
+}
+
+func TestChunkSchedulerPicksRarest(t *testing.T) {
+	d := &download{have: []bool{false, true, false, false, false}}
+	scheduler := &chunkScheduler{
+		d:            d,
+		files:        NewFileTransfers(),
+		availability: []int{3, 1, 2, 1, 3},
+		inFlight:     make(map[int]bool),
+	}
+	seeder := &chunkPeer{}
+	partial := &chunkPeer{have: []bool{true, true, false, false, true}}
+
+	tests := []struct {
+		name string
+		peer *chunkPeer
+		want int
+	}{
+		{"rarest missing chunk", seeder, 3},
+		{"next rarest once it's in flight", seeder, 2},
+		{"only chunks the peer has", partial, 0},
+		{"skips chunks in flight", partial, 4},
+		{"nothing left for the peer", partial, -1},
+	}
+	for _, tt := range tests {
+		if got := scheduler.next(tt.peer); got != tt.want {
+			t.Fatalf("%s: next = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	scheduler.release(3)
+	if got := scheduler.next(seeder); got != 3 {
+		t.Fatalf("released chunk not handed out again, got %d", got)
+	}
+	if got := scheduler.missing(); got != 4 {
+		t.Fatalf("missing = %d, want 4", got)
+	}
+}
+
+func TestSwarmDownloadFromPartialPeers(t *testing.T) {
+	rooms := testRoom(t, "swarm", testNode(t, 75), testNode(t, 76), testNode(t, 77))
+	path, data := testFile(t, t.TempDir(), "swarm.bin", 4*AppConfig.FileChunkSize)
+	fileHash, _, err := hashFile(path, AppConfig.FileChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rooms[0].OfferFile(path); err != nil {
+		t.Fatal(err)
+	}
+	acceptAndWait(t, rooms[1], fileHash)
+
+	// Once the sender stops sharing, the file is only available from the
+	// member that downloaded it
+	if err := rooms[0].CancelTransfer(fileHash); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(acceptAndWait(t, rooms[2], fileHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("file fetched from another member differs from the offered one")
+	}
+}
+
+// Seed copies of this room's files
+func seedFiles(room *RoomSession) []string {
+	entries, _ := os.ReadDir(room.seedDir())
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestSeedCopies(t *testing.T) {
+	rooms := testRoom(t, "seed", testNode(t, 78), testNode(t, 79))
+	sender, seeder := rooms[0], rooms[1]
+	var err error
+
+	offerFile := func(size int) fileOffer {
+		path, _ := testFile(t, t.TempDir(), fmt.Sprintf("seed%d.bin", size), size)
+		if err := sender.OfferFile(path); err != nil {
+			t.Fatal(err)
+		}
+		fileHash, _, _ := hashFile(path, AppConfig.FileChunkSize)
+		var offer fileOffer
+		if !eventually(5*time.Second, func() bool { offer, err = seeder.Files.findOffer(fileHash); return err == nil }) {
+			t.Fatal("offer never arrived")
+		}
+		return offer
+	}
+	seeded := func(offer fileOffer) bool {
+		seeder.Files.mu.Lock()
+		defer seeder.Files.mu.Unlock()
+		d, ok := seeder.Files.downloads[offer.FileHash]
+		return ok && d.state == downloadComplete
+	}
+
+	first := offerFile(2 * AppConfig.FileChunkSize)
+	if err := seeder.startSeeding(first); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(10*time.Second, func() bool { return seeded(first) }) {
+		t.Fatal("seed copy never completed")
+	}
+	if files := seedFiles(seeder); len(files) != 1 {
+		t.Fatalf("seed directory holds %v", files)
+	}
+
+	// Seeds already held count against SEED_MAX_SIZE
+	seeder.Files.mu.Lock()
+	seeder.Files.downloads["held"] = &download{offer: fileOffer{Size: AppConfig.SeedMaxSize - first.Size}, seedOnly: true, state: downloadComplete}
+	seeder.Files.mu.Unlock()
+	second := offerFile(AppConfig.FileChunkSize)
+	if err := seeder.startSeeding(second); err != nil {
+		t.Fatal(err)
+	}
+	seeder.Files.mu.Lock()
+	_, started := seeder.Files.downloads[second.FileHash]
+	delete(seeder.Files.downloads, "held")
+	seeder.Files.mu.Unlock()
+	if started {
+		t.Fatal("seeded past SEED_MAX_SIZE")
+	}
+
+	// Cancelling a seed deletes its copy
+	if err := seeder.CancelTransfer(first.FileHash); err != nil {
+		t.Fatal(err)
+	}
+	if files := seedFiles(seeder); len(files) != 0 {
+		t.Fatalf("cancelled seed left %v", files)
+	}
+
+	// Closing the room deletes the rest
+	if err := seeder.startSeeding(second); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(10*time.Second, func() bool { return seeded(second) }) {
+		t.Fatal("seed copy never completed")
+	}
+	seeder.close()
+	if _, err := os.Stat(seeder.seedDir()); !os.IsNotExist(err) {
+		t.Fatalf("seed directory left after closing the room: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(AppConfig.FileSaveDir, second.FileHash[:16]+".part")); !os.IsNotExist(err) {
+		t.Fatal("partial seed file left after closing the room")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Transcript formats accepted by /save, with their file extensions
+var transcriptFormats = map[string]string{
+	"text":  "txt",
+	"jsonl": "jsonl",
+	"md":    "md",
+}
+
+// Time layouts accepted for /save range bounds
+var transcriptTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// Parse a /save range bound: an absolute time, a time of day (today), or a
+// duration meaning that long ago (e.g. 30m, 2h)
+func parseTimeBound(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range transcriptTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (use 2006-01-02T15:04, 15:04 or a duration like 30m)", value)
+}
+
+// Display name of a message sender in a transcript
+func (r *RoomSession) transcriptSender(message Message) string {
+	if message.SenderID == r.LocalNode.ID {
+		return message.Sender + " (me)"
+	}
+	return message.Sender
+}
+
+// SaveTranscript writes the logged messages sent between from and to to a new
+// file in the given format. Returns the file name and the number of messages.
+func (r *RoomSession) SaveTranscript(format string, from, to time.Time) (string, int, error) {
+	ext, ok := transcriptFormats[format]
+	if !ok {
+		return "", 0, fmt.Errorf("unknown format %q (use text, jsonl or md)", format)
+	}
+
+	messages := r.History.Between(from, to)
+	now := time.Now()
+	filename := fmt.Sprintf("chat_log_%s.%s", now.Format("20060102_150405"), ext)
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	switch format {
+	case "jsonl":
+		// One signed message per line, so the transcript can be verified later
+		encoder := json.NewEncoder(w)
+		for _, message := range messages {
+			if err := encoder.Encode(message); err != nil {
+				return "", 0, err
+			}
+		}
+
+	case "md":
+		fmt.Fprintf(w, "# P2P Chat Log - %s\n\n", r.Room.ID)
+		fmt.Fprintf(w, "Saved %s, %d messages\n\n", now.Format("2006-01-02 15:04:05"), len(messages))
+		for _, message := range messages {
+			content := strings.ReplaceAll(message.Content, "\n", "  \n")
+			fmt.Fprintf(w, "**%s** _%s_  \n%s\n\n", r.transcriptSender(message), message.Timestamp, content)
+		}
+
+	default:
+		fmt.Fprintf(w, "P2P Chat Log - %s\n", now.Format("2006-01-02 15:04:05"))
+		fmt.Fprintf(w, "Room: %s\n\n", r.Room.ID)
+		for _, message := range messages {
+			fmt.Fprintf(w, "[%s] %s: %s\n", message.Timestamp, r.transcriptSender(message), message.Content)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return "", 0, err
+	}
+	return filename, len(messages), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimeBound(t *testing.T) {
+	now := time.Date(2024, 5, 6, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"30m", now.Add(-30 * time.Minute)},
+		{"2h", now.Add(-2 * time.Hour)},
+		{"2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)},
+		{"2024-05-01T08:30", time.Date(2024, 5, 1, 8, 30, 0, 0, time.Local)},
+		{"09:15", time.Date(2024, 5, 6, 9, 15, 0, 0, time.Local)},
+		{"09:15:30", time.Date(2024, 5, 6, 9, 15, 30, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeBound(tt.value, now)
+		if err != nil {
+			t.Errorf("parseTimeBound(%q): %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseTimeBound(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+	if _, err := parseTimeBound("yesterday", now); err == nil {
+		t.Error("parsed an invalid bound")
+	}
+}
+
+func TestSaveTranscript(t *testing.T) {
+	room := testRoom(t, "transcript", testNode(t, 64))[0]
+	for i := 1; i <= 3; i++ {
+		message := testMessage(i)
+		message.Timestamp = "12:00"
+		room.History.Add(message)
+	}
+	own := testMessage(4)
+	own.SenderID, own.Sender, own.Content = room.LocalNode.ID, "me", "line one\nline two"
+	room.History.Add(own)
+
+	tests := []struct {
+		name     string
+		format   string
+		from, to time.Time
+		count    int
+		contains []string
+	}{
+		{"text", "text", time.Time{}, time.Time{}, 4, []string{"Room: transcript", "[12:00] alice: message 1", "me (me): line one"}},
+		{"markdown", "md", time.Time{}, time.Time{}, 4, []string{"# P2P Chat Log - transcript", "**alice** _12:00_  \nmessage 2", "line one  \nline two"}},
+		{"jsonl range", "jsonl", time.UnixMilli(1002), time.UnixMilli(1003), 2, []string{`"content":"message 2"`, `"content":"message 3"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			filename, count, err := room.SaveTranscript(tt.format, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tt.count {
+				t.Fatalf("saved %d messages, want %d", count, tt.count)
+			}
+			if !strings.HasSuffix(filename, "."+transcriptFormats[tt.format]) {
+				t.Fatalf("file name %q lacks the %s extension", filename, tt.format)
+			}
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(string(data), want) {
+					t.Fatalf("transcript lacks %q:\n%s", want, data)
+				}
+			}
+		})
+	}
+
+	if _, _, err := room.SaveTranscript("pdf", time.Time{}, time.Time{}); err == nil {
+		t.Fatal("saved a transcript in an unknown format")
+	}
+}
+
+func TestSaveTranscriptJSONLKeepsSignatures(t *testing.T) {
+	room := testRoom(t, "signed-transcript", testNode(t, 65))[0]
+	room.displayMessage(testSignedMessage(t, 65, "signed-transcript", "1", 1))
+	room.displayMessage(testSignedMessage(t, 66, "signed-transcript", "2", 2))
+
+	t.Chdir(t.TempDir())
+	filename, _, err := room.SaveTranscript("jsonl", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var message Message
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			t.Fatal(err)
+		}
+		if !verifyMessage(message) {
+			t.Fatalf("message %s no longer verifies", message.ID)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Fatalf("%d lines, want 2", lines)
+	}
+}
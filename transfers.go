@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Transfer monitor parameters
+const (
+	transferSampleInterval   = time.Second
+	transferProgressInterval = 5 * time.Second  // How often the progress line is printed
+	uploadIdleTimeout        = 10 * time.Second // Uploads with no recent chunk are shown as idle
+)
+
+// A download was paused or cancelled by the user
+var errTransferStopped = errors.New("transfer stopped")
+
+// upload tracks the chunks of one local file served to one member
+type upload struct {
+	fileHash   string
+	name       string
+	peer       string
+	bytes      int64
+	started    time.Time
+	lastActive time.Time
+}
+
+// Record a chunk served to a member
+func (ft *FileTransfers) recordUpload(fileHash, name, peer string, n int) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	key := fileHash + ":" + peer
+	u, ok := ft.uploads[key]
+	if !ok {
+		u = &upload{fileHash: fileHash, name: name, peer: peer, started: time.Now()}
+		ft.uploads[key] = u
+	}
+	u.bytes += int64(n)
+	u.lastActive = time.Now()
+
+	// Rates over less than a second are too noisy to advertise
+	if elapsed := u.lastActive.Sub(u.started).Seconds(); elapsed >= 1 {
+		ft.peakUpload = max(ft.peakUpload, int64(float64(u.bytes)/elapsed))
+	}
+}
+
+// Best upload rate seen, in bytes per second
+func (ft *FileTransfers) peakUploadRate() int64 {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.peakUpload
+}
+
+// Check whether a download should keep fetching
+func (ft *FileTransfers) isRunning(d *download) bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return d.state == downloadActive
+}
+
+// Find a download by file ID prefix. Ambiguous prefixes fail.
+func (ft *FileTransfers) findDownload(idPrefix string) (*download, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	var matches []*download
+	for hash, d := range ft.downloads {
+		if strings.HasPrefix(hash, idPrefix) && d.state != downloadCanceled {
+			matches = append(matches, d)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no transfer with ID %s", idPrefix)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("transfer ID %s is ambiguous", idPrefix)
+	}
+}
+
+// Clean up after a download goroutine stopped because the user paused or
+// cancelled it
+func (r *RoomSession) stopDownload(d *download) {
+	r.Files.mu.Lock()
+	canceled := d.state == downloadCanceled
+	r.Files.mu.Unlock()
+
+	if canceled {
+		os.Remove(d.partPath)
+		os.Remove(d.metaPath)
+	}
+}
+
+// PauseTransfer stops fetching a download, keeping what was received
+func (r *RoomSession) PauseTransfer(idPrefix string) error {
+	d, err := r.Files.findDownload(idPrefix)
+	if err != nil {
+		return err
+	}
+
+	r.Files.mu.Lock()
+	defer r.Files.mu.Unlock()
+	if d.state != downloadActive && d.state != downloadInterrupted {
+		return fmt.Errorf("%s is %s", d.offer.Name, d.state)
+	}
+	d.state = downloadPaused
+	fmt.Printf("[File] Paused %s at %s\n", d.offer.Name, formatBytes(d.done))
+	return nil
+}
+
+// ResumeTransfer restarts a paused, interrupted or failed download
+func (r *RoomSession) ResumeTransfer(idPrefix string) error {
+	d, err := r.Files.findDownload(idPrefix)
+	if err != nil {
+		return err
+	}
+
+	r.Files.mu.Lock()
+	switch d.state {
+	case downloadPaused, downloadInterrupted, downloadFailed:
+	default:
+		r.Files.mu.Unlock()
+		return fmt.Errorf("%s is %s", d.offer.Name, d.state)
+	}
+	if d.state != downloadPaused {
+		d.have = nil // Recheck the partial file before continuing
+	}
+	d.state = downloadActive
+	d.lastDone = d.done
+	r.Files.mu.Unlock()
+
+	fmt.Printf("[File] Resuming %s\n", d.offer.Name)
+	r.startWorker(d)
+	return nil
+}
+
+// CancelTransfer abandons a download and deletes its partial file, or stops
+// sharing a file offered by the local node
+func (r *RoomSession) CancelTransfer(idPrefix string) error {
+	d, err := r.Files.findDownload(idPrefix)
+	if err != nil {
+		return r.stopSharing(idPrefix)
+	}
+
+	r.Files.mu.Lock()
+	state := d.state
+	if state == downloadComplete {
+		seedOnly := d.seedOnly
+		r.Files.mu.Unlock()
+		if seedOnly {
+			return r.stopSharing(idPrefix)
+		}
+		return fmt.Errorf("%s is already complete", d.offer.Name)
+	}
+	d.state = downloadCanceled
+	r.Files.mu.Unlock()
+
+	// A running download cleans up once its workers stop
+	if state != downloadActive {
+		r.stopDownload(d)
+	}
+	fmt.Printf("[File] Cancelled %s\n", d.offer.Name)
+	return nil
+}
+
+// Stop serving a file the local node offered, or delete the seed copy of a
+// file fetched for the room
+func (r *RoomSession) stopSharing(idPrefix string) error {
+	r.Files.mu.Lock()
+	defer r.Files.mu.Unlock()
+
+	var matches []string
+	for hash := range r.Files.shared {
+		if strings.HasPrefix(hash, idPrefix) {
+			matches = append(matches, hash)
+		}
+	}
+	for hash, d := range r.Files.downloads {
+		if strings.HasPrefix(hash, idPrefix) && d.seedOnly && d.state == downloadComplete {
+			matches = append(matches, hash)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("no transfer with ID %s", idPrefix)
+	case 1:
+		if shared, ok := r.Files.shared[matches[0]]; ok {
+			fmt.Printf("[File] Stopped sharing %s\n", shared.offer.Name)
+			delete(r.Files.shared, matches[0])
+			return nil
+		}
+		d := r.Files.downloads[matches[0]]
+		delete(r.Files.downloads, matches[0])
+		os.Remove(d.savePath)
+		fmt.Printf("[File] Stopped seeding %s\n", d.offer.Name)
+		return nil
+	default:
+		return fmt.Errorf("transfer ID %s is ambiguous", idPrefix)
+	}
+}
+
+// Human-readable remaining time for a download
+func formatETA(remaining int64, rate float64) string {
+	if rate < 1 {
+		return "--"
+	}
+	return (time.Duration(float64(remaining)/rate) * time.Second).Round(time.Second).String()
+}
+
+// Percentage of a download received
+func downloadPercent(d *download) int {
+	if d.offer.Size == 0 {
+		return 100
+	}
+	return int(d.done * 100 / d.offer.Size)
+}
+
+// Print every download and upload
+func (r *RoomSession) printTransfers() {
+	r.Files.mu.Lock()
+	defer r.Files.mu.Unlock()
+
+	downloads := make([]*download, 0, len(r.Files.downloads))
+	for _, d := range r.Files.downloads {
+		if d.state != downloadCanceled {
+			downloads = append(downloads, d)
+		}
+	}
+	uploads := make([]*upload, 0, len(r.Files.uploads))
+	for _, u := range r.Files.uploads {
+		uploads = append(uploads, u)
+	}
+
+	if len(downloads) == 0 && len(uploads) == 0 && len(r.Files.shared) == 0 {
+		fmt.Println("No file transfers")
+		return
+	}
+
+	sort.Slice(downloads, func(i, j int) bool { return downloads[i].started.Before(downloads[j].started) })
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].started.Before(uploads[j].started) })
+
+	fmt.Println("Transfers:")
+	for _, d := range downloads {
+		kind := "down"
+		if d.seedOnly {
+			kind = "seed"
+		}
+		line := fmt.Sprintf("  %s  %s  %s  %3d%%  %s/%s  %s",
+			shortID(d.offer.FileHash), kind, d.offer.Name, downloadPercent(d),
+			formatBytes(d.done), formatBytes(d.offer.Size), d.state)
+		if d.state == downloadActive {
+			peers := make([]string, 0, len(d.peers))
+			for peer := range d.peers {
+				peers = append(peers, peer)
+			}
+			sort.Strings(peers)
+			line += fmt.Sprintf("  %s/s  ETA %s", formatBytes(int64(d.rate)), formatETA(d.offer.Size-d.done, d.rate))
+			if len(peers) > 0 {
+				line += "  from " + strings.Join(peers, ", ")
+			}
+		}
+		fmt.Println(line)
+	}
+	for _, u := range uploads {
+		state := "idle"
+		if time.Since(u.lastActive) < uploadIdleTimeout {
+			state = "active"
+		}
+		elapsed := max(u.lastActive.Sub(u.started).Seconds(), 1)
+		fmt.Printf("  %s  up    %s  %s sent to %s  %s/s  %s\n",
+			shortID(u.fileHash), u.name, formatBytes(u.bytes), u.peer, formatBytes(int64(float64(u.bytes)/elapsed)), state)
+	}
+	for hash, shared := range r.Files.shared {
+		fmt.Printf("  %s  share %s  %s\n", shortID(hash), shared.offer.Name, formatBytes(shared.offer.Size))
+	}
+}
+
+// Start the progress monitor unless it's already running
+func (r *RoomSession) startTransferMonitor() {
+	r.Files.mu.Lock()
+	defer r.Files.mu.Unlock()
+	if r.Files.monitor {
+		return
+	}
+	r.Files.monitor = true
+	go r.monitorTransfers()
+}
+
+// Sample download rates every second and print a progress line while
+// user downloads run. Stops once no download is active.
+func (r *RoomSession) monitorTransfers() {
+	ticker := time.NewTicker(transferSampleInterval)
+	defer ticker.Stop()
+	lastPrint := time.Now()
+
+	for range ticker.C {
+		r.Files.mu.Lock()
+		var progress []string
+		active := 0
+		for _, d := range r.Files.downloads {
+			if d.state != downloadActive {
+				continue
+			}
+			active++
+
+			// Exponentially smoothed rate
+			sample := float64(d.done-d.lastDone) / transferSampleInterval.Seconds()
+			if d.rate == 0 {
+				d.rate = sample
+			} else {
+				d.rate = 0.7*d.rate + 0.3*sample
+			}
+			d.lastDone = d.done
+
+			if !d.seedOnly {
+				progress = append(progress, fmt.Sprintf("%s %d%% %s/s ETA %s",
+					d.offer.Name, downloadPercent(d), formatBytes(int64(d.rate)), formatETA(d.offer.Size-d.done, d.rate)))
+			}
+		}
+		if active == 0 || !r.Running {
+			r.Files.monitor = false
+			r.Files.mu.Unlock()
+			return
+		}
+		r.Files.mu.Unlock()
+
+		if len(progress) > 0 && time.Since(lastPrint) >= transferProgressInterval {
+			sort.Strings(progress)
+			fmt.Printf("[Transfer] %s\n", strings.Join(progress, " | "))
+			lastPrint = time.Now()
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Start downloading a file whose sender is unreachable, so the download's
+// worker keeps retrying
+func unreachableDownload(t *testing.T, room *RoomSession) *download {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	path, _ := testFile(t, t.TempDir(), "unreachable.bin", AppConfig.FileChunkSize)
+	offer := testDownload(t, path, AppConfig.FileChunkSize).offer
+	offer.SenderID, offer.Sender, offer.Address = "gone", "gone", addr
+	if err := room.startDownload(offer, false); err != nil {
+		t.Fatal(err)
+	}
+	d := room.Files.downloads[offer.FileHash]
+	t.Cleanup(func() { room.CancelTransfer(offer.FileHash) })
+	return d
+}
+
+func TestPauseResumeKeepsOneWorker(t *testing.T) {
+	room := testRoom(t, "pause", testNode(t, 80))[0]
+	d := unreachableDownload(t, room)
+	id := d.offer.FileHash
+
+	// Let the worker fail its first attempt and wait to retry
+	time.Sleep(200 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		if err := room.PauseTransfer(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := room.ResumeTransfer(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := runtime.NumGoroutine(); after >= before+10 {
+		t.Fatalf("%d goroutines after pausing and resuming, %d before", after, before)
+	}
+
+	// Pausing stops the worker once it next checks in
+	if err := room.PauseTransfer(id); err != nil {
+		t.Fatal(err)
+	}
+	stopped := func() bool {
+		room.Files.mu.Lock()
+		defer room.Files.mu.Unlock()
+		return !d.worker
+	}
+	if !eventually(2*downloadRetryBackoff, stopped) {
+		t.Fatal("worker still running after pause")
+	}
+
+	// Resuming a stopped download starts a new worker
+	if err := room.ResumeTransfer(id); err != nil {
+		t.Fatal(err)
+	}
+	if stopped() {
+		t.Fatal("resume didn't start a worker")
+	}
+}
+
+func TestTransferCommands(t *testing.T) {
+	room := testRoom(t, "transfer-commands", testNode(t, 81))[0]
+	d := unreachableDownload(t, room)
+	id := d.offer.FileHash
+
+	tests := []struct {
+		name  string
+		cmd   func(string) error
+		ok    bool
+		state downloadState
+	}{
+		{"resume active", room.ResumeTransfer, false, downloadActive},
+		{"pause", room.PauseTransfer, true, downloadPaused},
+		{"pause paused", room.PauseTransfer, false, downloadPaused},
+		{"resume", room.ResumeTransfer, true, downloadActive},
+		{"cancel", room.CancelTransfer, true, downloadCanceled},
+	}
+	for _, tt := range tests {
+		if err := tt.cmd(id[:8]); (err == nil) != tt.ok {
+			t.Fatalf("%s: error = %v, want success %v", tt.name, err, tt.ok)
+		}
+		room.Files.mu.Lock()
+		state := d.state
+		room.Files.mu.Unlock()
+		if state != tt.state {
+			t.Fatalf("%s: state = %s, want %s", tt.name, state, tt.state)
+		}
+	}
+	if _, err := room.Files.findDownload(id); err == nil {
+		t.Fatal("cancelled download is still listed")
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Relayed connections
+//
+// When a member can neither be dialled nor reached through a punched hole,
+// the pool relays the connection through a third party, much like TURN.
+// Both ends open a TCP connection of their own to the relay and send it a
+// FrameTunnelBind naming the same tunnel ID. The relay pairs the two
+// connections, answers each with FrameTunnelReady, and from then on copies
+// bytes between them without reading them. The ends run the usual connHello
+// exchange and frames through the tunnel, so the relay can neither read the
+// room's traffic nor pose as either end.
+//
+// Any member that can accept TCP connections relays for the other members
+// of its rooms, up to RELAY_MAX_TUNNELS tunnels at once, and only for them:
+// the bind is sealed under the room key. RELAY_SERVERS lists standalone
+// relays ("p2pchat relay") to fall back to after the members; those can't
+// check room membership, so their binds are plain and they relay for anyone.
+//
+// The side that wants to connect picks the relay and the tunnel ID, binds,
+// and sends the target a rendezvousOffer naming the relay through a member
+// both are connected to, as for hole punching.
+
+// Relay parameters
+const (
+	tunnelPairTimeout = 10 * time.Second // How long a relay keeps the first end waiting
+	relayAttempts     = 3                // Members tried as relay before the relay servers
+)
+
+// Default address of a standalone relay
+const defaultRelayServerAddr = "127.0.0.1:8090"
+
+// tunnelBind asks a relay to join the connection to the other end of a
+// tunnel
+type tunnelBind struct {
+	Tunnel string `json:"tunnel"` // Tunnel ID, hex
+}
+
+// tunnelConn is a connection relayed through relay
+type tunnelConn struct {
+	net.Conn
+	relay string
+}
+
+// tunnelEnd is a bound connection waiting for the other end of its tunnel
+type tunnelEnd struct {
+	conn    net.Conn
+	partner chan net.Conn // Receives the other end once both are ready
+}
+
+// TunnelRelay pairs the two ends of each tunnel and copies between them
+type TunnelRelay struct {
+	mu      sync.Mutex
+	waiting map[string]*tunnelEnd // Tunnel ID -> first end
+	tunnels int                   // Tunnels waiting or open
+	max     int
+}
+
+// NewTunnelRelay creates a relay for up to max tunnels at once
+func NewTunnelRelay(max int) *TunnelRelay {
+	return &TunnelRelay{
+		waiting: make(map[string]*tunnelEnd),
+		max:     max,
+	}
+}
+
+// Join conn to the other end of tunnel and copy what arrives on reader to
+// it until either end closes. A connection that finds no partner within
+// tunnelPairTimeout, or no room for another tunnel, is turned away.
+func (t *TunnelRelay) bind(tunnel string, conn net.Conn, reader io.Reader) {
+	end := &tunnelEnd{conn: conn, partner: make(chan net.Conn, 1)}
+
+	t.mu.Lock()
+	first, second := t.waiting[tunnel]
+	switch {
+	case second:
+		delete(t.waiting, tunnel)
+	case t.tunnels >= t.max:
+		t.mu.Unlock()
+		return
+	default:
+		t.waiting[tunnel] = end
+		t.tunnels++
+	}
+	t.mu.Unlock()
+
+	var partner net.Conn
+	if second {
+		// Tell both ends before either starts copying, so neither's data can
+		// overtake the other's ready frame
+		conn.SetDeadline(time.Time{})
+		first.conn.SetDeadline(time.Time{})
+		writeFrame(conn, FrameTunnelReady, nil)
+		writeFrame(first.conn, FrameTunnelReady, nil)
+		first.partner <- conn
+		partner = first.conn
+	} else {
+		timer := time.NewTimer(tunnelPairTimeout)
+		select {
+		case partner = <-end.partner:
+			timer.Stop()
+		case <-timer.C:
+			t.mu.Lock()
+			gaveUp := t.waiting[tunnel] == end
+			if gaveUp {
+				delete(t.waiting, tunnel)
+				t.tunnels--
+			}
+			t.mu.Unlock()
+			if gaveUp {
+				return
+			}
+			// The other end arrived just as we gave up
+			partner = <-end.partner
+		}
+		defer func() {
+			t.mu.Lock()
+			t.tunnels--
+			t.mu.Unlock()
+		}()
+	}
+
+	io.Copy(partner, reader)
+	partner.Close()
+	conn.Close()
+}
+
+// Handle a tunnel bind from a member of one of our rooms
+func (p *P2PChat) handleTunnelBind(conn net.Conn, reader io.Reader, payload []byte) {
+	room, data := p.openRoomPayload(payload)
+	if room == nil {
+		return
+	}
+	var bind tunnelBind
+	if err := json.Unmarshal(data, &bind); err != nil || bind.Tunnel == "" {
+		return
+	}
+	p.Tunnels.bind(bind.Tunnel, conn, reader)
+}
+
+// Relays to try for a tunnel to targetID: SuperNodes, then other members,
+// then the configured relay servers. The bind for each is sealed under the
+// room key unless it goes to a relay server.
+func (r *RoomSession) relayCandidates(targetID, tunnel string) (relays []string, binds [][]byte) {
+	superNodes := make(map[string]bool)
+	for _, sn := range r.SuperNodeMgr.GetSuperNodes() {
+		superNodes[sn.ID] = true
+	}
+
+	r.NodeMutex.RLock()
+	var preferred, others []string
+	for _, node := range r.Room.Nodes {
+		if node.ID == r.LocalNode.ID || node.ID == targetID {
+			continue
+		}
+		if superNodes[node.ID] {
+			preferred = append(preferred, node.Address)
+		} else {
+			others = append(others, node.Address)
+		}
+	}
+	r.NodeMutex.RUnlock()
+
+	members := append(preferred, others...)
+	if len(members) > relayAttempts {
+		members = members[:relayAttempts]
+	}
+	if sealed, err := r.sealRoomJSON(tunnelBind{Tunnel: tunnel}); err == nil {
+		for _, addr := range members {
+			relays = append(relays, addr)
+			binds = append(binds, sealed)
+		}
+	}
+	plain, _ := json.Marshal(tunnelBind{Tunnel: tunnel})
+	for _, addr := range AppConfig.RelayServers {
+		relays = append(relays, addr)
+		binds = append(binds, plain)
+	}
+	return relays, binds
+}
+
+// Connect to a relay, bind one end of a tunnel and return the connection
+func dialTunnel(relay string, bind []byte) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", relay, connDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(conn, FrameTunnelBind, bind); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Wait for the relay to join the other end of the tunnel
+func awaitTunnel(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(tunnelPairTimeout))
+	// Read unbuffered, so nothing the other end sends next is consumed here
+	frame, err := readFrame(conn)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("relay turned the tunnel down")
+		}
+		return err
+	}
+	if frame.Type != FrameTunnelReady {
+		return fmt.Errorf("unexpected frame type 0x%02x from relay", frame.Type)
+	}
+	conn.SetReadDeadline(time.Time{})
+	return nil
+}
+
+// Open a tunnel to target through the first relay both of us can reach
+func (r *RoomSession) dialRelayed(target NodeInfo) (net.Conn, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	tunnel := hex.EncodeToString(id)
+
+	err := fmt.Errorf("no relay available")
+	relays, binds := r.relayCandidates(target.ID, tunnel)
+	for i, relay := range relays {
+		conn, dialErr := dialTunnel(relay, binds[i])
+		if dialErr != nil {
+			err = fmt.Errorf("relay %s: %v", relay, dialErr)
+			continue
+		}
+
+		offer := rendezvousOffer{
+			Session:   tunnel,
+			From:      r.localNodeInfo(),
+			TargetID:  target.ID,
+			Relay:     relay,
+			RelayBind: binds[i],
+		}
+		if err := r.introduce(offer); err != nil {
+			// No other relay would get the offer through either
+			conn.Close()
+			return nil, err
+		}
+		if waitErr := awaitTunnel(conn); waitErr != nil {
+			conn.Close()
+			err = fmt.Errorf("relay %s: %v", relay, waitErr)
+			continue
+		}
+
+		fmt.Printf("[System] %sRelaying the connection to %s through %s\n", r.roomTag(), target.Nickname, relay)
+		return &tunnelConn{Conn: conn, relay: relay}, nil
+	}
+	return nil, err
+}
+
+// Meet a member at the relay its rendezvous offer names and serve the
+// tunnel like an incoming connection
+func (r *RoomSession) joinTunnel(offer rendezvousOffer) {
+	conn, err := dialTunnel(offer.Relay, offer.RelayBind)
+	if err == nil {
+		err = awaitTunnel(conn)
+		if err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		fmt.Printf("Failed to meet %s at relay %s: %v\n", offer.From.Nickname, offer.Relay, err)
+		return
+	}
+	r.handleConnection(&tunnelConn{Conn: conn, relay: offer.Relay})
+}
+
+// Reach the member listening on addr when it can't be dialled: punch a
+// hole to it, or failing that relay through someone else
+func (p *P2PChat) dialIndirect(addr string) (net.Conn, error) {
+	room, target, ok := p.memberInfoAt(addr)
+	if !ok {
+		return nil, fmt.Errorf("no member listens on %s", addr)
+	}
+	conn, punchErr := room.dialPunched(target)
+	if punchErr == nil {
+		return conn, nil
+	}
+	conn, relayErr := room.dialRelayed(target)
+	if relayErr != nil {
+		return nil, fmt.Errorf("%v; %v", punchErr, relayErr)
+	}
+	return conn, nil
+}
+
+// Run a standalone relay on addr until the process exits. It serves
+// tunnels for anyone, so it is meant for testing, e.g. on loopback.
+func runRelayServer(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	relay := NewTunnelRelay(AppConfig.RelayMaxTunnels)
+	fmt.Printf("Relay server listening on %s (up to %d tunnels)\n", listener.Addr(), AppConfig.RelayMaxTunnels)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			fmt.Printf("Error accepting relay connection: %v\n", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(tunnelPairTimeout))
+			frame, err := readFrame(conn)
+			if err != nil || frame.Type != FrameTunnelBind {
+				return
+			}
+			var bind tunnelBind
+			if err := json.Unmarshal(frame.Payload, &bind); err != nil || bind.Tunnel == "" {
+				return
+			}
+			fmt.Printf("Tunnel %s: %s bound\n", shortID(bind.Tunnel), conn.RemoteAddr())
+			relay.bind(bind.Tunnel, conn, conn)
+		}()
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Bind one end of tunnel on relay over an in-memory pipe. Returns the
+// client side and a channel closed once the relay is done with it.
+func bindPipe(relay *TunnelRelay, tunnel string) (net.Conn, chan struct{}) {
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relay.bind(tunnel, server, server)
+		server.Close()
+	}()
+	return client, done
+}
+
+// Number of tunnels a relay counts as waiting or open
+func tunnelCount(relay *TunnelRelay) int {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	return relay.tunnels
+}
+
+func TestTunnelRelayPairsEnds(t *testing.T) {
+	relay := NewTunnelRelay(4)
+	first, _ := bindPipe(relay, "tunnel")
+	second, _ := bindPipe(relay, "tunnel")
+	other, otherDone := bindPipe(relay, "other")
+	defer other.Close()
+
+	ready := make(chan error, 2)
+	for _, conn := range []net.Conn{first, second} {
+		go func() { ready <- awaitTunnel(conn) }()
+	}
+	for range 2 {
+		if err := <-ready; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Bytes are copied both ways unchanged
+	for _, ends := range [][2]net.Conn{{first, second}, {second, first}} {
+		go ends[0].Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(ends[1], buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("read %q, %v", buf, err)
+		}
+	}
+	if got := tunnelCount(relay); got != 2 {
+		t.Fatalf("%d tunnels counted, want the open one and the waiting one", got)
+	}
+
+	// Closing one end closes the other
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read %v after the other end closed, want EOF", err)
+	}
+	if !eventually(time.Second, func() bool { return tunnelCount(relay) == 1 }) {
+		t.Fatal("closed tunnel still counted")
+	}
+
+	// An end whose partner never comes is left waiting, not paired with
+	// another tunnel's
+	select {
+	case <-otherDone:
+		t.Fatal("unpaired end was turned away")
+	default:
+	}
+}
+
+func TestTunnelRelayLimit(t *testing.T) {
+	relay := NewTunnelRelay(1)
+	waiting, _ := bindPipe(relay, "first")
+	defer waiting.Close()
+
+	// A new tunnel past the limit is turned away at once
+	turnedAway, done := bindPipe(relay, "second")
+	defer turnedAway.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("tunnel past the limit was accepted")
+	}
+	if err := awaitTunnel(turnedAway); err == nil {
+		t.Fatal("turned away end was told the tunnel is ready")
+	}
+
+	// The other end of the waiting tunnel still gets through
+	partner, _ := bindPipe(relay, "first")
+	defer partner.Close()
+	go awaitTunnel(waiting)
+	if err := awaitTunnel(partner); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleTunnelBind(t *testing.T) {
+	p := testNode(t, 138)
+	room := testRoom(t, "tunnel-bind", p)[0]
+	stranger := testRoom(t, "elsewhere", testNode(t, 139))[0]
+
+	tests := []struct {
+		name   string
+		sealer *RoomSession
+		bind   tunnelBind
+		bound  bool
+	}{
+		{"room we're not in", stranger, tunnelBind{Tunnel: "abc"}, false},
+		{"no tunnel ID", room, tunnelBind{}, false},
+		{"member of our room", room, tunnelBind{Tunnel: "abc"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := tt.sealer.sealRoomJSON(tt.bind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, server := net.Pipe()
+			defer client.Close()
+			go p.handleTunnelBind(server, server, sealed)
+
+			bound := eventually(200*time.Millisecond, func() bool { return tunnelCount(p.Tunnels) == 1 })
+			if bound != tt.bound {
+				t.Fatalf("bound = %v, want %v", bound, tt.bound)
+			}
+		})
+	}
+
+	// Relay servers' plain binds aren't accepted by members
+	plain, _ := json.Marshal(tunnelBind{Tunnel: "plain"})
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() { p.handleTunnelBind(server, server, plain); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("plain bind was accepted")
+	}
+}
+
+func TestDialRelayed(t *testing.T) {
+	rooms := testRoom(t, "relayed", testNode(t, 140), testNode(t, 141), testNode(t, 142))
+	relay, dialer, target := rooms[0], rooms[1], rooms[2]
+
+	// The relay passes the offer on over connections it already has
+	for _, pair := range [][2]*RoomSession{{dialer, relay}, {relay, target}} {
+		if _, err := pair[0].Conns.get(pair[1].LocalNode.Address); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, err := dialer.dialRelayed(target.LocalNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if tc, ok := conn.(*tunnelConn); !ok || tc.relay != relay.LocalNode.Address {
+		t.Fatal("connection not relayed through the member")
+	}
+	if got := tunnelCount(relay.Tunnels); got != 1 {
+		t.Fatalf("relay counts %d tunnels", got)
+	}
+
+	// The target serves the tunnel like any incoming connection
+	message := testSignedMessage(t, 141, "relayed", "tunneled", time.Now().UnixMilli())
+	sealed, err := dialer.sealRoomJSON(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(conn, FrameMessage, sealed); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame, err := readFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != FrameAck || string(frame.Payload) != messageKey(message) {
+		t.Fatalf("got frame 0x%02x %q, want the acknowledgement", frame.Type, frame.Payload)
+	}
+	if !target.History.Contains(message) {
+		t.Fatal("message sent through the tunnel not logged")
+	}
+
+	conn.Close()
+	if !eventually(time.Second, func() bool { return tunnelCount(relay.Tunnels) == 0 }) {
+		t.Fatal("relay still counts the closed tunnel")
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reliable stream over UDP
+//
+// Once a hole is punched (see holepunch.go), the two ends talk over a
+// udpStream: an ordered, reliable byte stream that implements net.Conn, so
+// the connection pool runs its handshake and frames over it exactly as it
+// does over TCP. Data is cut into numbered segments of at most
+// udpSegmentSize bytes. Every packet carries the number of the next segment
+// the sender expects, which acknowledges everything before it. Up to
+// udpWindow segments may be unacknowledged at once; a segment still
+// unacknowledged after the retransmission timeout is sent again, and the
+// timeout doubles each time until an acknowledgement arrives.
+//
+// Both ends send a bare acknowledgement when they have been quiet for
+// udpKeepalive, which also keeps the NAT mappings open. A stream that hears
+// nothing for udpDeadAfter, or gives up retransmitting, is closed.
+//
+// Closing sends a close packet numbered like the next segment, and keeps
+// retransmitting it and any unacknowledged data until the peer acknowledges
+// them all or stops responding. The peer reports the end of the stream only
+// once every segment before the close has arrived, and lingers for
+// udpLinger to acknowledge the close again if its acknowledgement was lost.
+//
+// Stream packets are laid out as:
+//
+//	+------+-------------+---------+---------+---------+
+//	| kind | session (8) | seq (4) | ack (4) | payload |
+//	+------+-------------+---------+---------+---------+
+
+// Stream parameters
+const (
+	udpSegmentSize = 1100 // Payload bytes per packet, under common path MTUs
+	udpWindow      = 64   // Segments in flight at once
+	udpHeaderSize  = 17
+	udpTick        = 20 * time.Millisecond
+	udpInitialRTO  = 300 * time.Millisecond
+	udpMinRTO      = 100 * time.Millisecond
+	udpMaxRTO      = 3 * time.Second
+	udpMaxRetries  = 10
+	udpKeepalive   = 5 * time.Second
+	udpDeadAfter   = 30 * time.Second
+	udpLinger      = 2 * udpMaxRTO
+)
+
+var errStreamTimeout = errors.New("peer stopped acknowledging")
+
+// udpSegment is a piece of the stream sent but not yet acknowledged
+type udpSegment struct {
+	seq     uint32
+	data    []byte
+	close   bool // The close packet, which ends the stream
+	sentAt  time.Time
+	retries int
+}
+
+// Encode a segment for sending, acknowledging everything before ack
+func (segment *udpSegment) packet(session uint64, ack uint32) []byte {
+	kind := udpData
+	if segment.close {
+		kind = udpClose
+	}
+	return udpStreamPacket(kind, session, segment.seq, ack, segment.data)
+}
+
+// udpStream is a reliable, ordered byte stream to one peer over the punch
+// socket
+type udpStream struct {
+	socket  *PunchSocket
+	session uint64
+	remote  *net.UDPAddr
+
+	mu          sync.Mutex
+	cond        *sync.Cond // Signalled when data, acknowledgements or deadlines may unblock a caller
+	closed      bool
+	err         error     // Why the stream closed, returned by reads once the buffer is drained
+	lingerUntil time.Time // A closed stream stays registered until then, and until its close is acknowledged
+
+	// Sending
+	nextSeq  uint32
+	inFlight []*udpSegment // Oldest first
+	rto      time.Duration
+	srtt     time.Duration
+	lastSent time.Time
+
+	// Receiving
+	expected   uint32            // Next segment to hand to the reader
+	early      map[uint32][]byte // Segments that arrived ahead of a gap
+	peerClose  uint32            // Number of the peer's close packet, if peerClosed
+	peerClosed bool
+	readBuf    []byte
+	lastHeard  time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newUDPStream(socket *PunchSocket, session uint64, remote *net.UDPAddr) *udpStream {
+	s := &udpStream{
+		socket:    socket,
+		session:   session,
+		remote:    remote,
+		rto:       udpInitialRTO,
+		early:     make(map[uint32][]byte),
+		lastSent:  time.Now(),
+		lastHeard: time.Now(),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+// Encode a stream packet
+func udpStreamPacket(kind byte, session uint64, seq, ack uint32, payload []byte) []byte {
+	packet := make([]byte, 0, udpHeaderSize+len(payload))
+	packet = append(packet, kind)
+	packet = append(packet, uint32ToBytes(uint32(session>>32))...)
+	packet = append(packet, uint32ToBytes(uint32(session))...)
+	packet = append(packet, uint32ToBytes(seq)...)
+	packet = append(packet, uint32ToBytes(ack)...)
+	return append(packet, payload...)
+}
+
+// Check whether segment number a comes before b, allowing for wraparound
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// Check whether a deadline is set and has passed
+func deadlinePassed(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+// Read reads stream data in order, waiting for some to arrive
+func (s *udpStream) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.readBuf) == 0 {
+		if s.closed {
+			return 0, s.err
+		}
+		if deadlinePassed(s.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.cond.Wait()
+	}
+	n := copy(b, s.readBuf)
+	s.readBuf = s.readBuf[n:]
+	return n, nil
+}
+
+// Write sends b as one or more segments, waiting while the window is full
+func (s *udpStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n := min(len(b)-written, udpSegmentSize)
+
+		s.mu.Lock()
+		for !s.closed && len(s.inFlight) >= udpWindow {
+			if deadlinePassed(s.writeDeadline) {
+				s.mu.Unlock()
+				return written, os.ErrDeadlineExceeded
+			}
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return written, errConnClosed
+		}
+		segment := &udpSegment{
+			seq:    s.nextSeq,
+			data:   append([]byte(nil), b[written:written+n]...),
+			sentAt: time.Now(),
+		}
+		s.nextSeq++
+		s.inFlight = append(s.inFlight, segment)
+		s.lastSent = segment.sentAt
+		packet := segment.packet(s.session, s.expected)
+		s.mu.Unlock()
+
+		s.socket.send(packet, s.remote)
+		written += n
+	}
+	return written, nil
+}
+
+// Handle a stream packet from the peer. A closed stream still takes
+// acknowledgements of its close and acknowledges the peer's.
+func (s *udpStream) receive(kind byte, seq, ack uint32, payload []byte) {
+	s.mu.Lock()
+	now := time.Now()
+	s.lastHeard = now
+
+	// Drop the segments the peer acknowledged
+	for len(s.inFlight) > 0 && seqBefore(s.inFlight[0].seq, ack) {
+		segment := s.inFlight[0]
+		if segment.retries == 0 {
+			s.sampleRTT(now.Sub(segment.sentAt))
+		}
+		s.inFlight = s.inFlight[1:]
+	}
+	s.cond.Broadcast()
+
+	// An empty segment is a bare acknowledgement
+	if kind == udpData && len(payload) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	switch {
+	case kind == udpClose:
+		if !s.peerClosed && !seqBefore(seq, s.expected) {
+			s.peerClose = seq
+			s.peerClosed = true
+		}
+	case seq == s.expected:
+		if !s.closed {
+			s.readBuf = append(s.readBuf, payload...)
+		}
+		s.expected++
+	case seqBefore(s.expected, seq) && seq-s.expected < 2*udpWindow:
+		s.early[seq] = append([]byte(nil), payload...)
+	}
+	for {
+		data, ok := s.early[s.expected]
+		if !ok {
+			break
+		}
+		delete(s.early, s.expected)
+		if !s.closed {
+			s.readBuf = append(s.readBuf, data...)
+		}
+		s.expected++
+	}
+
+	// The stream ends once everything before the peer's close has arrived
+	if s.peerClosed && s.expected == s.peerClose {
+		s.expected++
+		if !s.closed {
+			s.closeLocked(io.EOF)
+			s.inFlight = nil // The peer reads no more
+		}
+		s.lingerUntil = now.Add(udpLinger)
+	}
+
+	// Acknowledge every segment, duplicates included, since the previous
+	// acknowledgement may have been lost
+	packet := udpStreamPacket(udpData, s.session, 0, s.expected, nil)
+	s.lastSent = now
+	s.mu.Unlock()
+	s.socket.send(packet, s.remote)
+}
+
+// Update the retransmission timeout from a round trip sample
+func (s *udpStream) sampleRTT(rtt time.Duration) {
+	if s.srtt == 0 {
+		s.srtt = rtt
+	} else {
+		s.srtt = (7*s.srtt + rtt) / 8
+	}
+	s.rto = min(max(2*s.srtt, udpMinRTO), udpMaxRTO)
+}
+
+// Retransmit, keep the path alive and wake callers waiting on deadlines
+// until the stream is closed and done closing
+func (s *udpStream) run() {
+	ticker := time.NewTicker(udpTick)
+	defer ticker.Stop()
+	defer s.socket.removeStream(s.session)
+
+	for range ticker.C {
+		now := time.Now()
+		var packets [][]byte
+
+		s.mu.Lock()
+		if s.closed && len(s.inFlight) == 0 && now.After(s.lingerUntil) {
+			s.mu.Unlock()
+			return
+		}
+		if now.Sub(s.lastHeard) > udpDeadAfter {
+			s.giveUpLocked()
+			s.mu.Unlock()
+			return
+		}
+
+		expired := false
+		for _, segment := range s.inFlight {
+			if now.Sub(segment.sentAt) < s.rto {
+				continue
+			}
+			if segment.retries >= udpMaxRetries {
+				s.giveUpLocked()
+				s.mu.Unlock()
+				return
+			}
+			segment.retries++
+			segment.sentAt = now
+			packets = append(packets, segment.packet(s.session, s.expected))
+			expired = true
+		}
+		if expired {
+			s.rto = min(2*s.rto, udpMaxRTO)
+		}
+		if len(packets) == 0 && !s.closed && now.Sub(s.lastSent) > udpKeepalive {
+			packets = append(packets, udpStreamPacket(udpData, s.session, 0, s.expected, nil))
+		}
+		if len(packets) > 0 {
+			s.lastSent = now
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		for _, packet := range packets {
+			s.socket.send(packet, s.remote)
+		}
+	}
+}
+
+// Mark the stream closed with s.mu held
+func (s *udpStream) closeLocked(err error) {
+	s.closed = true
+	s.err = err
+	s.cond.Broadcast()
+}
+
+// Stop retransmitting to a peer that stopped responding, with s.mu held
+func (s *udpStream) giveUpLocked() {
+	if !s.closed {
+		s.closeLocked(errStreamTimeout)
+	}
+	s.inFlight = nil
+}
+
+// Close closes the stream and tells the peer. Data already written is still
+// delivered: the stream keeps retransmitting it and the close until the peer
+// acknowledges them or stops responding.
+func (s *udpStream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	segment := &udpSegment{seq: s.nextSeq, close: true, sentAt: time.Now()}
+	s.nextSeq++
+	s.inFlight = append(s.inFlight, segment)
+	s.closeLocked(net.ErrClosed)
+	packet := segment.packet(s.session, s.expected)
+	s.mu.Unlock()
+
+	s.socket.send(packet, s.remote)
+	return nil
+}
+
+// LocalAddr returns the address of the punch socket
+func (s *udpStream) LocalAddr() net.Addr {
+	return s.socket.conn.LocalAddr()
+}
+
+// RemoteAddr returns the punched address of the peer
+func (s *udpStream) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+// SetDeadline sets the read and write deadlines
+func (s *udpStream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read
+func (s *udpStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write
+func (s *udpStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDeadline = t
+	return nil
+}
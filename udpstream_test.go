@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyProxy forwards UDP packets between two punch sockets, dropping a
+// share of them in each direction
+type lossyProxy struct {
+	conn *net.UDPConn
+	a, b *net.UDPAddr
+	loss float64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newLossyProxy(t *testing.T, a, b *net.UDPAddr, loss float64) *lossyProxy {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &lossyProxy{conn: conn, a: a, b: b, loss: loss, rng: rand.New(rand.NewSource(1))}
+	t.Cleanup(func() { conn.Close() })
+	go p.run()
+	return p
+}
+
+func (p *lossyProxy) run() {
+	buffer := make([]byte, 2048)
+	for {
+		n, from, err := p.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		drop := p.rng.Float64() < p.loss
+		p.mu.Unlock()
+		if drop {
+			continue
+		}
+		to := p.b
+		if from.Port == p.b.Port {
+			to = p.a
+		}
+		p.conn.WriteToUDP(buffer[:n], to)
+	}
+}
+
+func (p *lossyProxy) addr() *net.UDPAddr {
+	return p.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Open a stream between two loopback punch sockets, through a proxy that
+// drops the given share of packets
+func newStreamPair(t *testing.T, loss float64) (*udpStream, *udpStream) {
+	t.Helper()
+	sockets := make([]*PunchSocket, 2)
+	addrs := make([]*net.UDPAddr, 2)
+	for i := range sockets {
+		ps, err := ListenPunchSocket(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ps.conn.Close() })
+		sockets[i] = ps
+		addrs[i] = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ps.conn.LocalAddr().(*net.UDPAddr).Port}
+	}
+	proxy := newLossyProxy(t, addrs[0], addrs[1], loss)
+
+	const session = 0x5eed
+	streams := make([]*udpStream, 2)
+	for i, ps := range sockets {
+		stream := newUDPStream(ps, session, proxy.addr())
+		ps.mu.Lock()
+		ps.streams[session] = stream
+		ps.mu.Unlock()
+		streams[i] = stream
+	}
+	return streams[0], streams[1]
+}
+
+func TestSeqBefore(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{0, 1, true},
+		{1, 0, false},
+		{5, 5, false},
+		{0xFFFFFFFF, 0, true},
+		{0, 0xFFFFFFFF, false},
+		{0xFFFFFFF0, 0x10, true},
+	}
+	for _, tt := range tests {
+		if got := seqBefore(tt.a, tt.b); got != tt.want {
+			t.Errorf("seqBefore(%#x, %#x) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestUDPStreamDeliversEverythingBeforeClose(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		loss float64
+	}{
+		{"empty", 0, 0},
+		{"one byte", 1, 0},
+		{"one segment", udpSegmentSize, 0},
+		{"several windows", 5 * udpWindow * udpSegmentSize, 0},
+		{"lossy", 200 * 1024, 0.2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, receiver := newStreamPair(t, tt.loss)
+
+			data := make([]byte, tt.size)
+			rand.New(rand.NewSource(int64(tt.size))).Read(data)
+			go func() {
+				if _, err := sender.Write(data); err != nil {
+					t.Errorf("Write: %v", err)
+				}
+				// Close right away: the stream must still deliver the data
+				sender.Close()
+			}()
+
+			receiver.SetReadDeadline(time.Now().Add(20 * time.Second))
+			got, err := io.ReadAll(receiver)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("received %d bytes, want %d matching bytes", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestUDPStreamWriteAfterClose(t *testing.T) {
+	a, _ := newStreamPair(t, 0)
+	a.Close()
+	if _, err := a.Write([]byte("late")); !errors.Is(err, errConnClosed) {
+		t.Fatalf("Write after Close = %v, want %v", err, errConnClosed)
+	}
+	if _, err := a.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Read after Close = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestUDPStreamCloseHeldBackByGap(t *testing.T) {
+	_, b := newStreamPair(t, 0)
+
+	// Segment 1 and the close arrive, segment 0 doesn't yet
+	b.receive(udpData, 1, 0, []byte("world"))
+	b.receive(udpClose, 2, 0, nil)
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed {
+		t.Fatal("stream reported the end before segment 0 arrived")
+	}
+
+	b.receive(udpData, 0, 0, []byte("hello "))
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("read %q, want %q", got, "hello world")
+	}
+}
+
+func TestUDPStreamPacketLayout(t *testing.T) {
+	packet := udpStreamPacket(udpData, 0x0102030405060708, 9, 10, []byte("x"))
+	if len(packet) != udpHeaderSize+1 {
+		t.Fatalf("packet is %d bytes, want %d", len(packet), udpHeaderSize+1)
+	}
+	if packet[0] != udpData || packet[1] != 0x01 || packet[8] != 0x08 {
+		t.Fatalf("bad kind or session in % x", packet[:9])
+	}
+	if bytesToUint32(packet[9:13]) != 9 || bytesToUint32(packet[13:17]) != 10 || packet[17] != 'x' {
+		t.Fatalf("bad seq, ack or payload in % x", packet)
+	}
+}